@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 
 	"github.com/asdine/storm"
 
@@ -163,6 +165,69 @@ func apiDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// document lock admin functionality 🔒
+
+// apiListLocksHandler returns every current document lock
+//
+// GET /api/admin/locks
+func apiListLocksHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	locks, err := currentLocks()
+	if err != nil {
+		Error.Println("Could not retrieve locks", err.Error())
+		fr = FailureResponse{Message: "Could not retrieve locks"}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	list := []DocumentLock{}
+	for _, lock := range locks {
+		list = append(list, lock)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+
+	JSONResponse(list, http.StatusOK, w)
+}
+
+// apiBreakLockHandler removes a lock regardless of who holds it
+//
+// DELETE /api/admin/locks/:id
+func apiBreakLockHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var sr SuccessResponse
+
+	sid := vestigo.Param(r, "id")
+	id, err := strconv.Atoi(sid)
+	if err != nil {
+		fr = FailureResponse{Message: fmt.Sprintf("Invalid id %s", sid)}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	lock, err := breakLock(id)
+	if err == ErrLockNotFound {
+		fr = FailureResponse{Message: fmt.Sprintf("No lock %d", id)}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Couldn't break lock", id, err.Error())
+		fr = FailureResponse{Message: fmt.Sprintf("Cannot break lock %d", id)}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	Info.Printf("%s broke %s's lock on %s", getCurrentUser(r.Context()).Username, lock.Username, lock.Path)
+
+	sr = SuccessResponse{Message: fmt.Sprintf("Lock on %s broken", lock.Path)}
+	JSONResponse(sr, http.StatusOK, w)
+}
+
 func apiActivateUserHandler(w http.ResponseWriter, r *http.Request)   {}
 func apiDeactivateUserHandler(w http.ResponseWriter, r *http.Request) {}
 
@@ -321,3 +321,130 @@ func Test_apiUpdateUserHandler(t *testing.T) {
 	}
 
 }
+
+func Test_apiBreakLockHandler(t *testing.T) {
+
+	server := setupMiddlewareAdminTestServer()
+	setupTestKeys()
+
+	db.Drop("User")
+	db.Drop("DocumentLock")
+
+	_ = createUser(ck)
+	admin, _ := getUserByUsername(ck.Username)
+
+	lock, _ := acquireLock("documents", "document_1", "index.md", ds)
+
+	client := &http.Client{}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/admin/locks", server.URL), nil)
+	req = authorizeRequest(admin, req)
+	resp, _ := client.Do(req)
+
+	var locks []DocumentLock
+	json.NewDecoder(resp.Body).Decode(&locks)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	if assert.Len(t, locks, 1) {
+		assert.Equal(t, ds.Username, locks[0].Username)
+	}
+
+	target := fmt.Sprintf("%s/api/admin/locks/%d", server.URL, lock.ID)
+
+	req, _ = http.NewRequest("DELETE", target, nil)
+	req = authorizeRequest(admin, req)
+	resp, _ = client.Do(req)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	current, _ := currentLock(lock.Path)
+	assert.Nil(t, current)
+
+	req, _ = http.NewRequest("DELETE", target, nil)
+	req = authorizeRequest(admin, req)
+	resp, _ = client.Do(req)
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+}
+
+func Test_apiDeleteOrphanedMediaHandler(t *testing.T) {
+	server := setupMiddlewareAdminTestServer()
+	setupTestKeys()
+
+	db.Drop("User")
+
+	_ = createUser(ck)
+	admin, _ := getUserByUsername(ck.Username)
+
+	_ = createUser(mh)
+	nonAdmin, _ := getUserByUsername(mh.Username)
+
+	repoPath := "../tests/tmp/repositories/delete_orphaned_media_handler"
+	target := fmt.Sprintf("%s/api/admin/media/orphans", server.URL)
+
+	deleteMediaAs := func(user User, md MediaDeletion, query string) *http.Response {
+		payload, _ := json.Marshal(md)
+		req, _ := http.NewRequest("DELETE", target+query, bytes.NewBuffer(payload))
+		req = authorizeRequest(user, req)
+		resp, _ := http.DefaultClient.Do(req)
+		return resp
+	}
+
+	deleteMedia := func(md MediaDeletion, query string) *http.Response {
+		return deleteMediaAs(admin, md, query)
+	}
+
+	lr, _ := setupMediaTestRepo(repoPath)
+
+	md := MediaDeletion{
+		Message:        "Remove unused images",
+		Paths:          []string{"documents/document_2/images/image_1.jpg"},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	t.Run("Not an admin", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, deleteMediaAs(nonAdmin, md, "").StatusCode)
+
+		orphans, _ := getOrphanedMedia("images")
+		assert.Len(t, orphans, 3)
+	})
+
+	t.Run("Dry run", func(t *testing.T) {
+		resp := deleteMedia(md, "?dry_run=true")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var dr DryRun
+		json.NewDecoder(resp.Body).Decode(&dr)
+		assert.Equal(t, []string{"documents/document_2/images/image_1.jpg"}, dr.Paths)
+
+		orphans, _ := getOrphanedMedia("images")
+		assert.Len(t, orphans, 3)
+	})
+
+	t.Run("Referenced", func(t *testing.T) {
+		inUse := md
+		inUse.Paths = []string{"documents/document_1/images/image_1.gif"}
+		assert.Equal(t, http.StatusConflict, deleteMedia(inUse, "").StatusCode)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		missing := md
+		missing.Paths = []string{"documents/document_2/images/image_9.jpg"}
+		assert.Equal(t, http.StatusNotFound, deleteMedia(missing, "").StatusCode)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		invalid := md
+		invalid.Paths = nil
+		assert.Equal(t, http.StatusBadRequest, deleteMedia(invalid, "").StatusCode)
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		resp := deleteMedia(md, "")
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		orphans, _ := getOrphanedMedia("images")
+		assert.Len(t, orphans, 2)
+	})
+}
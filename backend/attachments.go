@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	// registering the formats image.DecodeConfig can read dimensions from
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+// ErrAttachmentNotFound is returned when the requested attachment isn't
+// in the document's directory
+var ErrAttachmentNotFound = errors.New("attachment not found")
+
+// newAttachment describes the blob without including its contents,
+// images also have their dimensions. LFS pointers are described by the
+// object they point to
+func newAttachment(directory string, te *git.TreeEntry, blob *git.Blob) Attachment {
+
+	ext := filepath.Ext(te.Name)
+
+	attachment := Attachment{
+		Filename:  te.Name,
+		Extension: ext,
+		Path:      directory,
+		MediaType: getMediaType(ext),
+		Size:      blob.Size(),
+		Oid:       te.Id.String(),
+	}
+
+	var contents io.Reader = bytes.NewReader(blob.Contents())
+
+	if p, ok := parseLFSPointer(blob.Contents()); ok {
+		attachment.LFS, attachment.Size = true, p.Size
+
+		f, err := openLFSObject(p.Oid)
+		if err != nil {
+			Warning.Println("Could not find LFS object for", te.Name, err.Error())
+			return attachment
+		}
+		defer f.Close()
+
+		contents = f
+	}
+
+	if strings.HasPrefix(attachment.MediaType, "image/") {
+		ic, _, err := image.DecodeConfig(contents)
+		if err == nil {
+			attachment.Width, attachment.Height = ic.Width, ic.Height
+		}
+	}
+
+	return attachment
+}
+
+// attachmentReader reads an attachment's contents, LFS objects are read
+// from the store so it must be closed
+type attachmentReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// blobReader reads a blob's contents, which libgit2 has already loaded
+type blobReader struct {
+	*bytes.Reader
+}
+
+func (blobReader) Close() error {
+	return nil
+}
+
+// openBlob returns a reader for the blob's contents, or for the object
+// it points to when it's an LFS pointer
+func openBlob(blob *git.Blob) (attachmentReader, error) {
+
+	data := blob.Contents()
+
+	p, ok := parseLFSPointer(data)
+	if !ok {
+		return blobReader{bytes.NewReader(data)}, nil
+	}
+
+	f, err := openLFSObject(p.Oid)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// openAttachment returns the attachment at path, which is relative to the
+// document's directory, along with a reader for its contents that the
+// caller must close
+func openAttachment(directory, document, path string) (attachment Attachment, contents attachmentReader, err error) {
+
+	path = filepath.Clean(path)
+	if path == "." || strings.HasPrefix(path, "..") || filepath.IsAbs(path) {
+		return attachment, nil, ErrAttachmentNotFound
+	}
+
+	repo, err := repository(config)
+	if err != nil {
+		return attachment, nil, err
+	}
+	defer repo.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return attachment, nil, err
+	}
+	defer ht.Free()
+
+	target := filepath.Join(directory, document, path)
+
+	te, err := ht.EntryByPath(target)
+	if err != nil || te.Type != git.ObjectBlob || filepath.Ext(te.Name) == ".md" {
+		return attachment, nil, ErrAttachmentNotFound
+	}
+
+	blob, err := repo.LookupBlob(te.Id)
+	if err != nil {
+		return attachment, nil, err
+	}
+	defer blob.Free()
+
+	contents, err = openBlob(blob)
+	if err != nil {
+		return attachment, nil, err
+	}
+
+	return newAttachment(filepath.Dir(target), te, blob), contents, nil
+}
+
+// getAttachment returns the attachment at path, which is relative to the
+// document's directory, along with its contents. Attachments that are
+// only being served should be opened with openAttachment instead
+func getAttachment(directory, document, path string) (attachment Attachment, contents []byte, err error) {
+
+	attachment, r, err := openAttachment(directory, document, path)
+	if err != nil {
+		return attachment, nil, err
+	}
+	defer r.Close()
+
+	contents, err = ioutil.ReadAll(r)
+
+	return attachment, contents, err
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/dgrijalva/jwt-go/request"
+	"github.com/gorilla/websocket"
 	"github.com/rs/xid"
 )
 
@@ -23,7 +25,7 @@ func ValidateTokenMiddleware(w http.ResponseWriter, r *http.Request, next http.H
 	var usernameFromToken string
 	var fr FailureResponse
 
-	token, err := request.ParseFromRequest(r, request.AuthorizationHeaderExtractor,
+	token, err := request.ParseFromRequest(r, tokenExtractor(r),
 		func(token *jwt.Token) (interface{}, error) {
 			return verifyKey, nil
 		})
@@ -73,6 +75,63 @@ func ValidateTokenMiddleware(w http.ResponseWriter, r *http.Request, next http.H
 
 }
 
+// tokenExtractor returns where the request's token should be found. It's
+// always in the Authorization header apart from when joining a collaboration
+// session, browsers can't set headers on WebSocket requests so the token is
+// passed as the access_token param instead
+func tokenExtractor(r *http.Request) request.Extractor {
+
+	if strings.HasSuffix(r.URL.Path, "/collaborate") && websocket.IsWebSocketUpgrade(r) {
+		return request.OAuth2Extractor
+	}
+
+	return request.AuthorizationHeaderExtractor
+}
+
+// ValidateLFSTokenMiddleware validates the short lived tokens given to
+// git-lfs over SSH, regular tokens aren't accepted and LFS tokens aren't
+// accepted anywhere else as they're never stored against the user
+func ValidateLFSTokenMiddleware(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	var fr FailureResponse
+
+	token, err := request.ParseFromRequest(r, request.AuthorizationHeaderExtractor,
+		func(token *jwt.Token) (interface{}, error) {
+			return verifyKey, nil
+		})
+
+	if err != nil || !token.Valid {
+		fr = FailureResponse{Message: "Unauthorized access, invalid JWT"}
+		lfsResponse(fr, http.StatusUnauthorized, w)
+		return
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+
+	if scope, _ := claims["scope"].(string); scope != lfsTokenScope {
+		fr = FailureResponse{Message: "Token can't be used for LFS"}
+		lfsResponse(fr, http.StatusUnauthorized, w)
+		return
+	}
+
+	username, _ := claims["sub"].(string)
+
+	user, err := getUserByUsername(username)
+	if err != nil {
+		fr = FailureResponse{Message: "Cannot match user with token"}
+		lfsResponse(fr, http.StatusUnauthorized, w)
+		return
+	}
+
+	if !user.Active {
+		fr = FailureResponse{Message: "User has been deactivated"}
+		lfsResponse(fr, http.StatusUnauthorized, w)
+		return
+	}
+
+	ctx := newContextWithCurrentUser(r.Context(), r, user)
+	next(w, r.WithContext(ctx))
+}
+
 // ValidateAdminMiddleware ensures the user is an administrator
 func ValidateAdminMiddleware(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
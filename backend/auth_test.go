@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http/httptest"
 	"testing"
 
 	"github.com/dgrijalva/jwt-go"
@@ -24,3 +25,34 @@ func TestNewToken(t *testing.T) {
 	//assert.True(t, token.Valid)
 
 }
+
+func Test_tokenExtractor(t *testing.T) {
+
+	token := "eyJhbGciOiJSUzI1NiJ9"
+
+	tests := []struct {
+		name      string
+		path      string
+		websocket bool
+		expected  string
+	}{
+		{name: "Collaboration WebSocket", path: "/api/directories/documents/documents/document_1/files/index.md/collaborate", websocket: true, expected: token},
+		{name: "Collaboration without upgrade", path: "/api/directories/documents/documents/document_1/files/index.md/collaborate"},
+		{name: "Regular endpoint", path: "/api/directories/documents/documents/document_1/files/index.md"},
+		{name: "Regular WebSocket", path: "/api/directories", websocket: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path+"?access_token="+token, nil)
+
+			if tt.websocket {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", "websocket")
+			}
+
+			extracted, _ := tokenExtractor(r).ExtractToken(r)
+			assert.Equal(t, tt.expected, extracted)
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+var (
+	// ErrUnknownAuthor is returned when a document's authors include a
+	// username that doesn't belong to a CMS user
+	ErrUnknownAuthor = errors.New("authors must be existing users")
+
+	// contributions holds each viewed file's contributors, walking the
+	// history is only worth doing again once the head has moved on
+	contributions = &contributorCache{}
+)
+
+// Contributor is somebody who has written or edited a document. Username
+// is only present when they can be matched to a CMS user
+type Contributor struct {
+	Name            string    `json:"name"`
+	Email           string    `json:"email,omitempty"`
+	Username        string    `json:"username,omitempty"`
+	Commits         int       `json:"commits,omitempty"`
+	LastContributed time.Time `json:"last_contributed,omitempty"`
+}
+
+// assignAuthors credits new documents to the user creating them unless
+// authors have been named. When only authors are named, the free-text
+// author is filled in with their names so themes that only know about
+// author still show something sensible
+func assignAuthors(files []NewCommitFile, user User) error {
+	for i := range files {
+
+		if !files[i].isDocument() {
+			continue
+		}
+
+		fm := &files[i].FrontMatter
+
+		if len(fm.Authors) == 0 && fm.Author == "" {
+			fm.Authors = []string{user.Username}
+			fm.Author = user.Name
+			continue
+		}
+
+		authors, err := lookupAuthors(fm.Authors)
+		if err != nil {
+			return err
+		}
+
+		if fm.Author == "" {
+			names := []string{}
+			for _, author := range authors {
+				names = append(names, author.Name)
+			}
+			fm.Author = strings.Join(names, ", ")
+		}
+	}
+
+	return nil
+}
+
+// checkAuthors ensures every author added to an updated document is a
+// CMS user. Authors already listed are left alone so documents can still
+// be updated after one of their authors' accounts has been deleted
+func checkAuthors(repo *git.Repository, files []NewCommitFile) error {
+	for _, ncf := range files {
+
+		if !ncf.isDocument() {
+			continue
+		}
+
+		fm, _ := existingFrontMatter(repo, filepath.Join(ncf.Path, ncf.Document, ncf.Filename))
+
+		added := []string{}
+		for _, username := range ncf.FrontMatter.Authors {
+			if !contains(fm.Authors, username) {
+				added = append(added, username)
+			}
+		}
+
+		_, err := lookupAuthors(added)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lookupAuthors returns the contributor details of each named author, in
+// the order they're listed
+func lookupAuthors(usernames []string) (authors []Contributor, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	authors = []Contributor{}
+
+	for _, username := range usernames {
+
+		user, err := getUserByUsername(username)
+		if err != nil {
+			return nil, ErrUnknownAuthor
+		}
+
+		authors = append(authors, Contributor{Name: user.Name, Email: user.Email, Username: user.Username})
+	}
+
+	return authors, nil
+}
+
+// getAuthors is the lenient version of lookupAuthors used when displaying
+// documents, authors whose accounts have since been deleted are listed by
+// username alone
+func getAuthors(usernames []string) (authors []Contributor) {
+
+	authors = []Contributor{}
+
+	for _, username := range usernames {
+
+		user, err := getUserByUsername(username)
+		if err != nil {
+			authors = append(authors, Contributor{Name: username, Username: username})
+			continue
+		}
+
+		authors = append(authors, Contributor{Name: user.Name, Email: user.Email, Username: user.Username})
+	}
+
+	return authors
+}
+
+// contributorCache maps paths to their contributors at a revision
+type contributorCache struct {
+	sync.Mutex
+	revision string
+	files    map[string][]Contributor
+}
+
+// get returns the file's contributors if they've been found since the
+// head last moved on
+func (cc *contributorCache) get(revision, path string) (contributors []Contributor, found bool) {
+	cc.Lock()
+	defer cc.Unlock()
+
+	if cc.revision != revision {
+		return nil, false
+	}
+
+	contributors, found = cc.files[path]
+	return contributors, found
+}
+
+// set stores the file's contributors, anything found at an earlier
+// revision is discarded
+func (cc *contributorCache) set(revision, path string, contributors []Contributor) {
+	cc.Lock()
+	defer cc.Unlock()
+
+	if cc.revision != revision {
+		cc.revision = revision
+		cc.files = make(map[string][]Contributor)
+	}
+
+	cc.files[path] = contributors
+}
+
+// fileContributors returns the file's contributors, the most prolific
+// first, matched to CMS users where possible. The history is only walked
+// once per file each time the head moves on
+func fileContributors(repo *git.Repository, path string) (contributors []Contributor, err error) {
+
+	lr, err := getLatestRevision(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, found := contributions.get(lr.String(), path)
+	if !found {
+		cached, err = walkContributors(repo, lr, path)
+		if err != nil {
+			return nil, err
+		}
+		contributions.set(lr.String(), path, cached)
+	}
+
+	// copied so usernames, which change as accounts do, aren't cached
+	contributors = append([]Contributor{}, cached...)
+
+	for i, contributor := range contributors {
+		user, err := getUserByEmail(contributor.Email)
+		if err == nil {
+			contributors[i].Username = user.Username
+		}
+	}
+
+	return contributors, nil
+}
+
+// walkContributors walks the history from revision counting the commits
+// that changed the file by each author, identified by their email
+// address. The most prolific contributors are listed first
+func walkContributors(repo *git.Repository, revision *git.Oid, path string) (contributors []Contributor, err error) {
+
+	contributors = []Contributor{}
+
+	revWalk, err := repo.Walk()
+	if err != nil {
+		return nil, err
+	}
+	defer revWalk.Free()
+
+	err = revWalk.Push(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	revWalk.Sorting(git.SortTime)
+
+	index := make(map[string]int)
+
+	revWalkIterator := func(c *git.Commit) bool {
+		defer c.Free()
+
+		changed, err := commitChangesPath(c, path)
+		if err != nil {
+			Warning.Println("Could not compare commit", c.Id(), "with its parent", err.Error())
+			return true
+		}
+
+		if !changed {
+			return true
+		}
+
+		author := c.Author()
+		key := strings.ToLower(author.Email)
+
+		i, found := index[key]
+		if !found {
+			index[key] = len(contributors)
+			contributors = append(
+				contributors,
+				Contributor{Name: author.Name, Email: author.Email, LastContributed: author.When},
+			)
+			i = len(contributors) - 1
+		}
+
+		contributors[i].Commits++
+
+		return true
+	}
+
+	err = revWalk.Iterate(revWalkIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(contributors, func(i, j int) bool {
+		return contributors[i].Commits > contributors[j].Commits
+	})
+
+	return contributors, nil
+}
+
+// commitChangesPath returns true if the file at path differs between the
+// commit and its first parent
+func commitChangesPath(c *git.Commit, path string) (bool, error) {
+
+	tree, err := c.Tree()
+	if err != nil {
+		return false, err
+	}
+	defer tree.Free()
+
+	var current *git.Oid
+	if te, err := tree.EntryByPath(path); err == nil {
+		current = te.Id
+	}
+
+	if c.ParentCount() == 0 {
+		return current != nil, nil
+	}
+
+	parent := c.Parent(0)
+	defer parent.Free()
+
+	pt, err := parent.Tree()
+	if err != nil {
+		return false, err
+	}
+	defer pt.Free()
+
+	var previous *git.Oid
+	if te, err := pt.EntryByPath(path); err == nil {
+		previous = te.Id
+	}
+
+	if current == nil || previous == nil {
+		return current != previous, nil
+	}
+
+	return !current.Equal(previous), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_assignAuthors(t *testing.T) {
+
+	db.Drop("User")
+	_ = createUser(mh)
+	_ = createUser(ck)
+
+	t.Run("Defaults to the current user", func(t *testing.T) {
+		files := []NewCommitFile{NewCommitFile{Path: "documents", Document: "document_9", Filename: "index.md"}}
+
+		assert.Nil(t, assignAuthors(files, mh))
+		assert.Equal(t, []string{mh.Username}, files[0].FrontMatter.Authors)
+		assert.Equal(t, mh.Name, files[0].FrontMatter.Author)
+	})
+
+	t.Run("Named authors", func(t *testing.T) {
+		files := []NewCommitFile{
+			NewCommitFile{
+				Path:        "documents",
+				Document:    "document_9",
+				Filename:    "index.md",
+				FrontMatter: FrontMatter{Authors: []string{ck.Username, mh.Username}},
+			},
+		}
+
+		assert.Nil(t, assignAuthors(files, mh))
+		assert.Equal(t, ck.Name+", "+mh.Name, files[0].FrontMatter.Author)
+	})
+
+	t.Run("Free-text author is left alone", func(t *testing.T) {
+		files := []NewCommitFile{
+			NewCommitFile{Path: "documents", Document: "document_9", Filename: "index.md", FrontMatter: FrontMatter{Author: "Lindsay Naegle"}},
+		}
+
+		assert.Nil(t, assignAuthors(files, mh))
+		assert.Equal(t, "Lindsay Naegle", files[0].FrontMatter.Author)
+		assert.Empty(t, files[0].FrontMatter.Authors)
+	})
+
+	t.Run("Unknown authors", func(t *testing.T) {
+		files := []NewCommitFile{
+			NewCommitFile{Path: "documents", Document: "document_9", Filename: "index.md", FrontMatter: FrontMatter{Authors: []string{"lindsay.naegle"}}},
+		}
+
+		assert.Equal(t, ErrUnknownAuthor, assignAuthors(files, mh))
+	})
+}
+
+func Test_checkAuthors(t *testing.T) {
+
+	db.Drop("User")
+	_ = createUser(mh)
+
+	repoPath := "../tests/tmp/repositories/check_authors"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	files := func(authors ...string) []NewCommitFile {
+		return []NewCommitFile{
+			NewCommitFile{Path: "documents", Document: "document_1", Filename: "index.md", Body: "# Document 1", FrontMatter: FrontMatter{Title: "document 1", Authors: authors}},
+		}
+	}
+
+	// lindsay.naegle's account has since been deleted
+	_, err := writeFiles(
+		repo,
+		NewCommit{Message: "Credit Lindsay", Files: files(mh.Username, "lindsay.naegle"), RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	t.Run("Existing authors are retained", func(t *testing.T) {
+		assert.Nil(t, checkAuthors(repo, files(mh.Username, "lindsay.naegle")))
+		assert.Nil(t, checkAuthors(repo, files("lindsay.naegle")))
+	})
+
+	t.Run("New authors must be users", func(t *testing.T) {
+		assert.Equal(t, ErrUnknownAuthor, checkAuthors(repo, files(mh.Username, "lindsay.naegle", "artie.ziff")))
+	})
+
+	t.Run("New documents", func(t *testing.T) {
+		nf := files("artie.ziff")
+		nf[0].Document = "document_9"
+		assert.Equal(t, ErrUnknownAuthor, checkAuthors(repo, nf))
+	})
+}
+
+func Test_fileContributors(t *testing.T) {
+
+	db.Drop("User")
+	_ = createUser(mh)
+
+	repoPath := "../tests/tmp/repositories/contributors"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	edit := func(body string, user User) {
+		var err error
+		lr, err = writeFiles(
+			repo,
+			NewCommit{
+				Message: "Edit document 1",
+				Files: []NewCommitFile{
+					NewCommitFile{Path: "documents", Document: "document_1", Filename: "index.md", Body: body, FrontMatter: FrontMatter{Title: "document 1"}},
+				},
+				RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+			},
+			user,
+		)
+		assert.Nil(t, err)
+	}
+
+	edit("# First", mh)
+	edit("# Second", ck)
+	edit("# Third", mh)
+
+	contributors, err := fileContributors(repo, "documents/document_1/index.md")
+	assert.Nil(t, err)
+
+	// the small repo's original author is included too
+	if assert.Len(t, contributors, 3) {
+		assert.Equal(t, mh.Name, contributors[0].Name)
+		assert.Equal(t, mh.Username, contributors[0].Username)
+		assert.Equal(t, 2, contributors[0].Commits)
+
+		assert.Equal(t, ck.Name, contributors[1].Name)
+		assert.Equal(t, 1, contributors[1].Commits)
+
+		// ck doesn't have an account in this test so can't be linked
+		assert.Empty(t, contributors[1].Username)
+	}
+
+	// once the head moves on the history is walked again
+	edit("# Fourth", ck)
+
+	contributors, _ = fileContributors(repo, "documents/document_1/index.md")
+	if assert.Len(t, contributors, 3) {
+		assert.Equal(t, 2, contributors[1].Commits)
+	}
+
+	contributors, _ = fileContributors(repo, "documents/document_2/index.md")
+	for _, contributor := range contributors {
+		assert.NotEqual(t, mh.Email, contributor.Email)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/asdine/storm"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+var (
+	// ErrAutosaveNotFound is returned when the user has no autosaved
+	// changes for the requested document
+	ErrAutosaveNotFound = errors.New("autosave not found")
+
+	// ErrNoBaseRevision is returned when an autosave doesn't specify
+	// the revision the changes were based upon
+	ErrNoBaseRevision = errors.New("no base revision specified")
+)
+
+// Autosave holds a user's uncommitted changes to a document. There is one
+// per user, document and base revision, so changes made on top of an
+// older revision aren't overwritten by those made on top of a newer one
+type Autosave struct {
+	ID           string      `json:"id" storm:"id"`
+	Username     string      `json:"username" storm:"index"`
+	Path         string      `json:"path"`
+	Document     string      `json:"document"`
+	Filename     string      `json:"filename"`
+	BaseRevision string      `json:"base_revision"`
+	Body         string      `json:"body"`
+	FrontMatter  FrontMatter `json:"frontmatter"`
+	SavedAt      time.Time   `json:"saved_at"`
+
+	// Outdated is set when retrieved if the repository has moved on since
+	// the changes were started, committing them would be out of sync.
+	// DocumentChanged is set if the document itself has been modified
+	Outdated        bool   `json:"outdated"`
+	DocumentChanged bool   `json:"document_changed"`
+	Warning         string `json:"warning,omitempty"`
+}
+
+// FullPath constructs the absolute path using the path, document and filename
+func (as Autosave) FullPath() string {
+	return filepath.Join(as.Path, as.Document, as.Filename)
+}
+
+func autosaveID(username, path, revision string) string {
+	return fmt.Sprintf("%s:%s:%s", username, path, revision)
+}
+
+// saveAutosave stores the user's in-progress changes, replacing any
+// made earlier on top of the same revision
+func saveAutosave(as Autosave, user User) (Autosave, error) {
+
+	if as.BaseRevision == "" {
+		return as, ErrNoBaseRevision
+	}
+
+	as.Username = user.Username
+	as.ID = autosaveID(user.Username, as.FullPath(), as.BaseRevision)
+	as.SavedAt = time.Now()
+	as.Outdated, as.DocumentChanged, as.Warning = false, false, ""
+
+	return as, db.Save(&as)
+}
+
+// getAutosaves returns the user's autosaves, most recent first. If a path
+// is supplied only autosaves of that document are returned
+func getAutosaves(user User, path string) (autosaves []Autosave, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	autosaves = []Autosave{}
+
+	var all []Autosave
+
+	err = db.Find("Username", user.Username, &all)
+	if err != nil && err != storm.ErrNotFound {
+		return autosaves, err
+	}
+
+	repo, err := repository(config)
+	if err != nil {
+		return autosaves, err
+	}
+	defer repo.Free()
+
+	lr, err := getLatestRevision(repo)
+	if err != nil {
+		return autosaves, err
+	}
+
+	for _, as := range all {
+
+		if path != "" && as.FullPath() != path {
+			continue
+		}
+
+		if as.BaseRevision != lr.String() {
+			as.Outdated = true
+			as.Warning = "The repository has changed since these changes were started"
+		}
+
+		if as.Outdated && documentChangedSince(repo, as.FullPath(), as.BaseRevision) {
+			as.DocumentChanged = true
+			as.Warning = "The document has been modified since these changes were started"
+		}
+
+		autosaves = append(autosaves, as)
+	}
+
+	sort.Slice(autosaves, func(i, j int) bool {
+		return autosaves[i].SavedAt.After(autosaves[j].SavedAt)
+	})
+
+	return autosaves, nil
+}
+
+// getLatestAutosave returns the user's most recent autosave of the
+// document at the supplied path
+func getLatestAutosave(user User, path string) (as Autosave, err error) {
+
+	autosaves, err := getAutosaves(user, path)
+	if err != nil {
+		return as, err
+	}
+
+	if len(autosaves) == 0 {
+		return as, ErrAutosaveNotFound
+	}
+
+	return autosaves[0], nil
+}
+
+// discardAutosaves removes all of the user's autosaves of the document
+// at the supplied path, regardless of their base revision
+func discardAutosaves(user User, path string) (discarded int, err error) {
+
+	autosaves, err := getAutosaves(user, path)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, as := range autosaves {
+		err = db.DeleteStruct(&as)
+		if err != nil {
+			return discarded, err
+		}
+		discarded++
+	}
+
+	return discarded, nil
+}
+
+// documentChangedSince returns true if the file at the supplied path at
+// head differs from the one at the supplied revision, including if it's
+// been added or removed
+func documentChangedSince(repo *git.Repository, path, revision string) bool {
+
+	oid, err := git.NewOid(revision)
+	if err != nil {
+		return true
+	}
+
+	commit, err := repo.LookupCommit(oid)
+	if err != nil {
+		return true
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return true
+	}
+	defer tree.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return true
+	}
+	defer ht.Free()
+
+	before, _ := tree.EntryByPath(path)
+	after, _ := ht.EntryByPath(path)
+
+	if before == nil || after == nil {
+		return before != after
+	}
+
+	return !before.Id.Equal(after.Id)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_saveAutosave(t *testing.T) {
+
+	db.Drop("Autosave")
+
+	repoPath := "../tests/tmp/repositories/save_autosave"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	as := Autosave{
+		Path:         "documents",
+		Document:     "document_1",
+		Filename:     "index.md",
+		BaseRevision: lr.String(),
+		Body:         "Me fail English?",
+		FrontMatter:  FrontMatter{Title: "Document 1"},
+	}
+
+	t.Run("No base revision", func(t *testing.T) {
+		_, err := saveAutosave(Autosave{Path: "documents", Document: "document_1", Filename: "index.md"}, ds)
+		assert.Equal(t, ErrNoBaseRevision, err)
+	})
+
+	t.Run("Saving replaces earlier changes on the same revision", func(t *testing.T) {
+
+		_, err := saveAutosave(as, ds)
+		assert.Nil(t, err)
+
+		as.Body = "Me fail English? That's unpossible!"
+
+		_, err = saveAutosave(as, ds)
+		assert.Nil(t, err)
+
+		autosaves, err := getAutosaves(ds, "documents/document_1/index.md")
+		assert.Nil(t, err)
+
+		if assert.Len(t, autosaves, 1) {
+			assert.Equal(t, as.Body, autosaves[0].Body)
+			assert.Equal(t, ds.Username, autosaves[0].Username)
+			assert.False(t, autosaves[0].Outdated)
+			assert.Empty(t, autosaves[0].Warning)
+		}
+	})
+
+	t.Run("Autosaves are per-user", func(t *testing.T) {
+
+		autosaves, err := getAutosaves(sb, "")
+		assert.Nil(t, err)
+		assert.Len(t, autosaves, 0)
+
+		_, err = getLatestAutosave(sb, "documents/document_1/index.md")
+		assert.Equal(t, ErrAutosaveNotFound, err)
+	})
+}
+
+func Test_getLatestAutosaveOutdated(t *testing.T) {
+
+	db.Drop("Autosave")
+
+	repoPath := "../tests/tmp/repositories/outdated_autosave"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	for _, document := range []string{"document_1", "document_2"} {
+		saveAutosave(
+			Autosave{
+				Path:         "documents",
+				Document:     document,
+				Filename:     "index.md",
+				BaseRevision: lr.String(),
+				Body:         "Super Nintendo Chalmers!",
+			},
+			ds,
+		)
+	}
+
+	// now change document 2 so the repository moves on
+	_, err := updateFiles(
+		NewCommit{
+			Message: "Update document 2",
+			Files: []NewCommitFile{
+				NewCommitFile{
+					Filename:    "index.md",
+					Document:    "document_2",
+					Path:        "documents",
+					Body:        "I'm learnding!",
+					FrontMatter: FrontMatter{Title: "Document 2"},
+				},
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	unchanged, err := getLatestAutosave(ds, "documents/document_1/index.md")
+	assert.Nil(t, err)
+	assert.True(t, unchanged.Outdated)
+	assert.False(t, unchanged.DocumentChanged)
+	assert.Equal(t, "The repository has changed since these changes were started", unchanged.Warning)
+
+	changed, err := getLatestAutosave(ds, "documents/document_2/index.md")
+	assert.Nil(t, err)
+	assert.True(t, changed.Outdated)
+	assert.True(t, changed.DocumentChanged)
+	assert.Equal(t, "The document has been modified since these changes were started", changed.Warning)
+}
+
+func Test_getAutosavesOrder(t *testing.T) {
+
+	db.Drop("Autosave")
+
+	repoPath := "../tests/tmp/repositories/autosave_order"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	for _, document := range []string{"document_1", "document_2", "document_3"} {
+		saveAutosave(
+			Autosave{Path: "documents", Document: document, Filename: "index.md", BaseRevision: lr.String()},
+			ds,
+		)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	autosaves, err := getAutosaves(ds, "")
+	assert.Nil(t, err)
+
+	var documents []string
+	for _, as := range autosaves {
+		documents = append(documents, as.Document)
+	}
+
+	assert.Equal(t, []string{"document_3", "document_2", "document_1"}, documents)
+}
+
+func Test_discardAutosaves(t *testing.T) {
+
+	db.Drop("Autosave")
+
+	repoPath := "../tests/tmp/repositories/discard_autosave"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	// autosaves on top of two different revisions
+	for _, revision := range []string{"0000000000000000000000000000000000000000", lr.String()} {
+		saveAutosave(
+			Autosave{Path: "documents", Document: "document_1", Filename: "index.md", BaseRevision: revision},
+			ds,
+		)
+	}
+
+	discarded, err := discardAutosaves(ds, "documents/document_1/index.md")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, discarded)
+
+	autosaves, _ := getAutosaves(ds, "")
+	assert.Len(t, autosaves, 0)
+}
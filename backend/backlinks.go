@@ -0,0 +1,155 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+// backlinks holds the reference graph, it is rebuilt whenever the
+// repository's head moves on
+var backlinks = &referenceGraph{}
+
+// referenceGraph maps the path of every referenced file to the links
+// and images pointing at it at a given revision
+type referenceGraph struct {
+	sync.RWMutex
+	revision string
+	incoming map[string][]Reference
+}
+
+// refresh rebuilds the graph from the head tree, unless it's already
+// up to date
+func (rg *referenceGraph) refresh(repo *git.Repository) error {
+
+	lr, err := getLatestRevision(repo)
+	if err != nil {
+		return err
+	}
+
+	rg.Lock()
+	defer rg.Unlock()
+
+	if rg.revision == lr.String() {
+		return nil
+	}
+
+	incoming, err := buildReferenceGraph(repo)
+	if err != nil {
+		return err
+	}
+
+	Debug.Printf("Reference graph rebuilt at %s with %d entries", lr, len(incoming))
+
+	rg.incoming = incoming
+	rg.revision = lr.String()
+
+	return nil
+}
+
+func (rg *referenceGraph) lookup(path string) []Reference {
+	rg.RLock()
+	defer rg.RUnlock()
+
+	return rg.incoming[path]
+}
+
+// buildReferenceGraph resolves every internal reference in the head tree
+// to the file it'll be served from. Broken references point at nothing
+// so aren't included
+func buildReferenceGraph(repo *git.Repository) (incoming map[string][]Reference, err error) {
+
+	incoming = make(map[string][]Reference)
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer ht.Free()
+
+	// attachments can be referred to from raw HTML, shortcodes and the
+	// front matter as well as Markdown, and they all count when working
+	// out what's in use
+	_, refs, err := treeReferences(repo, ht, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range refs {
+
+		path, found := locateReference(ht, ref.Target)
+		if !found || path == "" {
+			continue
+		}
+
+		incoming[path] = append(incoming[path], ref)
+	}
+
+	return incoming, nil
+}
+
+// incomingReferences returns the links and images in other documents that
+// point at the file with the supplied path
+func incomingReferences(repo *git.Repository, path string) (refs []Reference, err error) {
+
+	// Initialise the slice so [] is marshalled instead of null
+	refs = []Reference{}
+
+	err = backlinks.refresh(repo)
+	if err != nil {
+		return refs, err
+	}
+
+	for _, ref := range backlinks.lookup(path) {
+
+		// documents linking to themselves don't count
+		if ref.Source == path {
+			continue
+		}
+
+		refs = append(refs, ref)
+	}
+
+	return refs, nil
+}
+
+// danglingReferences returns the references that would be left broken
+// if the supplied files were deleted. References from files that are
+// being deleted too, like a document's links to its own images, are
+// ignored
+func danglingReferences(files []NewCommitFile) (refs []Reference, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	var paths []string
+
+	deleting := make(map[string]bool)
+	for _, ncf := range files {
+		path := filepath.Join(ncf.Path, ncf.Document, ncf.Filename)
+		if !deleting[path] {
+			paths = append(paths, path)
+		}
+		deleting[path] = true
+	}
+
+	for _, path := range paths {
+
+		incoming, err := incomingReferences(repo, path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range incoming {
+			if !deleting[ref.Source] {
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	return refs, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+// setupBacklinksTestRepo adds two documents to the multiple filetypes
+// repository, document 4 links to documents 1 and 2 and an image in
+// document 1, document 5 links to document 4 and itself
+func setupBacklinksTestRepo(repoPath string) (oid *git.Oid, err error) {
+
+	lr, _ := setupMultipleFiletypesTestRepo(repoPath)
+
+	nc := NewCommit{
+		Message: "Add documents 4 and 5",
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Filename: "index.md",
+				Document: "document_4",
+				Path:     "documents",
+				Body: `
+* [Document 1](../document_1)
+* [Document 2](/documents/document_2/index.md)
+
+![Image 1](../document_1/images/image_1.gif)
+`,
+				FrontMatter: FrontMatter{Title: "Document 4"},
+			},
+			NewCommitFile{
+				Filename:    "index.md",
+				Document:    "document_5",
+				Path:        "documents",
+				Body:        "See [document 4](/cms/documents/document_4) or [this document](../document_5)",
+				FrontMatter: FrontMatter{Title: "Document 5"},
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	return createFiles(nc, mh)
+}
+
+func Test_incomingReferences(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/incoming_references"
+	setupBacklinksTestRepo(repoPath)
+	repo, _ := repository(config)
+
+	tests := []struct {
+		name    string
+		path    string
+		sources []string
+	}{
+		{name: "Linked by directory", path: "documents/document_1/index.md", sources: []string{"documents/document_4/index.md"}},
+		{name: "Linked by filename", path: "documents/document_2/index.md", sources: []string{"documents/document_4/index.md"}},
+		{name: "Image", path: "documents/document_1/images/image_1.gif", sources: []string{"documents/document_4/index.md"}},
+		{name: "Self reference ignored", path: "documents/document_4/index.md", sources: []string{"documents/document_5/index.md"}},
+		{name: "Not linked", path: "documents/document_3/index.md", sources: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			refs, err := incomingReferences(repo, tt.path)
+			assert.Nil(t, err)
+
+			sources := []string{}
+			for _, ref := range refs {
+				sources = append(sources, ref.Source)
+			}
+
+			assert.Equal(t, tt.sources, sources)
+		})
+	}
+}
+
+func Test_incomingReferencesRefreshed(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/incoming_references_refreshed"
+	lr, _ := setupBacklinksTestRepo(repoPath)
+	repo, _ := repository(config)
+
+	refs, _ := incomingReferences(repo, "documents/document_3/index.md")
+	assert.Len(t, refs, 0)
+
+	nc := NewCommit{
+		Message: "Link to document 3",
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Filename:    "index.md",
+				Document:    "document_2",
+				Path:        "documents",
+				Body:        "Now see [document 3](../document_3)",
+				FrontMatter: FrontMatter{Title: "Document 2"},
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	_, err := updateFiles(nc, mh)
+	if err != nil {
+		panic(err)
+	}
+
+	refs, _ = incomingReferences(repo, "documents/document_3/index.md")
+	if assert.Len(t, refs, 1) {
+		assert.Equal(t, "documents/document_2/index.md", refs[0].Source)
+	}
+}
+
+func Test_danglingReferences(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/dangling_references"
+	setupBacklinksTestRepo(repoPath)
+
+	t.Run("Referenced document", func(t *testing.T) {
+		refs, err := danglingReferences([]NewCommitFile{
+			NewCommitFile{Path: "documents", Document: "document_1", Filename: "index.md"},
+		})
+		assert.Nil(t, err)
+		if assert.Len(t, refs, 1) {
+			assert.Equal(t, "documents/document_4/index.md", refs[0].Source)
+			assert.Equal(t, "../document_1", refs[0].Destination)
+		}
+	})
+
+	t.Run("Referencing document deleted too", func(t *testing.T) {
+		refs, err := danglingReferences([]NewCommitFile{
+			NewCommitFile{Path: "documents", Document: "document_4", Filename: "index.md"},
+			NewCommitFile{Path: "documents", Document: "document_5", Filename: "index.md"},
+		})
+		assert.Nil(t, err)
+		assert.Len(t, refs, 0)
+	})
+
+	t.Run("Unreferenced document", func(t *testing.T) {
+		refs, err := danglingReferences([]NewCommitFile{
+			NewCommitFile{Path: "documents", Document: "document_3", Filename: "index.md"},
+		})
+		assert.Nil(t, err)
+		assert.Len(t, refs, 0)
+	})
+}
+
+func Test_getFileIncomingLinks(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/file_incoming_links"
+	setupBacklinksTestRepo(repoPath)
+
+	file, err := getConvertedFile("documents", "document_4", "index.md")
+	if err != nil {
+		panic(err)
+	}
+
+	// links are only found when the file is being viewed
+	assert.Len(t, file.IncomingLinks, 0)
+	describeFile(file)
+
+	if assert.Len(t, file.IncomingLinks, 1) {
+		assert.Equal(
+			t,
+			Reference{
+				Source:      "documents/document_5/index.md",
+				Destination: "/cms/documents/document_4",
+				Target:      "documents/document_4",
+				Kind:        referenceKindLink,
+			},
+			file.IncomingLinks[0],
+		)
+	}
+}
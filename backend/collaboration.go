@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// collaboration message types
+	collabInit         = "init"
+	collabOperation    = "operation"
+	collabAck          = "ack"
+	collabCursor       = "cursor"
+	collabPresence     = "presence"
+	collabSave         = "save"
+	collabSaved        = "saved"
+	collabError        = "error"
+	collabSendBuffer   = 64
+	collabWriteTimeout = 10 * time.Second
+)
+
+var (
+	// ErrRevisionInFuture is returned when a client sends an operation based
+	// on a revision the session hasn't reached
+	ErrRevisionInFuture = errors.New("operation revision is ahead of the session")
+
+	// collaborations holds the active editing sessions, keyed by path
+	collaborations = &collaborationHub{sessions: make(map[string]*collaborationSession)}
+
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+)
+
+// CollaborationMessage is sent in both directions over a collaboration
+// WebSocket, which fields are present depends on the type
+type CollaborationMessage struct {
+	Type         string         `json:"type"`
+	Revision     int            `json:"revision"`
+	Operation    *TextOperation `json:"operation,omitempty"`
+	Body         *string        `json:"body,omitempty"`
+	FrontMatter  *FrontMatter   `json:"frontmatter,omitempty"`
+	Username     string         `json:"username,omitempty"`
+	Cursor       *Cursor        `json:"cursor,omitempty"`
+	Participants []Participant  `json:"participants,omitempty"`
+	Message      string         `json:"message,omitempty"`
+	Oid          string         `json:"oid,omitempty"`
+}
+
+// Cursor is a participant's position in the document, Position and
+// SelectionEnd are the same when nothing is selected
+type Cursor struct {
+	Position     int `json:"position"`
+	SelectionEnd int `json:"selection_end"`
+}
+
+// transform returns the cursor moved to follow the operation
+func (cur *Cursor) transform(op *TextOperation) *Cursor {
+	return &Cursor{
+		Position:     transformIndex(op, cur.Position),
+		SelectionEnd: transformIndex(op, cur.SelectionEnd),
+	}
+}
+
+// Participant is somebody taking part in a collaboration session
+type Participant struct {
+	Username string  `json:"username"`
+	Name     string  `json:"name"`
+	Cursor   *Cursor `json:"cursor,omitempty"`
+}
+
+// collaborationHub keeps track of sessions so everyone editing the same
+// document joins the same one
+type collaborationHub struct {
+	sync.Mutex
+	sessions map[string]*collaborationSession
+}
+
+// collaborationSession is the shared state of a document being edited by
+// several people at once. Edits are exchanged as operations which are
+// transformed against any made concurrently before being applied, the
+// server's order of operations is authoritative. The body as it was at
+// baseRevision is kept so commits made outside of the session can be
+// merged into it
+type collaborationSession struct {
+	sync.Mutex
+	directory    string
+	document     string
+	filename     string
+	baseRevision string
+	baseBody     []uint16
+	frontMatter  FrontMatter
+	body         []uint16
+	history      []*TextOperation
+	dirty        bool
+	lastEditor   User
+	clients      map[*collaborator]bool
+}
+
+// collaborator is a single connection to a session
+type collaborator struct {
+	user   User
+	conn   *websocket.Conn
+	send   chan CollaborationMessage
+	cursor *Cursor
+}
+
+// join adds the user to the session for the document, starting one from
+// the document's contents at head if nobody else is editing it
+func (h *collaborationHub) join(directory, document, filename string, c *collaborator) (*collaborationSession, error) {
+
+	h.Lock()
+	defer h.Unlock()
+
+	path := filepath.Join(directory, document, filename)
+
+	cs, found := h.sessions[path]
+	if !found {
+
+		file, err := getRawFile(directory, document, filename)
+		if err != nil {
+			return nil, err
+		}
+
+		body := utf16.Encode([]rune(*file.Markdown))
+
+		cs = &collaborationSession{
+			directory:    directory,
+			document:     document,
+			filename:     filename,
+			baseRevision: file.RepositoryInfo.LatestRevision,
+			baseBody:     body,
+			frontMatter:  file.FrontMatter,
+			body:         body,
+			clients:      make(map[*collaborator]bool),
+		}
+
+		h.sessions[path] = cs
+
+		Info.Println("Collaboration session started", path)
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	// newcomers start from the latest contents, not whatever was at head
+	// when the session started
+	err := cs.rebase()
+	if err != nil {
+		Warning.Println("Could not bring collaboration session up to date", path, err.Error())
+	}
+
+	cs.clients[c] = true
+
+	body := string(utf16.Decode(cs.body))
+	fm := cs.frontMatter
+
+	c.deliver(CollaborationMessage{
+		Type:         collabInit,
+		Revision:     len(cs.history),
+		Body:         &body,
+		FrontMatter:  &fm,
+		Participants: cs.participants(),
+	})
+
+	cs.broadcast(CollaborationMessage{Type: collabPresence, Participants: cs.participants()}, c)
+
+	return cs, nil
+}
+
+// leave removes the collaborator from the session, once the last one has
+// gone the session ends. Unsaved changes are kept as an autosave for
+// whoever edited last so they aren't lost
+func (h *collaborationHub) leave(cs *collaborationSession, c *collaborator) {
+
+	h.Lock()
+	defer h.Unlock()
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	delete(cs.clients, c)
+	close(c.send)
+
+	if len(cs.clients) > 0 {
+		cs.broadcast(CollaborationMessage{Type: collabPresence, Participants: cs.participants()}, nil)
+		return
+	}
+
+	path := filepath.Join(cs.directory, cs.document, cs.filename)
+	delete(h.sessions, path)
+
+	Info.Println("Collaboration session ended", path)
+
+	if cs.dirty {
+		_, err := saveAutosave(
+			Autosave{
+				Path:         cs.directory,
+				Document:     cs.document,
+				Filename:     cs.filename,
+				BaseRevision: cs.baseRevision,
+				Body:         string(utf16.Decode(cs.body)),
+				FrontMatter:  cs.frontMatter,
+			},
+			cs.lastEditor,
+		)
+		if err != nil {
+			Warning.Println("Could not autosave collaboration session", path, err.Error())
+		}
+	}
+}
+
+// participants lists everybody connected, the session must be locked
+func (cs *collaborationSession) participants() (participants []Participant) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	participants = []Participant{}
+
+	for c := range cs.clients {
+		participants = append(participants, Participant{
+			Username: c.user.Username,
+			Name:     c.user.Name,
+			Cursor:   c.cursor,
+		})
+	}
+
+	return participants
+}
+
+// broadcast sends the message to every collaborator except the one
+// supplied, the session must be locked
+func (cs *collaborationSession) broadcast(msg CollaborationMessage, except *collaborator) {
+	for c := range cs.clients {
+
+		if c == except {
+			continue
+		}
+
+		c.deliver(msg)
+	}
+}
+
+// applyOperation transforms an operation made at the supplied revision
+// against everything that has happened since, applies it and returns the
+// transformed operation along with the new revision
+func (cs *collaborationSession) applyOperation(op *TextOperation, revision int, user User) (*TextOperation, int, error) {
+
+	if revision < 0 || revision > len(cs.history) {
+		return nil, 0, ErrRevisionInFuture
+	}
+
+	var err error
+
+	for _, concurrent := range cs.history[revision:] {
+		op, _, err = transformOperations(op, concurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	body, err := op.Apply(cs.body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cs.body = body
+	cs.history = append(cs.history, op)
+	cs.dirty = true
+	cs.lastEditor = user
+
+	cs.transformCursors(op)
+
+	return op, len(cs.history), nil
+}
+
+// transformCursors moves everybody's cursor to follow the operation, the
+// session must be locked
+func (cs *collaborationSession) transformCursors(op *TextOperation) {
+	for c := range cs.clients {
+		if c.cursor != nil {
+			c.cursor = c.cursor.transform(op)
+		}
+	}
+}
+
+// transformCursor moves a cursor placed at the supplied revision through
+// everything that has happened since, like an operation would be
+func (cs *collaborationSession) transformCursor(cursor *Cursor, revision int) (*Cursor, error) {
+
+	if revision < 0 || revision > len(cs.history) {
+		return nil, ErrRevisionInFuture
+	}
+
+	for _, concurrent := range cs.history[revision:] {
+		cursor = cursor.transform(concurrent)
+	}
+
+	return cursor, nil
+}
+
+// rebase brings the session up to date with commits made outside of it,
+// by regular edits, SSH pushes or the scheduler. Their changes to the
+// body are transformed against the session's own and sent to everybody
+// as an operation, the session must be locked
+func (cs *collaborationSession) rebase() error {
+
+	file, err := getRawFile(cs.directory, cs.document, cs.filename)
+	if err != nil {
+		return err
+	}
+
+	head := file.RepositoryInfo.LatestRevision
+	if head == cs.baseRevision {
+		return nil
+	}
+
+	after := utf16.Encode([]rune(*file.Markdown))
+
+	local := diffOperation(cs.baseBody, cs.body)
+	external := diffOperation(cs.baseBody, after)
+
+	_, external, err = transformOperations(local, external)
+	if err != nil {
+		return err
+	}
+
+	body, err := external.Apply(cs.body)
+	if err != nil {
+		return err
+	}
+
+	cs.baseRevision = head
+	cs.baseBody = after
+	cs.frontMatter = file.FrontMatter
+
+	// the commits didn't change the body
+	if external.isNoop() {
+		return nil
+	}
+
+	cs.body = body
+	cs.history = append(cs.history, external)
+	cs.transformCursors(external)
+
+	Info.Println("Collaboration session brought up to date with", head)
+
+	cs.broadcast(CollaborationMessage{Type: collabOperation, Revision: len(cs.history), Operation: external}, nil)
+
+	return nil
+}
+
+// save commits the session's current contents through the regular
+// update path, so all the usual checks apply
+func (cs *collaborationSession) save(msg CollaborationMessage, user User) (oid string, err error) {
+
+	fm := cs.frontMatter
+	if msg.FrontMatter != nil {
+		fm = *msg.FrontMatter
+	}
+
+	// catch up with anything committed since the session last saved,
+	// otherwise the update would be out of sync
+	err = cs.rebase()
+	if err != nil {
+		return "", err
+	}
+
+	message := msg.Message
+	if message == "" {
+		message = fmt.Sprintf("Collaborative edit of %s", filepath.Join(cs.directory, cs.document, cs.filename))
+	}
+
+	nc := NewCommit{
+		Message: message,
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Path:        cs.directory,
+				Document:    cs.document,
+				Filename:    cs.filename,
+				Body:        string(utf16.Decode(cs.body)),
+				FrontMatter: fm,
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: cs.baseRevision},
+	}
+
+	commit, err := updateFiles(nc, user)
+	if err != nil {
+		return "", err
+	}
+
+	cs.baseRevision = commit.String()
+	cs.baseBody = cs.body
+	cs.frontMatter = fm
+	cs.dirty = false
+
+	return cs.baseRevision, nil
+}
+
+// handle processes a message received from a collaborator
+func (cs *collaborationSession) handle(msg CollaborationMessage, c *collaborator) {
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	switch msg.Type {
+
+	case collabOperation:
+
+		if msg.Operation == nil {
+			c.deliver(CollaborationMessage{Type: collabError, Message: "No operation supplied"})
+			return
+		}
+
+		op, revision, err := cs.applyOperation(msg.Operation, msg.Revision, c.user)
+		if err != nil {
+			Warning.Println("Could not apply operation from", c.user.Username, err.Error())
+			c.deliver(CollaborationMessage{Type: collabError, Message: err.Error()})
+			return
+		}
+
+		c.deliver(CollaborationMessage{Type: collabAck, Revision: revision})
+
+		cs.broadcast(
+			CollaborationMessage{
+				Type:      collabOperation,
+				Revision:  revision,
+				Operation: op,
+				Username:  c.user.Username,
+			},
+			c,
+		)
+
+	case collabCursor:
+
+		cursor := msg.Cursor
+
+		// cursors placed before operations the collaborator hadn't
+		// received yet are moved to follow them
+		if cursor != nil {
+			var err error
+
+			cursor, err = cs.transformCursor(cursor, msg.Revision)
+			if err != nil {
+				c.deliver(CollaborationMessage{Type: collabError, Message: err.Error()})
+				return
+			}
+		}
+
+		c.cursor = cursor
+
+		cs.broadcast(
+			CollaborationMessage{
+				Type:     collabCursor,
+				Revision: len(cs.history),
+				Username: c.user.Username,
+				Cursor:   cursor,
+			},
+			c,
+		)
+
+	case collabSave:
+
+		oid, err := cs.save(msg, c.user)
+		if err == ErrRepoOutOfSync {
+			c.deliver(CollaborationMessage{Type: collabError, Message: "Repository out of sync with commit"})
+			return
+		}
+
+		if err != nil {
+			Error.Println("Could not save collaboration session", err.Error())
+			c.deliver(CollaborationMessage{Type: collabError, Message: err.Error()})
+			return
+		}
+
+		cs.broadcast(
+			CollaborationMessage{Type: collabSaved, Revision: len(cs.history), Oid: oid, Username: c.user.Username},
+			nil,
+		)
+
+	default:
+		c.deliver(CollaborationMessage{Type: collabError, Message: fmt.Sprintf("Unknown message type %s", msg.Type)})
+	}
+}
+
+// deliver queues a message for sending. Collaborators that can't keep up
+// are disconnected rather than holding everybody else up
+func (c *collaborator) deliver(msg CollaborationMessage) {
+	select {
+	case c.send <- msg:
+	default:
+		Warning.Println("Collaborator not keeping up, disconnecting", c.user.Username)
+		c.conn.Close()
+	}
+}
+
+// readMessages passes messages from the collaborator's browser to the
+// session until the connection is closed
+func (c *collaborator) readMessages(cs *collaborationSession) {
+	for {
+		var msg CollaborationMessage
+
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				Warning.Println("Collaboration connection closed", c.user.Username, err.Error())
+			}
+			return
+		}
+
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			c.deliver(CollaborationMessage{Type: collabError, Message: "Invalid message"})
+			continue
+		}
+
+		cs.handle(msg, c)
+	}
+}
+
+// writeMessages sends queued messages to the collaborator's browser until
+// the send channel is closed
+func (c *collaborator) writeMessages() {
+
+	defer c.conn.Close()
+
+	for msg := range c.send {
+
+		c.conn.SetWriteDeadline(time.Now().Add(collabWriteTimeout))
+
+		err := c.conn.WriteJSON(msg)
+		if err != nil {
+			Warning.Println("Could not send collaboration message", c.user.Username, err.Error())
+			return
+		}
+	}
+
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func dialCollaboration(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// receive reads messages until one of the requested type arrives
+func receive(t *testing.T, conn *websocket.Conn, msgType string) (msg CollaborationMessage) {
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	for {
+		msg = CollaborationMessage{}
+
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			t.Fatalf("waiting for %s: %s", msgType, err.Error())
+		}
+
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestCollaboration(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/collaboration"
+	setupSmallTestRepo(repoPath)
+
+	db.Drop("Autosave")
+
+	url := fmt.Sprintf(
+		"%s/%s",
+		strings.Replace(server.URL, "http", "ws", 1),
+		"api/directories/documents/documents/document_3/files/index.md/collaborate",
+	)
+
+	first := dialCollaboration(t, url)
+	defer first.Close()
+
+	start := receive(t, first, collabInit)
+	assert.Equal(t, 0, start.Revision)
+	assert.Len(t, start.Participants, 1)
+
+	original, _ := getRawFile("documents", "document_3", "index.md")
+	assert.Equal(t, *original.Markdown, *start.Body)
+
+	length := utf16Length(*start.Body)
+
+	second := dialCollaboration(t, url)
+	defer second.Close()
+
+	assert.Len(t, receive(t, second, collabInit).Participants, 2)
+	assert.Len(t, receive(t, first, collabPresence).Participants, 2)
+
+	t.Run("Concurrent operations", func(t *testing.T) {
+
+		// both clients make a change on top of revision 0
+		first.WriteJSON(CollaborationMessage{
+			Type:      collabOperation,
+			Revision:  0,
+			Operation: (&TextOperation{}).Insert("First ").Retain(length),
+		})
+
+		assert.Equal(t, 1, receive(t, first, collabAck).Revision)
+
+		second.WriteJSON(CollaborationMessage{
+			Type:      collabOperation,
+			Revision:  0,
+			Operation: (&TextOperation{}).Retain(length).Insert(" Last"),
+		})
+
+		// the second operation is transformed against the first
+		op := receive(t, first, collabOperation)
+		assert.Equal(t, 2, op.Revision)
+		assert.Equal(t, (&TextOperation{}).Retain(length+6).Insert(" Last"), op.Operation)
+
+		assert.Equal(t, 2, receive(t, second, collabAck).Revision)
+	})
+
+	t.Run("Cursors", func(t *testing.T) {
+
+		second.WriteJSON(CollaborationMessage{Type: collabCursor, Revision: 2, Cursor: &Cursor{Position: 3, SelectionEnd: 5}})
+
+		cursor := receive(t, first, collabCursor)
+		assert.Equal(t, apiTestUser().Username, cursor.Username)
+		assert.Equal(t, &Cursor{Position: 3, SelectionEnd: 5}, cursor.Cursor)
+
+		// placed before the first operation, which inserted 'First '
+		second.WriteJSON(CollaborationMessage{Type: collabCursor, Revision: 0, Cursor: &Cursor{Position: 3, SelectionEnd: 5}})
+
+		cursor = receive(t, first, collabCursor)
+		assert.Equal(t, 2, cursor.Revision)
+		assert.Equal(t, &Cursor{Position: 9, SelectionEnd: 11}, cursor.Cursor)
+	})
+
+	t.Run("Save", func(t *testing.T) {
+
+		first.WriteJSON(CollaborationMessage{Type: collabSave, Message: "Collaborated"})
+
+		saved := receive(t, second, collabSaved)
+		assert.NotEmpty(t, saved.Oid)
+
+		file, _ := getRawFile("documents", "document_3", "index.md")
+		assert.Equal(t, fmt.Sprintf("First %s Last", *original.Markdown), *file.Markdown)
+		assert.Equal(t, original.FrontMatter.Title, file.FrontMatter.Title)
+	})
+
+	t.Run("Commits made outside the session", func(t *testing.T) {
+
+		file, _ := getRawFile("documents", "document_3", "index.md")
+		body := *file.Markdown
+
+		_, err := updateFiles(
+			NewCommit{
+				Message: "Edited outside the session",
+				Files: []NewCommitFile{
+					NewCommitFile{Path: "documents", Document: "document_3", Filename: "index.md", Body: "Outside. " + body, FrontMatter: file.FrontMatter},
+				},
+				RepositoryInfo: RepositoryInfo{LatestRevision: file.RepositoryInfo.LatestRevision},
+			},
+			mh,
+		)
+		assert.Nil(t, err)
+
+		// made without knowing about the outside commit
+		first.WriteJSON(CollaborationMessage{
+			Type:      collabOperation,
+			Revision:  2,
+			Operation: (&TextOperation{}).Retain(utf16Length(body)).Insert(" Again"),
+		})
+
+		assert.Equal(t, 3, receive(t, first, collabAck).Revision)
+
+		first.WriteJSON(CollaborationMessage{Type: collabSave, Message: "Collaborated again"})
+
+		// the outside commit's changes are sent to everybody
+		rebased := receive(t, first, collabOperation)
+		assert.Equal(t, 4, rebased.Revision)
+		assert.Equal(t, (&TextOperation{}).Insert("Outside. ").Retain(utf16Length(body)+6), rebased.Operation)
+
+		saved := receive(t, first, collabSaved)
+		assert.NotEmpty(t, saved.Oid)
+
+		file, _ = getRawFile("documents", "document_3", "index.md")
+		assert.Equal(t, "Outside. "+body+" Again", *file.Markdown)
+	})
+
+	t.Run("Invalid operation", func(t *testing.T) {
+
+		first.WriteJSON(CollaborationMessage{
+			Type:      collabOperation,
+			Revision:  99,
+			Operation: (&TextOperation{}).Retain(3),
+		})
+
+		assert.Equal(t, ErrRevisionInFuture.Error(), receive(t, first, collabError).Message)
+	})
+
+}
+
+func TestCollaborationAutosavesOnLeaving(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/collaboration_autosave"
+	setupSmallTestRepo(repoPath)
+
+	db.Drop("Autosave")
+
+	url := fmt.Sprintf(
+		"%s/%s",
+		strings.Replace(server.URL, "http", "ws", 1),
+		"api/directories/documents/documents/document_2/files/index.md/collaborate",
+	)
+
+	conn := dialCollaboration(t, url)
+
+	start := receive(t, conn, collabInit)
+
+	conn.WriteJSON(CollaborationMessage{
+		Type:      collabOperation,
+		Revision:  0,
+		Operation: (&TextOperation{}).Retain(utf16Length(*start.Body)).Insert("Unsaved"),
+	})
+
+	receive(t, conn, collabAck)
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+
+	// the session is closed asynchronously
+	var as Autosave
+	var err error
+
+	for i := 0; i < 20; i++ {
+		as, err = getLatestAutosave(apiTestUser(), "documents/document_2/index.md")
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("%sUnsaved", *start.Body), as.Body)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf16"
+
+	"github.com/asdine/storm"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+var (
+	// ErrCommentNotFound is returned when there's no comment with the
+	// requested ID on the document
+	ErrCommentNotFound = errors.New("comment not found")
+
+	// ErrInvalidAnchor is returned when a comment's anchor doesn't fall
+	// within the document
+	ErrInvalidAnchor = errors.New("comment anchor is outside the document")
+)
+
+// Comment is a piece of review feedback left on a document. Comments
+// without a ParentID start a thread, replies belong to the thread's first
+// comment. Only threads can be anchored and resolved. Comments are kept
+// against the document's ID so they follow it when it's moved, Path is
+// where the document was when the comment was last seen
+type Comment struct {
+	ID         int            `json:"id" storm:"id,increment"`
+	DocumentID string         `json:"document_id" storm:"index"`
+	Path       string         `json:"path" storm:"index"`
+	ParentID   int            `json:"parent_id,omitempty" storm:"index"`
+	Username   string         `json:"username"`
+	Name       string         `json:"name"`
+	Body       string         `json:"body" validate:"required"`
+	Anchor     *CommentAnchor `json:"anchor,omitempty"`
+	Resolved   bool           `json:"resolved"`
+	ResolvedBy string         `json:"resolved_by,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Replies    []Comment      `json:"replies,omitempty"`
+}
+
+// CommentAnchor attaches a comment to part of a document's Markdown.
+// Start and End are offsets in UTF-16 code units, matching the browser,
+// and are valid at Revision. A comment can be anchored to a whole line by
+// supplying only Line. When the text is edited away the anchor is
+// Orphaned and left where it was last seen
+type CommentAnchor struct {
+	Revision string `json:"revision"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+	Line     int    `json:"line"`
+	Quote    string `json:"quote"`
+	Orphaned bool   `json:"orphaned"`
+}
+
+// createComment starts a new thread on the document at path, anchoring
+// it to the current version of the document if an anchor is supplied
+func createComment(path string, comment Comment, user User) (Comment, error) {
+
+	documentID, err := documentIDAt(path)
+	if err != nil {
+		return comment, err
+	}
+
+	comment.ID = 0
+	comment.ParentID = 0
+	comment.DocumentID = documentID
+	comment.Path = path
+	comment.Username = user.Username
+	comment.Name = user.Name
+	comment.Resolved = false
+	comment.ResolvedBy = ""
+	comment.Replies = nil
+	comment.CreatedAt = time.Now()
+
+	if comment.Anchor != nil {
+
+		repo, err := repository(config)
+		if err != nil {
+			return comment, err
+		}
+		defer repo.Free()
+
+		lr, err := getLatestRevision(repo)
+		if err != nil {
+			return comment, err
+		}
+
+		body, err := documentBodyAt(repo, path, lr.String())
+		if err != nil {
+			return comment, err
+		}
+
+		anchor, err := newAnchor(*comment.Anchor, body)
+		if err != nil {
+			return comment, err
+		}
+
+		anchor.Revision = lr.String()
+		comment.Anchor = &anchor
+	}
+
+	err = db.Save(&comment)
+
+	return comment, err
+}
+
+// replyToComment adds a comment to the thread containing the comment
+// with the supplied ID, replies to replies join the original thread
+func replyToComment(path string, id int, reply Comment, user User) (Comment, error) {
+
+	thread, err := getThread(path, id)
+	if err != nil {
+		return reply, err
+	}
+
+	reply.ID = 0
+	reply.ParentID = thread.ID
+	reply.DocumentID = thread.DocumentID
+	reply.Path = path
+	reply.Username = user.Username
+	reply.Name = user.Name
+	reply.Anchor = nil
+	reply.Resolved = false
+	reply.ResolvedBy = ""
+	reply.Replies = nil
+	reply.CreatedAt = time.Now()
+
+	err = db.Save(&reply)
+
+	return reply, err
+}
+
+// resolveThread marks the thread containing the comment as resolved, or
+// reopens it
+func resolveThread(path string, id int, resolved bool, user User) (Comment, error) {
+
+	thread, err := getThread(path, id)
+	if err != nil {
+		return thread, err
+	}
+
+	thread.Resolved = resolved
+	thread.ResolvedBy = ""
+
+	if resolved {
+		thread.ResolvedBy = user.Username
+	}
+
+	err = db.Save(&thread)
+
+	return thread, err
+}
+
+// getThread returns the first comment of the thread containing the
+// comment with the supplied ID
+func getThread(path string, id int) (comment Comment, err error) {
+
+	documentID, err := documentIDAt(path)
+	if err != nil {
+		return comment, err
+	}
+
+	for {
+		err = db.One("ID", id, &comment)
+		if err == storm.ErrNotFound || (err == nil && !comment.belongsTo(documentID, path)) {
+			return comment, ErrCommentNotFound
+		}
+		if err != nil {
+			return comment, err
+		}
+
+		if comment.ParentID == 0 {
+			return comment, nil
+		}
+
+		id = comment.ParentID
+	}
+}
+
+// belongsTo returns true if the comment was left on the document, those
+// left before it had an ID are matched by path instead
+func (c Comment) belongsTo(documentID, path string) bool {
+
+	if c.DocumentID != "" {
+		return c.DocumentID == documentID
+	}
+
+	return c.Path == path
+}
+
+// findComments returns every comment left on the document, including
+// any left before it had an ID
+func findComments(documentID, path string) (comments []Comment, err error) {
+
+	if documentID != "" {
+		err = db.Find("DocumentID", documentID, &comments)
+		if err != nil && err != storm.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	var unidentified []Comment
+
+	err = db.Find("Path", path, &unidentified)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	for _, comment := range unidentified {
+		if comment.DocumentID == "" {
+			comments = append(comments, comment)
+		}
+	}
+
+	return comments, nil
+}
+
+// getComments returns the threads on the document at path, oldest first
+// and with their replies. Anchors made against earlier versions of the
+// document are moved to follow the text they refer to
+func getComments(path string) (threads []Comment, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	threads = []Comment{}
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	documentID := existingDocumentID(repo, path)
+
+	comments, err := findComments(documentID, path)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(comments, func(i, j int) bool {
+		return comments[i].ID < comments[j].ID
+	})
+
+	positions := make(map[int]int)
+
+	for _, comment := range comments {
+
+		// comments left before the document had an ID are moved over
+		// to it, so they aren't lost if it's moved
+		if comment.DocumentID == "" && documentID != "" {
+			comment.DocumentID = documentID
+
+			err = db.Save(&comment)
+			if err != nil {
+				Warning.Println("Could not update comment", comment.ID, err.Error())
+			}
+		}
+
+		if comment.ParentID != 0 {
+			if i, found := positions[comment.ParentID]; found {
+				threads[i].Replies = append(threads[i].Replies, comment)
+			}
+			continue
+		}
+
+		if comment.Anchor != nil {
+			err = remapAnchor(repo, &comment, path)
+			if err != nil {
+				Warning.Println("Could not remap comment anchor", comment.ID, err.Error())
+			}
+		}
+
+		positions[comment.ID] = len(threads)
+		threads = append(threads, comment)
+	}
+
+	return threads, nil
+}
+
+// remapAnchor moves the comment's anchor from the revision it was made
+// against to head, where the document is at path, saving it so the work
+// isn't repeated
+func remapAnchor(repo *git.Repository, comment *Comment, path string) error {
+
+	lr, err := getLatestRevision(repo)
+	if err != nil {
+		return err
+	}
+
+	if comment.Anchor.Revision == lr.String() {
+		return nil
+	}
+
+	before, err := documentBodyAt(repo, comment.Path, comment.Anchor.Revision)
+	if err != nil {
+		return err
+	}
+
+	after, err := documentBodyAt(repo, path, lr.String())
+	if err != nil {
+		return err
+	}
+
+	anchor := mapAnchor(*comment.Anchor, before, after)
+	anchor.Revision = lr.String()
+	comment.Anchor = &anchor
+	comment.Path = path
+
+	return db.Save(comment)
+}
+
+// newAnchor validates the anchor against the document's body, expanding
+// line anchors to cover the line and recording the quoted text
+func newAnchor(anchor CommentAnchor, body []uint16) (CommentAnchor, error) {
+
+	if anchor.Start == 0 && anchor.End == 0 && anchor.Line > 0 {
+
+		start, end, found := lineRange(body, anchor.Line)
+		if !found {
+			return anchor, ErrInvalidAnchor
+		}
+
+		anchor.Start, anchor.End = start, end
+	}
+
+	if anchor.Start < 0 || anchor.End < anchor.Start || anchor.End > len(body) {
+		return anchor, ErrInvalidAnchor
+	}
+
+	anchor.Quote = string(utf16.Decode(body[anchor.Start:anchor.End]))
+	anchor.Line = lineAt(body, anchor.Start)
+	anchor.Orphaned = false
+
+	return anchor, nil
+}
+
+// mapAnchor works out where the anchor's text has moved to. Edits before
+// the anchor shift it and edits after it leave it alone. When the edit
+// overlaps the anchor the quoted text is looked for, choosing the
+// occurrence closest to where it used to be
+func mapAnchor(anchor CommentAnchor, before, after []uint16) CommentAnchor {
+
+	if anchor.Orphaned {
+		return anchor
+	}
+
+	// find the region that changed
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(before)-prefix && suffix < len(after)-prefix &&
+		before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+
+	delta := len(after) - len(before)
+
+	switch {
+
+	case anchor.End <= prefix:
+		// the edit came after the anchor
+
+	case anchor.Start >= len(before)-suffix:
+		anchor.Start += delta
+		anchor.End += delta
+
+	default:
+		quote := utf16.Encode([]rune(anchor.Quote))
+
+		start, found := nearestOccurrence(after, quote, anchor.Start)
+		if !found || len(quote) == 0 {
+			anchor.Orphaned = true
+			return anchor
+		}
+
+		anchor.Start, anchor.End = start, start+len(quote)
+	}
+
+	anchor.Line = lineAt(after, anchor.Start)
+
+	return anchor
+}
+
+// nearestOccurrence finds the occurrence of needle in haystack closest
+// to the supplied position
+func nearestOccurrence(haystack, needle []uint16, position int) (nearest int, found bool) {
+
+	if len(needle) == 0 {
+		return 0, false
+	}
+
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+
+		match := true
+		for j := range needle {
+			if haystack[i+j] != needle[j] {
+				match = false
+				break
+			}
+		}
+
+		if !match {
+			continue
+		}
+
+		if !found || distance(i, position) < distance(nearest, position) {
+			nearest, found = i, true
+		}
+	}
+
+	return nearest, found
+}
+
+func distance(a, b int) int {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// lineAt returns the (1-based) line number containing the offset
+func lineAt(body []uint16, offset int) int {
+
+	line := 1
+
+	for i := 0; i < offset && i < len(body); i++ {
+		if body[i] == '\n' {
+			line++
+		}
+	}
+
+	return line
+}
+
+// lineRange returns the offsets of the start and end of the line,
+// excluding the newline
+func lineRange(body []uint16, line int) (start, end int, found bool) {
+
+	current := 1
+
+	for i, c := range body {
+
+		if current == line && c == '\n' {
+			return start, i, true
+		}
+
+		if c == '\n' {
+			current++
+			start = i + 1
+		}
+	}
+
+	if current == line {
+		return start, len(body), true
+	}
+
+	return 0, 0, false
+}
+
+// documentBodyAt returns the Markdown body, without frontmatter, of the
+// document at path as it was at the supplied revision
+func documentBodyAt(repo *git.Repository, path, revision string) ([]uint16, error) {
+
+	oid, err := git.NewOid(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := repo.LookupCommit(oid)
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	entry, err := tree.EntryByPath(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := getFileContentsByOid(repo, entry.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return utf16.Encode([]rune(string(stripFrontMatter(contents)))), nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeUTF16(s string) []uint16 {
+	return utf16.Encode([]rune(s))
+}
+
+func Test_newAnchor(t *testing.T) {
+
+	body := encodeUTF16("# Krusty Burger\n\nThe Ribwich is back\nFor a limited time")
+
+	t.Run("Range", func(t *testing.T) {
+		anchor, err := newAnchor(CommentAnchor{Start: 21, End: 28}, body)
+		assert.Nil(t, err)
+		assert.Equal(t, "Ribwich", anchor.Quote)
+		assert.Equal(t, 3, anchor.Line)
+	})
+
+	t.Run("Line", func(t *testing.T) {
+		anchor, err := newAnchor(CommentAnchor{Line: 4}, body)
+		assert.Nil(t, err)
+		assert.Equal(t, "For a limited time", anchor.Quote)
+		assert.Equal(t, 37, anchor.Start)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := newAnchor(CommentAnchor{Start: 21, End: 99}, body)
+		assert.Equal(t, ErrInvalidAnchor, err)
+
+		_, err = newAnchor(CommentAnchor{Line: 9}, body)
+		assert.Equal(t, ErrInvalidAnchor, err)
+	})
+}
+
+func Test_mapAnchor(t *testing.T) {
+
+	before := "The Ribwich is back for a limited time"
+	anchor, _ := newAnchor(CommentAnchor{Start: 4, End: 11}, encodeUTF16(before))
+
+	tests := []struct {
+		name     string
+		after    string
+		start    int
+		orphaned bool
+	}{
+		{name: "Unchanged", after: before, start: 4},
+		{name: "Edited afterwards", after: "The Ribwich is back for good", start: 4},
+		{name: "Edited beforehand", after: "Krusty says the Ribwich is back for a limited time", start: 16},
+		{name: "Edited around", after: "Ribwich is here for a limited time", start: 0},
+		{name: "Removed", after: "The McRib is back for a limited time", orphaned: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			mapped := mapAnchor(anchor, encodeUTF16(before), encodeUTF16(tt.after))
+
+			assert.Equal(t, tt.orphaned, mapped.Orphaned)
+
+			if !tt.orphaned {
+				assert.Equal(t, tt.start, mapped.Start)
+				assert.Equal(t, "Ribwich", string(utf16.Decode(encodeUTF16(tt.after)[mapped.Start:mapped.End])))
+			}
+		})
+	}
+
+	t.Run("Nearest occurrence", func(t *testing.T) {
+
+		before := "Ribwich one. Ribwich two. Ribwich three."
+		anchor, _ := newAnchor(CommentAnchor{Start: 13, End: 20}, encodeUTF16(before))
+
+		mapped := mapAnchor(anchor, encodeUTF16(before), encodeUTF16("Ribwich one! Ribwich two! Ribwich three!"))
+
+		assert.Equal(t, 13, mapped.Start)
+		assert.False(t, mapped.Orphaned)
+	})
+}
+
+func TestComments(t *testing.T) {
+
+	db.Drop("Comment")
+
+	repoPath := "../tests/tmp/repositories/comments"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	path := "documents/document_1/index.md"
+
+	file, _ := getRawFile("documents", "document_1", "index.md")
+	start := utf16Length((*file.Markdown)[:strings.Index(*file.Markdown, "Lorem ipsum")])
+
+	thread, err := createComment(
+		path,
+		Comment{Body: "Is this Latin?", Anchor: &CommentAnchor{Start: start, End: start + 11}},
+		mh,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, "Lorem ipsum", thread.Anchor.Quote)
+	assert.Equal(t, lr.String(), thread.Anchor.Revision)
+
+	t.Run("Replies", func(t *testing.T) {
+
+		reply, err := replyToComment(path, thread.ID, Comment{Body: "Sort of"}, ck)
+		assert.Nil(t, err)
+		assert.Equal(t, thread.ID, reply.ParentID)
+
+		// replying to a reply continues the thread
+		nested, err := replyToComment(path, reply.ID, Comment{Body: "Thanks"}, mh)
+		assert.Nil(t, err)
+		assert.Equal(t, thread.ID, nested.ParentID)
+
+		_, err = replyToComment("documents/document_2/index.md", thread.ID, Comment{Body: "Wrong document"}, mh)
+		assert.Equal(t, ErrCommentNotFound, err)
+
+		threads, _ := getComments(path)
+		if assert.Len(t, threads, 1) {
+			assert.Len(t, threads[0].Replies, 2)
+			assert.Equal(t, ck.Username, threads[0].Replies[0].Username)
+		}
+	})
+
+	t.Run("Resolving", func(t *testing.T) {
+
+		resolved, err := resolveThread(path, thread.ID, true, ck)
+		assert.Nil(t, err)
+		assert.True(t, resolved.Resolved)
+		assert.Equal(t, ck.Username, resolved.ResolvedBy)
+
+		reopened, err := resolveThread(path, thread.ID, false, mh)
+		assert.Nil(t, err)
+		assert.False(t, reopened.Resolved)
+		assert.Empty(t, reopened.ResolvedBy)
+	})
+
+	t.Run("Anchors follow the text", func(t *testing.T) {
+
+		oid, err := updateFiles(
+			NewCommit{
+				Message: "Add an introduction",
+				Files: []NewCommitFile{
+					NewCommitFile{
+						Path:        "documents",
+						Document:    "document_1",
+						Filename:    "index.md",
+						Body:        "An introduction\n\n" + *file.Markdown,
+						FrontMatter: file.FrontMatter,
+					},
+				},
+				RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+			},
+			mh,
+		)
+		assert.Nil(t, err)
+
+		threads, _ := getComments(path)
+		anchor := threads[0].Anchor
+
+		assert.Equal(t, oid.String(), anchor.Revision)
+		assert.Equal(t, start+17, anchor.Start)
+		assert.Equal(t, "Lorem ipsum", anchor.Quote)
+		assert.False(t, anchor.Orphaned)
+
+		// the document was given an ID when it was updated, its comments
+		// are now kept against that instead of the path
+		updated, _ := getRawFile("documents", "document_1", "index.md")
+		assert.NotEmpty(t, updated.FrontMatter.ID)
+		assert.Equal(t, updated.FrontMatter.ID, threads[0].DocumentID)
+		assert.Equal(t, updated.FrontMatter.ID, threads[0].Replies[0].DocumentID)
+	})
+}
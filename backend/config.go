@@ -31,6 +31,7 @@ type Config struct {
 	PublicKeyPath      string              `yaml:"public_key_path"`
 	FileCategories     map[string][]string `yaml:"file_categories"`
 	MediaTypes         map[string]string   `yaml:"media_types"`
+	UploadDirectories  map[string]string   `yaml:"upload_directories"` // file categories
 	SSHEnabled         bool                `yaml:"ssh_enabled"`
 	SSHListenPort      string              `yaml:"ssh_listen_port"`
 	GitBinPath         string              `yaml:"git_bin_path"`
@@ -47,6 +48,32 @@ type Config struct {
 		Name string `yaml:"name"`
 		Flag string `yaml:"flag"`
 	} `yaml:"all_languages"`
+	ValidateLinksOnCommit  bool           `yaml:"validate_links_on_commit"`
+	EditLockTimeout        int            `yaml:"edit_lock_timeout"` // seconds
+	Workflow               Workflow       `yaml:"workflow"`
+	ScheduleInterval       int            `yaml:"schedule_interval"`        // seconds
+	ReviewReminderInterval int            `yaml:"review_reminder_interval"` // days
+	TrashRetention         int            `yaml:"trash_retention"`          // days
+	MaxAttachmentSize      int            `yaml:"max_attachment_size"`      // megabytes
+	ImageMaxWidth          int            `yaml:"image_max_width"`          // pixels
+	ImageMaxHeight         int            `yaml:"image_max_height"`         // pixels
+	ImageJPEGQuality       int            `yaml:"image_jpeg_quality"`
+	ImageMaxPixels         int            `yaml:"image_max_pixels"` // megapixels
+	ImageWebP              bool           `yaml:"image_webp"`
+	CWebPBin               string         `yaml:"cwebp_bin"`
+	ThumbnailSize          int            `yaml:"thumbnail_size"` // pixels
+	ThumbnailCache         string         `yaml:"thumbnail_cache"`
+	StripMetadata          []string       `yaml:"strip_metadata"` // file categories
+	UploadPolicies         []UploadPolicy `yaml:"upload_policies"`
+	StorageQuota           int            `yaml:"storage_quota"` // megabytes per user
+	Scanner                string         `yaml:"scanner"`
+	ClamdAddress           string         `yaml:"clamd_address"`
+	ScanTimeout            int            `yaml:"scan_timeout"`   // seconds
+	ScanOversized          string         `yaml:"scan_oversized"` // reject or allow
+	QuarantineDirectory    string         `yaml:"quarantine_directory"`
+	LFSEnabled             bool           `yaml:"lfs_enabled"`
+	LFSExtensions          []string       `yaml:"lfs_extensions"`
+	LFSStore               string         `yaml:"lfs_store"`
 }
 
 // HTTPListenPortWithColon returns the HTTPListenPort with a
@@ -135,6 +162,14 @@ func loadConfig(path *string) (Config, error) {
 		return *c, fmt.Errorf("Repository path not specified")
 	}
 
+	// a workflow is optional, the default is used when there isn't one
+	if len(c.Workflow.States) > 0 {
+		err = c.Workflow.validate()
+		if err != nil {
+			return *c, err
+		}
+	}
+
 	return *c, err
 
 }
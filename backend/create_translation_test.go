@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/libgit2/git2go.v25"
@@ -126,3 +127,59 @@ func Test_createTranslation(t *testing.T) {
 		})
 	}
 }
+
+func Test_createTranslationPublished(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/create_translation_published"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	reset := useMultilingualConfig(repoPath)
+	defer reset()
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	file, _ := getRawFile("documents", "document_1", "index.md")
+
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	nextWeek := time.Now().Add(7 * 24 * time.Hour).Format(time.RFC3339)
+
+	fm := file.FrontMatter
+	fm.State = "published"
+	fm.Draft = false
+	fm.PublishAt = tomorrow
+	fm.UnpublishAt = nextWeek
+
+	oid, err := writeFiles(
+		repo,
+		NewCommit{
+			Message: "Publish and schedule document 1",
+			Files: []NewCommitFile{
+				NewCommitFile{Path: "documents", Document: "document_1", Filename: "index.md", Body: *file.Markdown, FrontMatter: fm},
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	_, target, err := createTranslation(NewTranslation{
+		Path:           "documents",
+		SourceFilename: "index.md",
+		SourceDocument: "document_1",
+		LanguageCode:   "fi",
+		RepositoryInfo: RepositoryInfo{LatestRevision: oid.String()},
+	}, mh)
+	assert.Nil(t, err)
+
+	translation, _ := getRawFile("documents", "document_1", target)
+	assert.Equal(t, currentWorkflow().InitialState, translation.FrontMatter.State)
+	assert.True(t, translation.FrontMatter.Draft)
+	assert.Empty(t, translation.FrontMatter.PublishAt)
+	assert.Empty(t, translation.FrontMatter.UnpublishAt)
+
+	// the source keeps its state and schedule
+	source, _ := getRawFile("documents", "document_1", "index.md")
+	assert.Equal(t, "published", source.FrontMatter.State)
+	assert.Equal(t, tomorrow, source.FrontMatter.PublishAt)
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+const (
+	defaultDataRowsPerPage = 50
+	maxDataRowsPerPage     = 500
+
+	// schemaSuffix is added to a JSON file's name, minus its extension, to
+	// find the schema it's validated against
+	schemaSuffix = ".schema.json"
+)
+
+// ErrNotDataFile is returned when asked to preview or edit a file that
+// isn't CSV, JSON or XML
+var ErrNotDataFile = errors.New("only CSV, JSON and XML files can be previewed")
+
+// DataError is a problem found in a data file, either a syntax error,
+// located by line and column, or a schema violation, located by path
+type DataError struct {
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// DataValidationError is returned when saving a data file that isn't
+// well formed or doesn't match its schema
+type DataValidationError struct {
+	Errors []DataError
+}
+
+func (dve DataValidationError) Error() string {
+	return fmt.Sprintf("%d problem(s) found", len(dve.Errors))
+}
+
+// DataNode is an element of a JSON or XML tree. JSON objects and XML
+// elements keep their children in the order they appear in the file
+type DataNode struct {
+	Name       string            `json:"name,omitempty"`
+	Type       string            `json:"type"`
+	Value      string            `json:"value,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Children   []DataNode        `json:"children,omitempty"`
+}
+
+// DataPreview is a parsed data file. CSV files are returned a page of
+// rows at a time, JSON and XML files as a tree
+type DataPreview struct {
+	Path      string      `json:"path"`
+	Format    string      `json:"format"`
+	Valid     bool        `json:"valid"`
+	Errors    []DataError `json:"errors"`
+	Schema    string      `json:"schema,omitempty"`
+	Header    []string    `json:"header,omitempty"`
+	Rows      [][]string  `json:"rows,omitempty"`
+	Page      int         `json:"page,omitempty"`
+	PerPage   int         `json:"per_page,omitempty"`
+	TotalRows int         `json:"total_rows,omitempty"`
+	Tree      *DataNode   `json:"tree,omitempty"`
+}
+
+// DataUpdate replaces the contents of a data file
+type DataUpdate struct {
+	Message        string `json:"message" validate:"required,min=5"`
+	Contents       string `json:"contents"`
+	RepositoryInfo `json:"repository_info"`
+}
+
+// dataFormat returns the format files with the extension are parsed as
+func dataFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	case ".xml":
+		return "xml"
+	}
+	return ""
+}
+
+// schemaFor returns the path of the schema a JSON file is validated
+// against, schemas themselves aren't validated
+func schemaFor(path string) string {
+	if dataFormat(path) != "json" || strings.HasSuffix(path, schemaSuffix) {
+		return ""
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path)) + schemaSuffix
+}
+
+// lineAndColumn converts an offset in data to a one based line and column
+func lineAndColumn(data []byte, offset int64) (line, column int) {
+
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = len(before) - bytes.LastIndexByte(before, '\n')
+
+	return line, column
+}
+
+// previewCSV reads every row, so errors anywhere in the file are found
+// and the total is known, but only returns the requested page
+func previewCSV(data []byte, page, perPage int) (dp DataPreview) {
+
+	dp.Page, dp.PerPage = page, perPage
+	dp.Errors = []DataError{}
+
+	r := csv.NewReader(bytes.NewReader(data))
+
+	// spreadsheets often pad fields, eg "a", "b", "c"
+	r.TrimLeadingSpace = true
+
+	first := (page - 1) * perPage
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if pe, ok := err.(*csv.ParseError); ok {
+			dp.Errors = append(dp.Errors, DataError{Line: pe.Line, Column: pe.Column, Message: pe.Err.Error()})
+
+			// a row with the wrong number of fields is still returned
+			if pe.Err != csv.ErrFieldCount {
+				break
+			}
+		} else if err != nil {
+			dp.Errors = append(dp.Errors, DataError{Message: err.Error()})
+			break
+		}
+
+		if dp.Header == nil {
+			dp.Header = record
+			continue
+		}
+
+		if dp.TotalRows >= first && dp.TotalRows < first+perPage {
+			dp.Rows = append(dp.Rows, record)
+		}
+
+		dp.TotalRows++
+	}
+
+	return dp
+}
+
+// jsonNode builds the tree for the next value from the decoder, reading
+// tokens rather than unmarshalling so objects keep their key order
+func jsonNode(dec *json.Decoder, name string) (node DataNode, err error) {
+
+	node.Name = name
+
+	tok, err := dec.Token()
+	if err != nil {
+		return node, err
+	}
+
+	switch v := tok.(type) {
+
+	case json.Delim:
+
+		if v == '{' {
+			node.Type = "object"
+
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return node, err
+				}
+
+				child, err := jsonNode(dec, fmt.Sprint(key))
+				if err != nil {
+					return node, err
+				}
+
+				node.Children = append(node.Children, child)
+			}
+		} else {
+			node.Type = "array"
+
+			for i := 0; dec.More(); i++ {
+				child, err := jsonNode(dec, strconv.Itoa(i))
+				if err != nil {
+					return node, err
+				}
+
+				node.Children = append(node.Children, child)
+			}
+		}
+
+		// the closing delimiter
+		_, err = dec.Token()
+		return node, err
+
+	case string:
+		node.Type, node.Value = "string", v
+	case json.Number:
+		node.Type, node.Value = "number", v.String()
+	case bool:
+		node.Type, node.Value = "boolean", strconv.FormatBool(v)
+	case nil:
+		node.Type = "null"
+	}
+
+	return node, nil
+}
+
+// previewJSON parses the file into a tree and validates it against the
+// schema, if there is one
+func previewJSON(data, schema []byte) (dp DataPreview) {
+
+	dp.Errors = []DataError{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	syntaxError := func(err error) DataError {
+		de := DataError{Message: err.Error()}
+		if se, ok := err.(*json.SyntaxError); ok {
+			de.Line, de.Column = lineAndColumn(data, se.Offset)
+		}
+		return de
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		dp.Errors = append(dp.Errors, DataError{Message: "file is empty"})
+		return dp
+	}
+
+	tree, err := jsonNode(dec, "")
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		dp.Errors = append(dp.Errors, syntaxError(err))
+		return dp
+	}
+
+	if _, err = dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after the top-level value")
+		}
+		dp.Errors = append(dp.Errors, syntaxError(err))
+		return dp
+	}
+
+	dp.Tree = &tree
+
+	if schema == nil {
+		return dp
+	}
+
+	var s map[string]interface{}
+	var value interface{}
+
+	err = json.Unmarshal(schema, &s)
+	if err != nil {
+		dp.Errors = append(dp.Errors, DataError{Message: fmt.Sprintf("schema is invalid: %s", err.Error())})
+		return dp
+	}
+
+	json.Unmarshal(data, &value)
+
+	dp.Errors = append(dp.Errors, validateSchema(s, value, "")...)
+
+	return dp
+}
+
+// previewXML parses the file into a tree of elements and text, comments
+// and processing instructions are left out
+func previewXML(data []byte) (dp DataPreview) {
+
+	dp.Errors = []DataError{}
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+
+	var root *DataNode
+	var stack []*DataNode
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			de := DataError{Message: err.Error()}
+			if se, ok := err.(*xml.SyntaxError); ok {
+				de.Line, de.Message = se.Line, se.Msg
+			}
+			dp.Errors = append(dp.Errors, de)
+			return dp
+		}
+
+		switch t := tok.(type) {
+
+		case xml.StartElement:
+
+			if len(stack) == 0 && root != nil {
+				line, column := lineAndColumn(data, dec.InputOffset())
+				dp.Errors = append(dp.Errors, DataError{Line: line, Column: column, Message: "only one root element is allowed"})
+				return dp
+			}
+
+			node := &DataNode{Name: xmlName(t.Name), Type: "element"}
+
+			for _, attr := range t.Attr {
+				if node.Attributes == nil {
+					node.Attributes = make(map[string]string)
+				}
+				node.Attributes[xmlName(attr.Name)] = attr.Value
+			}
+
+			stack = append(stack, node)
+
+		case xml.EndElement:
+
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			if len(stack) == 0 {
+				root = node
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, *node)
+			}
+
+		case xml.CharData:
+
+			text := strings.TrimSpace(string(t))
+			if text == "" || len(stack) == 0 {
+				continue
+			}
+
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, DataNode{Type: "text", Value: text})
+		}
+	}
+
+	if root == nil {
+		dp.Errors = append(dp.Errors, DataError{Message: "no root element found"})
+		return dp
+	}
+
+	dp.Tree = root
+
+	return dp
+}
+
+// xmlName includes the namespace prefix, when there is one
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// previewData parses and validates the contents, which are of the file at
+// path. page and perPage only apply to CSV files
+func previewData(path string, data, schema []byte, page, perPage int) (dp DataPreview, err error) {
+
+	switch dataFormat(path) {
+	case "csv":
+		dp = previewCSV(data, page, perPage)
+	case "json":
+		dp = previewJSON(data, schema)
+	case "xml":
+		dp = previewXML(data)
+	default:
+		return dp, ErrNotDataFile
+	}
+
+	dp.Path = path
+	dp.Format = dataFormat(path)
+	dp.Valid = len(dp.Errors) == 0
+
+	return dp, nil
+}
+
+// dataPage returns the page and number of rows per page to show, falling
+// back to the first page of the default size
+func dataPage(page, perPage int) (int, int) {
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > maxDataRowsPerPage {
+		perPage = defaultDataRowsPerPage
+	}
+	return page, perPage
+}
+
+// readSchema returns the schema for the file at path, or nil if it
+// doesn't have one
+func readSchema(tree *git.Tree, repo *git.Repository, path string) (schema []byte, schemaPath string) {
+
+	schemaPath = schemaFor(path)
+	if schemaPath == "" {
+		return nil, ""
+	}
+
+	te, err := tree.EntryByPath(schemaPath)
+	if err != nil || te.Type != git.ObjectBlob {
+		return nil, ""
+	}
+
+	blob, err := repo.LookupBlob(te.Id)
+	if err != nil {
+		return nil, ""
+	}
+	defer blob.Free()
+
+	return blob.Contents(), schemaPath
+}
+
+// getDataPreview previews the data file at path, which is relative to the
+// document's directory
+func getDataPreview(directory, document, path string, page, perPage int) (dp DataPreview, err error) {
+
+	if dataFormat(path) == "" {
+		return dp, ErrNotDataFile
+	}
+
+	attachment, contents, err := getAttachment(directory, document, path)
+	if err != nil {
+		return dp, err
+	}
+
+	return previewContents(filepath.Join(attachment.Path, attachment.Filename), contents, page, perPage)
+}
+
+// previewContents previews contents as though they were at the full path
+// in the repository, validating them against the schema at head
+func previewContents(fullPath string, contents []byte, page, perPage int) (dp DataPreview, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return dp, err
+	}
+	defer repo.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return dp, err
+	}
+	defer ht.Free()
+
+	schema, schemaPath := readSchema(ht, repo, fullPath)
+
+	page, perPage = dataPage(page, perPage)
+
+	dp, err = previewData(fullPath, contents, schema, page, perPage)
+	dp.Schema = schemaPath
+
+	return dp, err
+}
+
+// previewDataUpdate validates the new contents without saving them
+func previewDataUpdate(directory, document, path string, du DataUpdate) (dp DataPreview, err error) {
+
+	if dataFormat(path) == "" {
+		return dp, ErrNotDataFile
+	}
+
+	attachment, contents, err := openAttachment(directory, document, path)
+	if err != nil {
+		return dp, err
+	}
+	contents.Close()
+
+	return previewContents(filepath.Join(attachment.Path, attachment.Filename), []byte(du.Contents), 1, maxDataRowsPerPage)
+}
+
+// updateDataFile replaces the contents of an existing data file, as long
+// as the new contents are well formed and match the schema
+func updateDataFile(directory, document, path string, du DataUpdate, user User) (oid *git.Oid, err error) {
+
+	dp, err := previewDataUpdate(directory, document, path, du)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dp.Valid {
+		return nil, DataValidationError{Errors: dp.Errors}
+	}
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	err = checkLatestRevision(repo, du.RepositoryInfo.LatestRevision)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := repo.Index()
+	if err != nil {
+		return nil, err
+	}
+	defer index.Free()
+
+	ncf := NewCommitFile{
+		Path:     directory,
+		Document: document,
+		Filename: filepath.Clean(path),
+		Body:     du.Contents,
+	}
+
+	err = stageFiles(repo, index, []NewCommitFile{ncf})
+	if err != nil {
+		return nil, err
+	}
+
+	return writeTreeAndCommit(repo, index, du.Message, user)
+}
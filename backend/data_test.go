@@ -0,0 +1,245 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_previewCSV(t *testing.T) {
+
+	data := []byte("name,age\nBart,10\nLisa,8\nMaggie,1\n")
+
+	t.Run("First page", func(t *testing.T) {
+		dp := previewCSV(data, 1, 2)
+		assert.Empty(t, dp.Errors)
+		assert.Equal(t, []string{"name", "age"}, dp.Header)
+		assert.Equal(t, [][]string{{"Bart", "10"}, {"Lisa", "8"}}, dp.Rows)
+		assert.Equal(t, 3, dp.TotalRows)
+	})
+
+	t.Run("Last page", func(t *testing.T) {
+		dp := previewCSV(data, 2, 2)
+		assert.Equal(t, [][]string{{"Maggie", "1"}}, dp.Rows)
+	})
+
+	t.Run("Wrong number of fields", func(t *testing.T) {
+		dp := previewCSV([]byte("name,age\nBart,10,4th grade\n"), 1, 50)
+		assert.Equal(t, 2, dp.Errors[0].Line)
+		assert.Len(t, dp.Rows, 1)
+	})
+
+	t.Run("Unterminated quote", func(t *testing.T) {
+		dp := previewCSV([]byte("name,age\n\"Bart,10\n"), 1, 50)
+		assert.Len(t, dp.Errors, 1)
+		assert.Equal(t, 2, dp.Errors[0].Line)
+	})
+}
+
+func Test_previewJSON(t *testing.T) {
+
+	t.Run("Tree", func(t *testing.T) {
+		dp := previewJSON([]byte(`{"name": "Bart", "age": 10, "siblings": ["Lisa", "Maggie"], "pet": null}`), nil)
+		assert.Empty(t, dp.Errors)
+		assert.Equal(t,
+			&DataNode{
+				Type: "object",
+				Children: []DataNode{
+					DataNode{Name: "name", Type: "string", Value: "Bart"},
+					DataNode{Name: "age", Type: "number", Value: "10"},
+					DataNode{Name: "siblings", Type: "array", Children: []DataNode{
+						DataNode{Name: "0", Type: "string", Value: "Lisa"},
+						DataNode{Name: "1", Type: "string", Value: "Maggie"},
+					}},
+					DataNode{Name: "pet", Type: "null"},
+				},
+			},
+			dp.Tree,
+		)
+	})
+
+	t.Run("Syntax error", func(t *testing.T) {
+		dp := previewJSON([]byte("{\n  \"name\": \"Bart\",\n  \"age\": 10,\n}"), nil)
+		assert.Nil(t, dp.Tree)
+		assert.Len(t, dp.Errors, 1)
+		assert.Equal(t, 3, dp.Errors[0].Line)
+	})
+
+	t.Run("Trailing data", func(t *testing.T) {
+		dp := previewJSON([]byte(`{"name": "Bart"} {"name": "Lisa"}`), nil)
+		assert.Len(t, dp.Errors, 1)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		dp := previewJSON([]byte(""), nil)
+		assert.Equal(t, "file is empty", dp.Errors[0].Message)
+	})
+
+	t.Run("Schema", func(t *testing.T) {
+		schema := []byte(`{"type": "object", "required": ["name", "age"]}`)
+		dp := previewJSON([]byte(`{"name": "Bart"}`), schema)
+		assert.NotNil(t, dp.Tree)
+		assert.Equal(t, []DataError{DataError{Path: "/", Message: "missing required property 'age'"}}, dp.Errors)
+	})
+}
+
+func Test_previewXML(t *testing.T) {
+
+	t.Run("Tree", func(t *testing.T) {
+		dp := previewXML([]byte(`<?xml version="1.0"?><family name="Simpson"><!-- kids --><child>Bart</child><child/></family>`))
+		assert.Empty(t, dp.Errors)
+		assert.Equal(t,
+			&DataNode{
+				Name:       "family",
+				Type:       "element",
+				Attributes: map[string]string{"name": "Simpson"},
+				Children: []DataNode{
+					DataNode{Name: "child", Type: "element", Children: []DataNode{DataNode{Type: "text", Value: "Bart"}}},
+					DataNode{Name: "child", Type: "element"},
+				},
+			},
+			dp.Tree,
+		)
+	})
+
+	t.Run("Mismatched tags", func(t *testing.T) {
+		dp := previewXML([]byte("<family>\n<child>Bart</kid>\n</family>"))
+		assert.Nil(t, dp.Tree)
+		assert.Equal(t, 2, dp.Errors[0].Line)
+	})
+
+	t.Run("Multiple roots", func(t *testing.T) {
+		dp := previewXML([]byte("<child>Bart</child><child>Lisa</child>"))
+		assert.Equal(t, "only one root element is allowed", dp.Errors[0].Message)
+	})
+
+	t.Run("No root", func(t *testing.T) {
+		dp := previewXML([]byte(`<?xml version="1.0"?>`))
+		assert.Equal(t, "no root element found", dp.Errors[0].Message)
+	})
+}
+
+func Test_schemaFor(t *testing.T) {
+	assert.Equal(t, "data/people.schema.json", schemaFor("data/people.json"))
+	assert.Equal(t, "", schemaFor("data/people.schema.json"))
+	assert.Equal(t, "", schemaFor("data/people.csv"))
+}
+
+func Test_getDataPreview(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/data_preview"
+	setupMultipleFiletypesTestRepo(repoPath)
+
+	t.Run("CSV", func(t *testing.T) {
+		dp, err := getDataPreview("documents", "document_1", "data/data_1.csv", 2, 4)
+		assert.Nil(t, err)
+		assert.True(t, dp.Valid)
+		assert.Equal(t, "csv", dp.Format)
+		assert.Equal(t, "documents/document_1/data/data_1.csv", dp.Path)
+		assert.Equal(t, []string{"a", "b", "c"}, dp.Header)
+		assert.Equal(t, 6, dp.TotalRows)
+		assert.Equal(t, [][]string{{"13 ", "14  ", "15"}, {"16 ", "17  ", "18"}}, dp.Rows)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		dp, err := getDataPreview("appendices", "appendix_1", "data/data.json", 0, 0)
+		assert.Nil(t, err)
+		assert.True(t, dp.Valid)
+		assert.Equal(t, "catalog", dp.Tree.Children[0].Name)
+		assert.Len(t, dp.Tree.Children[0].Children[0].Children, 3)
+	})
+
+	t.Run("XML", func(t *testing.T) {
+		dp, err := getDataPreview("appendices", "appendix_1", "data/data.xml", 0, 0)
+		assert.Nil(t, err)
+		assert.True(t, dp.Valid)
+		assert.Equal(t, "catalog", dp.Tree.Name)
+		assert.Len(t, dp.Tree.Children, 3)
+	})
+
+	t.Run("Not a data file", func(t *testing.T) {
+		_, err := getDataPreview("appendices", "appendix_1", "images/image_1.png", 0, 0)
+		assert.Equal(t, ErrNotDataFile, err)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		_, err := getDataPreview("appendices", "appendix_1", "data/missing.csv", 0, 0)
+		assert.Equal(t, ErrAttachmentNotFound, err)
+	})
+}
+
+func Test_updateDataFile(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/update_data_file"
+
+	update := func(contents string) error {
+
+		repo, _ := repository(config)
+		defer repo.Free()
+
+		lr, _ := getLatestRevision(repo)
+
+		du := DataUpdate{
+			Message:        "Update the catalog",
+			Contents:       contents,
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+
+		_, err := updateDataFile("appendices", "appendix_1", "data/data.json", du, mh)
+		return err
+	}
+
+	t.Run("Updated", func(t *testing.T) {
+		setupMultipleFiletypesTestRepo(repoPath)
+
+		assert.Nil(t, update(`{"catalog": {"season": []}}`))
+
+		_, contents, _ := getAttachment("appendices", "appendix_1", "data/data.json")
+		assert.Equal(t, `{"catalog": {"season": []}}`, string(contents))
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		setupMultipleFiletypesTestRepo(repoPath)
+
+		err := update(`{"catalog": `)
+		dve, ok := err.(DataValidationError)
+		assert.True(t, ok)
+		assert.Len(t, dve.Errors, 1)
+	})
+
+	t.Run("Breaks schema", func(t *testing.T) {
+		setupMultipleFiletypesTestRepo(repoPath)
+
+		schema := `{"type": "object", "properties": {"catalog": {"type": "object", "required": ["season"]}}}`
+
+		repo, _ := repository(config)
+		lr, _ := getLatestRevision(repo)
+		repo.Free()
+
+		nc := NewCommit{
+			Message:        "Add a schema",
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+			Files: []NewCommitFile{
+				NewCommitFile{Path: "appendices", Document: "appendix_1", Filename: "data/data.schema.json", Body: schema},
+			},
+		}
+		_, err := createFiles(nc, mh)
+		assert.Nil(t, err)
+
+		err = update(`{"catalog": {}}`)
+		dve, ok := err.(DataValidationError)
+		assert.True(t, ok)
+		assert.Equal(t, []DataError{DataError{Path: "/catalog", Message: "missing required property 'season'"}}, dve.Errors)
+
+		assert.Nil(t, update(`{"catalog": {"season": []}}`))
+	})
+
+	t.Run("Out of sync", func(t *testing.T) {
+		setupMultipleFiletypesTestRepo(repoPath)
+
+		du := DataUpdate{Message: "Update the catalog", Contents: "{}", RepositoryInfo: RepositoryInfo{LatestRevision: strings.Repeat("a", 40)}}
+		_, err := updateDataFile("appendices", "appendix_1", "data/data.json", du, mh)
+		assert.Equal(t, ErrRepoOutOfSync, err)
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+// DryRun describes what a destructive operation would do without it
+// being committed. Paths lists every file that would be removed or
+// changed, including translations and attachments removed along with
+// documents
+type DryRun struct {
+	Paths       []string    `json:"paths"`
+	Changeset   Changeset   `json:"changeset"`
+	BrokenLinks []Reference `json:"broken_links,omitempty"`
+}
+
+// previewDeleteDirectories returns the result of deleting the
+// directories without deleting them
+func previewDeleteDirectories(nc NewCommit, user User) (dr DryRun, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return dr, err
+	}
+	defer repo.Free()
+
+	index, err := stageDirectoryDeletions(repo, nc)
+	if err != nil {
+		return dr, err
+	}
+	defer index.Free()
+
+	return previewIndex(repo, index, nc.Message, user)
+}
+
+// previewDeleteFiles returns the result of deleting the files without
+// deleting them
+func previewDeleteFiles(nc NewCommit, user User) (dr DryRun, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return dr, err
+	}
+	defer repo.Free()
+
+	index, err := stageFileDeletions(repo, nc)
+	if err != nil {
+		return dr, err
+	}
+	defer index.Free()
+
+	return previewIndex(repo, index, nc.Message, user)
+}
+
+// previewUpdateDirectories returns the result of updating the
+// directories' metadata without updating them
+func previewUpdateDirectories(nc NewCommit, user User) (dr DryRun, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return dr, err
+	}
+	defer repo.Free()
+
+	index, err := stageMetadataFiles(repo, nc)
+	if err != nil {
+		return dr, err
+	}
+	defer index.Free()
+
+	return previewIndex(repo, index, nc.Message, user)
+}
+
+// previewIndex compares the tree that would be committed from the index
+// with head. Writing the tree only adds objects to the repository, the
+// index itself isn't saved and head doesn't move
+func previewIndex(repo *git.Repository, index *git.Index, message string, user User) (dr DryRun, err error) {
+
+	treeID, err := index.WriteTree()
+	if err != nil {
+		return dr, err
+	}
+
+	tree, err := repo.LookupTree(treeID)
+	if err != nil {
+		return dr, err
+	}
+	defer tree.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return dr, err
+	}
+	defer ht.Free()
+
+	dr.Changeset, dr.Paths, err = diffTrees(repo, ht, tree)
+	if err != nil {
+		return dr, err
+	}
+
+	dr.Changeset.Message = message
+	dr.Changeset.Author = sign(user)
+	dr.Changeset.Time = time.Now()
+
+	return dr, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_previewDeleteDirectories(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/preview_delete_directories"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	nc := NewCommit{
+		Message:        "Delete appendices",
+		Directories:    []NewCommitDirectory{NewCommitDirectory{Path: "appendices"}},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	dr, err := previewDeleteDirectories(nc, mh)
+	assert.Nil(t, err)
+
+	assert.ElementsMatch(
+		t,
+		[]string{"appendices/another_file.txt", "appendices/appendix_1/index.md", "appendices/appendix_2/index.md"},
+		dr.Paths,
+	)
+	assert.Equal(t, 3, dr.Changeset.NumDeleted)
+	assert.Equal(t, "Delete appendices", dr.Changeset.Message)
+	assert.Contains(t, dr.Changeset.FullDiff, "-# Appendix 1")
+
+	// nothing has actually been removed
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	hc, _ := headCommit(repo)
+	assert.Equal(t, lr.String(), hc.Id().String())
+
+	_, err = os.Stat(filepath.Join(repoPath, "appendices", "appendix_1", "index.md"))
+	assert.False(t, os.IsNotExist(err))
+
+	// and the preview hasn't left anything behind to be committed
+	// with the next change
+	oid, err := createFiles(
+		NewCommit{
+			Message:        "Add a document",
+			Files:          []NewCommitFile{NewCommitFile{Path: "documents", Document: "document_4", Filename: "index.md", Body: "# Document 4"}},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	cs, _ := diffForCommit(oid.String())
+	assert.Equal(t, 1, cs.NumDeltas)
+}
+
+func Test_previewDeleteFiles(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/preview_delete_files"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	nc := NewCommit{
+		Files:          []NewCommitFile{NewCommitFile{Path: "documents", Document: "document_2", Filename: "index.md"}},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	dr, err := previewDeleteFiles(nc, mh)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"documents/document_2/index.md"}, dr.Paths)
+	assert.Equal(t, 1, dr.Changeset.NumDeltas)
+
+	t.Run("Out of date", func(t *testing.T) {
+		nc.RepositoryInfo.LatestRevision = "abc"
+		_, err := previewDeleteFiles(nc, mh)
+		assert.Equal(t, ErrRepoOutOfSync, err)
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		nc.RepositoryInfo.LatestRevision = lr.String()
+		nc.Files[0].Document = "document_9"
+		_, err := previewDeleteFiles(nc, mh)
+		assert.NotNil(t, err)
+	})
+}
+
+func Test_previewUpdateDirectories(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/preview_update_directories"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	nc := NewCommit{
+		Message: "Rename documents",
+		Directories: []NewCommitDirectory{
+			NewCommitDirectory{
+				Path:          "documents",
+				DirectoryInfo: DirectoryInfo{Title: "Important documents", Description: "Documents go here"},
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	dr, err := previewUpdateDirectories(nc, mh)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"documents/_index.md"}, dr.Paths)
+	assert.Equal(t, 1, dr.Changeset.NumDeltas)
+	assert.Contains(t, dr.Changeset.FullDiff, "+title: Important documents")
+
+	// nothing has been committed
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	hc, _ := headCommit(repo)
+	assert.Equal(t, lr.String(), hc.Id().String())
+}
@@ -71,6 +71,13 @@ func getFilesInDir(directory string) (files []FileItem, err error) {
 
 	defer tree.Free()
 
+	locks, err := currentLocks()
+	if err != nil {
+		Warning.Println("Could not retrieve document locks", err.Error())
+	}
+
+	wf := currentWorkflow()
+
 	walkIterator := func(currentDir string, te *git.TreeEntry) int {
 		var fm FrontMatter
 		var blob *git.Blob
@@ -116,6 +123,11 @@ func getFilesInDir(directory string) (files []FileItem, err error) {
 				Document:    filepath.Clean(currentDir),
 				Path:        directory,
 				FrontMatter: fm,
+				State:       wf.stateOf(fm),
+			}
+
+			if lock, found := locks[filepath.Join(directory, currentDir, te.Name)]; found {
+				fi.Lock = &lock
 			}
 
 			files = append(files, fi)
@@ -126,6 +138,11 @@ func getFilesInDir(directory string) (files []FileItem, err error) {
 	}
 
 	err = tree.Walk(walkIterator)
+	if err != nil {
+		return files, err
+	}
+
+	sortDocuments(files)
 
 	return files, err
 
@@ -158,6 +175,23 @@ func createFiles(nc NewCommit, user User) (oid *git.Oid, err error) {
 
 	}
 
+	err = assignAuthors(nc.Files, user)
+	if err != nil {
+		return nil, err
+	}
+
+	assignNewDocumentIDs(nc.Files)
+
+	err = retainWorkflowStates(repo, nc.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkScheduleChanges(repo, nc.Files, user)
+	if err != nil {
+		return nil, err
+	}
+
 	oid, err = writeFiles(repo, nc, user)
 
 	return oid, err
@@ -171,12 +205,37 @@ func updateFiles(nc NewCommit, user User) (oid *git.Oid, err error) {
 	}
 	defer repo.Free()
 
+	err = checkAuthors(repo, nc.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	retainDocumentIDs(repo, nc.Files)
+	retainTranslatedFrom(repo, nc.Files)
+
+	err = retainWorkflowStates(repo, nc.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkScheduleChanges(repo, nc.Files, user)
+	if err != nil {
+		return nil, err
+	}
+
 	oid, err = writeFiles(repo, nc, user)
 
 	return oid, err
 }
 
 func writeFiles(repo *git.Repository, nc NewCommit, user User) (oid *git.Oid, err error) {
+	return writeFilesAs(repo, nc, user, user)
+}
+
+// writeFilesAs writes the files, recording the change as made by the
+// author and committed by the committer, who will differ when one user
+// approves another's changes
+func writeFilesAs(repo *git.Repository, nc NewCommit, author, committer User) (oid *git.Oid, err error) {
 
 	index, err := repo.Index()
 	if err != nil {
@@ -190,23 +249,74 @@ func writeFiles(repo *git.Repository, nc NewCommit, user User) (oid *git.Oid, er
 		return oid, err
 	}
 
-	var contents []byte
+	err = stageFiles(repo, index, nc.Files)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, ncf := range nc.Files {
+	if config.ValidateLinksOnCommit {
+		err = validateReferences(repo, index, nc.Files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	oid, err = writeTreeAndCommitAs(repo, index, nc.Message, author, committer)
+
+	return oid, err
+
+}
+
+// stageFiles writes each file's contents to a blob and adds it to the
+// index, ready to be committed
+func stageFiles(repo *git.Repository, index *git.Index, files []NewCommitFile) error {
+
+	for _, ncf := range files {
 
 		var ie git.IndexEntry
 
 		// get the file contents in the correct format
-		contents, err = extractContents(ncf)
+		contents, err := extractContents(ncf)
 		if err != nil {
 			Error.Println("Failed to extract contents", err.Error())
-			return oid, err
+			return err
+		}
+
+		// images attached to the commit are stripped of metadata and
+		// shrunk like uploaded ones
+		if ncf.Base64Encoded {
+			contents, err = stripMetadataFromBytes(ncf.Filename, contents)
+			if err != nil {
+				Error.Println("Could not strip metadata from", ncf.Filename, err.Error())
+				return err
+			}
+
+			// images stored with LFS are left as they are, like uploaded ones
+			if !lfsTracked(ncf.Filename) {
+				processed, changed, err := processImage(ncf.Filename, contents)
+				if err != nil {
+					Warning.Println("Could not process image", ncf.Filename, err.Error())
+				}
+				if changed {
+					contents = processed
+				}
+			}
+		}
+
+		var oid *git.Oid
+
+		if lfsTracked(ncf.Filename) {
+			oid, _, err = createLFSBlob(repo, bytes.NewReader(contents))
+			if err == nil {
+				err = stageLFSAttributes(repo, index)
+			}
+		} else {
+			oid, err = repo.CreateBlobFromBuffer(contents)
 		}
 
-		oid, err = repo.CreateBlobFromBuffer(contents)
 		if err != nil {
 			Error.Println("Failed to create blob from buffer", err.Error())
-			return oid, err
+			return err
 		}
 
 		// build the git index entry and add it to the index
@@ -214,24 +324,39 @@ func writeFiles(repo *git.Repository, nc NewCommit, user User) (oid *git.Oid, er
 
 		err = index.Add(&ie)
 		if err != nil {
-			return oid, err
+			return err
 		}
 
 	}
 
+	return nil
+}
+
+func writeMetadataFiles(repo *git.Repository, nc NewCommit, user User) (oid *git.Oid, err error) {
+
+	index, err := stageMetadataFiles(repo, nc)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Free()
+
 	oid, err = writeTreeAndCommit(repo, index, nc.Message, user)
+	if err != nil {
+		return oid, err
+	}
 
 	return oid, err
 
 }
 
-func writeMetadataFiles(repo *git.Repository, nc NewCommit, user User) (oid *git.Oid, err error) {
+// stageMetadataFiles adds each directory's _index.md to the index,
+// the caller is responsible for freeing it
+func stageMetadataFiles(repo *git.Repository, nc NewCommit) (index *git.Index, err error) {
 
-	index, err := repo.Index()
+	index, err = repo.Index()
 	if err != nil {
 		return nil, err
 	}
-	defer index.Free()
 
 	var meta []byte
 
@@ -246,8 +371,9 @@ func writeMetadataFiles(repo *git.Repository, nc NewCommit, user User) (oid *git
 			particle.YAMLEncoding.Encode(meta, body, &ncd.DirectoryInfo)
 		}
 
-		oid, err = repo.CreateBlobFromBuffer(meta)
+		oid, err := repo.CreateBlobFromBuffer(meta)
 		if err != nil {
+			index.Free()
 			return nil, err
 		}
 
@@ -256,18 +382,13 @@ func writeMetadataFiles(repo *git.Repository, nc NewCommit, user User) (oid *git
 
 		err = index.Add(&ie)
 		if err != nil {
+			index.Free()
 			return nil, err
 		}
 
 	}
 
-	oid, err = writeTreeAndCommit(repo, index, nc.Message, user)
-	if err != nil {
-		return oid, err
-	}
-
-	return oid, err
-
+	return index, nil
 }
 
 func listRootDirectories() (directories []Directory, err error) {
@@ -413,8 +534,19 @@ func createTranslation(nt NewTranslation, user User) (oid *git.Oid, target strin
 	}
 	defer index.Free()
 
-	// set the new translation to draft
+	// the new translation starts at the beginning of the workflow without
+	// the source's schedule, it's a separate document so needs its own
+	// identifier
+	wf := currentWorkflow()
+	sf.FrontMatter.State = wf.InitialState
 	sf.FrontMatter.Draft = true
+	sf.FrontMatter.PublishAt = ""
+	sf.FrontMatter.UnpublishAt = ""
+	sf.FrontMatter.ID = generateDocumentID()
+
+	// the source's revision is recorded so changes made to it afterwards
+	// can be found
+	sf.FrontMatter.TranslatedFrom = nt.RepositoryInfo.LatestRevision
 	contents := sf.ToMarkdown()
 
 	boid, err := repo.CreateBlobFromBuffer(contents)
@@ -558,20 +690,40 @@ func deleteDirectories(nc NewCommit, user User) (oid *git.Oid, err error) {
 	}
 	defer repo.Free()
 
+	index, err := stageDirectoryDeletions(repo, nc)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Free()
+
+	oid, err = writeTreeAndCommit(repo, index, nc.Message, user)
+	if err != nil {
+		return oid, err
+	}
+
+	return oid, err
+
+}
+
+// stageDirectoryDeletions removes the directories from the repository's
+// index, leaving it to the caller to commit or preview the changes
+func stageDirectoryDeletions(repo *git.Repository, nc NewCommit) (index *git.Index, err error) {
+
 	ht, err := headTree(repo)
 	if err != nil {
 		return nil, err
 	}
 
 	// first grab the repo's index
-	index, err := repo.Index()
+	index, err = repo.Index()
 	if err != nil {
 		return nil, err
 	}
 
 	err = checkLatestRevision(repo, nc.RepositoryInfo.LatestRevision)
 	if err != nil {
-		return oid, err
+		index.Free()
+		return nil, err
 	}
 
 	for _, ncd := range nc.Directories {
@@ -579,6 +731,7 @@ func deleteDirectories(nc NewCommit, user User) (oid *git.Oid, err error) {
 		// ensure that the directory exists before we try to delete it
 		d, _ := ht.EntryByPath(ncd.Path)
 		if d == nil {
+			index.Free()
 			return nil, fmt.Errorf("directory does not exist: %s", ncd.Path)
 		}
 
@@ -586,17 +739,13 @@ func deleteDirectories(nc NewCommit, user User) (oid *git.Oid, err error) {
 		Debug.Println("Removing directory:", ncd.Path)
 		err = index.RemoveDirectory(ncd.Path, 0)
 		if err != nil {
+			index.Free()
 			return nil, err
 		}
 
 	}
 
-	oid, err = writeTreeAndCommit(repo, index, nc.Message, user)
-	if err != nil {
-		return oid, err
-	}
-
-	return oid, err
+	return index, nil
 
 }
 
@@ -608,22 +757,46 @@ func deleteFiles(nc NewCommit, user User) (oid *git.Oid, err error) {
 	}
 	defer repo.Free()
 
-	err = checkLatestRevision(repo, nc.RepositoryInfo.LatestRevision)
+	index, err := stageFileDeletions(repo, nc)
 	if err != nil {
 		return oid, err
 	}
+	defer index.Free()
 
-	ht, err := headTree(repo)
+	// final check, if no commit message supplied use a generic one
+	if nc.Message == "" {
+		nc.Message = "File deleted"
+	}
+
+	oid, err = writeTreeAndCommit(repo, index, nc.Message, user)
 	if err != nil {
 		return oid, err
 	}
 
+	return oid, err
+
+}
+
+// stageFileDeletions removes the files, and any accompanying directories,
+// from the repository's index leaving it to the caller to commit or
+// preview the changes
+func stageFileDeletions(repo *git.Repository, nc NewCommit) (index *git.Index, err error) {
+
+	err = checkLatestRevision(repo, nc.RepositoryInfo.LatestRevision)
+	if err != nil {
+		return nil, err
+	}
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+
 	// first grab the repo's index
-	index, err := repo.Index()
+	index, err = repo.Index()
 	if err != nil {
-		return oid, err
+		return nil, err
 	}
-	defer index.Free()
 
 	for _, ncf := range nc.Files {
 
@@ -633,17 +806,20 @@ func deleteFiles(nc NewCommit, user User) (oid *git.Oid, err error) {
 		file, err := ht.EntryByPath(target)
 
 		if file == nil {
-			return oid, fmt.Errorf("file does not exist %s", target)
+			index.Free()
+			return nil, fmt.Errorf("file does not exist %s", target)
 		}
 
 		if err != nil {
-			return oid, err
+			index.Free()
+			return nil, err
 		}
 
 		// and remove the target by path
 		err = index.RemoveByPath(target)
 		if err != nil {
-			return oid, err
+			index.Free()
+			return nil, err
 		}
 
 	}
@@ -666,22 +842,13 @@ func deleteFiles(nc NewCommit, user User) (oid *git.Oid, err error) {
 		err = index.RemoveDirectory(ncd.Path, 0)
 		if err != nil {
 			Error.Println("cannot delete directory", ncd.Path, err.Error())
+			index.Free()
 			return nil, err
 		}
 
 	}
 
-	// final check, if no commit message supplied use a generic one
-	if nc.Message == "" {
-		nc.Message = "File deleted"
-	}
-
-	oid, err = writeTreeAndCommit(repo, index, nc.Message, user)
-	if err != nil {
-		return oid, err
-	}
-
-	return oid, err
+	return index, nil
 
 }
 
@@ -789,6 +956,11 @@ func getFile(directory, document, filename string, includeMd, includeHTML bool)
 
 	translations, err := getTranslations(repo, directory, document, filename)
 
+	lock, err := currentLock(target)
+	if err != nil {
+		Warning.Println("Could not retrieve document lock", target, err.Error())
+	}
+
 	file = &File{
 		Filename:       filename,
 		Document:       document,
@@ -799,11 +971,71 @@ func getFile(directory, document, filename string, includeMd, includeHTML bool)
 		DirectoryInfo:  di,
 		RepositoryInfo: &ri,
 		Translations:   translations,
+		IncomingLinks:  []Reference{},
+		Lock:           lock,
+		Authors:        getAuthors(fm.Authors),
+		Contributors:   []Contributor{},
 	}
 
 	return file, nil
 }
 
+// describeFile adds the details that need the repository's history or
+// every document to be examined, they're only worth finding when the file
+// is being viewed or edited
+func describeFile(file *File) error {
+
+	repo, err := repository(config)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	target := file.FullPath()
+
+	incoming, err := incomingReferences(repo, target)
+	if err != nil {
+		Warning.Println("Could not find incoming links", target, err.Error())
+	} else {
+		file.IncomingLinks = incoming
+	}
+
+	contributors, err := fileContributors(repo, target)
+	if err != nil {
+		Warning.Println("Could not find contributors", target, err.Error())
+	} else {
+		file.Contributors = contributors
+	}
+
+	if config.TranslationEnabled {
+		describeTranslation(repo, file)
+	}
+
+	return nil
+}
+
+// describeTranslation adds whether a translation is behind its source or,
+// for a source document, which of its translations are behind it
+func describeTranslation(repo *git.Repository, file *File) {
+
+	ht, err := headTree(repo)
+	if err != nil {
+		Warning.Println("Could not check translations", file.FullPath(), err.Error())
+		return
+	}
+	defer ht.Free()
+
+	ts, err := translationStatus(repo, ht, file.Path, file.Document, file.Filename, false)
+	switch err {
+	case nil:
+		file.TranslationStatus = &ts
+	case ErrNotTranslation:
+		file.OutdatedTranslations = outdatedTranslations(repo, ht, file.Path, file.Document, file.Filename)
+	default:
+		Warning.Println("Could not check translation", file.FullPath(), err.Error())
+	}
+}
+
 func getTranslations(repo *git.Repository, directory, document, filename string) (langs []string, err error) {
 
 	langs = []string{}
@@ -870,15 +1102,11 @@ func getAttachments(directory string) (files []Attachment, err error) {
 
 	walkIterator := func(path string, te *git.TreeEntry) int {
 		var blob *git.Blob
-		var ext string
-		var attachment Attachment
 
 		if te.Type == git.ObjectBlob {
 
-			ext = filepath.Ext(te.Name)
-
 			// skip if a Markdown file
-			if ext == ".md" {
+			if filepath.Ext(te.Name) == ".md" {
 				Debug.Println("markdown file, skipping:", te.Name)
 				return 0
 			}
@@ -889,18 +1117,11 @@ func getAttachments(directory string) (files []Attachment, err error) {
 				Warning.Println("Failed to find blob", te.Id)
 				return -1
 			}
+			defer blob.Free()
 
-			data := blob.Contents()
-
-			attachment = Attachment{
-				Filename:  te.Name,
-				Extension: ext,
-				Data:      base64.StdEncoding.EncodeToString(data),
-				Path:      filepath.Join(directory, path),
-				MediaType: getMediaType(ext),
-			}
-
-			files = append(files, attachment)
+			// only the metadata is listed, the contents are retrieved
+			// individually from the attachment endpoint
+			files = append(files, newAttachment(filepath.Join(directory, path), te, blob))
 
 		}
 
@@ -990,6 +1211,10 @@ func getFileCounts(repo *git.Repository) (counter map[string]int, err error) {
 }
 
 func writeTreeAndCommit(repo *git.Repository, index *git.Index, message string, user User) (oid *git.Oid, err error) {
+	return writeTreeAndCommitAs(repo, index, message, user, user)
+}
+
+func writeTreeAndCommitAs(repo *git.Repository, index *git.Index, message string, author, committer User) (oid *git.Oid, err error) {
 
 	// write the tree, persisting our addition to the git repo
 	treeID, err := index.WriteTree()
@@ -1009,16 +1234,38 @@ func writeTreeAndCommit(repo *git.Repository, index *git.Index, message string,
 		return oid, err
 	}
 
-	// git signatures
-	author := sign(user)
-	committer := sign(user)
+	// reject files that break the upload policies or would take the
+	// author over their storage quota
+	incoming, err := enforceUploadPolicies(repo, tree, author)
+	if err != nil {
+		return oid, err
+	}
+
+	// scan attachments for malware, anything infected is quarantined
+	scanned, err := scanIncomingFiles(repo, incoming, author)
+	if err != nil {
+		return oid, err
+	}
 
 	// now commit our updated tree to the tip (parent)
-	oid, err = repo.CreateCommit("HEAD", author, committer, message, tree, tip)
+	oid, err = repo.CreateCommit("HEAD", sign(author), sign(committer), message, tree, tip)
 	if err != nil {
 		return oid, err
 	}
 
+	// maintenance commands run without the database
+	if author.Username != maintenanceUser.Username {
+		err = recordStorage(author.Username, incoming)
+		if err != nil {
+			Warning.Println("Could not record storage used by", author.Username, err.Error())
+		}
+
+		err = recordScanResults(oid, scanned)
+		if err != nil {
+			Warning.Println("Could not record scan results for", oid.String(), err.Error())
+		}
+	}
+
 	// checkout to keep file system in sync with git
 	err = repo.CheckoutHead(
 		&git.CheckoutOpts{Strategy: git.CheckoutSafe | git.CheckoutRecreateMissing | git.CheckoutForce},
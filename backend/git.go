@@ -213,12 +213,6 @@ func diffForCommit(hash string) (cs Changeset, err error) {
 	}
 	defer commitTree.Free()
 
-	options, err := git.DefaultDiffOptions()
-	if err != nil {
-		return cs, err
-	}
-	options.IdAbbrev = 40
-
 	var parentTree *git.Tree
 	if commit.ParentCount() > 0 {
 		parentTree, err = commit.Parent(0).Tree()
@@ -227,11 +221,38 @@ func diffForCommit(hash string) (cs Changeset, err error) {
 		}
 	}
 
-	gitDiff, err := repo.DiffTreeToTree(parentTree, commitTree, &options)
+	cs, _, err = diffTrees(repo, parentTree, commitTree)
 	if err != nil {
 		return cs, err
 	}
 
+	cs.Message = commit.Message()
+	cs.Author = commit.Author()
+	cs.Hash = commit.Id().String()
+	cs.Time = commit.Committer().When
+
+	return cs, nil
+
+}
+
+// diffTrees builds a Changeset describing the differences between two
+// trees, along with the paths of any files that were removed. When paths
+// are supplied only they are compared
+func diffTrees(repo *git.Repository, oldTree, newTree *git.Tree, paths ...string) (cs Changeset, deleted []string, err error) {
+
+	options, err := git.DefaultDiffOptions()
+	if err != nil {
+		return cs, nil, err
+	}
+	options.IdAbbrev = 40
+	options.Pathspec = paths
+
+	gitDiff, err := repo.DiffTreeToTree(oldTree, newTree, &options)
+	if err != nil {
+		return cs, nil, err
+	}
+	defer gitDiff.Free()
+
 	// Show all file patch diffs in a commit.
 	numDeltas, err := gitDiff.NumDeltas()
 
@@ -246,6 +267,10 @@ func diffForCommit(hash string) (cs Changeset, err error) {
 	files = make(map[string]ChangesetFiles)
 	var csf ChangesetFiles
 
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	deleted = []string{}
+
 	err = gitDiff.ForEach(func(file git.DiffDelta, progress float64) (git.DiffForEachHunkCallback, error) {
 
 		patch, err := gitDiff.Patch(numDiffs)
@@ -269,6 +294,7 @@ func diffForCommit(hash string) (cs Changeset, err error) {
 			numAdded++
 		case git.DeltaDeleted:
 			numDeleted++
+			deleted = append(deleted, file.OldFile.Path)
 		}
 
 		var old, new []byte
@@ -282,15 +308,20 @@ func diffForCommit(hash string) (cs Changeset, err error) {
 			return nil, err
 		}
 
-		csf = ChangesetFiles{}
+		_, oldLFS := parseLFSPointer(old)
+		_, newLFS := parseLFSPointer(new)
 
-		if hasImageExt(file.OldFile.Path) {
+		// files stored with LFS are shown as their pointers rather than
+		// embedding what could be huge objects in the changeset
+		csf = ChangesetFiles{LFS: oldLFS || newLFS}
+
+		if hasImageExt(file.OldFile.Path) && !csf.LFS {
 			csf.Old = base64.StdEncoding.EncodeToString(old)
 		} else {
 			csf.Old = string(old)
 		}
 
-		if hasImageExt(file.NewFile.Path) {
+		if hasImageExt(file.NewFile.Path) && !csf.LFS {
 			csf.New = base64.StdEncoding.EncodeToString(new)
 		} else {
 			csf.New = string(new)
@@ -307,7 +338,7 @@ func diffForCommit(hash string) (cs Changeset, err error) {
 	}, git.DiffDetailLines)
 
 	if err != nil {
-		return cs, err
+		return cs, nil, err
 	}
 
 	cs = Changeset{
@@ -316,13 +347,9 @@ func diffForCommit(hash string) (cs Changeset, err error) {
 		NumDeleted: numDeleted,
 		FullDiff:   buffer.String(),
 		Files:      files,
-		Message:    commit.Message(),
-		Author:     commit.Author(),
-		Hash:       commit.Id().String(),
-		Time:       commit.Committer().When,
 	}
 
-	return cs, nil
+	return cs, deleted, nil
 
 }
 
@@ -337,9 +364,11 @@ func getFileContentsByOid(repo *git.Repository, oid *git.Oid) (contents []byte,
 	if err != nil {
 		return contents, err
 	}
-	contents = blob.Contents()
+	defer blob.Free()
 
-	return contents, err
+	// LFS pointers are returned as they are, the objects they point to
+	// can be any size
+	return blob.Contents(), nil
 }
 
 func getFileHistory(path string, size int) (history []HistoricCommit, err error) {
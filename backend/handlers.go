@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/dgrijalva/jwt-go/request"
@@ -17,9 +21,10 @@ import (
 // SuccessResponse contains information about a successful
 // update to the repository
 type SuccessResponse struct {
-	Message string `json:"message"`
-	Oid     string `json:"oid,omitempty"`
-	Meta    string `json:"meta,omitempty"`
+	Message     string       `json:"message"`
+	Oid         string       `json:"oid,omitempty"`
+	Meta        string       `json:"meta,omitempty"`
+	ScanResults []ScanResult `json:"scan_results,omitempty"`
 }
 
 // FailureResponse accompanies the HTTP status code with
@@ -29,6 +34,34 @@ type FailureResponse struct {
 	Meta    string `json:"meta,omitempty"`
 }
 
+// BrokenLinksResponse is returned when a commit is rejected because
+// its documents reference files that don't exist
+type BrokenLinksResponse struct {
+	Message     string      `json:"message"`
+	BrokenLinks []Reference `json:"broken_links"`
+}
+
+// PolicyViolationsResponse is returned when a commit is rejected because
+// its files break the upload policies
+type PolicyViolationsResponse struct {
+	Message    string            `json:"message"`
+	Violations []PolicyViolation `json:"violations"`
+}
+
+// ScanRejectedResponse is returned when a commit is rejected because
+// malware was found in its files
+type ScanRejectedResponse struct {
+	Message string       `json:"message"`
+	Results []ScanResult `json:"results"`
+}
+
+// DataValidationResponse is returned when a data file is rejected because
+// it isn't well formed or doesn't match its schema
+type DataValidationResponse struct {
+	Message string      `json:"message"`
+	Errors  []DataError `json:"errors"`
+}
+
 // HTTPS Redirect 👉
 func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
 
@@ -502,6 +535,7 @@ func apiListDirectoriesHandler(w http.ResponseWriter, r *http.Request) {
 // the Repository's contents.
 //
 // GET /api/directory_summary
+// GET /api/directory_summary?state=published
 //
 // eg. when the documents directory contains Documents 1 and 2:
 //
@@ -527,6 +561,12 @@ func apiDirectorySummary(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if state := r.URL.Query().Get("state"); state != "" {
+		for i, ds := range summary {
+			summary[i].Contents = filterFilesByState(ds.Contents, state)
+		}
+	}
+
 	JSONResponse(summary, http.StatusOK, w)
 
 }
@@ -591,6 +631,9 @@ func apiRenameDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 // title: My favourite document
 // description: The greatest doc ever!
 // ---
+//
+// pass dry_run=true to receive a DryRun listing the metadata files that
+// would be changed along with the resulting changeset, nothing is committed
 func apiUpdateDirectoriesHandler(w http.ResponseWriter, r *http.Request) {
 	var directory string
 	var nc NewCommit
@@ -621,6 +664,21 @@ func apiUpdateDirectoriesHandler(w http.ResponseWriter, r *http.Request) {
 
 	user := getCurrentUser(r.Context())
 
+	if r.URL.Query().Get("dry_run") == "true" {
+
+		dr, err := previewUpdateDirectories(nc, user)
+		if err != nil {
+			fr = FailureResponse{
+				Message: fmt.Sprintln("Failed to preview directory update:", err.Error()),
+			}
+			JSONResponse(fr, http.StatusBadRequest, w)
+			return
+		}
+
+		JSONResponse(dr, http.StatusOK, w)
+		return
+	}
+
 	oid, err := updateDirectories(nc, user)
 
 	if err == ErrRepoOutOfSync {
@@ -659,6 +717,9 @@ func apiUpdateDirectoriesHandler(w http.ResponseWriter, r *http.Request) {
 //
 // returns a SuccessResponse containing the git commit hash or a FailureResponse
 // containing an error message
+//
+// pass dry_run=true to receive a DryRun listing everything that would be
+// deleted along with the resulting changeset, nothing is committed
 func apiDeleteDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 	var directory string
 	var nc NewCommit
@@ -691,6 +752,28 @@ func apiDeleteDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 
 	user := getCurrentUser(r.Context())
 
+	if r.URL.Query().Get("dry_run") == "true" {
+
+		dr, err := previewDeleteDirectories(nc, user)
+
+		if err == ErrRepoOutOfSync {
+			fr = FailureResponse{Message: "Repository out of sync with commit"}
+			JSONResponse(fr, http.StatusConflict, w)
+			return
+		}
+
+		if err != nil {
+			fr = FailureResponse{
+				Message: fmt.Sprintln("Failed to preview directory deletion:", err.Error()),
+			}
+			JSONResponse(fr, http.StatusBadRequest, w)
+			return
+		}
+
+		JSONResponse(dr, http.StatusOK, w)
+		return
+	}
+
 	oid, err := deleteDirectories(nc, user)
 
 	if err == ErrRepoOutOfSync {
@@ -720,9 +803,11 @@ func apiDeleteDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 // Inside a directory functionality 🗂
 
 // apiListFilesInDirectoryHandler returns a JSON array containing
-// the all files belonging to :directory
+// the all files belonging to :directory, documents can be limited
+// to those in a workflow state with the state parameter
 //
 // GET /api/directories/:directory/documents
+// GET /api/directories/:directory/documents?state=in_review
 //
 // eg. when the documents directory contains Documents 1 and 2:
 //
@@ -751,6 +836,10 @@ func apiListFilesInDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if state := r.URL.Query().Get("state"); state != "" {
+		files = filterFilesByState(files, state)
+	}
+
 	metadata, err := getMetadataFromDirectory(directory)
 
 	if err == ErrMetadataNotFound {
@@ -774,6 +863,71 @@ func apiListFilesInDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 	JSONResponse(result, http.StatusOK, w)
 }
 
+// apiReorderDocumentsHandler sets the order documents are listed in
+// within a directory by rewriting their weights in a single commit.
+// Every document in the directory must be included
+//
+// PUT /api/directories/:directory/order
+// {
+//   "documents": ["document_3", "document_1", "document_2"],
+//   "message": "Move document 3 to the front",
+//   "repository_info": {"latest_revision": "9cd5f2e1..."}
+// }
+//
+// returns a SuccessResponse containing the git commit hash or a FailureResponse
+// containing an error message
+func apiReorderDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	var order DocumentOrder
+	var fr FailureResponse
+	var sr SuccessResponse
+
+	directory := vestigo.Param(r, "directory")
+
+	json.NewDecoder(r.Body).Decode(&order)
+
+	err := validate.Struct(order)
+	if err != nil {
+		errors := validationErrorsToJSON(err)
+		JSONResponse(errors, http.StatusBadRequest, w)
+		return
+	}
+
+	user := getCurrentUser(r.Context())
+
+	oid, err := reorderDocuments(directory, order, user)
+
+	if err == ErrRepoOutOfSync {
+		fr = FailureResponse{Message: "Repository out of sync with commit"}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
+	}
+
+	if err == ErrDirectoryNotFound {
+		fr = FailureResponse{Message: ErrDirectoryNotFound.Error()}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err == ErrInvalidOrder {
+		fr = FailureResponse{Message: ErrInvalidOrder.Error()}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err != nil {
+		fr = FailureResponse{Message: fmt.Sprintf("Failed to reorder documents: %s", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	sr = SuccessResponse{
+		Message: "Documents reordered",
+		Oid:     oid.String(),
+	}
+
+	JSONResponse(sr, http.StatusOK, w)
+}
+
 // apiGetDirectoryMetadata returns the `DirectoryInfo` for the
 // given directory
 //
@@ -851,6 +1005,30 @@ func apiCreateFileInDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err == ErrUnknownAuthor {
+		fr = FailureResponse{Message: "Authors must be existing users"}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err == ErrScheduleForbidden {
+		fr = FailureResponse{Message: "Not permitted to schedule publishing or unpublishing this document"}
+		JSONResponse(fr, http.StatusForbidden, w)
+		return
+	}
+
+	if uploadRejectionFailure(err, w) {
+		return
+	}
+
+	// If the commit contains broken links, return a 422 (Unprocessable Entity)
+	// listing them so they can be corrected
+	if ble, ok := err.(BrokenLinksError); ok {
+		blr := BrokenLinksResponse{Message: "Document contains broken links", BrokenLinks: ble.References}
+		JSONResponse(blr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
 	if err != nil {
 		fr = FailureResponse{Message: fmt.Sprintf("Failed to create files: %s", err.Error())}
 		JSONResponse(fr, http.StatusOK, w)
@@ -860,8 +1038,9 @@ func apiCreateFileInDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 	Debug.Println("File(s) created", oid)
 
 	sr = SuccessResponse{
-		Message: "File(s) created",
-		Oid:     oid.String(),
+		Message:     "File(s) created",
+		Oid:         oid.String(),
+		ScanResults: commitScanResults(oid),
 	}
 
 	JSONResponse(sr, http.StatusCreated, w)
@@ -925,6 +1104,36 @@ func apiUpdateFileInDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err == ErrUnknownAuthor {
+		fr = FailureResponse{Message: "Authors must be existing users"}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err == ErrDraftRequiresTransition {
+		fr = FailureResponse{Message: "Documents can only be published or unpublished using the workflow"}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err == ErrScheduleForbidden {
+		fr = FailureResponse{Message: "Not permitted to schedule publishing or unpublishing this document"}
+		JSONResponse(fr, http.StatusForbidden, w)
+		return
+	}
+
+	if uploadRejectionFailure(err, w) {
+		return
+	}
+
+	// If the commit contains broken links, return a 422 (Unprocessable Entity)
+	// listing them so they can be corrected
+	if ble, ok := err.(BrokenLinksError); ok {
+		blr := BrokenLinksResponse{Message: "Document contains broken links", BrokenLinks: ble.References}
+		JSONResponse(blr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
 	if err != nil {
 
 		Error.Println("Failed to update files", nc.Files, err.Error())
@@ -938,9 +1147,21 @@ func apiUpdateFileInDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 
 	Warning.Println("File updated", oid)
 
+	// the changes have been saved so the editing session is over
+	err = releaseLock(directory, document, filename, user)
+	if err != nil && err != ErrLockNotFound && err != ErrDocumentLocked {
+		Warning.Println("Could not release lock", err.Error())
+	}
+
+	_, err = discardAutosaves(user, filepath.Join(directory, document, filename))
+	if err != nil {
+		Warning.Println("Could not discard autosaves", err.Error())
+	}
+
 	sr = SuccessResponse{
-		Message: "File updated",
-		Oid:     oid.String(),
+		Message:     "File updated",
+		Oid:         oid.String(),
+		ScanResults: commitScanResults(oid),
 	}
 
 	JSONResponse(sr, http.StatusCreated, w)
@@ -1009,6 +1230,14 @@ func apiTranslateFileHandler(w http.ResponseWriter, r *http.Request) {
 // directory
 //
 // DELETE /api/directories/:directory/documents/:document/files/:filename
+//
+// if other documents link to the file a 422 is returned listing them,
+// pass force=true to delete it regardless
+//
+// pass dry_run=true to receive a DryRun listing everything that would be
+// deleted, the resulting changeset and any links that would break,
+// nothing is committed
+//
 // {
 //	  "message": "Deleted document 6 as it's no longer required",
 //	  "files": [
@@ -1053,6 +1282,54 @@ func apiDeleteFileFromDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 
 	user := getCurrentUser(r.Context())
 
+	if r.URL.Query().Get("dry_run") == "true" {
+
+		dr, err := previewDeleteFiles(nc, user)
+
+		if err == ErrRepoOutOfSync {
+			fr = FailureResponse{Message: "Repository out of sync with commit"}
+			JSONResponse(fr, http.StatusConflict, w)
+			return
+		}
+
+		if err != nil {
+			fr = FailureResponse{Message: fmt.Sprintf("Failed to preview deletion: %s", err.Error())}
+			JSONResponse(fr, http.StatusBadRequest, w)
+			return
+		}
+
+		dr.BrokenLinks, err = danglingReferences(nc.Files)
+		if err != nil {
+			Error.Println("Failed to check incoming links:", err.Error())
+			fr = FailureResponse{Message: err.Error()}
+			JSONResponse(fr, http.StatusBadRequest, w)
+			return
+		}
+
+		JSONResponse(dr, http.StatusOK, w)
+		return
+	}
+
+	// unless the deletion has been forced, refuse to delete files that are
+	// linked to from other documents and list them so the user can decide
+	if r.URL.Query().Get("force") != "true" {
+
+		dangling, err := danglingReferences(nc.Files)
+		if err != nil {
+			Error.Println("Failed to check incoming links:", err.Error())
+			fr = FailureResponse{Message: err.Error()}
+			JSONResponse(fr, http.StatusBadRequest, w)
+			return
+		}
+
+		if len(dangling) > 0 {
+			Warning.Println("Deletion would break links", dangling)
+			blr := BrokenLinksResponse{Message: "File is referenced by other documents", BrokenLinks: dangling}
+			JSONResponse(blr, http.StatusUnprocessableEntity, w)
+			return
+		}
+	}
+
 	oid, err := deleteFiles(nc, user)
 
 	// If err is a ErrRepoOutOfSync, return a 409 (Edit Conflict) and appropriate message
@@ -1117,376 +1394,1564 @@ func apiGetFileInDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	JSONResponse(file, http.StatusOK, w)
-
-}
-
-func apiGetFileAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
-	var fr FailureResponse
-
-	directory := vestigo.Param(r, "directory")
-	document := vestigo.Param(r, "document")
-
-	path := fmt.Sprintf("%s/%s", directory, document)
-
-	files, err := getAttachments(path)
-
+	err = describeFile(file)
 	if err != nil {
-
-		Warning.Println("No attachments dir found for path", path)
-
-		fr = FailureResponse{
-			Message: "No attachments",
-		}
-
-		JSONResponse(fr, http.StatusNotFound, w)
-
-		return
+		Warning.Println("Could not describe file", file.FullPath(), err.Error())
 	}
 
-	JSONResponse(files, http.StatusOK, w)
-}
+	JSONResponse(file, http.StatusOK, w)
 
-func apiGetFileAttachmentHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Not implemented yet"))
 }
 
-// apiEditFileInDirectoryHandler returns a File object representing the
-// specified file to be used on the editor page of the application. A
-// server-renedered preview isn't shown, so we don't generate HTML but
-// just send the raw Markdown
+// apiGetDocumentHandler returns a File object for the document with the
+// supplied identifier, wherever it currently resides in the repository.
+// Identifiers are assigned when documents are created and survive renames
+// so are suitable for bookmarks and external links
 //
-// GET /api/directories/:directory/documents/:document/files/:filename/edit
+// GET /api/documents/:id
 //
 // returns
 //
 // {
-//   "filename": "document_3.md",
+//   "filename": "index.md",
 //   "path": "documents",
-//   "author": "Carl Carlson",
-//	 "markdown": "# The quick brown fox\nJumped over *the* lazy dog",
-//	 "html": nil
+//   "document": "document_3",
+//   "frontmatter": {"id": "2a5e0c8c-4a4a-4f5e-9d0e-5b5c2ee1f6b3", ...},
+//   "html": "<h1>The quick brown fox</h1><p>Jumped over <em>the</em> lazy dog</p>"
 //	 ...
 // }
-func apiEditFileInDirectoryHandler(w http.ResponseWriter, r *http.Request) {
+func apiGetDocumentHandler(w http.ResponseWriter, r *http.Request) {
 	var fr FailureResponse
 
-	directory := vestigo.Param(r, "directory")
-	document := vestigo.Param(r, "document")
-	filename := vestigo.Param(r, "file")
-
-	file, err := getRawFile(directory, document, filename)
+	id := vestigo.Param(r, "id")
 
-	if err != nil {
-		Error.Println("Could not update file", err.Error())
+	dl, err := lookupDocumentByID(id)
 
+	if err == ErrDocumentNotFound {
 		fr = FailureResponse{
-			Message: fmt.Sprintln("Could not update file", file, err.Error()),
+			Message: fmt.Sprintf("No document found with id %s", id),
 		}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
 
+	if err != nil {
+		Error.Println("Could not look up document", id, err.Error())
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Failed to look up document: %s", err.Error()),
+		}
 		JSONResponse(fr, http.StatusBadRequest, w)
 		return
 	}
 
-	JSONResponse(file, http.StatusOK, w)
-}
-
-// user functionality 👩🏽‍💻
-
-// apiListUsers
-func apiListUsersHandler(w http.ResponseWriter, r *http.Request) {
-	var fr FailureResponse
-
-	users, err := allUsers()
+	file, err := getConvertedFile(dl.Path, dl.Document, dl.Filename)
 	if err != nil {
 
-		Error.Println("Could not retrieve user list", err.Error())
+		Error.Println("Could not find converted file", dl.FullPath(), err.Error())
 
 		fr = FailureResponse{
-			Message: fmt.Sprintf("Could not retrieve list of users"),
+			Message: fmt.Sprintf("Failed to get converted file: %s", err.Error()),
 		}
-
 		JSONResponse(fr, http.StatusBadRequest, w)
 		return
 	}
 
-	JSONResponse(users, http.StatusOK, w)
+	err = describeFile(file)
+	if err != nil {
+		Warning.Println("Could not describe file", file.FullPath(), err.Error())
+	}
+
+	JSONResponse(file, http.StatusOK, w)
 
 }
 
-// apiGetUser
-func apiGetUserHandler(w http.ResponseWriter, r *http.Request) {
+func apiGetFileAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
 	var fr FailureResponse
 
-	username := vestigo.Param(r, "username")
-	Debug.Println("Retrieving user", username)
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+
+	path := fmt.Sprintf("%s/%s", directory, document)
+
+	files, err := getAttachments(path)
 
-	user, err := getLimitedUserByUsername(username)
 	if err != nil {
 
-		Error.Println("Could not retrieve user", username, err.Error())
+		Warning.Println("No attachments dir found for path", path)
 
 		fr = FailureResponse{
-			Message: fmt.Sprintln("Failed to find restricted user", username, err.Error()),
+			Message: "No attachments",
 		}
+
 		JSONResponse(fr, http.StatusNotFound, w)
+
 		return
 	}
 
-	JSONResponse(user, http.StatusOK, w)
+	JSONResponse(files, http.StatusOK, w)
 }
 
-// apiUpdateUser
-func apiUpdateUserNameHandler(w http.ResponseWriter, r *http.Request) {
-
-	// FIXME add validation!
-	type payload struct {
-		Name string `json:"name"`
-	}
-
-	var params payload
-	var err error
+// apiGetFileAttachmentHandler returns the raw contents of a single
+// attachment. The path after attachments/ is relative to the document, so
+// images/cat.jpg is found in documents/document_1/images/cat.jpg
+//
+// GET /api/directories/:directory/documents/:document/attachments/images/cat.jpg
+//
+// The blob's identifier is used as the ETag so unchanged attachments
+// aren't downloaded again, and Range requests are supported
+func apiGetFileAttachmentHandler(w http.ResponseWriter, r *http.Request) {
 	var fr FailureResponse
 
-	user := getCurrentUser(r.Context())
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	path := vestigo.Param(r, "_name")
 
-	// only updating the name is supported at this time
+	attachment, contents, err := openAttachment(directory, document, path)
 
-	json.NewDecoder(r.Body).Decode(&params)
+	if err == ErrAttachmentNotFound {
+		fr = FailureResponse{Message: "Attachment not found"}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
 
-	err = db.UpdateField(&user, "Name", params.Name)
 	if err != nil {
-		fr = FailureResponse{
-			Message: err.Error(),
-		}
-		JSONResponse(fr, http.StatusBadRequest, w)
+		Error.Println("Failed to retrieve attachment", path, err.Error())
+		fr = FailureResponse{Message: "Failed to retrieve attachment"}
+		JSONResponse(fr, http.StatusInternalServerError, w)
 		return
 	}
 
-	JSONResponse(SuccessResponse{Message: "User updated"}, http.StatusOK, w)
+	defer contents.Close()
+
+	attachmentHeaders(w, attachment)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, attachment.Oid))
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	// ServeContent takes care of Range and If-None-Match, the blob's
+	// contents never change so there's no need for a modification time
+	http.ServeContent(w, r, attachment.Filename, time.Time{}, contents)
 }
 
-// apiUpdatePasswordHandler updates the password after confirming that the
-// user knows their current password
-//
-// PATCH /api/settings/password
+// apiGetThumbnailHandler returns a thumbnail of a JPEG or PNG attachment,
+// the size is optional and defaults to thumbnail_size
 //
-// returns
+// GET /api/directories/:directory/documents/:document/thumbnails/images/cat.jpg?size=120
 //
-// {
-//   "current_password": "p455w0rd",
-//   "new_password": "passwORDx123",
-// }
-func apiUpdatePasswordHandler(w http.ResponseWriter, r *http.Request) {
-
+// Thumbnails are cached, so like the attachments themselves they're
+// identified by the blob's ETag
+func apiGetThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 	var fr FailureResponse
-	var err error
 
-	var pl PasswordUpdate
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	path := vestigo.Param(r, "_name")
 
-	user := getCurrentUser(r.Context())
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+	size = thumbnailSize(size)
 
-	json.NewDecoder(r.Body).Decode(&pl)
+	attachment, contents, err := openAttachment(directory, document, path)
 
-	Debug.Println("password update payload", pl)
+	if err == ErrAttachmentNotFound {
+		fr = FailureResponse{Message: "Attachment not found"}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
 
-	err = validate.Struct(pl)
 	if err != nil {
-		JSONResponse(validationErrorsToJSON(err), http.StatusBadRequest, w)
+		Error.Println("Failed to retrieve attachment", path, err.Error())
+		fr = FailureResponse{Message: "Failed to retrieve attachment"}
+		JSONResponse(fr, http.StatusInternalServerError, w)
 		return
 	}
+	defer contents.Close()
 
-	// check current matches old
-	err = user.checkPassword(pl.CurrentPassword)
-	if err != nil {
-		fr = FailureResponse{
-			Message: "Current password is not correct",
-		}
-		JSONResponse(fr, http.StatusBadRequest, w)
+	thumbnail, err := getThumbnail(attachment, contents, size)
+
+	if err == ErrNotProcessable {
+		fr = FailureResponse{Message: "Thumbnails are only available for JPEG and PNG images"}
+		JSONResponse(fr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if err == ErrImageTooLarge {
+		fr = FailureResponse{Message: "The image is too large to make a thumbnail of"}
+		JSONResponse(fr, http.StatusUnprocessableEntity, w)
 		return
 	}
 
-	// everything's ok, update
-	err = user.setPassword(pl.NewPassword)
 	if err != nil {
-		fr = FailureResponse{
-			Message: "Password could not be set",
-		}
-		JSONResponse(fr, http.StatusBadRequest, w)
+		Error.Println("Failed to create thumbnail", path, err.Error())
+		fr = FailureResponse{Message: "Failed to create thumbnail"}
+		JSONResponse(fr, http.StatusInternalServerError, w)
 		return
 	}
 
-	JSONResponse(SuccessResponse{Message: "Password updated"}, http.StatusOK, w)
+	attachmentHeaders(w, attachment)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, attachment.Oid, size))
+	w.Header().Set("Cache-Control", "private, no-cache")
 
+	http.ServeContent(w, r, attachment.Filename, time.Time{}, bytes.NewReader(thumbnail))
 }
 
-func apiUserListPublicKeysHandler(w http.ResponseWriter, r *http.Request) {
-	var user User
+// apiUploadAttachmentsHandler streams uploaded files into the document. The
+// request is multipart/form-data containing a 'commit' part and any number
+// of 'attachments' parts. The commit's files, if any, must belong to the
+// document and are updated in the same commit. Attachments are stored in
+// the directory upload_directories gives their category, images/ for
+// images by default, unless a 'directory' part precedes them
+//
+// POST /api/directories/:directory/documents/:document/attachments
+// Content-Type: multipart/form-data; boundary=...
+//
+// commit: {"message": "Add a diagram", "files": [...], "repository_info": {...}}
+// attachments: <diagram.png>
+// attachments: <photo.jpg>
+// directory: downloads
+// attachments: <brochure.pdf>
+//
+// Files larger than max_attachment_size are rejected with a 413, files
+// breaking the upload policies with a 422 listing the problems and
+// uploads exceeding the user's storage quota with a 507
+//
+// When a scanner is configured the response lists each attachment's
+// scan result, infected files are quarantined and rejected with a 422
+func apiUploadAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	var nc NewCommit
 	var fr FailureResponse
+	var sr SuccessResponse
+	var uploads []Upload
+	var uploadDirectory string
 
-	user = getCurrentUser(r.Context())
-
-	type rk struct {
-		ID          int    `json:"id"`
-		Fingerprint string `json:"fingerprint"`
-		Raw         string `json:"raw"`
-		Name        string `json:"name"`
-	}
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
 
-	upks, err := user.keys()
+	mr, err := r.MultipartReader()
 	if err != nil {
-		Debug.Println("error", err.Error())
-		fr = FailureResponse{
-			Message: fmt.Sprintf("Cannot retrieve keys belonging to: %s", user.Username),
-		}
+		fr = FailureResponse{Message: "Attachments must be uploaded as multipart/form-data"}
 		JSONResponse(fr, http.StatusBadRequest, w)
+		return
 	}
 
-	// properly initialise the slice so if empty,
-	// marshalled JSON is a empty array instead of null
-	var keys []rk
-	keys = make([]rk, 0)
+	repo, err := repository(config)
+	if err != nil {
+		fr = FailureResponse{Message: "Could not open repository"}
+		JSONResponse(fr, http.StatusInternalServerError, w)
+		return
+	}
+	defer repo.Free()
 
-	for _, upk := range upks {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
 
-		file, err := upk.File()
 		if err != nil {
-			Error.Println("Could not decode key", upk.Fingerprint)
-			continue
+			fr = FailureResponse{Message: fmt.Sprintf("Could not read upload: %s", err.Error())}
+			JSONResponse(fr, http.StatusBadRequest, w)
+			return
 		}
 
-		keys = append(keys, rk{
-			ID:          upk.ID,
-			Name:        upk.Name,
-			Fingerprint: upk.Fingerprint,
-			Raw:         file,
-		})
-	}
-
-	JSONResponse(keys, http.StatusOK, w)
+		if part.FormName() == "commit" {
+			err = json.NewDecoder(io.LimitReader(part, maxAttachmentSize())).Decode(&nc)
+			if err != nil {
+				fr = FailureResponse{Message: "Could not parse commit"}
+				JSONResponse(fr, http.StatusBadRequest, w)
+				return
+			}
+			continue
+		}
 
-}
+		// attachments are stored in a directory chosen by their category
+		// unless one is given before them
+		if part.FormName() == "directory" {
+			name, _ := ioutil.ReadAll(io.LimitReader(part, 1024))
 
-func apiUserAddPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
-	type payload struct {
-		Name string `json:"name"`
-		Key  string `json:"key"`
-	}
+			uploadDirectory, err = attachmentDirectory(string(name))
+			if err != nil {
+				fr = FailureResponse{Message: fmt.Sprintf("Invalid directory '%s'", name)}
+				JSONResponse(fr, http.StatusBadRequest, w)
+				return
+			}
+			continue
+		}
 
-	var user User
-	var pl payload
-	var err error
-	var sr SuccessResponse
-	var fr FailureResponse
+		if part.FormName() != "attachments" {
+			continue
+		}
 
-	json.NewDecoder(r.Body).Decode(&pl)
+		upload, err := createBlobFromReader(repo, part.FileName(), part, maxAttachmentSize())
 
-	user = getCurrentUser(r.Context())
+		if err == ErrAttachmentTooLarge {
+			fr = FailureResponse{
+				Message: fmt.Sprintf("%s is larger than %dMB", upload.Filename, maxAttachmentSize()/1024/1024),
+			}
+			JSONResponse(fr, http.StatusRequestEntityTooLarge, w)
+			return
+		}
 
-	Debug.Println("supplied key:", pl.Key)
+		if err == ErrInvalidAttachmentName {
+			fr = FailureResponse{Message: fmt.Sprintf("Invalid filename '%s'", part.FileName())}
+			JSONResponse(fr, http.StatusBadRequest, w)
+			return
+		}
 
-	err = user.addPublicKey(pl.Name, pl.Key)
+		if err != nil {
+			Error.Println("Failed to store attachment", part.FileName(), err.Error())
+			fr = FailureResponse{Message: "Failed to store attachment"}
+			JSONResponse(fr, http.StatusInternalServerError, w)
+			return
+		}
 
-	if err != nil && err.Error() == "already exists" {
-		Error.Println("Key already exists", user.Username, err.Error(), pl.Key)
-		fr = FailureResponse{
-			Message: fmt.Sprintf("Key already exists\n%s", pl.Key),
+		if uploadDirectory != "" {
+			upload.Directory = uploadDirectory
 		}
-		JSONResponse(fr, http.StatusConflict, w)
-		return
+
+		uploads = append(uploads, upload)
 	}
 
+	err = validate.Struct(nc)
 	if err != nil {
-		Error.Println("Failed to create public key", user.Username, err.Error())
-		fr = FailureResponse{
-			Message: fmt.Sprintf("Cannot set public key for %s", user.Username),
-		}
-		JSONResponse(fr, http.StatusBadRequest, w)
+		errors := validationErrorsToJSON(err)
+		JSONResponse(errors, http.StatusBadRequest, w)
 		return
 	}
 
-	sr = SuccessResponse{
-		Message: fmt.Sprintf("Public key created for %s", user.Username),
+	for _, ncf := range nc.Files {
+		if ncf.Path != directory || ncf.Document != document {
+			fr = FailureResponse{Message: "Supplied files must belong to the document"}
+			JSONResponse(fr, http.StatusBadRequest, w)
+			return
+		}
 	}
 
-	JSONResponse(sr, http.StatusOK, w)
-
-}
+	user := getCurrentUser(r.Context())
 
-func apiUserDeletePublicKeyHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-	var pkr PublicKey
-	var sr SuccessResponse
-	var fr FailureResponse
-	var user User
+	oid, err := commitUploads(directory, document, uploads, nc, user)
 
-	sid := vestigo.Param(r, "id")
-	id, err := strconv.Atoi(sid)
-	if err != nil {
-		fr = FailureResponse{
-			Message: fmt.Sprintf("Invalid id %d", id),
-		}
+	if err == ErrNoAttachments {
+		fr = FailureResponse{Message: "No attachments uploaded"}
 		JSONResponse(fr, http.StatusBadRequest, w)
 		return
 	}
 
-	user = getCurrentUser(r.Context())
+	// If err is a ErrRepoOutOfSync, return a 409 (Edit Conflict) and appropriate message
+	if err == ErrRepoOutOfSync {
+		fr = FailureResponse{Message: "Repository out of sync with commit"}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
+	}
 
-	err = db.One("ID", id, &pkr)
-	if err != nil {
-		Warning.Println("Cannot find public key", id)
-		fr = FailureResponse{
-			Message: fmt.Sprintf("Cannot find public key %d", id),
-		}
+	if err == ErrUnknownAuthor {
+		fr = FailureResponse{Message: "Authors must be existing users"}
 		JSONResponse(fr, http.StatusBadRequest, w)
 		return
 	}
-	if user.ID != pkr.UserID {
-		Warning.Println("Key does not belong to user", id, user)
-		fr = FailureResponse{
-			Message: fmt.Sprintf("Key %d does not belong to you", id),
-		}
+
+	if err == ErrDraftRequiresTransition {
+		fr = FailureResponse{Message: "Documents can only be published or unpublished using the workflow"}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err == ErrScheduleForbidden {
+		fr = FailureResponse{Message: "Not permitted to schedule publishing or unpublishing this document"}
 		JSONResponse(fr, http.StatusForbidden, w)
 		return
 	}
 
-	err = db.DeleteStruct(&pkr)
-	if user.ID != pkr.UserID {
-		Error.Println("Could not delete public key", err.Error())
-		fr = FailureResponse{
-			Message: fmt.Sprintf("Could not delete key %d", id),
-		}
+	if uploadRejectionFailure(err, w) {
+		return
+	}
+
+	// If the commit contains broken links, return a 422 (Unprocessable Entity)
+	// listing them so they can be corrected
+	if ble, ok := err.(BrokenLinksError); ok {
+		blr := BrokenLinksResponse{Message: "Document contains broken links", BrokenLinks: ble.References}
+		JSONResponse(blr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if err != nil {
+		fr = FailureResponse{Message: fmt.Sprintf("Failed to upload attachments: %s", err.Error())}
 		JSONResponse(fr, http.StatusBadRequest, w)
 		return
 	}
 
-	// no errors, success!
 	sr = SuccessResponse{
-		Message: fmt.Sprintf("Key %d deleted", id),
+		Message:     fmt.Sprintf("%d attachment(s) uploaded", len(uploads)),
+		Oid:         oid.String(),
+		ScanResults: commitScanResults(oid),
 	}
 
-	JSONResponse(sr, http.StatusOK, w)
-
+	JSONResponse(sr, http.StatusCreated, w)
 }
-func apiPublishHandler(w http.ResponseWriter, r *http.Request) {
+
+// apiGetDataPreviewHandler parses a CSV, JSON or XML attachment, CSV
+// files are returned a page of rows at a time and JSON and XML as a tree.
+// Problems with the file are listed in errors rather than failing
+//
+// GET /api/directories/:directory/documents/:document/data/data/people.csv?page=2&per_page=50
+//
+// JSON files are validated against a sibling schema, people.json against
+// people.schema.json, when there is one
+func apiGetDataPreviewHandler(w http.ResponseWriter, r *http.Request) {
 	var fr FailureResponse
 
-	output, err := buildStaticSite()
-	if err != nil {
-		fr = FailureResponse{
-			Message: fmt.Sprintf("Failed to publish site: %s", err.Error()),
-			Meta:    string(output),
-		}
-		JSONResponse(fr, http.StatusBadRequest, w)
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	path := vestigo.Param(r, "_name")
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+
+	dp, err := getDataPreview(directory, document, path, page, perPage)
+
+	if err == ErrNotDataFile {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusUnprocessableEntity, w)
 		return
 	}
 
-	Info.Println("Site published!")
+	if err == ErrAttachmentNotFound {
+		fr = FailureResponse{Message: "Attachment not found"}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
 
-	type publishResponse struct {
-		Message string `json:"message"`
-		Meta    string `json:"meta"`
+	if err != nil {
+		Error.Println("Failed to preview data file", path, err.Error())
+		fr = FailureResponse{Message: "Failed to preview data file"}
+		JSONResponse(fr, http.StatusInternalServerError, w)
+		return
+	}
+
+	JSONResponse(dp, http.StatusOK, w)
+}
+
+// apiUpdateDataFileHandler replaces the contents of a CSV, JSON or XML
+// attachment. Contents that aren't well formed or don't match the schema
+// are rejected with a 422 listing the problems
+//
+// PATCH /api/directories/:directory/documents/:document/data/data/people.csv
+//
+// {
+//   "message": "Add Milhouse",
+//   "contents": "name,age\nBart,10\nMilhouse,10\n",
+//   "repository_info": {"latest_revision": "2f1e..."}
+// }
+//
+// pass dry_run=true to receive the DataPreview of the new contents,
+// nothing is committed
+func apiUpdateDataFileHandler(w http.ResponseWriter, r *http.Request) {
+	var du DataUpdate
+	var fr FailureResponse
+	var sr SuccessResponse
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	path := vestigo.Param(r, "_name")
+
+	err := json.NewDecoder(r.Body).Decode(&du)
+	if err != nil {
+		fr = FailureResponse{Message: "Could not parse data file update"}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if r.URL.Query().Get("dry_run") == "true" {
+
+		dp, err := previewDataUpdate(directory, document, path, du)
+
+		if err != nil {
+			dataUpdateFailure(err, w)
+			return
+		}
+
+		JSONResponse(dp, http.StatusOK, w)
+		return
+	}
+
+	err = validate.Struct(du)
+	if err != nil {
+		errors := validationErrorsToJSON(err)
+		JSONResponse(errors, http.StatusBadRequest, w)
+		return
+	}
+
+	user := getCurrentUser(r.Context())
+
+	oid, err := updateDataFile(directory, document, path, du, user)
+	if err != nil {
+		dataUpdateFailure(err, w)
+		return
+	}
+
+	sr = SuccessResponse{
+		Message:     fmt.Sprintf("%s updated", path),
+		Oid:         oid.String(),
+		ScanResults: commitScanResults(oid),
+	}
+
+	JSONResponse(sr, http.StatusCreated, w)
+}
+
+// dataUpdateFailure responds with the status matching why a data file
+// couldn't be previewed or updated
+func dataUpdateFailure(err error, w http.ResponseWriter) {
+	var fr FailureResponse
+
+	if dve, ok := err.(DataValidationError); ok {
+		dvr := DataValidationResponse{Message: "Data file is invalid", Errors: dve.Errors}
+		JSONResponse(dvr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if uploadRejectionFailure(err, w) {
+		return
+	}
+
+	if err == ErrNotDataFile {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if err == ErrAttachmentNotFound {
+		fr = FailureResponse{Message: "Attachment not found"}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err == ErrRepoOutOfSync {
+		fr = FailureResponse{Message: "Repository out of sync with commit"}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
+	}
+
+	fr = FailureResponse{Message: fmt.Sprintf("Failed to update data file: %s", err.Error())}
+	JSONResponse(fr, http.StatusBadRequest, w)
+}
+
+// uploadRejectionFailure responds if the upload policies, storage quota
+// or content scanner rejected the commit, returning false when err is
+// something else for the caller to deal with
+func uploadRejectionFailure(err error, w http.ResponseWriter) bool {
+	var fr FailureResponse
+
+	// If the commit contains files that aren't allowed, return a 422
+	// (Unprocessable Entity) listing why
+	if pve, ok := err.(PolicyViolationsError); ok {
+		pvr := PolicyViolationsResponse{Message: "Files break the upload policy", Violations: pve.Violations}
+		JSONResponse(pvr, http.StatusUnprocessableEntity, w)
+		return true
+	}
+
+	if err == ErrStorageQuotaExceeded {
+		fr = FailureResponse{Message: fmt.Sprintf("Storage quota of %dMB exceeded", config.StorageQuota)}
+		JSONResponse(fr, http.StatusInsufficientStorage, w)
+		return true
+	}
+
+	// If malware was found, return a 422 (Unprocessable Entity) listing
+	// the infected files, they've been quarantined
+	if sre, ok := err.(ScanRejectedError); ok {
+		srr := ScanRejectedResponse{Message: "Malware found in uploaded files", Results: sre.Results}
+		JSONResponse(srr, http.StatusUnprocessableEntity, w)
+		return true
+	}
+
+	if err == ErrScanTooLarge {
+		fr = FailureResponse{Message: "Uploaded files are too large to be scanned"}
+		JSONResponse(fr, http.StatusRequestEntityTooLarge, w)
+		return true
+	}
+
+	if err == ErrScannerUnavailable {
+		fr = FailureResponse{Message: "Uploaded files could not be scanned, try again later"}
+		JSONResponse(fr, http.StatusServiceUnavailable, w)
+		return true
+	}
+
+	return false
+}
+
+// apiEditFileInDirectoryHandler returns a File object representing the
+// specified file to be used on the editor page of the application. A
+// server-renedered preview isn't shown, so we don't generate HTML but
+// just send the raw Markdown
+//
+// GET /api/directories/:directory/documents/:document/files/:filename/edit
+//
+// returns
+//
+// {
+//   "filename": "document_3.md",
+//   "path": "documents",
+//   "author": "Carl Carlson",
+//	 "markdown": "# The quick brown fox\nJumped over *the* lazy dog",
+//	 "html": nil
+//	 "lock": {"username": "lenny", "expires_at": "2017-07-14T12:39:45Z", ...}
+//	 ...
+// }
+//
+// Entering the editor locks the document for the current user. If someone
+// else already holds the lock the file is still returned, but the lock
+// shows who is editing it
+func apiEditFileInDirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	filename := vestigo.Param(r, "file")
+
+	file, err := getRawFile(directory, document, filename)
+
+	if err != nil {
+		Error.Println("Could not update file", err.Error())
+
+		fr = FailureResponse{
+			Message: fmt.Sprintln("Could not update file", file, err.Error()),
+		}
+
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	err = describeFile(file)
+	if err != nil {
+		Warning.Println("Could not describe file", file.FullPath(), err.Error())
+	}
+
+	user := getCurrentUser(r.Context())
+
+	lock, err := acquireLock(directory, document, filename, user)
+	if err == ErrDocumentLocked {
+		Info.Printf("%s is already being edited by %s", file.FullPath(), lock.Username)
+	} else if err != nil {
+		Warning.Println("Could not lock file", file.FullPath(), err.Error())
+	}
+
+	if err == nil || err == ErrDocumentLocked {
+		file.Lock = &lock
+	}
+
+	JSONResponse(file, http.StatusOK, w)
+}
+
+// apiLockFileHandler acquires or extends the current user's lock on a
+// document, the editor calls it periodically as a heartbeat
+//
+// POST /api/directories/:directory/documents/:document/files/:filename/lock
+//
+// returns the lock, with a 423 (Locked) if it's held by someone else
+//
+// {
+//   "id": 3,
+//   "path": "documents/document_3/index.md",
+//   "username": "lenny",
+//   "name": "Lenny Leonard",
+//   "acquired_at": "2017-07-14T12:34:45Z",
+//   "expires_at": "2017-07-14T12:39:45Z"
+// }
+func apiLockFileHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	filename := vestigo.Param(r, "file")
+
+	user := getCurrentUser(r.Context())
+
+	lock, err := acquireLock(directory, document, filename, user)
+	if err == ErrDocumentLocked {
+		JSONResponse(lock, http.StatusLocked, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not lock file", err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not lock file", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(lock, http.StatusOK, w)
+}
+
+// apiUnlockFileHandler releases the current user's lock on a document,
+// called when leaving the editor
+//
+// DELETE /api/directories/:directory/documents/:document/files/:filename/lock
+func apiUnlockFileHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var sr SuccessResponse
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	filename := vestigo.Param(r, "file")
+
+	user := getCurrentUser(r.Context())
+
+	err := releaseLock(directory, document, filename, user)
+	if err == ErrLockNotFound {
+		fr = FailureResponse{Message: "File is not locked"}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err == ErrDocumentLocked {
+		fr = FailureResponse{Message: "File is locked by another user"}
+		JSONResponse(fr, http.StatusForbidden, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not unlock file", err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not unlock file", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	sr = SuccessResponse{Message: "File unlocked"}
+	JSONResponse(sr, http.StatusOK, w)
+}
+
+// apiSaveAutosaveHandler stores the current user's uncommitted changes
+// to a document
+//
+// PUT /api/directories/:directory/documents/:document/files/:filename/autosave
+// {
+//   "base_revision": "abcde12345",
+//   "body": "# The quick brown fox",
+//   "frontmatter": {"title": "Document 3", ...}
+// }
+func apiSaveAutosaveHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var as Autosave
+
+	json.NewDecoder(r.Body).Decode(&as)
+
+	as.Path = vestigo.Param(r, "directory")
+	as.Document = vestigo.Param(r, "document")
+	as.Filename = vestigo.Param(r, "file")
+
+	user := getCurrentUser(r.Context())
+
+	as, err := saveAutosave(as, user)
+	if err == ErrNoBaseRevision {
+		fr = FailureResponse{Message: "No base revision specified"}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not save autosave", err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not save changes", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(as, http.StatusOK, w)
+}
+
+// apiGetAutosaveHandler returns the current user's most recent uncommitted
+// changes to a document so they can be resumed. If the document has been
+// modified since they were started a warning is included
+//
+// GET /api/directories/:directory/documents/:document/files/:filename/autosave
+//
+// returns
+//
+// {
+//   "base_revision": "abcde12345",
+//   "body": "# The quick brown fox",
+//   "frontmatter": {"title": "Document 3", ...},
+//   "saved_at": "2017-07-14T12:34:45Z",
+//   "outdated": true,
+//   "document_changed": true,
+//   "warning": "The document has been modified since these changes were started"
+// }
+func apiGetAutosaveHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	filename := vestigo.Param(r, "file")
+
+	user := getCurrentUser(r.Context())
+
+	as, err := getLatestAutosave(user, filepath.Join(directory, document, filename))
+	if err == ErrAutosaveNotFound {
+		fr = FailureResponse{Message: "No autosaved changes found"}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not retrieve autosave", err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not retrieve changes", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(as, http.StatusOK, w)
+}
+
+// apiDiscardAutosaveHandler removes all of the current user's uncommitted
+// changes to a document
+//
+// DELETE /api/directories/:directory/documents/:document/files/:filename/autosave
+func apiDiscardAutosaveHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var sr SuccessResponse
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	filename := vestigo.Param(r, "file")
+
+	user := getCurrentUser(r.Context())
+
+	discarded, err := discardAutosaves(user, filepath.Join(directory, document, filename))
+	if err != nil {
+		Error.Println("Could not discard autosaves", err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not discard changes", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if discarded == 0 {
+		fr = FailureResponse{Message: "No autosaved changes found"}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	sr = SuccessResponse{Message: fmt.Sprintf("%d autosave(s) discarded", discarded)}
+	JSONResponse(sr, http.StatusOK, w)
+}
+
+// apiCollaborateHandler upgrades the connection to a WebSocket and joins the
+// collaborative editing session for the document. Browsers can't set headers
+// on WebSocket requests, so the token is passed as the access_token param
+//
+// GET /api/directories/:directory/documents/:document/files/:filename/collaborate
+//
+// Messages are JSON objects with a type, on joining the server sends:
+//
+// {"type": "init", "revision": 3, "body": "# The quick...", "participants": [...]}
+//
+// Clients send operations (in ot.js's format) made on top of a revision,
+// cursor positions and, when they're done, a request to save:
+//
+// {"type": "operation", "revision": 3, "operation": [5, "brown ", -3, 20]}
+// {"type": "cursor", "cursor": {"position": 10, "selection_end": 10}}
+// {"type": "save", "message": "Updated intro", "frontmatter": {...}}
+//
+// operations are acknowledged with an ack and relayed to other participants
+// along with presence changes, cursor movements and saves
+func apiCollaborateHandler(w http.ResponseWriter, r *http.Request) {
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	filename := vestigo.Param(r, "file")
+
+	user := getCurrentUser(r.Context())
+
+	// if the upgrade fails a response has already been sent
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		Warning.Println("Could not upgrade connection", err.Error())
+		return
+	}
+
+	c := &collaborator{
+		user: user,
+		conn: conn,
+		send: make(chan CollaborationMessage, collabSendBuffer),
+	}
+
+	go c.writeMessages()
+
+	cs, err := collaborations.join(directory, document, filename, c)
+	if err != nil {
+		Warning.Println("Could not join collaboration session", err.Error())
+		c.deliver(CollaborationMessage{Type: collabError, Message: "Could not open document"})
+		close(c.send)
+		return
+	}
+	defer collaborations.leave(cs, c)
+
+	c.readMessages(cs)
+}
+
+// apiListAutosavesHandler returns all of the current user's uncommitted
+// changes, most recent first
+//
+// GET /api/autosaves
+func apiListAutosavesHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	user := getCurrentUser(r.Context())
+
+	autosaves, err := getAutosaves(user, "")
+	if err != nil {
+		Error.Println("Could not retrieve autosaves", err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not retrieve autosaves", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(autosaves, http.StatusOK, w)
+}
+
+// apiListCommentsHandler returns the comment threads on a document, with
+// their replies. Anchors are moved to match the current version of the
+// document. Threads can be filtered with the resolved parameter
+//
+// GET /api/directories/:directory/documents/:document/files/:file/comments
+// GET /api/directories/:directory/documents/:document/files/:file/comments?resolved=false
+//
+// [
+//   {
+//     "id": 1,
+//     "body": "Should this be a list?",
+//     "anchor": {"start": 24, "end": 38, "line": 3, "quote": "eggs and ham", ...},
+//     "resolved": false,
+//     "replies": [{"id": 2, "parent_id": 1, "body": "Good idea", ...}]
+//   }
+// ]
+func apiListCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	path := filepath.Join(vestigo.Param(r, "directory"), vestigo.Param(r, "document"), vestigo.Param(r, "file"))
+
+	threads, err := getComments(path)
+	if err != nil {
+		Error.Println("Could not retrieve comments", path, err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not retrieve comments", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if resolved := r.URL.Query().Get("resolved"); resolved != "" {
+
+		filtered := []Comment{}
+
+		for _, thread := range threads {
+			if strconv.FormatBool(thread.Resolved) == resolved {
+				filtered = append(filtered, thread)
+			}
+		}
+
+		threads = filtered
+	}
+
+	JSONResponse(threads, http.StatusOK, w)
+}
+
+// apiCreateCommentHandler starts a new comment thread on a document,
+// optionally anchored to a range of its Markdown or a line
+//
+// POST /api/directories/:directory/documents/:document/files/:file/comments
+// {
+//   "body": "Should this be a list?",
+//   "anchor": {"start": 24, "end": 38}
+// }
+func apiCreateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var comment Comment
+
+	path := filepath.Join(vestigo.Param(r, "directory"), vestigo.Param(r, "document"), vestigo.Param(r, "file"))
+
+	json.NewDecoder(r.Body).Decode(&comment)
+
+	err := validate.Struct(comment)
+	if err != nil {
+		errors := validationErrorsToJSON(err)
+		JSONResponse(errors, http.StatusBadRequest, w)
+		return
+	}
+
+	user := getCurrentUser(r.Context())
+
+	comment, err = createComment(path, comment, user)
+	if err == ErrInvalidAnchor {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not create comment", path, err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not create comment", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(comment, http.StatusCreated, w)
+}
+
+// apiReplyToCommentHandler adds a reply to a comment thread
+//
+// POST /api/directories/:directory/documents/:document/files/:file/comments/:id/replies
+// {
+//   "body": "Good idea"
+// }
+func apiReplyToCommentHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var reply Comment
+
+	path := filepath.Join(vestigo.Param(r, "directory"), vestigo.Param(r, "document"), vestigo.Param(r, "file"))
+
+	sid := vestigo.Param(r, "id")
+	id, err := strconv.Atoi(sid)
+	if err != nil {
+		fr = FailureResponse{Message: fmt.Sprintf("Invalid id %s", sid)}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	json.NewDecoder(r.Body).Decode(&reply)
+
+	err = validate.Struct(reply)
+	if err != nil {
+		errors := validationErrorsToJSON(err)
+		JSONResponse(errors, http.StatusBadRequest, w)
+		return
+	}
+
+	user := getCurrentUser(r.Context())
+
+	reply, err = replyToComment(path, id, reply, user)
+	if err == ErrCommentNotFound {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not reply to comment", id, err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not reply to comment", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(reply, http.StatusCreated, w)
+}
+
+// apiResolveCommentHandler marks a comment thread as resolved, deleting
+// the resolution reopens it
+//
+// POST /api/directories/:directory/documents/:document/files/:file/comments/:id/resolve
+// DELETE /api/directories/:directory/documents/:document/files/:file/comments/:id/resolve
+func apiResolveCommentHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	path := filepath.Join(vestigo.Param(r, "directory"), vestigo.Param(r, "document"), vestigo.Param(r, "file"))
+
+	sid := vestigo.Param(r, "id")
+	id, err := strconv.Atoi(sid)
+	if err != nil {
+		fr = FailureResponse{Message: fmt.Sprintf("Invalid id %s", sid)}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	user := getCurrentUser(r.Context())
+
+	thread, err := resolveThread(path, id, r.Method != http.MethodDelete, user)
+	if err == ErrCommentNotFound {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not resolve comment", id, err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not resolve comment", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(thread, http.StatusOK, w)
+}
+
+// apiListSuggestionsHandler returns the changes suggested to a document,
+// oldest first. Pending suggestions include the affected lines before and
+// after the change so they can be shown as a diff, they can be filtered
+// with the status parameter
+//
+// GET /api/directories/:directory/documents/:document/files/:file/suggestions
+// GET /api/directories/:directory/documents/:document/files/:file/suggestions?status=pending
+func apiListSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	path := filepath.Join(vestigo.Param(r, "directory"), vestigo.Param(r, "document"), vestigo.Param(r, "file"))
+
+	suggestions, err := getSuggestions(path, r.URL.Query().Get("status"))
+	if err != nil {
+		Error.Println("Could not retrieve suggestions", path, err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not retrieve suggestions", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(suggestions, http.StatusOK, w)
+}
+
+// apiCreateSuggestionHandler stores a suggested change to a document
+// without modifying it. Start and end are offsets into the Markdown at
+// the base revision
+//
+// POST /api/directories/:directory/documents/:document/files/:file/suggestions
+// {
+//   "base_revision": "9cd5f2e1...",
+//   "start": 24,
+//   "end": 38,
+//   "replacement": "green eggs and ham",
+//   "comment": "Be more specific"
+// }
+func apiCreateSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var suggestion Suggestion
+
+	path := filepath.Join(vestigo.Param(r, "directory"), vestigo.Param(r, "document"), vestigo.Param(r, "file"))
+
+	json.NewDecoder(r.Body).Decode(&suggestion)
+
+	err := validate.Struct(suggestion)
+	if err != nil {
+		errors := validationErrorsToJSON(err)
+		JSONResponse(errors, http.StatusBadRequest, w)
+		return
+	}
+
+	user := getCurrentUser(r.Context())
+
+	suggestion, err = createSuggestion(path, suggestion, user)
+	if err == ErrInvalidAnchor {
+		fr = FailureResponse{Message: "Suggestion is outside the document"}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not create suggestion", path, err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not create suggestion", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(suggestion, http.StatusCreated, w)
+}
+
+// apiAcceptSuggestionHandler applies a suggestion to the document, the
+// commit is authored by the reviewer and committed by the current user
+//
+// POST /api/directories/:directory/documents/:document/files/:file/suggestions/:id/accept
+// {
+//   "message": "Be more specific about breakfast"
+// }
+//
+// returns a SuccessResponse containing the git commit hash or a FailureResponse
+// containing an error message
+func apiAcceptSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var sr SuccessResponse
+	var nc NewCommit
+
+	path := filepath.Join(vestigo.Param(r, "directory"), vestigo.Param(r, "document"), vestigo.Param(r, "file"))
+
+	sid := vestigo.Param(r, "id")
+	id, err := strconv.Atoi(sid)
+	if err != nil {
+		fr = FailureResponse{Message: fmt.Sprintf("Invalid id %s", sid)}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	json.NewDecoder(r.Body).Decode(&nc)
+
+	user := getCurrentUser(r.Context())
+
+	oid, err := acceptSuggestion(path, id, nc.Message, user)
+
+	if err == ErrSuggestionNotFound {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err == ErrOwnSuggestion || err == ErrSuggestionForbidden {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusForbidden, w)
+		return
+	}
+
+	if err == ErrSuggestionClosed || err == ErrSuggestionConflict || err == ErrRepoOutOfSync {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
+	}
+
+	if ble, ok := err.(BrokenLinksError); ok {
+		blr := BrokenLinksResponse{Message: "Document contains broken links", BrokenLinks: ble.References}
+		JSONResponse(blr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not accept suggestion", id, err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not accept suggestion", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	sr = SuccessResponse{
+		Message: "Suggestion accepted",
+		Oid:     oid.String(),
+	}
+
+	JSONResponse(sr, http.StatusOK, w)
+}
+
+// apiRejectSuggestionHandler closes a suggestion without applying it
+//
+// POST /api/directories/:directory/documents/:document/files/:file/suggestions/:id/reject
+func apiRejectSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	path := filepath.Join(vestigo.Param(r, "directory"), vestigo.Param(r, "document"), vestigo.Param(r, "file"))
+
+	sid := vestigo.Param(r, "id")
+	id, err := strconv.Atoi(sid)
+	if err != nil {
+		fr = FailureResponse{Message: fmt.Sprintf("Invalid id %s", sid)}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	user := getCurrentUser(r.Context())
+
+	suggestion, err := rejectSuggestion(path, id, user)
+
+	if err == ErrSuggestionNotFound {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err == ErrSuggestionClosed {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not reject suggestion", id, err.Error())
+		fr = FailureResponse{Message: fmt.Sprintln("Could not reject suggestion", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(suggestion, http.StatusOK, w)
+}
+
+// user functionality 👩🏽‍💻
+
+// apiListUsers
+func apiListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	users, err := allUsers()
+	if err != nil {
+
+		Error.Println("Could not retrieve user list", err.Error())
+
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Could not retrieve list of users"),
+		}
+
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(users, http.StatusOK, w)
+
+}
+
+// apiGetUser
+func apiGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	username := vestigo.Param(r, "username")
+	Debug.Println("Retrieving user", username)
+
+	user, err := getLimitedUserByUsername(username)
+	if err != nil {
+
+		Error.Println("Could not retrieve user", username, err.Error())
+
+		fr = FailureResponse{
+			Message: fmt.Sprintln("Failed to find restricted user", username, err.Error()),
+		}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	JSONResponse(user, http.StatusOK, w)
+}
+
+// apiUpdateUser
+func apiUpdateUserNameHandler(w http.ResponseWriter, r *http.Request) {
+
+	// FIXME add validation!
+	type payload struct {
+		Name string `json:"name"`
+	}
+
+	var params payload
+	var err error
+	var fr FailureResponse
+
+	user := getCurrentUser(r.Context())
+
+	// only updating the name is supported at this time
+
+	json.NewDecoder(r.Body).Decode(&params)
+
+	err = db.UpdateField(&user, "Name", params.Name)
+	if err != nil {
+		fr = FailureResponse{
+			Message: err.Error(),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(SuccessResponse{Message: "User updated"}, http.StatusOK, w)
+}
+
+// apiUpdatePasswordHandler updates the password after confirming that the
+// user knows their current password
+//
+// PATCH /api/settings/password
+//
+// returns
+//
+// {
+//   "current_password": "p455w0rd",
+//   "new_password": "passwORDx123",
+// }
+func apiUpdatePasswordHandler(w http.ResponseWriter, r *http.Request) {
+
+	var fr FailureResponse
+	var err error
+
+	var pl PasswordUpdate
+
+	user := getCurrentUser(r.Context())
+
+	json.NewDecoder(r.Body).Decode(&pl)
+
+	Debug.Println("password update payload", pl)
+
+	err = validate.Struct(pl)
+	if err != nil {
+		JSONResponse(validationErrorsToJSON(err), http.StatusBadRequest, w)
+		return
+	}
+
+	// check current matches old
+	err = user.checkPassword(pl.CurrentPassword)
+	if err != nil {
+		fr = FailureResponse{
+			Message: "Current password is not correct",
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	// everything's ok, update
+	err = user.setPassword(pl.NewPassword)
+	if err != nil {
+		fr = FailureResponse{
+			Message: "Password could not be set",
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(SuccessResponse{Message: "Password updated"}, http.StatusOK, w)
+
+}
+
+func apiUserListPublicKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var user User
+	var fr FailureResponse
+
+	user = getCurrentUser(r.Context())
+
+	type rk struct {
+		ID          int    `json:"id"`
+		Fingerprint string `json:"fingerprint"`
+		Raw         string `json:"raw"`
+		Name        string `json:"name"`
+	}
+
+	upks, err := user.keys()
+	if err != nil {
+		Debug.Println("error", err.Error())
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Cannot retrieve keys belonging to: %s", user.Username),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+	}
+
+	// properly initialise the slice so if empty,
+	// marshalled JSON is a empty array instead of null
+	var keys []rk
+	keys = make([]rk, 0)
+
+	for _, upk := range upks {
+
+		file, err := upk.File()
+		if err != nil {
+			Error.Println("Could not decode key", upk.Fingerprint)
+			continue
+		}
+
+		keys = append(keys, rk{
+			ID:          upk.ID,
+			Name:        upk.Name,
+			Fingerprint: upk.Fingerprint,
+			Raw:         file,
+		})
+	}
+
+	JSONResponse(keys, http.StatusOK, w)
+
+}
+
+func apiUserAddPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	type payload struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}
+
+	var user User
+	var pl payload
+	var err error
+	var sr SuccessResponse
+	var fr FailureResponse
+
+	json.NewDecoder(r.Body).Decode(&pl)
+
+	user = getCurrentUser(r.Context())
+
+	Debug.Println("supplied key:", pl.Key)
+
+	err = user.addPublicKey(pl.Name, pl.Key)
+
+	if err != nil && err.Error() == "already exists" {
+		Error.Println("Key already exists", user.Username, err.Error(), pl.Key)
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Key already exists\n%s", pl.Key),
+		}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Failed to create public key", user.Username, err.Error())
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Cannot set public key for %s", user.Username),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	sr = SuccessResponse{
+		Message: fmt.Sprintf("Public key created for %s", user.Username),
+	}
+
+	JSONResponse(sr, http.StatusOK, w)
+
+}
+
+func apiUserDeletePublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var pkr PublicKey
+	var sr SuccessResponse
+	var fr FailureResponse
+	var user User
+
+	sid := vestigo.Param(r, "id")
+	id, err := strconv.Atoi(sid)
+	if err != nil {
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Invalid id %d", id),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	user = getCurrentUser(r.Context())
+
+	err = db.One("ID", id, &pkr)
+	if err != nil {
+		Warning.Println("Cannot find public key", id)
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Cannot find public key %d", id),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+	if user.ID != pkr.UserID {
+		Warning.Println("Key does not belong to user", id, user)
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Key %d does not belong to you", id),
+		}
+		JSONResponse(fr, http.StatusForbidden, w)
+		return
+	}
+
+	err = db.DeleteStruct(&pkr)
+	if user.ID != pkr.UserID {
+		Error.Println("Could not delete public key", err.Error())
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Could not delete key %d", id),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	// no errors, success!
+	sr = SuccessResponse{
+		Message: fmt.Sprintf("Key %d deleted", id),
+	}
+
+	JSONResponse(sr, http.StatusOK, w)
+
+}
+func apiPublishHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	output, err := buildStaticSite()
+	if err != nil {
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Failed to publish site: %s", err.Error()),
+			Meta:    string(output),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	Info.Println("Site published!")
+
+	type publishResponse struct {
+		Message string `json:"message"`
+		Meta    string `json:"meta"`
 	}
 
 	pr := publishResponse{
@@ -1494,204 +2959,643 @@ func apiPublishHandler(w http.ResponseWriter, r *http.Request) {
 		Meta:    string(output),
 	}
 
-	JSONResponse(pr, http.StatusOK, w)
-
+	JSONResponse(pr, http.StatusOK, w)
+
+}
+
+// Repository data 💁
+
+// GET /api/recent_commits
+//
+// returns the most recent commits made to the repository. Currently hard-coded
+// to 5, but would make sense to accept a param
+//
+// [
+//	  {
+//	    "message": "Changed some stuff",
+//	    "id": "e2da99aa078c",
+//	    "object_type": "blob",
+//	    "author": "Peter Yates"
+//	    "time": "Fri Jul 14 12:34:45 2017 +0100"
+//	  },
+// ]
+func apiGetCommitsHandler(w http.ResponseWriter, r *http.Request) {
+	const qty = 5
+	var fr FailureResponse
+	var commits []Commit
+	var err error
+
+	// TODO manage quantity param
+
+	commits, err = getCommits(qty)
+	if err != nil {
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Failed to retrieve recent commits: %s", err.Error()),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(commits, http.StatusOK, w)
+
+}
+
+// GET /api/link_report
+//
+// checks every link and image in every document at the repository's head,
+// returning the totals along with details of any that are broken
+//
+// {
+//	  "revision": "abcde12345",
+//	  "documents": 12,
+//	  "references": 30,
+//	  "broken": [
+//	    {
+//	      "source": "documents/document_1/index.md",
+//	      "destination": "../document_9",
+//	      "target": "documents/document_9",
+//	      "kind": "link"
+//	    }
+//	  ]
+// }
+func apiGetLinkReportHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	report, err := checkLinks()
+	if err != nil {
+		fr = FailureResponse{
+			Message: fmt.Sprintln("Failed to check links", err.Error()),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(report, http.StatusOK, w)
+
+}
+
+// GET /api/repository_info
+//
+// returns the repositorys head commit's hash, used to ensure subsequent commits
+// aren't applied to an out-of-sync repo
+//
+// [
+//	  {
+//	    "latest_revision": "abcde12345"
+//	  },
+// ]
+func apiGetRepositoryInformationHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var ri RepositoryInfo
+	var err error
+
+	ri, err = getRepositoryInfo()
+	if err != nil {
+		fr = FailureResponse{
+			Message: fmt.Sprintln("Failed to retrieve repository info", err.Error()),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(ri, http.StatusOK, w)
+
+}
+
+func apiGetServerInformationHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var si ServerInfo
+	var err error
+
+	fc, err := countFiles()
+	if err != nil {
+		fr = FailureResponse{
+			Message: fmt.Sprintln("Failed to get file count", err.Error()),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	uc, err := countUsers()
+	if err != nil {
+		fr = FailureResponse{
+			Message: fmt.Sprintln("Failed to get user count", err.Error()),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	cc, err := countCommits()
+	if err != nil {
+		fr = FailureResponse{
+			Message: fmt.Sprintln("Failed to get commits count", err.Error()),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	si = ServerInfo{
+		Title:         config.SiteTitle,
+		Users:         uc,
+		Counts:        fc,
+		Commits:       cc,
+		Host:          config.Host,
+		SSHListenPort: config.SSHListenPort,
+	}
+
+	if err != nil {
+		fr = FailureResponse{
+			Message: fmt.Sprintln("Failed to retrieve server info", err.Error()),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(si, http.StatusOK, w)
+}
+
+// GET /api/commits/:commit_hash
+//
+// returns a single commit containing relevant info plus the list of files
+// and diff information, plus the file's contents before and after the change
+//
+//	{
+//	  "num_deltas": 2,
+//	  "num_added": 1,
+//	  "num_deleted": 1,
+//	  "full_diff": "raw diff text",
+//	  "files": {
+//	    "documents/document_1.md": {
+//	      "old": "the quick brown fox",
+//	      "new": "the thick brown fox"
+//	    }
+//	  },
+//	  "message": "changed quick to thick",
+//	  "author": "Cletus Spuckler",
+//	  "hash": "e2da99aa078c",
+//	  "timestamp": "Fri Jul 14 12:34:45 2017 +0100"
+//	},
+func apiGetCommitHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var hash string
+
+	hash = vestigo.Param(r, "hash")
+
+	cs, err := diffForCommit(hash)
+	if err != nil {
+		Error.Println("Could not find commit", hash, err.Error())
+
+		fr = FailureResponse{
+			Message: fmt.Sprintln("Failed to generate diff for commit", hash, err.Error()),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(cs, http.StatusOK, w)
+}
+
+// GET /api/directories/:directory/documents/:document/files/:filename/history
+//
+// returns the basic commit information for every commit that has
+// affected the specified file
+//
+// [
+//	  {
+//	    "message": "Changed some stuff",
+//	    "id": "e2da99aa078c",
+//	    "object_type": "blob",
+//	    "author": "Peter Yates"
+//	    "time": "Fri Jul 14 12:34:45 2017 +0100"
+//	  },
+// ]
+func apiGetFileHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	filename := vestigo.Param(r, "file")
+
+	path := filepath.Join(directory, document, filename)
+
+	history, err := getFileHistory(path, 10)
+	if err != nil {
+		Error.Println("Could not get file history for file", path)
+
+		fr = FailureResponse{
+			Message: fmt.Sprintln("Could not get file history for file", path),
+		}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	JSONResponse(history, http.StatusOK, w)
+
+}
+
+// apiGetWorkflowHandler returns the configured workflow's states and
+// transitions
+//
+// GET /api/workflow
+func apiGetWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	JSONResponse(currentWorkflow(), http.StatusOK, w)
+}
+
+// apiGetFileWorkflowHandler returns the document's workflow state, the
+// transitions the current user can make and its transition history
+//
+// GET /api/directories/:directory/documents/:document/files/:file/workflow
+//
+// {
+//   "state": "in_review",
+//   "transitions": [{"name": "approve", "from": ["in_review"], "to": "approved"}],
+//   "history": [{"transition": "submit", "from": "draft", "to": "in_review", ...}]
+// }
+func apiGetFileWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	filename := vestigo.Param(r, "file")
+
+	user := getCurrentUser(r.Context())
+
+	status, err := getWorkflowStatus(directory, document, filename, user)
+	if err != nil {
+		fr = FailureResponse{
+			Message: fmt.Sprintf("Could not get workflow status: %s", err.Error()),
+		}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	JSONResponse(status, http.StatusOK, w)
+}
+
+// apiTransitionFileHandler moves a document to a new workflow state
+//
+// POST /api/directories/:directory/documents/:document/files/:file/workflow
+// {
+//   "transition": "approve",
+//   "comment": "Looks good",
+//   "repository_info": {"latest_revision": "9cd5f2e1..."}
+// }
+//
+// returns a SuccessResponse containing the git commit hash or a FailureResponse
+// containing an error message
+func apiTransitionFileHandler(w http.ResponseWriter, r *http.Request) {
+	var wc WorkflowChange
+	var fr FailureResponse
+	var sr SuccessResponse
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	filename := vestigo.Param(r, "file")
+
+	json.NewDecoder(r.Body).Decode(&wc)
+
+	err := validate.Struct(wc)
+	if err != nil {
+		errors := validationErrorsToJSON(err)
+		JSONResponse(errors, http.StatusBadRequest, w)
+		return
+	}
+
+	user := getCurrentUser(r.Context())
+
+	oid, err := transitionDocument(directory, document, filename, wc, user)
+
+	if err == ErrRepoOutOfSync {
+		fr = FailureResponse{Message: "Repository out of sync with commit"}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
+	}
+
+	if err == ErrUnknownTransition {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err == ErrTransitionNotAvailable {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if err == ErrTransitionForbidden {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusForbidden, w)
+		return
+	}
+
+	if err != nil {
+		fr = FailureResponse{Message: fmt.Sprintf("Failed to change workflow state: %s", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	sr = SuccessResponse{
+		Message: "Workflow state changed",
+		Oid:     oid.String(),
+	}
+
+	JSONResponse(sr, http.StatusOK, w)
 }
 
-// Repository data 💁
-
-// GET /api/recent_commits
+// apiGetScheduleHandler lists the publications and withdrawals scheduled
+// by documents' publish_at and unpublish_at, earliest first
 //
-// returns the most recent commits made to the repository. Currently hard-coded
-// to 5, but would make sense to accept a param
+// GET /api/schedule
 //
 // [
-//	  {
-//	    "message": "Changed some stuff",
-//	    "id": "e2da99aa078c",
-//	    "object_type": "blob",
-//	    "author": "Peter Yates"
-//	    "time": "Fri Jul 14 12:34:45 2017 +0100"
-//	  },
+//   {
+//     "path": "documents",
+//     "document": "document_1",
+//     "filename": "index.md",
+//     "action": "publish",
+//     "at": "2018-05-14T09:00:00+01:00"
+//   }
 // ]
-func apiGetCommitsHandler(w http.ResponseWriter, r *http.Request) {
-	const qty = 5
+func apiGetScheduleHandler(w http.ResponseWriter, r *http.Request) {
 	var fr FailureResponse
-	var commits []Commit
-	var err error
-
-	// TODO manage quantity param
 
-	commits, err = getCommits(qty)
+	changes, err := getScheduledChanges()
 	if err != nil {
-		fr = FailureResponse{
-			Message: fmt.Sprintf("Failed to retrieve recent commits: %s", err.Error()),
-		}
+		fr = FailureResponse{Message: fmt.Sprintf("Could not retrieve schedule: %s", err.Error())}
 		JSONResponse(fr, http.StatusBadRequest, w)
 		return
 	}
 
-	JSONResponse(commits, http.StatusOK, w)
-
+	JSONResponse(changes, http.StatusOK, w)
 }
 
-// GET /api/repository_info
+// apiGetOverdueDocumentsHandler lists documents whose review_by date or
+// expiry has passed, grouped by their owner. Supplying an owner param
+// limits the results to that user's documents
 //
-// returns the repositorys head commit's hash, used to ensure subsequent commits
-// aren't applied to an out-of-sync repo
+// GET /api/reviews?owner=mh
 //
 // [
-//	  {
-//	    "latest_revision": "abcde12345"
-//	  },
+//   {
+//     "owner": "mh",
+//     "documents": [
+//       {
+//         "path": "documents",
+//         "document": "document_1",
+//         "filename": "index.md",
+//         "title": "Data protection policy",
+//         "review_by": "2018-05-14",
+//         "overdue": true,
+//         "expired": false
+//       }
+//     ]
+//   }
 // ]
-func apiGetRepositoryInformationHandler(w http.ResponseWriter, r *http.Request) {
+func apiGetOverdueDocumentsHandler(w http.ResponseWriter, r *http.Request) {
 	var fr FailureResponse
-	var ri RepositoryInfo
-	var err error
 
-	ri, err = getRepositoryInfo()
+	owners, err := getOverdueDocuments(r.URL.Query().Get("owner"), time.Now())
 	if err != nil {
-		fr = FailureResponse{
-			Message: fmt.Sprintln("Failed to retrieve repository info", err.Error()),
-		}
+		fr = FailureResponse{Message: fmt.Sprintf("Could not retrieve overdue documents: %s", err.Error())}
 		JSONResponse(fr, http.StatusBadRequest, w)
 		return
 	}
 
-	JSONResponse(ri, http.StatusOK, w)
-
+	JSONResponse(owners, http.StatusOK, w)
 }
 
-func apiGetServerInformationHandler(w http.ResponseWriter, r *http.Request) {
+// apiGetTrashHandler lists the directories and documents deleted within
+// the trash retention period that haven't been restored, most recent first
+//
+// GET /api/trash
+//
+// [
+//   {
+//     "type": "document",
+//     "path": "documents/document_1",
+//     "title": "Document 1",
+//     "files": ["documents/document_1/index.md", "documents/document_1/images/cat.jpg"],
+//     "oid": "3a9bd3d42c4c1ab7cbbd4a9a50e5b8d0fa6a1f0c",
+//     "message": "File deleted documents/document_1/index.md",
+//     "deleted_by": "Martin Prince",
+//     "deleted_at": "2018-05-14T09:00:00+01:00"
+//   }
+// ]
+func apiGetTrashHandler(w http.ResponseWriter, r *http.Request) {
 	var fr FailureResponse
-	var si ServerInfo
-	var err error
 
-	fc, err := countFiles()
+	items, err := getTrash()
 	if err != nil {
-		fr = FailureResponse{
-			Message: fmt.Sprintln("Failed to get file count", err.Error()),
-		}
+		fr = FailureResponse{Message: fmt.Sprintf("Could not retrieve trash: %s", err.Error())}
 		JSONResponse(fr, http.StatusBadRequest, w)
 		return
 	}
 
-	uc, err := countUsers()
+	JSONResponse(items, http.StatusOK, w)
+}
+
+// apiRestoreFromTrashHandler puts back a deleted directory or document
+// along with its attachments and translations
+//
+// POST /api/trash/restore
+//
+// {
+//   "oid": "3a9bd3d42c4c1ab7cbbd4a9a50e5b8d0fa6a1f0c",
+//   "path": "documents/document_1",
+//   "repository_info": {"latest_revision": "6e4ad7fd33e2e1c4a4c0f4f1c1b1ea5b0e8ac6c6"}
+// }
+//
+// returns a SuccessResponse containing the git commit hash, a 404 if the
+// commit didn't delete the path or a 409 if it's since been restored or
+// replaced
+func apiRestoreFromTrashHandler(w http.ResponseWriter, r *http.Request) {
+	var tr TrashRestore
+	var fr FailureResponse
+	var sr SuccessResponse
+
+	json.NewDecoder(r.Body).Decode(&tr)
+
+	err := validate.Struct(tr)
 	if err != nil {
-		fr = FailureResponse{
-			Message: fmt.Sprintln("Failed to get user count", err.Error()),
-		}
-		JSONResponse(fr, http.StatusBadRequest, w)
+		errors := validationErrorsToJSON(err)
+		JSONResponse(errors, http.StatusBadRequest, w)
 		return
 	}
 
-	cc, err := countCommits()
-	if err != nil {
-		fr = FailureResponse{
-			Message: fmt.Sprintln("Failed to get commits count", err.Error()),
-		}
-		JSONResponse(fr, http.StatusBadRequest, w)
+	user := getCurrentUser(r.Context())
+
+	oid, err := restoreFromTrash(tr, user)
+
+	if err == ErrTrashItemNotFound {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusNotFound, w)
 		return
 	}
 
-	si = ServerInfo{
-		Title:         config.SiteTitle,
-		Users:         uc,
-		Counts:        fc,
-		Commits:       cc,
-		Host:          config.Host,
-		SSHListenPort: config.SSHListenPort,
+	if err == ErrTrashItemRestored {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
+	}
+
+	if err == ErrRepoOutOfSync {
+		fr = FailureResponse{Message: "Repository out of sync with commit"}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
 	}
 
 	if err != nil {
-		fr = FailureResponse{
-			Message: fmt.Sprintln("Failed to retrieve server info", err.Error()),
-		}
+		fr = FailureResponse{Message: fmt.Sprintf("Failed to restore %s: %s", tr.Path, err.Error())}
 		JSONResponse(fr, http.StatusBadRequest, w)
 		return
 	}
 
-	JSONResponse(si, http.StatusOK, w)
+	sr = SuccessResponse{
+		Message: "Restored",
+		Oid:     oid.String(),
+	}
+
+	JSONResponse(sr, http.StatusOK, w)
 }
 
-// GET /api/commits/:commit_hash
+// apiGetMediaLibraryHandler lists every file in the repository that isn't
+// a document. Identical files stored in more than one place are listed
+// once, along with the documents that refer to any of them
 //
-// returns a single commit containing relevant info plus the list of files
-// and diff information, plus the file's contents before and after the change
+// GET /api/media?category=images
 //
-//	{
-//	  "num_deltas": 2,
-//	  "num_added": 1,
-//	  "num_deleted": 1,
-//	  "full_diff": "raw diff text",
-//	  "files": {
-//	    "documents/document_1.md": {
-//	      "old": "the quick brown fox",
-//	      "new": "the thick brown fox"
-//	    }
-//	  },
-//	  "message": "changed quick to thick",
-//	  "author": "Cletus Spuckler",
-//	  "hash": "e2da99aa078c",
-//	  "timestamp": "Fri Jul 14 12:34:45 2017 +0100"
-//	},
-func apiGetCommitHandler(w http.ResponseWriter, r *http.Request) {
+// [
+//   {
+//     "oid": "9c7c1b8b8e8a4d9ab2c0e4f37c5f4a2e8ae0c3d1",
+//     "filename": "cat.jpg",
+//     "extension": ".jpg",
+//     "filetype": "image/jpeg",
+//     "category": "images",
+//     "size": 15018,
+//     "width": 150,
+//     "height": 200,
+//     "paths": ["documents/document_1/images/cat.jpg"],
+//     "used_by": ["documents/document_1/index.md"],
+//     "orphaned": false
+//   }
+// ]
+func apiGetMediaLibraryHandler(w http.ResponseWriter, r *http.Request) {
 	var fr FailureResponse
-	var hash string
 
-	hash = vestigo.Param(r, "hash")
+	category := r.URL.Query().Get("category")
 
-	cs, err := diffForCommit(hash)
+	assets, err := getMediaLibrary(category)
 	if err != nil {
-		Error.Println("Could not find commit", hash, err.Error())
-
-		fr = FailureResponse{
-			Message: fmt.Sprintln("Failed to generate diff for commit", hash, err.Error()),
-		}
+		fr = FailureResponse{Message: fmt.Sprintf("Could not retrieve media: %s", err.Error())}
 		JSONResponse(fr, http.StatusBadRequest, w)
 		return
 	}
 
-	JSONResponse(cs, http.StatusOK, w)
+	JSONResponse(assets, http.StatusOK, w)
 }
 
-// GET /api/directories/:directory/documents/:document/files/:filename/history
-//
-// returns the basic commit information for every commit that has
-// affected the specified file
+// apiGetOrphanedMediaHandler lists the files that aren't documents and
+// that no document refers to, in the same format as the media library
 //
-// [
-//	  {
-//	    "message": "Changed some stuff",
-//	    "id": "e2da99aa078c",
-//	    "object_type": "blob",
-//	    "author": "Peter Yates"
-//	    "time": "Fri Jul 14 12:34:45 2017 +0100"
-//	  },
-// ]
-func apiGetFileHistoryHandler(w http.ResponseWriter, r *http.Request) {
+// GET /api/media/orphans?category=images
+func apiGetOrphanedMediaHandler(w http.ResponseWriter, r *http.Request) {
 	var fr FailureResponse
 
-	directory := vestigo.Param(r, "directory")
-	document := vestigo.Param(r, "document")
-	filename := vestigo.Param(r, "file")
+	category := r.URL.Query().Get("category")
 
-	path := filepath.Join(directory, document, filename)
+	orphans, err := getOrphanedMedia(category)
+	if err != nil {
+		fr = FailureResponse{Message: fmt.Sprintf("Could not retrieve orphaned media: %s", err.Error())}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
 
-	history, err := getFileHistory(path, 10)
+	JSONResponse(orphans, http.StatusOK, w)
+}
+
+// apiDeleteOrphanedMediaHandler deletes unused media in a single commit,
+// only admins can delete media
+//
+// DELETE /api/admin/media/orphans
+//
+// {
+//   "message": "Tidying up unused images",
+//   "paths": ["documents/document_1/images/old.jpg"],
+//   "repository_info": {"latest_revision": "6e4ad7fd33e2e1c4a4c0f4f1c1b1ea5b0e8ac6c6"}
+// }
+//
+// pass dry_run=true to receive a DryRun listing what would be deleted
+// without committing anything
+//
+// returns a 201 and SuccessResponse containing the git commit hash, a 404
+// if a path isn't media or a 409 if any of it is now referenced by a document
+func apiDeleteOrphanedMediaHandler(w http.ResponseWriter, r *http.Request) {
+	var md MediaDeletion
+	var sr SuccessResponse
+
+	json.NewDecoder(r.Body).Decode(&md)
+
+	err := validate.Struct(md)
 	if err != nil {
-		Error.Println("Could not get file history for file", path)
+		errors := validationErrorsToJSON(err)
+		JSONResponse(errors, http.StatusBadRequest, w)
+		return
+	}
 
-		fr = FailureResponse{
-			Message: fmt.Sprintln("Could not get file history for file", path),
+	user := getCurrentUser(r.Context())
+
+	if r.URL.Query().Get("dry_run") == "true" {
+
+		dr, err := previewDeleteOrphanedMedia(md, user)
+		if err != nil {
+			mediaDeletionFailure(err, w)
+			return
 		}
-		JSONResponse(fr, http.StatusBadRequest, w)
+
+		JSONResponse(dr, http.StatusOK, w)
 		return
 	}
 
-	JSONResponse(history, http.StatusOK, w)
+	oid, err := deleteOrphanedMedia(md, user)
+	if err != nil {
+		mediaDeletionFailure(err, w)
+		return
+	}
+
+	sr = SuccessResponse{
+		Message: "Deleted",
+		Oid:     oid.String(),
+	}
+
+	JSONResponse(sr, http.StatusCreated, w)
+}
+
+// mediaDeletionFailure responds with the status matching the reason
+// media couldn't be deleted
+func mediaDeletionFailure(err error, w http.ResponseWriter) {
+	var fr FailureResponse
+
+	if err == ErrMediaNotFound {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err == ErrMediaInUse {
+		fr = FailureResponse{Message: err.Error()}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
+	}
+
+	if err == ErrRepoOutOfSync {
+		fr = FailureResponse{Message: "Repository out of sync with commit"}
+		JSONResponse(fr, http.StatusConflict, w)
+		return
+	}
 
+	fr = FailureResponse{Message: fmt.Sprintf("Failed to delete media: %s", err.Error())}
+	JSONResponse(fr, http.StatusBadRequest, w)
 }
 
 // GET /api/history
@@ -1804,3 +3708,71 @@ func apiGetLanguageInformationHandler(w http.ResponseWriter, r *http.Request) {
 	JSONResponse(li, http.StatusOK, w)
 
 }
+
+// apiGetOutdatedTranslationsHandler lists translations whose source
+// document has changed since they were translated, along with the
+// changes made to the source
+//
+// GET /api/translations/outdated
+func apiGetOutdatedTranslationsHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	outdated, err := getOutdatedTranslations()
+
+	if err == ErrTranslationNotEnabled {
+		fr = FailureResponse{Message: "Translation is not enabled"}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not find outdated translations", err.Error())
+		fr = FailureResponse{Message: "Could not find outdated translations"}
+		JSONResponse(fr, http.StatusInternalServerError, w)
+		return
+	}
+
+	JSONResponse(outdated, http.StatusOK, w)
+}
+
+// apiGetTranslationStatusHandler returns whether the translation has
+// kept up with its source and, if it hasn't, the source's diff since the
+// revision it was translated from
+//
+// GET /api/directories/:directory/documents/:document/files/:file/translation_status
+func apiGetTranslationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	directory := vestigo.Param(r, "directory")
+	document := vestigo.Param(r, "document")
+	filename := vestigo.Param(r, "file")
+
+	ts, err := getTranslationStatus(directory, document, filename)
+
+	if err == ErrTranslationNotEnabled {
+		fr = FailureResponse{Message: "Translation is not enabled"}
+		JSONResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	if err == ErrNotTranslation {
+		fr = FailureResponse{Message: "File is not a translation"}
+		JSONResponse(fr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if err == ErrDocumentNotFound {
+		fr = FailureResponse{Message: "Translation not found"}
+		JSONResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not check translation", filename, err.Error())
+		fr = FailureResponse{Message: "Could not check translation"}
+		JSONResponse(fr, http.StatusInternalServerError, w)
+		return
+	}
+
+	JSONResponse(ts, http.StatusOK, w)
+}
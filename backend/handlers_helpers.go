@@ -2,11 +2,39 @@ package main
 
 import (
 	"encoding/json"
+	"mime"
 	"net/http"
 	"path/filepath"
 	"strings"
 )
 
+// inlineMediaTypes are the raster image formats attachments can safely be
+// displayed as, anything else might be run by the browser (HTML, SVG,
+// XML) so is downloaded instead
+var inlineMediaTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// attachmentHeaders prevents user-uploaded files being run on the app's
+// origin, the browser must use the supplied type and can't run scripts
+// in what it's served
+func attachmentHeaders(w http.ResponseWriter, attachment Attachment) {
+
+	w.Header().Set("Content-Type", attachment.MediaType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+
+	if !contains(inlineMediaTypes, attachment.MediaType) {
+
+		// filenames that can't be encoded are left for the browser to
+		// work out from the URL
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})
+		if disposition == "" {
+			disposition = "attachment"
+		}
+
+		w.Header().Set("Content-Disposition", disposition)
+	}
+}
+
 // JSONResponse is a helper function to jsonify and send a response
 func JSONResponse(response interface{}, status int, w http.ResponseWriter) {
 
@@ -32,8 +60,14 @@ func hasImageExt(uri string) bool {
 }
 
 func extractImagePath(uri string) string {
+	return filepath.Join(config.Repository, extractRepositoryPath(uri))
+}
+
+// extractRepositoryPath converts a URI, as requested by a browser viewing a
+// document in the CMS, to a path relative to the root of the repository
+func extractRepositoryPath(uri string) string {
 
-	var imagePath = []string{config.Repository}
+	var parts []string
 
 	// append the parts of the path required to serve the file
 	// from any point in the hierarchy
@@ -52,9 +86,9 @@ func extractImagePath(uri string) string {
 			part = strings.TrimSuffix(part, ".md")
 		}
 
-		imagePath = append(imagePath, part)
+		parts = append(parts, part)
 
 	}
 
-	return filepath.Join(imagePath...)
+	return filepath.Join(parts...)
 }
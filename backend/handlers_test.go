@@ -5,11 +5,14 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"image"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/gliderlabs/ssh"
@@ -460,6 +463,59 @@ func TestApiCreateFileInDirectoryNoRepoInfo(t *testing.T) {
 
 }
 
+func TestApiCreateFileInDirectoryBrokenLinks(t *testing.T) {
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/create_file_broken_links"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	config.ValidateLinksOnCommit = true
+	defer func() { config.ValidateLinksOnCommit = false }()
+
+	target := fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/documents")
+
+	ncf := NewCommitFile{
+		Path:        "documents",
+		Document:    "document_6",
+		Filename:    "index.md",
+		Body:        "Read [document 9](../document_9) first",
+		FrontMatter: FrontMatter{Title: "Document Six"},
+	}
+
+	nc := &NewCommit{
+		Message:        "Forty whacks with a wet noodle",
+		Files:          []NewCommitFile{ncf},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	payload, err := json.Marshal(nc)
+	if err != nil {
+		panic(err)
+	}
+
+	client := &http.Client{}
+
+	req, _ := http.NewRequest("POST", target, bytes.NewBuffer(payload))
+
+	resp, _ := client.Do(req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	var receiver BrokenLinksResponse
+
+	json.NewDecoder(resp.Body).Decode(&receiver)
+
+	assert.Equal(t, "Document contains broken links", receiver.Message)
+	assert.Equal(t, 1, len(receiver.BrokenLinks))
+	assert.Equal(t, "documents/document_9", receiver.BrokenLinks[0].Target)
+
+	// ensure nothing was committed
+	repo, _ := repository(config)
+	hc, _ := headCommit(repo)
+	assert.Equal(t, lr.String(), hc.Id().String())
+
+}
+
 func TestApiCreateFileInDirectoryWithErrors(t *testing.T) {
 	server = createTestServerWithContext(false)
 
@@ -937,6 +993,63 @@ func TestApiDeleteFileFromDirectory(t *testing.T) {
 
 }
 
+func TestApiDeleteReferencedFileFromDirectory(t *testing.T) {
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/delete_referenced_file"
+	oid, _ := setupBacklinksTestRepo(repoPath)
+
+	target := fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/documents/document_1/files/index.md")
+
+	nc := &NewCommit{
+		Files: []NewCommitFile{
+			NewCommitFile{Filename: "index.md", Document: "document_1", Path: "documents"},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: oid.String()},
+	}
+
+	payload, err := json.Marshal(nc)
+	if err != nil {
+		panic(err)
+	}
+
+	client := &http.Client{}
+
+	t.Run("Refused", func(t *testing.T) {
+
+		req, _ := http.NewRequest("DELETE", target, bytes.NewBuffer(payload))
+
+		resp, _ := client.Do(req)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+		var receiver BrokenLinksResponse
+
+		json.NewDecoder(resp.Body).Decode(&receiver)
+
+		assert.Equal(t, "File is referenced by other documents", receiver.Message)
+		if assert.Len(t, receiver.BrokenLinks, 1) {
+			assert.Equal(t, "documents/document_4/index.md", receiver.BrokenLinks[0].Source)
+		}
+
+		_, err = os.Stat(filepath.Join(repoPath, "documents", "document_1", "index.md"))
+		assert.Nil(t, err)
+	})
+
+	t.Run("Forced", func(t *testing.T) {
+
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s?force=true", target), bytes.NewBuffer(payload))
+
+		resp, _ := client.Do(req)
+
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		_, err = os.Stat(filepath.Join(repoPath, "documents", "document_1", "index.md"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+}
+
 func TestApiDeleteFileAndAttachmentsFromDirectory(t *testing.T) {
 	var err error
 
@@ -1402,6 +1515,204 @@ func TestApiEditFileInDirectory(t *testing.T) {
 
 }
 
+func TestApiEditFileInDirectoryLocks(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/edit_file_locks"
+	setupSmallTestRepo(repoPath)
+
+	db.Drop("DocumentLock")
+
+	base := fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/documents")
+
+	t.Run("Editing acquires a lock", func(t *testing.T) {
+
+		resp, _ := http.Get(fmt.Sprintf("%s/document_3/files/index.md/edit", base))
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var file File
+
+		json.NewDecoder(resp.Body).Decode(&file)
+
+		if assert.NotNil(t, file.Lock) {
+			assert.Equal(t, apiTestUser().Username, file.Lock.Username)
+		}
+	})
+
+	t.Run("Editing a document locked by someone else", func(t *testing.T) {
+
+		acquireLock("documents", "document_2", "index.md", ds)
+
+		resp, _ := http.Get(fmt.Sprintf("%s/document_2/files/index.md/edit", base))
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var file File
+
+		json.NewDecoder(resp.Body).Decode(&file)
+
+		if assert.NotNil(t, file.Lock) {
+			assert.Equal(t, ds.Username, file.Lock.Username)
+		}
+
+		// heartbeats from another user are refused
+		resp, _ = http.Post(fmt.Sprintf("%s/document_2/files/index.md/lock", base), "application/json", nil)
+		assert.Equal(t, http.StatusLocked, resp.StatusCode)
+	})
+
+	t.Run("Heartbeat and release", func(t *testing.T) {
+
+		target := fmt.Sprintf("%s/document_1/files/index.md/lock", base)
+
+		resp, _ := http.Post(target, "application/json", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		client := &http.Client{}
+		req, _ := http.NewRequest("DELETE", target, nil)
+
+		resp, _ = client.Do(req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, _ = client.Do(req)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+}
+
+func TestApiAutosaveHandlers(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/autosave_handlers"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	db.Drop("Autosave")
+
+	target := fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/documents/document_1/files/index.md/autosave")
+	client := &http.Client{}
+
+	t.Run("Nothing saved", func(t *testing.T) {
+		resp, _ := http.Get(target)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Save", func(t *testing.T) {
+
+		payload, _ := json.Marshal(Autosave{
+			BaseRevision: lr.String(),
+			Body:         "Hi, Super Nintendo Chalmers!",
+			FrontMatter:  FrontMatter{Title: "Document 1"},
+		})
+
+		req, _ := http.NewRequest("PUT", target, bytes.NewBuffer(payload))
+		resp, _ := client.Do(req)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+
+		resp, _ := http.Get(target)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var as Autosave
+		json.NewDecoder(resp.Body).Decode(&as)
+
+		assert.Equal(t, "Hi, Super Nintendo Chalmers!", as.Body)
+		assert.Equal(t, "Document 1", as.FrontMatter.Title)
+		assert.Equal(t, "documents/document_1/index.md", as.FullPath())
+		assert.False(t, as.Outdated)
+	})
+
+	t.Run("List", func(t *testing.T) {
+
+		resp, _ := http.Get(fmt.Sprintf("%s/%s", server.URL, "api/autosaves"))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var autosaves []Autosave
+		json.NewDecoder(resp.Body).Decode(&autosaves)
+
+		assert.Len(t, autosaves, 1)
+	})
+
+	t.Run("Discard", func(t *testing.T) {
+
+		req, _ := http.NewRequest("DELETE", target, nil)
+
+		resp, _ := client.Do(req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, _ = client.Do(req)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+}
+
+func Test_apiGetDocumentHandler(t *testing.T) {
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/get_document"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	nc := NewCommit{
+		Message: "Add document 4",
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Filename:    "index.md",
+				Document:    "document_4",
+				Path:        "documents",
+				Body:        "# Document 4",
+				FrontMatter: FrontMatter{Title: "Document 4"},
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	_, err := createFiles(nc, sb)
+	if err != nil {
+		panic(err)
+	}
+
+	created, _ := getRawFile("documents", "document_4", "index.md")
+
+	t.Run("Found", func(t *testing.T) {
+
+		target := fmt.Sprintf("%s/api/documents/%s", server.URL, created.FrontMatter.ID)
+
+		resp, _ := http.Get(target)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var file File
+
+		json.NewDecoder(resp.Body).Decode(&file)
+
+		assert.Equal(t, "index.md", file.Filename)
+		assert.Equal(t, "document_4", file.Document)
+		assert.Equal(t, "documents", file.Path)
+		assert.Equal(t, created.FrontMatter.ID, file.FrontMatter.ID)
+		assert.Contains(t, *file.HTML, "<h1>Document 4</h1>")
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+
+		target := fmt.Sprintf("%s/api/documents/%s", server.URL, "not-a-real-id")
+
+		resp, _ := http.Get(target)
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		var fr FailureResponse
+
+		json.NewDecoder(resp.Body).Decode(&fr)
+
+		assert.Equal(t, "No document found with id not-a-real-id", fr.Message)
+	})
+
+}
+
 func TestApiGetAttachmentsHandler(t *testing.T) {
 	server = createTestServerWithContext(false)
 
@@ -1426,38 +1737,44 @@ func TestApiGetAttachmentsHandler(t *testing.T) {
 
 	json.NewDecoder(resp.Body).Decode(&attachments)
 
-	jsonAttachmentContents, _ := ioutil.ReadFile(filepath.Join(repoPath, "appendices", "appendix_1", "data", "data.json"))
-	xmlAttachmentContents, _ := ioutil.ReadFile(filepath.Join(repoPath, "appendices", "appendix_1", "data", "data.xml"))
-	pngAttachmentContents, _ := ioutil.ReadFile(filepath.Join(repoPath, "appendices", "appendix_1", "images", "image_1.png"))
-	jpegAttachmentContents, _ := ioutil.ReadFile(filepath.Join(repoPath, "appendices", "appendix_1", "images", "image_2.jpg"))
+	// only metadata is returned, the blob's identifier is checked
+	// separately as it's the one thing we can't predict
+	for i := range attachments {
+		assert.Len(t, attachments[i].Oid, 40)
+		attachments[i].Oid = ""
+	}
 
 	expectedAttachments := []Attachment{
 		Attachment{
 			Path:      "appendices/appendix_1/data",
 			Extension: ".json",
 			MediaType: "text/json",
-			Data:      base64.StdEncoding.EncodeToString(jsonAttachmentContents),
+			Size:      305,
 			Filename:  "data.json",
 		},
 		Attachment{
 			Path:      "appendices/appendix_1/data",
 			Extension: ".xml",
 			MediaType: "text/xml",
-			Data:      base64.StdEncoding.EncodeToString(xmlAttachmentContents),
+			Size:      304,
 			Filename:  "data.xml",
 		},
 		Attachment{
 			Path:      "appendices/appendix_1/images",
 			Extension: ".png",
 			MediaType: "image/png",
-			Data:      base64.StdEncoding.EncodeToString(pngAttachmentContents),
+			Size:      25622,
+			Width:     150,
+			Height:    171,
 			Filename:  "image_1.png",
 		},
 		Attachment{
 			Path:      "appendices/appendix_1/images",
 			Extension: ".jpg",
 			MediaType: "image/jpeg",
-			Data:      base64.StdEncoding.EncodeToString(jpegAttachmentContents),
+			Size:      15018,
+			Width:     150,
+			Height:    200,
 			Filename:  "image_2.jpg",
 		},
 	}
@@ -1494,6 +1811,217 @@ func TestApiGetAttachmentsNoDirectoryHandler(t *testing.T) {
 
 }
 
+func TestApiGetAttachmentHandler(t *testing.T) {
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/get_attachment_handler"
+	setupMultipleFiletypesTestRepo(repoPath)
+
+	target := fmt.Sprintf(
+		"%s/%s",
+		server.URL,
+		"api/directories/appendices/documents/appendix_1/attachments/images/image_1.png",
+	)
+
+	contents, _ := ioutil.ReadFile(filepath.Join(repoPath, "appendices", "appendix_1", "images", "image_1.png"))
+
+	var etag string
+
+	t.Run("Whole file", func(t *testing.T) {
+		resp, _ := http.Get(target)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+		assert.Empty(t, resp.Header.Get("Content-Disposition"))
+
+		etag = resp.Header.Get("ETag")
+		assert.NotEmpty(t, etag)
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, contents, body)
+	})
+
+	t.Run("Unchanged", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", target, nil)
+		req.Header.Set("If-None-Match", etag)
+
+		resp, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", target, nil)
+		req.Header.Set("Range", "bytes=0-15")
+
+		resp, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, contents[:16], body)
+	})
+
+	t.Run("Downloaded unless a raster image", func(t *testing.T) {
+		resp, _ := http.Get(fmt.Sprintf("%s/api/directories/appendices/documents/appendix_1/attachments/data/data.xml", server.URL))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+		assert.Equal(t, `attachment; filename=data.xml`, resp.Header.Get("Content-Disposition"))
+		assert.Contains(t, resp.Header.Get("Content-Security-Policy"), "sandbox")
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		for _, path := range []string{"images/image_9.png", "index.md", "images"} {
+			resp, _ := http.Get(fmt.Sprintf("%s/api/directories/appendices/documents/appendix_1/attachments/%s", server.URL, path))
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+		}
+	})
+}
+
+func TestApiGetThumbnailHandler(t *testing.T) {
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/get_thumbnail_handler"
+	setupMultipleFiletypesTestRepo(repoPath)
+
+	config.ThumbnailCache = "../tests/tmp/thumbnails_handler"
+	defer func() { config.ThumbnailCache = "" }()
+
+	target := func(path string) string {
+		return fmt.Sprintf("%s/api/directories/appendices/documents/appendix_1/thumbnails/%s", server.URL, path)
+	}
+
+	resp, _ := http.Get(target("images/image_2.jpg?size=50"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/jpeg", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+
+	ic, _, err := image.DecodeConfig(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, 38, ic.Width)
+	assert.Equal(t, 50, ic.Height)
+
+	resp, _ = http.Get(target("data/data.json"))
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp, _ = http.Get(target("images/image_9.jpg"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestApiGetMediaLibraryHandler(t *testing.T) {
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/get_media_library_handler"
+	setupMediaTestRepo(repoPath)
+
+	var assets []MediaAsset
+
+	resp, _ := http.Get(fmt.Sprintf("%s/api/media?category=structured+data", server.URL))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	json.NewDecoder(resp.Body).Decode(&assets)
+	assert.Len(t, assets, 2)
+	for _, asset := range assets {
+		assert.Equal(t, "structured data", asset.Category)
+		assert.True(t, asset.Orphaned)
+	}
+
+	resp, _ = http.Get(fmt.Sprintf("%s/api/media/orphans?category=images", server.URL))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	json.NewDecoder(resp.Body).Decode(&assets)
+	assert.Len(t, assets, 3)
+}
+
+func TestApiGetDataPreviewHandler(t *testing.T) {
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/get_data_preview_handler"
+	setupMultipleFiletypesTestRepo(repoPath)
+
+	target := func(path string) string {
+		return fmt.Sprintf("%s/api/directories/documents/documents/document_1/data/%s", server.URL, path)
+	}
+
+	var dp DataPreview
+
+	resp, _ := http.Get(target("data/data_1.csv?page=3&per_page=2"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	json.NewDecoder(resp.Body).Decode(&dp)
+	assert.True(t, dp.Valid)
+	assert.Equal(t, 3, dp.Page)
+	assert.Equal(t, [][]string{{"13 ", "14  ", "15"}, {"16 ", "17  ", "18"}}, dp.Rows)
+
+	resp, _ = http.Get(target("images/image_1.gif"))
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp, _ = http.Get(target("data/data_9.csv"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestApiUpdateDataFileHandler(t *testing.T) {
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/update_data_file_handler"
+	target := fmt.Sprintf("%s/api/directories/documents/documents/document_1/data/data/data_1.csv", server.URL)
+
+	patch := func(du DataUpdate, query string) *http.Response {
+		payload, _ := json.Marshal(du)
+		req, _ := http.NewRequest("PATCH", target+query, bytes.NewBuffer(payload))
+		resp, _ := http.DefaultClient.Do(req)
+		return resp
+	}
+
+	lr, _ := setupMultipleFiletypesTestRepo(repoPath)
+
+	du := DataUpdate{
+		Message:        "Add the next row",
+		Contents:       "a,b,c\n1,2,3\n4,5,6\n",
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	t.Run("Dry run", func(t *testing.T) {
+		invalid := du
+		invalid.Contents = "a,b,c\n1,2\n"
+
+		resp := patch(invalid, "?dry_run=true")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var dp DataPreview
+		json.NewDecoder(resp.Body).Decode(&dp)
+		assert.False(t, dp.Valid)
+		assert.Equal(t, 2, dp.Errors[0].Line)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		invalid := du
+		invalid.Contents = "a,b,c\n\"1,2,3\n"
+
+		resp := patch(invalid, "")
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+		var dvr DataValidationResponse
+		json.NewDecoder(resp.Body).Decode(&dvr)
+		assert.Len(t, dvr.Errors, 1)
+	})
+
+	t.Run("No message", func(t *testing.T) {
+		unexplained := du
+		unexplained.Message = ""
+		assert.Equal(t, http.StatusBadRequest, patch(unexplained, "").StatusCode)
+	})
+
+	t.Run("Updated", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, patch(du, "").StatusCode)
+
+		_, contents, _ := getAttachment("documents", "document_1", "data/data_1.csv")
+		assert.Equal(t, du.Contents, string(contents))
+	})
+
+	t.Run("Out of sync", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, patch(du, "").StatusCode)
+	})
+}
+
 func TestApiUpdateDirectoriesHandler(t *testing.T) {
 	server = createTestServerWithContext(false)
 
@@ -1773,6 +2301,27 @@ func Test_apiGetRepositoryInformationHandler(t *testing.T) {
 
 }
 
+func Test_apiGetLinkReportHandler(t *testing.T) {
+	server = createTestServerWithContext(false)
+
+	gitRepoPath := "../tests/tmp/repositories/link_report"
+	oid, _ := setupSmallTestRepo(gitRepoPath)
+
+	target := fmt.Sprintf("%s/%s", server.URL, "api/link_report")
+
+	resp, _ := http.Get(target)
+
+	var report LinkReport
+
+	json.NewDecoder(resp.Body).Decode(&report)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, oid.String(), report.Revision)
+	assert.Equal(t, 0, report.References)
+	assert.Equal(t, []Reference{}, report.Broken)
+
+}
+
 func Test_apiGetLanguageInformationHandlerTranslationDisabled(t *testing.T) {
 
 	var translationDisabled = "../tests/data/config/translation-disabled.yml"
@@ -2413,3 +2962,563 @@ func Test_apiGetServerInformationHandler(t *testing.T) {
 	assert.Equal(t, 6, si.Counts["documents"])
 
 }
+
+func TestApiReorderDocumentsHandler(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/reorder_documents_handler"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	target := fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/order")
+	client := &http.Client{}
+
+	t.Run("Invalid order", func(t *testing.T) {
+
+		payload, _ := json.Marshal(DocumentOrder{
+			Documents:      []string{"document_2"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		})
+
+		req, _ := http.NewRequest("PUT", target, bytes.NewBuffer(payload))
+		resp, _ := client.Do(req)
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+
+		payload, _ := json.Marshal(DocumentOrder{
+			Documents:      []string{"document_2", "document_3", "document_1"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		})
+
+		req, _ := http.NewRequest("PUT", target, bytes.NewBuffer(payload))
+		resp, _ := client.Do(req)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var sr SuccessResponse
+		json.NewDecoder(resp.Body).Decode(&sr)
+		assert.Equal(t, "Documents reordered", sr.Message)
+
+		resp, _ = http.Get(fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/documents"))
+
+		var listing struct {
+			Files []FileItem `json:"files"`
+		}
+		json.NewDecoder(resp.Body).Decode(&listing)
+
+		assert.Equal(t, []string{"document_2", "document_3", "document_1"}, documentNames(listing.Files))
+	})
+
+}
+
+func TestApiWorkflowHandlers(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/workflow_handlers"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	db.Drop("WorkflowEvent")
+
+	target := fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/documents/document_2/files/index.md/workflow")
+
+	t.Run("Workflow", func(t *testing.T) {
+
+		resp, _ := http.Get(fmt.Sprintf("%s/%s", server.URL, "api/workflow"))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var wf Workflow
+		json.NewDecoder(resp.Body).Decode(&wf)
+		assert.Equal(t, defaultWorkflow.States, wf.States)
+	})
+
+	t.Run("Status", func(t *testing.T) {
+
+		resp, _ := http.Get(target)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var status WorkflowStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+
+		assert.Equal(t, "published", status.State)
+		assert.Empty(t, status.Transitions)
+		assert.Empty(t, status.History)
+	})
+
+	t.Run("Transitions", func(t *testing.T) {
+
+		tests := []struct {
+			transition string
+			status     int
+		}{
+			{transition: "", status: http.StatusBadRequest},
+			{transition: "defenestrate", status: http.StatusBadRequest},
+			{transition: "submit", status: http.StatusUnprocessableEntity},
+			{transition: "unpublish", status: http.StatusForbidden},
+		}
+
+		for _, tt := range tests {
+
+			payload, _ := json.Marshal(WorkflowChange{
+				Transition:     tt.transition,
+				RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+			})
+
+			resp, _ := http.Post(target, "application/json", bytes.NewBuffer(payload))
+			assert.Equal(t, tt.status, resp.StatusCode, tt.transition)
+		}
+	})
+
+	t.Run("Filtering by state", func(t *testing.T) {
+
+		resp, _ := http.Get(fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/documents?state=draft"))
+
+		var listing struct {
+			Files []FileItem `json:"files"`
+		}
+		json.NewDecoder(resp.Body).Decode(&listing)
+
+		assert.Empty(t, listing.Files)
+	})
+}
+
+func TestApiCommentHandlers(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/comment_handlers"
+	setupSmallTestRepo(repoPath)
+
+	db.Drop("Comment")
+
+	target := fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/documents/document_2/files/index.md/comments")
+
+	var thread Comment
+
+	t.Run("Create", func(t *testing.T) {
+
+		payload, _ := json.Marshal(Comment{Body: "Needs a title", Anchor: &CommentAnchor{Line: 1}})
+
+		resp, _ := http.Post(target, "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		json.NewDecoder(resp.Body).Decode(&thread)
+		assert.Equal(t, apiTestUser().Username, thread.Username)
+		file, _ := getRawFile("documents", "document_2", "index.md")
+		assert.Equal(t, strings.SplitN(*file.Markdown, "\n", 2)[0], thread.Anchor.Quote)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+
+		payload, _ := json.Marshal(Comment{Body: "Nowhere", Anchor: &CommentAnchor{Line: 999}})
+		resp, _ := http.Post(target, "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		payload, _ = json.Marshal(Comment{})
+		resp, _ = http.Post(target, "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Reply", func(t *testing.T) {
+
+		payload, _ := json.Marshal(Comment{Body: "Agreed"})
+
+		resp, _ := http.Post(fmt.Sprintf("%s/%d/replies", target, thread.ID), "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp, _ = http.Post(fmt.Sprintf("%s/%d/replies", target, 999), "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Resolve and list", func(t *testing.T) {
+
+		resp, _ := http.Post(fmt.Sprintf("%s/%d/resolve", target, thread.ID), "application/json", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var threads []Comment
+
+		resp, _ = http.Get(fmt.Sprintf("%s?resolved=false", target))
+		json.NewDecoder(resp.Body).Decode(&threads)
+		assert.Len(t, threads, 0)
+
+		resp, _ = http.Get(target)
+		json.NewDecoder(resp.Body).Decode(&threads)
+
+		if assert.Len(t, threads, 1) {
+			assert.True(t, threads[0].Resolved)
+			assert.Len(t, threads[0].Replies, 1)
+		}
+	})
+}
+
+func TestApiSuggestionHandlers(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/suggestion_handlers"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	db.Drop("Suggestion")
+
+	target := fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/documents/document_3/files/index.md/suggestions")
+
+	file, _ := getRawFile("documents", "document_3", "index.md")
+	start := utf16Length((*file.Markdown)[:strings.Index(*file.Markdown, "Lorem ipsum")])
+
+	var own Suggestion
+
+	t.Run("Create", func(t *testing.T) {
+
+		payload, _ := json.Marshal(Suggestion{BaseRevision: lr.String(), Start: start, End: start + 5, Replacement: "Lorum"})
+
+		resp, _ := http.Post(target, "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		json.NewDecoder(resp.Body).Decode(&own)
+		assert.Equal(t, apiTestUser().Username, own.Username)
+		assert.Equal(t, "Lorem", own.Original)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+
+		payload, _ := json.Marshal(Suggestion{BaseRevision: lr.String(), Start: start, End: 99999})
+		resp, _ := http.Post(target, "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		payload, _ = json.Marshal(Suggestion{})
+		resp, _ = http.Post(target, "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+
+		resp, _ := http.Post(fmt.Sprintf("%s/%d/accept", target, own.ID), "application/json", nil)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		other, _ := createSuggestion(
+			"documents/document_3/index.md",
+			Suggestion{BaseRevision: lr.String(), Start: start + 6, End: start + 11, Replacement: "dolor"},
+			ds,
+		)
+
+		resp, _ = http.Post(fmt.Sprintf("%s/%d/accept", target, other.ID), "application/json", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		file, _ := getRawFile("documents", "document_3", "index.md")
+		assert.Contains(t, *file.Markdown, "Lorem dolor dolor sit amet")
+
+		resp, _ = http.Post(fmt.Sprintf("%s/%d/accept", target, other.ID), "application/json", nil)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp, _ = http.Post(fmt.Sprintf("%s/%d/accept", target, 999), "application/json", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Reject and list", func(t *testing.T) {
+
+		resp, _ := http.Post(fmt.Sprintf("%s/%d/reject", target, own.ID), "application/json", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var suggestions []Suggestion
+
+		resp, _ = http.Get(fmt.Sprintf("%s?status=pending", target))
+		json.NewDecoder(resp.Body).Decode(&suggestions)
+		assert.Len(t, suggestions, 0)
+
+		resp, _ = http.Get(target)
+		json.NewDecoder(resp.Body).Decode(&suggestions)
+		assert.Len(t, suggestions, 2)
+	})
+}
+
+func TestApiGetScheduleHandler(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/schedule_handler"
+	setupSmallTestRepo(repoPath)
+
+	target := fmt.Sprintf("%s/%s", server.URL, "api/schedule")
+
+	resp, _ := http.Get(target)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var changes []ScheduledChange
+	json.NewDecoder(resp.Body).Decode(&changes)
+	assert.NotNil(t, changes)
+	assert.Len(t, changes, 0)
+}
+
+func TestApiTrashHandlers(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/trash_handlers"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	lr, _ = deleteFiles(
+		NewCommit{
+			Message:        "Delete document 2",
+			Files:          []NewCommitFile{NewCommitFile{Path: "documents", Document: "document_2", Filename: "index.md"}},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+
+	var items []TrashItem
+
+	t.Run("List", func(t *testing.T) {
+
+		resp, _ := http.Get(fmt.Sprintf("%s/%s", server.URL, "api/trash"))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		json.NewDecoder(resp.Body).Decode(&items)
+
+		if assert.Len(t, items, 1) {
+			assert.Equal(t, "documents/document_2", items[0].Path)
+			assert.Equal(t, lr.String(), items[0].Oid)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+
+		target := fmt.Sprintf("%s/%s", server.URL, "api/trash/restore")
+
+		payload, _ := json.Marshal(TrashRestore{})
+		resp, _ := http.Post(target, "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		restore := TrashRestore{Oid: lr.String(), Path: "documents/document_2", RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}
+
+		payload, _ = json.Marshal(restore)
+		resp, _ = http.Post(target, "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var sr SuccessResponse
+		json.NewDecoder(resp.Body).Decode(&sr)
+
+		// already restored
+		restore.RepositoryInfo.LatestRevision = sr.Oid
+		payload, _ = json.Marshal(restore)
+		resp, _ = http.Post(target, "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		restore.Path = "documents/document_3"
+		payload, _ = json.Marshal(restore)
+		resp, _ = http.Post(target, "application/json", bytes.NewBuffer(payload))
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestApiDeleteDryRun(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/delete_dry_run"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	client := &http.Client{}
+
+	t.Run("Directory", func(t *testing.T) {
+
+		nc := NewCommit{
+			Directories:    []NewCommitDirectory{NewCommitDirectory{Path: "appendices"}},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+
+		payload, _ := json.Marshal(nc)
+		target := fmt.Sprintf("%s/%s?dry_run=true", server.URL, "api/directories/appendices")
+
+		req, _ := http.NewRequest("DELETE", target, bytes.NewBuffer(payload))
+		resp, _ := client.Do(req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var dr DryRun
+		json.NewDecoder(resp.Body).Decode(&dr)
+		assert.Len(t, dr.Paths, 3)
+		assert.Equal(t, 3, dr.Changeset.NumDeleted)
+	})
+
+	t.Run("File", func(t *testing.T) {
+
+		nc := NewCommit{
+			Files:          []NewCommitFile{NewCommitFile{Path: "documents", Document: "document_3", Filename: "index.md"}},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+
+		payload, _ := json.Marshal(nc)
+		target := fmt.Sprintf("%s/%s?dry_run=true", server.URL, "api/directories/documents/documents/document_3/files/index.md")
+
+		req, _ := http.NewRequest("DELETE", target, bytes.NewBuffer(payload))
+		resp, _ := client.Do(req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var dr DryRun
+		json.NewDecoder(resp.Body).Decode(&dr)
+		assert.Equal(t, []string{"documents/document_3/index.md"}, dr.Paths)
+		assert.Contains(t, dr.Changeset.Files["documents/document_3/index.md"].Old, "# Document 3")
+	})
+
+	repo, _ := repository(config)
+	hc, _ := headCommit(repo)
+	assert.Equal(t, lr.String(), hc.Id().String())
+}
+
+func TestApiUploadAttachmentsHandler(t *testing.T) {
+
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/upload_attachments"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	target := fmt.Sprintf("%s/%s", server.URL, "api/directories/documents/documents/document_2/attachments")
+
+	upload := func(nc NewCommit, attachments map[string]string) *http.Response {
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+
+		commit, _ := json.Marshal(nc)
+		mw.WriteField("commit", string(commit))
+
+		for filename, contents := range attachments {
+			fw, _ := mw.CreateFormFile("attachments", filename)
+			fw.Write([]byte(contents))
+		}
+
+		mw.Close()
+
+		resp, _ := http.Post(target, mw.FormDataContentType(), &body)
+		return resp
+	}
+
+	t.Run("Not multipart", func(t *testing.T) {
+		resp, _ := http.Post(target, "application/json", strings.NewReader("{}"))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+
+		nc := NewCommit{Message: "Add photos", RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}
+
+		resp := upload(nc, map[string]string{"kwik-e-mart.jpg": "jpeg", "moes.png": "png"})
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var sr SuccessResponse
+		json.NewDecoder(resp.Body).Decode(&sr)
+		assert.Equal(t, "2 attachment(s) uploaded", sr.Message)
+
+		for _, filename := range []string{"kwik-e-mart.jpg", "moes.png"} {
+			_, err := os.Stat(filepath.Join(repoPath, "documents/document_2/images", filename))
+			assert.Nil(t, err)
+		}
+
+		// and again without updating the revision
+		resp = upload(nc, map[string]string{"krusty-burger.jpg": "jpeg"})
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("Files for other documents", func(t *testing.T) {
+
+		nc := NewCommit{
+			Message:        "Add photos",
+			Files:          []NewCommitFile{NewCommitFile{Path: "documents", Document: "document_3", Filename: "index.md"}},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+
+		resp := upload(nc, map[string]string{"moes.png": "png"})
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Too large", func(t *testing.T) {
+
+		config.MaxAttachmentSize = 1
+		defer func() { config.MaxAttachmentSize = 0 }()
+
+		nc := NewCommit{Message: "Add a huge photo", RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}
+
+		resp := upload(nc, map[string]string{"huge.jpg": strings.Repeat("x", 1024*1024+1)})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("Scanned", func(t *testing.T) {
+
+		_, reset := useFakeClamd(t)
+		defer reset()
+
+		latest := func() string {
+			repo, _ := repository(config)
+			defer repo.Free()
+			lr, _ := getLatestRevision(repo)
+			return lr.String()
+		}
+
+		nc := NewCommit{Message: "Add a virus", RepositoryInfo: RepositoryInfo{LatestRevision: latest()}}
+
+		resp := upload(nc, map[string]string{"virus.txt": eicar})
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+		var srr ScanRejectedResponse
+		json.NewDecoder(resp.Body).Decode(&srr)
+		assert.Equal(t, "Eicar-Test-Signature", srr.Results[0].Signature)
+
+		nc.Message = "Add some notes"
+		resp = upload(nc, map[string]string{"notes.txt": "Don't have a cow, man"})
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var sr SuccessResponse
+		json.NewDecoder(resp.Body).Decode(&sr)
+		assert.Len(t, sr.ScanResults, 1)
+		assert.True(t, sr.ScanResults[0].Clean)
+
+		config.ClamdAddress = "tcp://127.0.0.1:1"
+		nc.RepositoryInfo.LatestRevision = latest()
+		resp = upload(nc, map[string]string{"more-notes.txt": "Eat my shorts"})
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	})
+}
+
+func TestApiGetTranslationStatusHandler(t *testing.T) {
+	server = createTestServerWithContext(false)
+
+	repoPath := "../tests/tmp/repositories/get_translation_status_handler"
+	setupTranslationsTestRepo(repoPath)
+
+	target := func(filename string) string {
+		return fmt.Sprintf("%s/api/directories/documents/documents/document_1/files/%s/translation_status", server.URL, filename)
+	}
+
+	resp, _ := http.Get(target("index.sv.md"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	reset := useMultilingualConfig(repoPath)
+	defer reset()
+
+	var ts TranslationStatus
+
+	// translated before source revisions were recorded
+	resp, _ = http.Get(target("index.sv.md"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	json.NewDecoder(resp.Body).Decode(&ts)
+	assert.Equal(t, "sv", ts.Language)
+	assert.Equal(t, "", ts.TranslatedFrom)
+	assert.False(t, ts.Outdated)
+
+	resp, _ = http.Get(target("index.md"))
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp, _ = http.Get(target("index.fi.md"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	var outdated []TranslationStatus
+
+	resp, _ = http.Get(fmt.Sprintf("%s/api/translations/outdated", server.URL))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	json.NewDecoder(resp.Body).Decode(&outdated)
+	assert.Len(t, outdated, 0)
+}
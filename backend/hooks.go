@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// zeroOid is sent to hooks in place of a ref that doesn't exist
+	zeroOid = "0000000000000000000000000000000000000000"
+
+	// emptyTreeOid is git's well known empty tree, compared against when
+	// a branch is pushed for the first time
+	emptyTreeOid = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+	// storageRemainingEnv passes the pusher's remaining storage quota from
+	// the SSH server to the pre-receive hook, which can't open the database
+	storageRemainingEnv = "GRAPHIA_STORAGE_REMAINING"
+
+	preReceiveHookTemplate = `#!/bin/sh
+# installed by Graphia CMS, enforces upload policies and scans pushes
+exec %q -config %q -pre-receive
+`
+)
+
+// installPreReceiveHook makes git-receive-pack run this binary's
+// pre-receive command before accepting a push to the content repository
+func installPreReceiveHook() error {
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	configPath, err := filepath.Abs(loadedConfigPath)
+	if err != nil {
+		return err
+	}
+
+	hooks := filepath.Join(config.Repository, ".git", "hooks")
+
+	err = os.MkdirAll(hooks, 0755)
+	if err != nil {
+		return err
+	}
+
+	hook := fmt.Sprintf(preReceiveHookTemplate, executable, configPath)
+
+	return ioutil.WriteFile(filepath.Join(hooks, "pre-receive"), []byte(hook), 0755)
+}
+
+// gitCommand runs git from the configured path in dir. Hooks pass an
+// empty dir as git-receive-pack has already set up their environment
+func gitCommand(dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command(filepath.Join(config.GitBinPath, "git"), args...)
+	cmd.Dir = dir
+	return cmd
+}
+
+// parseDiffTree reads the output of git diff-tree -r -z, returning the
+// regular files that were added or changed. Symlinks and submodules
+// aren't attachments so are skipped
+func parseDiffTree(out []byte) (files []IncomingFile) {
+
+	fields := strings.Split(strings.TrimRight(string(out), "\x00"), "\x00")
+
+	for i := 0; i+1 < len(fields); i += 2 {
+
+		// :oldmode newmode oldoid newoid status
+		meta := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+		if len(meta) != 5 {
+			continue
+		}
+
+		if meta[1] != "100644" && meta[1] != "100755" {
+			continue
+		}
+
+		files = append(files, IncomingFile{Path: fields[i+1], Oid: meta[3]})
+	}
+
+	return files
+}
+
+// gitIncomingFiles lists the files added or changed between two revisions
+// using the git executable, which unlike libgit2 can see objects that are
+// still in git-receive-pack's quarantine
+func gitIncomingFiles(dir, oldRev, newRev string) (files []IncomingFile, err error) {
+
+	if oldRev == zeroOid {
+		oldRev = emptyTreeOid
+	}
+
+	out, err := gitCommand(dir, "diff-tree", "-r", "-z", "--no-renames", "--diff-filter=AMT", oldRev, newRev).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	files = parseDiffTree(out)
+	if len(files) == 0 {
+		return files, nil
+	}
+
+	cmd := gitCommand(dir, "cat-file", "--batch")
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	// don't leave git running if the output can't be read
+	defer func() {
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}()
+
+	go func() {
+		for _, file := range files {
+			fmt.Fprintln(stdin, file.Oid)
+		}
+		stdin.Close()
+	}()
+
+	br := bufio.NewReader(stdout)
+
+	for i := range files {
+
+		var header string
+
+		// <oid> blob <size>, followed by the contents and a newline
+		header, err = br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		meta := strings.Fields(header)
+		if len(meta) != 3 {
+			return nil, fmt.Errorf("could not read %s: %s", files[i].Path, strings.TrimSpace(header))
+		}
+
+		files[i].Size, err = strconv.ParseInt(meta[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		head := files[i].Size
+		if head > sniffLength {
+			head = sniffLength
+		}
+
+		files[i].Head = make([]byte, head)
+
+		_, err = io.ReadFull(br, files[i].Head)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.CopyN(ioutil.Discard, br, files[i].Size-head+1)
+		if err != nil {
+			return nil, err
+		}
+
+		// pointers must have had their objects uploaded first
+		files[i], err = resolveLFSIncomingFile(files[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = cmd.Wait()
+
+	return files, err
+}
+
+// gitStoredOids returns the identifiers of every attachment at the
+// revision, none if it doesn't exist yet
+func gitStoredOids(dir, rev string) map[string]bool {
+
+	oids := make(map[string]bool)
+
+	out, err := gitCommand(dir, "ls-tree", "-r", "-z", rev).Output()
+	if err != nil {
+		return oids
+	}
+
+	for _, entry := range bytes.Split(out, []byte{0}) {
+
+		// <mode> <type> <oid>\t<path>
+		parts := strings.SplitN(string(entry), "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		meta := strings.Fields(parts[0])
+		if len(meta) == 3 && meta[1] == "blob" && countsTowardsQuota(parts[1]) {
+			oids[meta[2]] = true
+		}
+	}
+
+	return oids
+}
+
+// preReceiveCommand is run by git-receive-pack with a line for each ref
+// being pushed. Files are checked against the same upload policies and
+// quota as commits made through the API, anything printed to stderr is
+// shown to the person pushing. The return value is the exit status,
+// anything other than zero rejects the push
+func preReceiveCommand(refs io.Reader, stderr io.Writer) int {
+
+	var files []IncomingFile
+
+	scanner := bufio.NewScanner(refs)
+
+	for scanner.Scan() {
+
+		// <old> <new> <ref>
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[1] == zeroOid {
+			continue
+		}
+
+		incoming, err := gitIncomingFiles("", fields[0], fields[1])
+		if err != nil {
+			fmt.Fprintln(stderr, "Could not check", fields[2], err.Error())
+			return 1
+		}
+
+		files = append(files, incoming...)
+	}
+
+	err := checkUploadPolicies(files)
+	if pve, ok := err.(PolicyViolationsError); ok {
+		fmt.Fprintln(stderr, "Push rejected, files break the upload policy:")
+		for _, v := range pve.Violations {
+			fmt.Fprintf(stderr, "  %s: %s\n", v.Path, v.Reason)
+		}
+		return 1
+	}
+
+	err = scanPushedFiles(files)
+	if sre, ok := err.(ScanRejectedError); ok {
+		fmt.Fprintln(stderr, "Push rejected, malware was found:")
+		for _, r := range sre.Results {
+			fmt.Fprintf(stderr, "  %s: %s\n", r.Path, r.Signature)
+		}
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "Push rejected, files could not be scanned:", err.Error())
+		return 1
+	}
+
+	remaining, err := strconv.ParseInt(os.Getenv(storageRemainingEnv), 10, 64)
+	if err != nil || remaining < 0 {
+		return 0
+	}
+
+	if newStorage(files, gitStoredOids("", "HEAD")) > remaining {
+		fmt.Fprintf(stderr, "Push rejected, it would exceed your storage quota of %dMB\n", config.StorageQuota)
+		return 1
+	}
+
+	return 0
+}
+
+// commandReader reads a command's output, closing it waits for the
+// command to finish
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (cr commandReader) Close() error {
+	cr.ReadCloser.Close()
+	return cr.cmd.Wait()
+}
+
+// scanPushedFiles scans the files being pushed, reading them with git
+// which can see the pushed objects before the push is accepted
+func scanPushedFiles(files []IncomingFile) error {
+
+	s, err := contentScanner()
+	if err != nil {
+		return err
+	}
+
+	contents := func(oid string) (io.ReadCloser, error) {
+
+		cmd := gitCommand("", "cat-file", "blob", oid)
+
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+
+		err = cmd.Start()
+		if err != nil {
+			return nil, err
+		}
+
+		return resolveLFSStream(commandReader{ReadCloser: out, cmd: cmd})
+	}
+
+	_, err = scanFiles(s, files, contents, os.Getenv(pusherEnv))
+
+	return err
+}
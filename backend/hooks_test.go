@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseDiffTree(t *testing.T) {
+
+	out := strings.Join([]string{
+		":000000 100644 0000000000000000000000000000000000000000 938add69dee35a74cb8c5371943005100eb9e03a A",
+		"documents/document_1/images/cat.png",
+		":100644 100755 21fb1eca31e64cd3914025058b21992ab76edcf9 a213aa40f11f7af2a9c9e973df599278413060bb M",
+		"scripts/build.sh",
+		":000000 120000 0000000000000000000000000000000000000000 dd0ea36c8eac0bf2448a210f66f18af47ec9320f A",
+		"documents/link",
+		"",
+	}, "\x00")
+
+	assert.Equal(t,
+		[]IncomingFile{
+			IncomingFile{Path: "documents/document_1/images/cat.png", Oid: "938add69dee35a74cb8c5371943005100eb9e03a"},
+			IncomingFile{Path: "scripts/build.sh", Oid: "a213aa40f11f7af2a9c9e973df599278413060bb"},
+		},
+		parseDiffTree([]byte(out)),
+	)
+
+	assert.Empty(t, parseDiffTree([]byte{}))
+}
+
+// setupPushTestRepo commits an image to the small repository, returning
+// the revisions before and after as a push would
+func setupPushTestRepo(repoPath string, image []byte) (before, after string) {
+
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	upload, _ := createBlobFromReader(repo, "cat.png", bytes.NewReader(image), maxAttachmentSize())
+
+	nc := NewCommit{Message: "Add a cat", RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}
+
+	oid, _ := commitUploads("documents", "document_1", []Upload{upload}, nc, mh)
+
+	return lr.String(), oid.String()
+}
+
+func Test_gitIncomingFiles(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/git_incoming_files"
+	before, after := setupPushTestRepo(repoPath, testImage(64, 64, "png"))
+
+	files, err := gitIncomingFiles(repoPath, before, after)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, "documents/document_1/images/cat.png", files[0].Path)
+	assert.True(t, files[0].Size > sniffLength)
+	assert.Len(t, files[0].Head, sniffLength)
+	assert.True(t, contentMatchesExtension(files[0].Path, files[0].Head))
+
+	t.Run("New branch", func(t *testing.T) {
+		files, err := gitIncomingFiles(repoPath, zeroOid, after)
+		assert.Nil(t, err)
+		assert.True(t, len(files) > 1)
+	})
+
+	t.Run("Stored", func(t *testing.T) {
+		oids := gitStoredOids(repoPath, after)
+		assert.True(t, oids[files[0].Oid])
+		assert.Empty(t, gitStoredOids(repoPath, "no-such-revision"))
+	})
+}
+
+func Test_preReceiveCommand(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/pre_receive"
+	before, after := setupPushTestRepo(repoPath, testImage(64, 64, "png"))
+
+	// hooks run with git's environment pointing at the repository
+	gitDir, _ := filepath.Abs(filepath.Join(repoPath, ".git"))
+	os.Setenv("GIT_DIR", gitDir)
+	defer os.Unsetenv("GIT_DIR")
+
+	push := fmt.Sprintf("%s %s refs/heads/master\n", before, after)
+
+	t.Run("Accepted", func(t *testing.T) {
+		var stderr bytes.Buffer
+		assert.Equal(t, 0, preReceiveCommand(strings.NewReader(push), &stderr))
+		assert.Empty(t, stderr.String())
+	})
+
+	t.Run("Breaks policy", func(t *testing.T) {
+		config.UploadPolicies = []UploadPolicy{UploadPolicy{Category: "images", Extensions: []string{".jpg"}}}
+		defer func() { config.UploadPolicies = nil }()
+
+		var stderr bytes.Buffer
+		assert.Equal(t, 1, preReceiveCommand(strings.NewReader(push), &stderr))
+		assert.Contains(t, stderr.String(), "documents/document_1/images/cat.png: '.png' files are not allowed here")
+	})
+
+	t.Run("Deleted branch", func(t *testing.T) {
+		var stderr bytes.Buffer
+		deletion := fmt.Sprintf("%s %s refs/heads/old\n", after, zeroOid)
+		assert.Equal(t, 0, preReceiveCommand(strings.NewReader(deletion), &stderr))
+	})
+
+	t.Run("Over quota", func(t *testing.T) {
+
+		// pre-receive runs before HEAD moves
+		gitCommand(repoPath, "update-ref", "HEAD", before).Run()
+
+		os.Setenv(storageRemainingEnv, "100")
+		defer os.Unsetenv(storageRemainingEnv)
+
+		var stderr bytes.Buffer
+		assert.Equal(t, 1, preReceiveCommand(strings.NewReader(push), &stderr))
+		assert.Contains(t, stderr.String(), "storage quota")
+
+		os.Setenv(storageRemainingEnv, "-1")
+		assert.Equal(t, 0, preReceiveCommand(strings.NewReader(push), &bytes.Buffer{}))
+	})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+var (
+	// ErrDocumentNotFound is returned when no document in the
+	// repository carries the requested identifier
+	ErrDocumentNotFound = errors.New("document not found")
+
+	// documents holds the identifier to location lookup, it is
+	// rebuilt whenever the repository's head moves on
+	documents = &documentIndex{}
+)
+
+// DocumentLocation is where a document with a stable identifier
+// can currently be found in the repository
+type DocumentLocation struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	Document string `json:"document"`
+	Filename string `json:"filename"`
+}
+
+// FullPath constructs the absolute path using the path, document and filename
+func (dl DocumentLocation) FullPath() string {
+	return filepath.Join(dl.Path, dl.Document, dl.Filename)
+}
+
+// documentIndex maps document identifiers to their locations at
+// a given revision
+type documentIndex struct {
+	sync.RWMutex
+	revision  string
+	locations map[string]DocumentLocation
+}
+
+// refresh rebuilds the index from the head tree, unless it's already
+// up to date. Documents can be moved by SSH pushes as well as via the
+// API so the head revision is the only reliable indicator of staleness
+func (di *documentIndex) refresh(repo *git.Repository) error {
+
+	lr, err := getLatestRevision(repo)
+	if err != nil {
+		return err
+	}
+
+	di.Lock()
+	defer di.Unlock()
+
+	if di.revision == lr.String() {
+		return nil
+	}
+
+	locations, err := buildDocumentIndex(repo)
+	if err != nil {
+		return err
+	}
+
+	Debug.Printf("Document index rebuilt at %s with %d entries", lr, len(locations))
+
+	di.locations = locations
+	di.revision = lr.String()
+
+	return nil
+}
+
+func (di *documentIndex) lookup(id string) (dl DocumentLocation, found bool) {
+	di.RLock()
+	defer di.RUnlock()
+
+	dl, found = di.locations[id]
+	return dl, found
+}
+
+// refreshDocumentIndex populates the document index from the repository,
+// it's called on startup so the first lookup isn't slowed down
+func refreshDocumentIndex() error {
+
+	repo, err := repository(config)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	return documents.refresh(repo)
+}
+
+// lookupDocumentByID returns the current location of the document
+// with the supplied identifier
+func lookupDocumentByID(id string) (dl DocumentLocation, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return dl, err
+	}
+	defer repo.Free()
+
+	err = documents.refresh(repo)
+	if err != nil {
+		return dl, err
+	}
+
+	dl, found := documents.lookup(id)
+	if !found {
+		return dl, ErrDocumentNotFound
+	}
+
+	return dl, nil
+}
+
+// buildDocumentIndex walks the head tree reading the frontmatter of every
+// Markdown document, recording where each identifier was found
+func buildDocumentIndex(repo *git.Repository) (locations map[string]DocumentLocation, err error) {
+
+	locations = make(map[string]DocumentLocation)
+
+	err = walkDocuments(repo, func(dl DocumentLocation, fm FrontMatter) {
+
+		if fm.ID == "" {
+			return
+		}
+
+		if existing, found := locations[fm.ID]; found {
+			Warning.Printf(
+				"Duplicate document id %s found at %s and %s, ignoring the latter",
+				fm.ID,
+				existing.FullPath(),
+				dl.FullPath(),
+			)
+			return
+		}
+
+		locations[fm.ID] = dl
+	})
+
+	return locations, err
+}
+
+// walkDocuments calls fn with the location and frontmatter of every
+// Markdown document in the head tree
+func walkDocuments(repo *git.Repository, fn func(dl DocumentLocation, fm FrontMatter)) error {
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return err
+	}
+	defer ht.Free()
+
+	walkIterator := func(root string, te *git.TreeEntry) int {
+
+		if te.Type != git.ObjectBlob {
+			return 0
+		}
+
+		// only documents have frontmatter, directory metadata
+		// files aren't documents
+		if filepath.Ext(te.Name) != ".md" || te.Name == "_index.md" {
+			return 0
+		}
+
+		// files in the root of the repository (README.md) don't
+		// belong to a directory so can't be addressed
+		if root == "" {
+			return 0
+		}
+
+		blob, err := repo.LookupBlob(te.Id)
+		if err != nil {
+			Warning.Println("Failed to find blob", te.Id)
+			return 0
+		}
+		defer blob.Free()
+
+		fm, err := getMetadataFromBlob(blob)
+		if err != nil {
+			return 0
+		}
+
+		directory, document := splitDocumentPath(root)
+
+		fn(
+			DocumentLocation{
+				ID:       fm.ID,
+				Path:     directory,
+				Document: document,
+				Filename: te.Name,
+			},
+			fm,
+		)
+
+		return 0
+	}
+
+	return ht.Walk(walkIterator)
+}
+
+// splitDocumentPath separates a tree walk's root, eg 'documents/document_1/'
+// into its directory and document parts
+func splitDocumentPath(root string) (directory, document string) {
+
+	parts := strings.SplitN(filepath.Clean(root), "/", 2)
+
+	directory = parts[0]
+
+	if len(parts) > 1 {
+		document = parts[1]
+	}
+
+	return directory, document
+}
+
+// existingDocumentID returns the identifier stored in the frontmatter of
+// the file at the supplied path at head, or an empty string if the file
+// doesn't exist or has no identifier
+func existingDocumentID(repo *git.Repository, path string) string {
+
+	fm, found := existingFrontMatter(repo, path)
+	if !found {
+		return ""
+	}
+
+	return fm.ID
+}
+
+// documentIDAt returns the ID of the document at path at head, which is
+// empty for documents that predate identifiers
+func documentIDAt(path string) (string, error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return "", err
+	}
+	defer repo.Free()
+
+	return existingDocumentID(repo, path), nil
+}
+
+// existingFrontMatter reads the frontmatter of the file at the supplied
+// path at head, found is false if it doesn't exist or can't be read
+func existingFrontMatter(repo *git.Repository, path string) (fm FrontMatter, found bool) {
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return fm, false
+	}
+	defer ht.Free()
+
+	entry, err := ht.EntryByPath(path)
+	if err != nil || entry == nil {
+		return fm, false
+	}
+
+	blob, err := repo.LookupBlob(entry.Id)
+	if err != nil {
+		return fm, false
+	}
+	defer blob.Free()
+
+	fm, err = getMetadataFromBlob(blob)
+	if err != nil {
+		return fm, false
+	}
+
+	return fm, true
+}
+
+// assignNewDocumentIDs gives every new document a freshly-generated
+// identifier, anything supplied by the client is ignored so duplicates
+// can't be introduced
+func assignNewDocumentIDs(files []NewCommitFile) {
+	for i := range files {
+		if files[i].isDocument() {
+			files[i].FrontMatter.ID = generateDocumentID()
+		}
+	}
+}
+
+// retainDocumentIDs ensures documents being updated keep the identifier
+// they already have. Documents that predate identifiers are given one
+func retainDocumentIDs(repo *git.Repository, files []NewCommitFile) {
+	for i, ncf := range files {
+
+		if !ncf.isDocument() {
+			continue
+		}
+
+		id := existingDocumentID(repo, filepath.Join(ncf.Path, ncf.Document, ncf.Filename))
+		if id == "" {
+			id = generateDocumentID()
+		}
+
+		files[i].FrontMatter.ID = id
+	}
+}
+
+// generateDocumentID returns a random (version 4) UUID
+func generateDocumentID() string {
+
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		panic("uuid: error reading random bytes: " + err.Error())
+	}
+
+	// set the version (4) and variant (RFC 4122) bits
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
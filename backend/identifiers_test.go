@@ -0,0 +1,257 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+// moveFile emulates a rename carried out outside of the CMS, eg via
+// a git push, by moving a blob to a new path in a single commit
+func moveFile(repo *git.Repository, from, to string, user User) (oid *git.Oid, err error) {
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := ht.EntryByPath(from)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := repo.Index()
+	if err != nil {
+		return nil, err
+	}
+	defer index.Free()
+
+	err = index.RemoveByPath(from)
+	if err != nil {
+		return nil, err
+	}
+
+	ie := git.IndexEntry{Id: entry.Id, Path: to, Mode: git.FilemodeBlob}
+
+	err = index.Add(&ie)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeTreeAndCommit(repo, index, "Moved file", user)
+}
+
+func Test_generateDocumentID(t *testing.T) {
+
+	format := regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$")
+
+	first := generateDocumentID()
+	second := generateDocumentID()
+
+	assert.Regexp(t, format, first)
+	assert.Regexp(t, format, second)
+	assert.NotEqual(t, first, second)
+}
+
+func Test_splitDocumentPath(t *testing.T) {
+
+	tests := []struct {
+		name, root, directory, document string
+	}{
+		{name: "Document", root: "documents/document_1/", directory: "documents", document: "document_1"},
+		{name: "Nested document", root: "documents/document_1/notes/", directory: "documents", document: "document_1/notes"},
+		{name: "Directory only", root: "documents/", directory: "documents", document: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			directory, document := splitDocumentPath(tt.root)
+			assert.Equal(t, tt.directory, directory)
+			assert.Equal(t, tt.document, document)
+		})
+	}
+}
+
+func Test_createFilesAssignsDocumentIDs(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/document_ids_create"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	nc := NewCommit{
+		Message: "Add document 4",
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Filename: "index.md",
+				Document: "document_4",
+				Path:     "documents",
+				Body:     "Me fail English? That's unpossible!",
+				FrontMatter: FrontMatter{
+					Title: "Document 4",
+					ID:    "client-supplied-id",
+				},
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	_, err := createFiles(nc, mh)
+	if err != nil {
+		panic(err)
+	}
+
+	file, err := getRawFile("documents", "document_4", "index.md")
+	if err != nil {
+		panic(err)
+	}
+
+	// the client's id should have been replaced with a generated one
+	assert.NotEqual(t, "client-supplied-id", file.FrontMatter.ID)
+	assert.Len(t, file.FrontMatter.ID, 36)
+
+	dl, err := lookupDocumentByID(file.FrontMatter.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "documents/document_4/index.md", dl.FullPath())
+
+}
+
+func Test_updateFilesRetainsDocumentID(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/document_ids_update"
+	lr, _ := setupSmallTestRepo(repoPath)
+	repo, _ := repository(config)
+
+	ncf := NewCommitFile{
+		Filename:    "index.md",
+		Document:    "document_4",
+		Path:        "documents",
+		Body:        "I bent my Wookiee.",
+		FrontMatter: FrontMatter{Title: "Document 4"},
+	}
+
+	_, err := createFiles(
+		NewCommit{
+			Message:        "Add document 4",
+			Files:          []NewCommitFile{ncf},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	created, _ := getRawFile("documents", "document_4", "index.md")
+	lr, _ = getLatestRevision(repo)
+
+	// the id is omitted from the update's frontmatter
+	ncf.FrontMatter = FrontMatter{Title: "Document 4 (revised)"}
+
+	_, err = updateFiles(
+		NewCommit{
+			Message:        "Update document 4",
+			Files:          []NewCommitFile{ncf},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	updated, _ := getRawFile("documents", "document_4", "index.md")
+
+	assert.Equal(t, "Document 4 (revised)", updated.FrontMatter.Title)
+	assert.Equal(t, created.FrontMatter.ID, updated.FrontMatter.ID)
+
+}
+
+func Test_updateFilesAssignsMissingDocumentID(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/document_ids_update_missing"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	nc := NewCommit{
+		Message: "Update document 3",
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Filename:    "index.md",
+				Document:    "document_3",
+				Path:        "documents",
+				Body:        "Super Nintendo Chalmers!",
+				FrontMatter: FrontMatter{Title: "Document 3"},
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	_, err := updateFiles(nc, mh)
+	if err != nil {
+		panic(err)
+	}
+
+	updated, _ := getRawFile("documents", "document_3", "index.md")
+
+	assert.Len(t, updated.FrontMatter.ID, 36)
+
+}
+
+func Test_lookupDocumentByIDAfterMove(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/document_ids_move"
+	lr, _ := setupSmallTestRepo(repoPath)
+	repo, _ := repository(config)
+
+	nc := NewCommit{
+		Message: "Add document 4",
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Filename:    "index.md",
+				Document:    "document_4",
+				Path:        "documents",
+				Body:        "My cat's breath smells like cat food.",
+				FrontMatter: FrontMatter{Title: "Document 4"},
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	_, err := createFiles(nc, mh)
+	if err != nil {
+		panic(err)
+	}
+
+	created, _ := getRawFile("documents", "document_4", "index.md")
+
+	_, err = moveFile(repo, "documents/document_4/index.md", "appendices/appendix_4/index.md", mh)
+	if err != nil {
+		panic(err)
+	}
+
+	dl, err := lookupDocumentByID(created.FrontMatter.ID)
+
+	assert.Nil(t, err)
+	assert.Equal(
+		t,
+		DocumentLocation{
+			ID:       created.FrontMatter.ID,
+			Path:     "appendices",
+			Document: "appendix_4",
+			Filename: "index.md",
+		},
+		dl,
+	)
+
+}
+
+func Test_lookupDocumentByIDNotFound(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/document_ids_not_found"
+	setupSmallTestRepo(repoPath)
+
+	_, err := lookupDocumentByID("00000000-0000-4000-8000-000000000000")
+
+	assert.Equal(t, ErrDocumentNotFound, err)
+
+}
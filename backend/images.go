@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	defaultJPEGQuality   = 85
+	defaultThumbnailSize = 200 // pixels
+	defaultMaxPixels     = 50  // megapixels
+
+	// maxThumbnailSize stops arbitrarily large thumbnails being requested
+	maxThumbnailSize = 1024
+)
+
+// ErrNotProcessable is returned when asked to process a file that isn't
+// a JPEG or PNG
+var ErrNotProcessable = errors.New("only JPEG and PNG images can be processed")
+
+// ErrImageTooLarge is returned instead of decoding an image with more
+// pixels than allowed, as the decoded image is held in memory
+var ErrImageTooLarge = errors.New("image has too many pixels to be processed")
+
+// exifHeader precedes the TIFF structure holding EXIF in a JPEG's APP1
+var exifHeader = []byte("Exif\x00\x00")
+
+// imageFormat returns the format images with the extension are processed
+// as, GIFs are left alone as they may be animated
+func imageFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".png":
+		return "png"
+	}
+	return ""
+}
+
+func jpegQuality() int {
+	if config.ImageJPEGQuality <= 0 || config.ImageJPEGQuality > 100 {
+		return defaultJPEGQuality
+	}
+	return config.ImageJPEGQuality
+}
+
+func maxImagePixels() int64 {
+	if config.ImageMaxPixels <= 0 {
+		return defaultMaxPixels * 1000000
+	}
+	return int64(config.ImageMaxPixels) * 1000000
+}
+
+func thumbnailCachePath() string {
+	if config.ThumbnailCache == "" {
+		return filepath.Join(os.TempDir(), "graphia-thumbnails")
+	}
+	return config.ThumbnailCache
+}
+
+// fitWithin scales the dimensions down, keeping the aspect ratio, so they
+// don't exceed the maximums. A maximum of zero is no limit
+func fitWithin(width, height, maxWidth, maxHeight int) (int, int) {
+
+	scale := 1.0
+
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+
+	if maxHeight > 0 && float64(height)*scale > float64(maxHeight) {
+		scale = float64(maxHeight) / float64(height)
+	}
+
+	if scale == 1.0 {
+		return width, height
+	}
+
+	w, h := int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	return w, h
+}
+
+func resizeImage(src image.Image, width, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
+
+// decodeImage checks the image's dimensions before decoding it and
+// returns it the right way up, as the orientation in its EXIF is lost
+// when it's re-encoded
+func decodeImage(data []byte) (image.Image, error) {
+
+	ic, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(ic.Width)*int64(ic.Height) > maxImagePixels() {
+		return nil, ErrImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return orientImage(img, exifOrientation(data)), nil
+}
+
+// exifData returns the TIFF structure holding a JPEG or PNG's EXIF, or
+// nil if it has none
+func exifData(data []byte) []byte {
+
+	if bytes.HasPrefix(data, jpegSignature) {
+
+		for i := len(jpegSignature); i+4 <= len(data); {
+
+			if data[i] != 0xff {
+				return nil
+			}
+
+			marker := data[i+1]
+
+			switch {
+			case marker == 0xff:
+				i++
+				continue
+			case marker == 0xda || marker == 0xd9:
+				return nil
+			case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+				i += 2
+				continue
+			}
+
+			length := int(binary.BigEndian.Uint16(data[i+2:]))
+			if length < 2 || i+2+length > len(data) {
+				return nil
+			}
+
+			segment := data[i+4 : i+2+length]
+			if marker == 0xe1 && bytes.HasPrefix(segment, exifHeader) {
+				return segment[len(exifHeader):]
+			}
+
+			i += 2 + length
+		}
+	}
+
+	if bytes.HasPrefix(data, pngSignature) {
+
+		for i := len(pngSignature); i+8 <= len(data); {
+
+			length := int64(binary.BigEndian.Uint32(data[i:]))
+			if int64(i)+12+length > int64(len(data)) {
+				return nil
+			}
+
+			if string(data[i+4:i+8]) == "eXIf" {
+				return data[i+8 : i+8+int(length)]
+			}
+
+			i += 12 + int(length)
+		}
+	}
+
+	return nil
+}
+
+// exifOrientation returns the EXIF Orientation of a JPEG or PNG, which
+// is 1 (upright) when there isn't one
+func exifOrientation(data []byte) int {
+	return tiffOrientation(exifData(data))
+}
+
+// tiffOrientation returns the Orientation from the TIFF structure EXIF
+// is held in
+func tiffOrientation(tiff []byte) int {
+
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	// Orientation is in the first IFD, each entry is 12 bytes long
+	ifd := int64(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > int64(len(tiff)) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+
+	for n := 0; n < entries; n++ {
+
+		entry := int(ifd) + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:]) != 0x0112 {
+			continue
+		}
+
+		// a SHORT, which is held in the first two bytes of the value
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+
+	return 1
+}
+
+// orientImage flips and rotates the image as the EXIF orientation says
+// it should be displayed
+func orientImage(src image.Image, orientation int) image.Image {
+
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// orientations 5 to 8 swap the width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+
+			var sx, sy int
+
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				sx, sy = x, h-1-y
+			case 5: // on its side and mirrored
+				sx, sy = y, x
+			case 6: // needs turning clockwise
+				sx, sy = y, h-1-x
+			case 7: // on its side, mirrored the other way
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs turning anticlockwise
+				sx, sy = w-1-y, x
+			}
+
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+
+	return dst
+}
+
+func encodeImage(img image.Image, format string) ([]byte, error) {
+
+	var buf bytes.Buffer
+	var err error
+
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality()})
+	case "png":
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		err = enc.Encode(&buf, img)
+	default:
+		return nil, ErrNotProcessable
+	}
+
+	return buf.Bytes(), err
+}
+
+// processImage shrinks images larger than the configured maximum
+// dimensions and re-encodes them the right way up. The re-encoded image
+// is only used if it was resized or is smaller than the original,
+// anything that can't be processed, including images with too many
+// pixels, is returned untouched
+func processImage(filename string, data []byte) (processed []byte, changed bool, err error) {
+
+	format := imageFormat(filename)
+	if format == "" {
+		return data, false, nil
+	}
+
+	img, err := decodeImage(data)
+	if err != nil {
+		return data, false, err
+	}
+
+	bounds := img.Bounds()
+	width, height := fitWithin(bounds.Dx(), bounds.Dy(), config.ImageMaxWidth, config.ImageMaxHeight)
+	resized := width != bounds.Dx() || height != bounds.Dy()
+
+	if resized {
+		img = resizeImage(img, width, height)
+	}
+
+	processed, err = encodeImage(img, format)
+	if err != nil {
+		return data, false, err
+	}
+
+	if !resized && len(processed) >= len(data) {
+		return data, false, nil
+	}
+
+	return processed, true, nil
+}
+
+// webpFilename is the name of the WebP copy made of an image
+func webpFilename(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".webp"
+}
+
+// convertToWebP makes a WebP copy of the image using cwebp, there's no
+// WebP encoder in the standard library
+func convertToWebP(data []byte) ([]byte, error) {
+
+	if config.CWebPBin == "" {
+		return nil, errors.New("cwebp_bin is not configured")
+	}
+
+	src, err := ioutil.TempFile("", "graphia-webp-src")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(src.Name())
+
+	_, err = src.Write(data)
+	src.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	dst := src.Name() + ".webp"
+	defer os.Remove(dst)
+
+	command := exec.Command(config.CWebPBin, "-quiet", "-q", fmt.Sprint(jpegQuality()), src.Name(), "-o", dst)
+
+	out, err := command.CombinedOutput()
+	if err != nil {
+		Error.Println("Couldn't convert to WebP", string(out), err.Error())
+		return nil, err
+	}
+
+	return ioutil.ReadFile(dst)
+}
+
+// thumbnailSize returns the requested size if it's reasonable, otherwise
+// the configured default
+func thumbnailSize(requested int) int {
+	if requested > 0 && requested <= maxThumbnailSize {
+		return requested
+	}
+	if config.ThumbnailSize > 0 {
+		return config.ThumbnailSize
+	}
+	return defaultThumbnailSize
+}
+
+// getThumbnail returns a thumbnail no larger than size in either
+// dimension. As blobs never change, thumbnails are cached on disk by the
+// blob's identifier along with the parameters they were made with, and
+// the contents are only read when there's no cached thumbnail
+func getThumbnail(attachment Attachment, contents io.Reader, size int) ([]byte, error) {
+
+	format := imageFormat(attachment.Filename)
+	if format == "" {
+		return nil, ErrNotProcessable
+	}
+
+	cached := filepath.Join(
+		thumbnailCachePath(),
+		fmt.Sprintf("%s-%d-%d.%s", attachment.Oid, size, jpegQuality(), format),
+	)
+
+	thumbnail, err := ioutil.ReadFile(cached)
+	if err == nil {
+		return thumbnail, nil
+	}
+
+	data, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	width, height := fitWithin(bounds.Dx(), bounds.Dy(), size, size)
+
+	thumbnail, err = encodeImage(resizeImage(img, width, height), format)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(thumbnailCachePath(), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(cached, thumbnail, 0644)
+	}
+	if err != nil {
+		Warning.Println("Could not cache thumbnail", cached, err.Error())
+	}
+
+	return thumbnail, nil
+}
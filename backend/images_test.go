@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testImage creates a noisy image so re-encoding it can't shrink it
+// dramatically without resizing
+func testImage(width, height int, format string) []byte {
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * y), uint8(x + y), uint8(x ^ y), 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if format == "png" {
+		png.Encode(&buf, img)
+	} else {
+		jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100})
+	}
+
+	return buf.Bytes()
+}
+
+// withOrientation adds an APP1 segment with only an EXIF Orientation to
+// the JPEG
+func withOrientation(data []byte, orientation int) []byte {
+
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // header, IFD0 follows it
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0,
+		0, 0, 0, 0, // no more IFDs
+	}
+
+	segment := append(append([]byte{}, exifHeader...), tiff...)
+	length := len(segment) + 2
+
+	out := append([]byte{}, jpegSignature...)
+	out = append(out, 0xff, 0xe1, byte(length>>8), byte(length))
+	out = append(out, segment...)
+
+	return append(out, data[len(jpegSignature):]...)
+}
+
+// withDimensions changes the dimensions in the PNG's header without
+// touching the image data, which DecodeConfig never reads
+func withDimensions(data []byte, width, height uint32) []byte {
+
+	out := append([]byte{}, data...)
+
+	// the IHDR chunk's data starts after its length and type
+	ihdr := out[len(pngSignature)+8 : len(pngSignature)+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+
+	checksum := crc32.ChecksumIEEE(out[len(pngSignature)+4 : len(pngSignature)+8+13])
+	binary.BigEndian.PutUint32(out[len(pngSignature)+8+13:], checksum)
+
+	return out
+}
+
+func Test_exifOrientation(t *testing.T) {
+
+	jpg := testImage(20, 10, "jpeg")
+
+	assert.Equal(t, 1, exifOrientation(jpg))
+	assert.Equal(t, 6, exifOrientation(withOrientation(jpg, 6)))
+	assert.Equal(t, 1, exifOrientation(withOrientation(jpg, 9)))
+	assert.Equal(t, 1, exifOrientation(testImage(20, 10, "png")))
+	assert.Equal(t, 1, exifOrientation([]byte("not an image")))
+}
+
+func Test_orientImage(t *testing.T) {
+
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	src.Set(1, 0, color.RGBA{0, 0, 255, 255})
+
+	// turned clockwise the left pixel ends up at the top
+	rotated := orientImage(src, 6)
+	assert.Equal(t, image.Rect(0, 0, 1, 2), rotated.Bounds())
+	assert.Equal(t, color.RGBA{255, 0, 0, 255}, color.RGBAModel.Convert(rotated.At(0, 0)))
+	assert.Equal(t, color.RGBA{0, 0, 255, 255}, color.RGBAModel.Convert(rotated.At(0, 1)))
+
+	mirrored := orientImage(src, 2)
+	assert.Equal(t, color.RGBA{0, 0, 255, 255}, color.RGBAModel.Convert(mirrored.At(0, 0)))
+
+	assert.Equal(t, src, orientImage(src, 1))
+}
+
+func Test_fitWithin(t *testing.T) {
+
+	tests := []struct {
+		name                  string
+		width, height         int
+		maxWidth, maxHeight   int
+		wantWidth, wantHeight int
+	}{
+		{"Within limits", 800, 600, 1024, 1024, 800, 600},
+		{"Too wide", 4000, 3000, 1000, 0, 1000, 750},
+		{"Too tall", 3000, 4000, 0, 1000, 750, 1000},
+		{"Both", 4000, 2000, 1000, 400, 800, 400},
+		{"No limits", 4000, 3000, 0, 0, 4000, 3000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := fitWithin(tt.width, tt.height, tt.maxWidth, tt.maxHeight)
+			assert.Equal(t, tt.wantWidth, w)
+			assert.Equal(t, tt.wantHeight, h)
+		})
+	}
+}
+
+func Test_processImage(t *testing.T) {
+
+	config.ImageMaxWidth, config.ImageMaxHeight = 100, 100
+	defer func() { config.ImageMaxWidth, config.ImageMaxHeight = 0, 0 }()
+
+	t.Run("Resized", func(t *testing.T) {
+
+		for _, format := range []string{"png", "jpeg"} {
+
+			processed, changed, err := processImage("photo."+format, testImage(400, 200, format))
+			assert.Nil(t, err)
+			assert.True(t, changed)
+
+			ic, decodedFormat, _ := image.DecodeConfig(bytes.NewReader(processed))
+			assert.Equal(t, format, decodedFormat)
+			assert.Equal(t, 100, ic.Width)
+			assert.Equal(t, 50, ic.Height)
+		}
+	})
+
+	t.Run("Small enough", func(t *testing.T) {
+		original := testImage(50, 50, "png")
+		processed, _, err := processImage("icon.png", original)
+		assert.Nil(t, err)
+		assert.True(t, len(processed) <= len(original))
+	})
+
+	t.Run("Rotated", func(t *testing.T) {
+
+		processed, changed, err := processImage("photo.jpg", withOrientation(testImage(400, 200, "jpeg"), 6))
+		assert.Nil(t, err)
+		assert.True(t, changed)
+
+		ic, _, _ := image.DecodeConfig(bytes.NewReader(processed))
+		assert.Equal(t, 50, ic.Width)
+		assert.Equal(t, 100, ic.Height)
+	})
+
+	t.Run("Too many pixels", func(t *testing.T) {
+		original := withDimensions(testImage(50, 50, "png"), 100000, 100000)
+		processed, changed, err := processImage("huge.png", original)
+		assert.Equal(t, ErrImageTooLarge, err)
+		assert.False(t, changed)
+		assert.Equal(t, original, processed)
+	})
+
+	t.Run("Not an image", func(t *testing.T) {
+		processed, changed, err := processImage("notes.txt", []byte("notes"))
+		assert.Nil(t, err)
+		assert.False(t, changed)
+		assert.Equal(t, []byte("notes"), processed)
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		_, changed, err := processImage("broken.jpg", []byte("not really a jpeg"))
+		assert.NotNil(t, err)
+		assert.False(t, changed)
+	})
+}
+
+func Test_getThumbnail(t *testing.T) {
+
+	config.ThumbnailCache = "../tests/tmp/thumbnails"
+	defer func() { config.ThumbnailCache = "" }()
+	os.RemoveAll(config.ThumbnailCache)
+
+	attachment := Attachment{Filename: "photo.jpg", Oid: "c2b0ed2d2c4a1f0f7da1c4b9b1c1f3f4a7d8e9f0"}
+
+	thumbnail, err := getThumbnail(attachment, bytes.NewReader(testImage(300, 150, "jpeg")), 60)
+	assert.Nil(t, err)
+
+	ic, _, _ := image.DecodeConfig(bytes.NewReader(thumbnail))
+	assert.Equal(t, 60, ic.Width)
+	assert.Equal(t, 30, ic.Height)
+
+	// the second request is served from the cache without decoding
+	cached, err := getThumbnail(attachment, strings.NewReader("ignored"), 60)
+	assert.Nil(t, err)
+	assert.Equal(t, thumbnail, cached)
+
+	files, _ := ioutil.ReadDir(config.ThumbnailCache)
+	if assert.Len(t, files, 1) {
+		assert.Contains(t, filepath.Base(files[0].Name()), attachment.Oid)
+	}
+
+	_, err = getThumbnail(Attachment{Filename: "animation.gif"}, nil, 60)
+	assert.Equal(t, ErrNotProcessable, err)
+
+	huge := withDimensions(testImage(50, 50, "png"), 100000, 100000)
+	_, err = getThumbnail(Attachment{Filename: "huge.png", Oid: "e0c1a6e1b5b84c1c97cd8b1fa3e2d1f0a9b8c7d6"}, bytes.NewReader(huge), 60)
+	assert.Equal(t, ErrImageTooLarge, err)
+}
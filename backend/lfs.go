@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+const (
+	lfsSpec = "https://git-lfs.github.com/spec/v1"
+
+	// lfsMediaType is used for batch API requests and responses
+	lfsMediaType = "application/vnd.git-lfs+json"
+
+	// maxLFSPointerSize is the largest file that's checked for being a
+	// pointer, real pointers are around 130 bytes
+	maxLFSPointerSize = 1024
+
+	// lfsTokenScope marks tokens issued to git-lfs, which can only be
+	// used with the LFS endpoints
+	lfsTokenScope = "lfs"
+
+	lfsTokenExpiry = 3600 // seconds
+
+	// lfsAttributesFile tells git-lfs clients which files are pointers
+	lfsAttributesFile = ".gitattributes"
+)
+
+var (
+	// ErrLFSObjectNotFound is returned when a pointer refers to an object
+	// that isn't in the store
+	ErrLFSObjectNotFound = errors.New("LFS object not found")
+
+	// ErrLFSObjectMismatch is returned when an uploaded object's contents
+	// don't match the oid or size it was uploaded as
+	ErrLFSObjectMismatch = errors.New("LFS object doesn't match its oid and size")
+
+	// ErrInvalidLFSOid is returned when an oid isn't a SHA-256 hash
+	ErrInvalidLFSOid = errors.New("invalid LFS oid")
+
+	// ErrUnknownLFSOperation is returned for batch requests that aren't
+	// uploads or downloads
+	ErrUnknownLFSOperation = errors.New("LFS operation must be upload or download")
+
+	lfsOidPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// LFSPointer is what's committed in place of a large file, the file
+// itself is kept in the LFS store
+type LFSPointer struct {
+	Oid  string
+	Size int64
+}
+
+// LFSObject is an object in a batch request or response
+type LFSObject struct {
+	Oid           string               `json:"oid"`
+	Size          int64                `json:"size"`
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]LFSAction `json:"actions,omitempty"`
+	Error         *LFSError            `json:"error,omitempty"`
+}
+
+// LFSAction tells the client where to transfer an object
+type LFSAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int               `json:"expires_in,omitempty"`
+}
+
+// LFSError explains why an object can't be transferred
+type LFSError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// LFSBatchRequest is sent by clients before transferring objects
+type LFSBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []LFSObject `json:"objects"`
+}
+
+// LFSBatchResponse lists what to do with each requested object, only
+// the basic transfer adapter is supported
+type LFSBatchResponse struct {
+	Transfer string      `json:"transfer"`
+	Objects  []LFSObject `json:"objects"`
+}
+
+// LFSAuthentication is returned to git-lfs-authenticate over SSH,
+// telling the client where the LFS server is and how to use it
+type LFSAuthentication struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header"`
+	ExpiresIn int               `json:"expires_in"`
+}
+
+// lfsTracked is true for files stored as LFS pointers
+func lfsTracked(filename string) bool {
+
+	if !config.LFSEnabled {
+		return false
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	for _, tracked := range config.LFSExtensions {
+		if strings.ToLower(tracked) == ext {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lfsStore is where objects are kept, by default next to the database
+func lfsStore() string {
+	if config.LFSStore == "" {
+		return filepath.Join(filepath.Dir(config.Database), "lfs")
+	}
+	return config.LFSStore
+}
+
+// lfsHref is the LFS server's address, used by clients for transfers
+func lfsHref() string {
+	return strings.TrimRight(config.URL, "/") + "/lfs"
+}
+
+// lfsPointerContents is the pointer file committed in place of an object
+func lfsPointerContents(p LFSPointer) []byte {
+	return []byte(fmt.Sprintf("version %s\noid sha256:%s\nsize %d\n", lfsSpec, p.Oid, p.Size))
+}
+
+// parseLFSPointer returns the pointer if data is one
+func parseLFSPointer(data []byte) (p LFSPointer, ok bool) {
+
+	if len(data) > maxLFSPointerSize || !bytes.HasPrefix(data, []byte("version "+lfsSpec+"\n")) {
+		return p, false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "oid":
+			p.Oid = strings.TrimPrefix(fields[1], "sha256:")
+		case "size":
+			p.Size, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+
+	return p, lfsOidPattern.MatchString(p.Oid)
+}
+
+// lfsObjectPath is where the object is stored, following git-lfs's own
+// layout of directories named after the first two pairs of characters
+func lfsObjectPath(oid string) (string, error) {
+
+	if !lfsOidPattern.MatchString(oid) {
+		return "", ErrInvalidLFSOid
+	}
+
+	return filepath.Join(lfsStore(), oid[0:2], oid[2:4], oid), nil
+}
+
+// lfsObjectExists returns the object's size if it's in the store
+func lfsObjectExists(oid string) (size int64, exists bool) {
+
+	path, err := lfsObjectPath(oid)
+	if err != nil {
+		return 0, false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+
+	return info.Size(), true
+}
+
+func openLFSObject(oid string) (*os.File, error) {
+
+	path, err := lfsObjectPath(oid)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrLFSObjectNotFound
+	}
+
+	return f, err
+}
+
+// storeLFSObject streams the reader into the store, hashing it on the
+// way. When expected has an oid the contents must match it, and its size
+// unless that's unknown, otherwise nothing is stored
+func storeLFSObject(r io.Reader, expected LFSPointer) (p LFSPointer, err error) {
+
+	tmp := filepath.Join(lfsStore(), "tmp")
+
+	err = os.MkdirAll(tmp, 0755)
+	if err != nil {
+		return p, err
+	}
+
+	f, err := ioutil.TempFile(tmp, "upload")
+	if err != nil {
+		return p, err
+	}
+	defer os.Remove(f.Name())
+
+	hash := sha256.New()
+
+	p.Size, err = io.Copy(io.MultiWriter(f, hash), r)
+	f.Close()
+	if err != nil {
+		return p, err
+	}
+
+	p.Oid = hex.EncodeToString(hash.Sum(nil))
+
+	if expected.Oid != "" && (expected.Oid != p.Oid || (expected.Size >= 0 && expected.Size != p.Size)) {
+		return p, ErrLFSObjectMismatch
+	}
+
+	path, _ := lfsObjectPath(p.Oid)
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return p, err
+	}
+
+	return p, os.Rename(f.Name(), path)
+}
+
+// createLFSBlob stores the reader's contents as an LFS object, returning
+// the blob of the pointer to commit in its place
+func createLFSBlob(repo *git.Repository, r io.Reader) (oid *git.Oid, p LFSPointer, err error) {
+
+	p, err = storeLFSObject(r, LFSPointer{})
+	if err != nil {
+		return nil, p, err
+	}
+
+	oid, err = repo.CreateBlobFromBuffer(lfsPointerContents(p))
+
+	return oid, p, err
+}
+
+// resolveLFSStream returns a reader for the object if the stream is a
+// pointer, otherwise for the stream itself. Only as much as a pointer
+// could be is read to tell, the stream is closed along with the reader
+func resolveLFSStream(rc io.ReadCloser) (io.ReadCloser, error) {
+
+	br := bufio.NewReaderSize(rc, maxLFSPointerSize+1)
+
+	// an error means there's less than asked for, which could be a pointer
+	head, _ := br.Peek(maxLFSPointerSize + 1)
+
+	p, ok := parseLFSPointer(head)
+	if !ok {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, rc}, nil
+	}
+
+	rc.Close()
+
+	f, err := openLFSObject(p.Oid)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// resolveLFSIncomingFile describes the object rather than its pointer,
+// so policies and quotas apply to the real file
+func resolveLFSIncomingFile(file IncomingFile) (IncomingFile, error) {
+
+	p, ok := parseLFSPointer(file.Head)
+	if !ok {
+		return file, nil
+	}
+
+	f, err := openLFSObject(p.Oid)
+	if err != nil {
+		return file, fmt.Errorf("%s: %s", file.Path, err.Error())
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffLength)
+
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return file, err
+	}
+
+	file.Size, file.Head = p.Size, head[:n]
+
+	return file, nil
+}
+
+// lfsAttributes adds a line for each tracked extension that's missing
+// from the attributes file, returning false if nothing was added
+func lfsAttributes(existing []byte) ([]byte, bool) {
+
+	var missing []string
+
+	for _, ext := range config.LFSExtensions {
+		line := fmt.Sprintf("*%s filter=lfs diff=lfs merge=lfs -text", strings.ToLower(ext))
+		if !bytes.Contains(existing, []byte(line)) {
+			missing = append(missing, line)
+		}
+	}
+
+	if len(missing) == 0 {
+		return existing, false
+	}
+
+	attributes := existing
+	if len(attributes) > 0 && !bytes.HasSuffix(attributes, []byte("\n")) {
+		attributes = append(attributes, '\n')
+	}
+
+	return append(attributes, []byte(strings.Join(missing, "\n")+"\n")...), true
+}
+
+// stageLFSAttributes makes sure the attributes file at head marks every
+// tracked extension, so clients cloning the repository fetch the objects
+func stageLFSAttributes(repo *git.Repository, index *git.Index) error {
+
+	var existing []byte
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return err
+	}
+	defer ht.Free()
+
+	if te, err := ht.EntryByPath(lfsAttributesFile); err == nil {
+		blob, err := repo.LookupBlob(te.Id)
+		if err != nil {
+			return err
+		}
+		existing = blob.Contents()
+		blob.Free()
+	}
+
+	attributes, changed := lfsAttributes(existing)
+	if !changed {
+		return nil
+	}
+
+	oid, err := repo.CreateBlobFromBuffer(attributes)
+	if err != nil {
+		return err
+	}
+
+	ie := git.IndexEntry{
+		Mode: git.FilemodeBlob,
+		Id:   oid,
+		Path: lfsAttributesFile,
+		Size: uint32(len(attributes)),
+	}
+
+	return index.Add(&ie)
+}
+
+// lfsBatch decides what the client should do with each object. Objects
+// being downloaded must exist, objects being uploaded are skipped if
+// they already do
+func lfsBatch(br LFSBatchRequest, header map[string]string) (LFSBatchResponse, error) {
+
+	response := LFSBatchResponse{Transfer: "basic", Objects: []LFSObject{}}
+
+	if br.Operation != "upload" && br.Operation != "download" {
+		return response, ErrUnknownLFSOperation
+	}
+
+	for _, requested := range br.Objects {
+
+		object := LFSObject{Oid: requested.Oid, Size: requested.Size}
+
+		if !lfsOidPattern.MatchString(requested.Oid) || requested.Size < 0 {
+			object.Error = &LFSError{Code: 422, Message: "Invalid object"}
+			response.Objects = append(response.Objects, object)
+			continue
+		}
+
+		size, exists := lfsObjectExists(requested.Oid)
+
+		action := LFSAction{
+			Href:      fmt.Sprintf("%s/objects/%s", lfsHref(), requested.Oid),
+			Header:    header,
+			ExpiresIn: lfsTokenExpiry,
+		}
+
+		switch {
+		case br.Operation == "download" && !exists:
+			object.Error = &LFSError{Code: 404, Message: "Object does not exist"}
+		case br.Operation == "download":
+			object.Size = size
+			object.Authenticated = true
+			object.Actions = map[string]LFSAction{"download": action}
+		case !exists || size != requested.Size:
+			object.Authenticated = true
+			object.Actions = map[string]LFSAction{"upload": action}
+		}
+
+		response.Objects = append(response.Objects, object)
+	}
+
+	return response, nil
+}
+
+// newLFSToken is given to git-lfs clients authenticating over SSH. Unlike
+// the tokens issued at login it's short lived and only valid for LFS
+func newLFSToken(user User) (string, error) {
+
+	token := jwt.New(jwt.SigningMethodRS256)
+
+	token.Claims = jwt.MapClaims{
+		"exp":   time.Now().Add(lfsTokenExpiry * time.Second).Unix(),
+		"iat":   time.Now().Unix(),
+		"sub":   user.Username,
+		"scope": lfsTokenScope,
+	}
+
+	return token.SignedString(signKey)
+}
+
+// lfsAuthentication is the response to git-lfs-authenticate
+func lfsAuthentication(user User) (la LFSAuthentication, err error) {
+
+	token, err := newLFSToken(user)
+	if err != nil {
+		return la, err
+	}
+
+	la = LFSAuthentication{
+		Href:      lfsHref(),
+		Header:    map[string]string{"Authorization": "Bearer " + token},
+		ExpiresIn: lfsTokenExpiry,
+	}
+
+	return la, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/husobee/vestigo"
+)
+
+// git-lfs batch API 📦, see
+// https://github.com/git-lfs/git-lfs/blob/master/docs/api/batch.md
+
+// lfsResponse is like JSONResponse but uses the media type git-lfs
+// expects, which must be set before the header is written
+func lfsResponse(response interface{}, status int, w http.ResponseWriter) {
+
+	json, err := json.Marshal(response)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(status)
+	w.Write(json)
+}
+
+// lfsBatchHandler tells the client where to upload or download each
+// object, the actions reuse the token the request was made with
+//
+// POST /lfs/objects/batch
+func lfsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+	var br LFSBatchRequest
+
+	err := json.NewDecoder(r.Body).Decode(&br)
+	if err != nil {
+		fr = FailureResponse{Message: "Invalid batch request"}
+		lfsResponse(fr, http.StatusBadRequest, w)
+		return
+	}
+
+	header := map[string]string{"Authorization": r.Header.Get("Authorization")}
+
+	response, err := lfsBatch(br, header)
+
+	if err == ErrUnknownLFSOperation {
+		fr = FailureResponse{Message: err.Error()}
+		lfsResponse(fr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not process LFS batch", err.Error())
+		fr = FailureResponse{Message: "Could not process batch request"}
+		lfsResponse(fr, http.StatusInternalServerError, w)
+		return
+	}
+
+	lfsResponse(response, http.StatusOK, w)
+}
+
+// lfsDownloadHandler returns an object from the store
+//
+// GET /lfs/objects/:oid
+func lfsDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	oid := vestigo.Param(r, "oid")
+
+	f, err := openLFSObject(oid)
+
+	if err == ErrInvalidLFSOid {
+		fr = FailureResponse{Message: err.Error()}
+		lfsResponse(fr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if err == ErrLFSObjectNotFound {
+		fr = FailureResponse{Message: "Object does not exist"}
+		lfsResponse(fr, http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not open LFS object", oid, err.Error())
+		fr = FailureResponse{Message: "Could not retrieve object"}
+		lfsResponse(fr, http.StatusInternalServerError, w)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, f)
+}
+
+// lfsUploadHandler stores an object, its contents must match the oid and
+// size it was uploaded as. Objects are limited to max_attachment_size
+// like attachments uploaded through the CMS
+//
+// PUT /lfs/objects/:oid
+func lfsUploadHandler(w http.ResponseWriter, r *http.Request) {
+	var fr FailureResponse
+
+	expected := LFSPointer{Oid: vestigo.Param(r, "oid"), Size: r.ContentLength}
+
+	if !lfsOidPattern.MatchString(expected.Oid) {
+		fr = FailureResponse{Message: ErrInvalidLFSOid.Error()}
+		lfsResponse(fr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if expected.Size > maxAttachmentSize() {
+		fr = FailureResponse{Message: fmt.Sprintf("Objects can't be larger than %d bytes", maxAttachmentSize())}
+		lfsResponse(fr, http.StatusRequestEntityTooLarge, w)
+		return
+	}
+
+	_, err := storeLFSObject(&sizeLimitReader{r: r.Body, remaining: maxAttachmentSize()}, expected)
+
+	if err == ErrLFSObjectMismatch {
+		fr = FailureResponse{Message: err.Error()}
+		lfsResponse(fr, http.StatusUnprocessableEntity, w)
+		return
+	}
+
+	if err == ErrAttachmentTooLarge {
+		fr = FailureResponse{Message: fmt.Sprintf("Objects can't be larger than %d bytes", maxAttachmentSize())}
+		lfsResponse(fr, http.StatusRequestEntityTooLarge, w)
+		return
+	}
+
+	if err != nil {
+		Error.Println("Could not store LFS object", expected.Oid, err.Error())
+		fr = FailureResponse{Message: "Could not store object"}
+		lfsResponse(fr, http.StatusInternalServerError, w)
+		return
+	}
+
+	Info.Println("Stored LFS object", expected.Oid, "from", getCurrentUser(r.Context()).Username)
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
+)
+
+// a PDF that's pretending to be large
+var lfsTestPDF = []byte("%PDF-1.4\n% Springfield Nuclear Power Plant safety manual\n")
+
+func lfsTestOid(contents []byte) string {
+	hash := sha256.Sum256(contents)
+	return hex.EncodeToString(hash[:])
+}
+
+// useLFS enables LFS for PDFs with a temporary store, returning a
+// function that restores the configuration
+func useLFS() (store string, reset func()) {
+
+	store = "../tests/tmp/lfs"
+	os.RemoveAll(store)
+
+	config.LFSEnabled = true
+	config.LFSExtensions = []string{".pdf"}
+	config.LFSStore = store
+
+	return store, func() {
+		config.LFSEnabled = false
+		config.LFSExtensions = nil
+		config.LFSStore = ""
+	}
+}
+
+func Test_parseLFSPointer(t *testing.T) {
+
+	oid := lfsTestOid(lfsTestPDF)
+	pointer := LFSPointer{Oid: oid, Size: int64(len(lfsTestPDF))}
+
+	contents := lfsPointerContents(pointer)
+	assert.Equal(t, fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", oid, len(lfsTestPDF)), string(contents))
+
+	p, ok := parseLFSPointer(contents)
+	assert.True(t, ok)
+	assert.Equal(t, pointer, p)
+
+	_, ok = parseLFSPointer(lfsTestPDF)
+	assert.False(t, ok)
+
+	_, ok = parseLFSPointer([]byte("version https://git-lfs.github.com/spec/v1\noid sha256:nope\nsize 4\n"))
+	assert.False(t, ok)
+}
+
+func Test_storeLFSObject(t *testing.T) {
+
+	store, reset := useLFS()
+	defer reset()
+
+	oid := lfsTestOid(lfsTestPDF)
+
+	t.Run("Matching", func(t *testing.T) {
+		p, err := storeLFSObject(bytes.NewReader(lfsTestPDF), LFSPointer{Oid: oid, Size: int64(len(lfsTestPDF))})
+		assert.Nil(t, err)
+		assert.Equal(t, oid, p.Oid)
+
+		stored, err := ioutil.ReadFile(filepath.Join(store, oid[0:2], oid[2:4], oid))
+		assert.Nil(t, err)
+		assert.Equal(t, lfsTestPDF, stored)
+	})
+
+	t.Run("Mismatched", func(t *testing.T) {
+		other := []byte("Not the safety manual")
+
+		_, err := storeLFSObject(bytes.NewReader(other), LFSPointer{Oid: oid, Size: int64(len(other))})
+		assert.Equal(t, ErrLFSObjectMismatch, err)
+
+		_, exists := lfsObjectExists(lfsTestOid(other))
+		assert.False(t, exists)
+	})
+
+	t.Run("Resolving pointers", func(t *testing.T) {
+		pointer := lfsPointerContents(LFSPointer{Oid: oid, Size: int64(len(lfsTestPDF))})
+
+		r, err := resolveLFSStream(ioutil.NopCloser(bytes.NewReader(pointer)))
+		assert.Nil(t, err)
+		contents, _ := ioutil.ReadAll(r)
+		r.Close()
+		assert.Equal(t, lfsTestPDF, contents)
+
+		// anything else is read as it is
+		r, err = resolveLFSStream(ioutil.NopCloser(bytes.NewReader(lfsTestPDF)))
+		assert.Nil(t, err)
+		contents, _ = ioutil.ReadAll(r)
+		assert.Equal(t, lfsTestPDF, contents)
+
+		missing := lfsPointerContents(LFSPointer{Oid: strings.Repeat("a", 64), Size: 1})
+		_, err = resolveLFSStream(ioutil.NopCloser(bytes.NewReader(missing)))
+		assert.Equal(t, ErrLFSObjectNotFound, err)
+	})
+}
+
+func Test_lfsAttributes(t *testing.T) {
+
+	_, reset := useLFS()
+	defer reset()
+
+	config.LFSExtensions = []string{".pdf", ".MP4"}
+
+	attributes, changed := lfsAttributes(nil)
+	assert.True(t, changed)
+	assert.Equal(t, "*.pdf filter=lfs diff=lfs merge=lfs -text\n*.mp4 filter=lfs diff=lfs merge=lfs -text\n", string(attributes))
+
+	_, changed = lfsAttributes(attributes)
+	assert.False(t, changed)
+
+	attributes, changed = lfsAttributes([]byte("*.md text\n*.pdf filter=lfs diff=lfs merge=lfs -text"))
+	assert.True(t, changed)
+	assert.Equal(t, "*.md text\n*.pdf filter=lfs diff=lfs merge=lfs -text\n*.mp4 filter=lfs diff=lfs merge=lfs -text\n", string(attributes))
+}
+
+func Test_lfsBatch(t *testing.T) {
+
+	_, reset := useLFS()
+	defer reset()
+
+	stored := lfsTestOid(lfsTestPDF)
+	missing := strings.Repeat("b", 64)
+	header := map[string]string{"Authorization": "Bearer abc"}
+
+	storeLFSObject(bytes.NewReader(lfsTestPDF), LFSPointer{})
+
+	objects := []LFSObject{
+		{Oid: stored, Size: int64(len(lfsTestPDF))},
+		{Oid: missing, Size: 10},
+		{Oid: "../../etc/passwd", Size: 10},
+	}
+
+	t.Run("Upload", func(t *testing.T) {
+		response, err := lfsBatch(LFSBatchRequest{Operation: "upload", Objects: objects}, header)
+		assert.Nil(t, err)
+		assert.Equal(t, "basic", response.Transfer)
+		assert.Len(t, response.Objects, 3)
+
+		// already stored so nothing to do
+		assert.Nil(t, response.Objects[0].Actions)
+		assert.Nil(t, response.Objects[0].Error)
+
+		assert.Equal(t, lfsHref()+"/objects/"+missing, response.Objects[1].Actions["upload"].Href)
+		assert.Equal(t, header, response.Objects[1].Actions["upload"].Header)
+
+		assert.Equal(t, 422, response.Objects[2].Error.Code)
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		response, err := lfsBatch(LFSBatchRequest{Operation: "download", Objects: objects}, header)
+		assert.Nil(t, err)
+
+		assert.Equal(t, lfsHref()+"/objects/"+stored, response.Objects[0].Actions["download"].Href)
+		assert.Equal(t, 404, response.Objects[1].Error.Code)
+		assert.Equal(t, 422, response.Objects[2].Error.Code)
+	})
+
+	t.Run("Unknown operation", func(t *testing.T) {
+		_, err := lfsBatch(LFSBatchRequest{Operation: "delete", Objects: objects}, header)
+		assert.Equal(t, ErrUnknownLFSOperation, err)
+	})
+}
+
+func Test_LFSUploads(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/lfs_uploads"
+	setupSmallTestRepo(repoPath)
+
+	_, reset := useLFS()
+	defer reset()
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	lr, _ := getLatestRevision(repo)
+
+	upload, err := createBlobFromReader(repo, "manual.pdf", bytes.NewReader(lfsTestPDF), maxAttachmentSize())
+	assert.Nil(t, err)
+
+	nc := NewCommit{Message: "Add the safety manual", RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}
+
+	_, err = commitUploads("documents", "document_1", []Upload{upload}, nc, mh)
+	assert.Nil(t, err)
+
+	t.Run("Committed as a pointer", func(t *testing.T) {
+		committed, _ := ioutil.ReadFile(filepath.Join(repoPath, "documents/document_1/files/manual.pdf"))
+		p, ok := parseLFSPointer(committed)
+		assert.True(t, ok)
+		assert.Equal(t, lfsTestOid(lfsTestPDF), p.Oid)
+
+		attributes, _ := ioutil.ReadFile(filepath.Join(repoPath, lfsAttributesFile))
+		assert.Equal(t, "*.pdf filter=lfs diff=lfs merge=lfs -text\n", string(attributes))
+	})
+
+	t.Run("Resolved when retrieved", func(t *testing.T) {
+		attachment, contents, err := getAttachment("documents", "document_1", "files/manual.pdf")
+		assert.Nil(t, err)
+		assert.Equal(t, lfsTestPDF, contents)
+		assert.True(t, attachment.LFS)
+		assert.Equal(t, int64(len(lfsTestPDF)), attachment.Size)
+
+		attachments, _ := getAttachments("documents/document_1")
+		for _, a := range attachments {
+			if a.Filename == "manual.pdf" {
+				assert.True(t, a.LFS)
+				assert.Equal(t, int64(len(lfsTestPDF)), a.Size)
+			}
+		}
+	})
+
+	t.Run("Attributes aren't media", func(t *testing.T) {
+		assets, _ := getMediaLibrary("")
+		for _, asset := range assets {
+			assert.NotEqual(t, lfsAttributesFile, asset.Filename)
+		}
+	})
+}
+
+func setupLFSTestServer() *httptest.Server {
+	n := negroni.New(
+		negroni.HandlerFunc(ValidateLFSTokenMiddleware),
+		negroni.Wrap(lfsRouter()),
+	)
+
+	return httptest.NewServer(n)
+}
+
+func TestLFSHandlers(t *testing.T) {
+
+	server := setupLFSTestServer()
+	defer server.Close()
+
+	_, reset := useLFS()
+	defer reset()
+
+	db.Drop("User")
+	setupTestKeys()
+
+	_ = createUser(ck)
+	cookieKwan, _ := getUserByUsername("cookie.kwan")
+
+	token, _ := newLFSToken(cookieKwan)
+	oid := lfsTestOid(lfsTestPDF)
+
+	send := func(method, path, token string, body []byte) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		req.Header.Set("Accept", lfsMediaType)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ := http.DefaultClient.Do(req)
+		return resp
+	}
+
+	t.Run("Regular tokens are rejected", func(t *testing.T) {
+		regular, _ := newToken(cookieKwan)
+		ts, _ := newTokenString(regular)
+
+		resp := send("POST", "/lfs/objects/batch", ts, []byte(`{"operation":"download","objects":[]}`))
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		batch, _ := json.Marshal(LFSBatchRequest{
+			Operation: "upload",
+			Objects:   []LFSObject{{Oid: oid, Size: int64(len(lfsTestPDF))}},
+		})
+
+		resp := send("POST", "/lfs/objects/batch", token, batch)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, lfsMediaType, resp.Header.Get("Content-Type"))
+
+		var response LFSBatchResponse
+		json.NewDecoder(resp.Body).Decode(&response)
+		assert.Equal(t, "Bearer "+token, response.Objects[0].Actions["upload"].Header["Authorization"])
+	})
+
+	t.Run("Upload", func(t *testing.T) {
+		resp := send("PUT", "/lfs/objects/"+oid, token, []byte("Not the safety manual"))
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+		resp = send("PUT", "/lfs/objects/"+oid, token, lfsTestPDF)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, exists := lfsObjectExists(oid)
+		assert.True(t, exists)
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		resp := send("GET", "/lfs/objects/"+oid, token, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		contents, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, lfsTestPDF, contents)
+
+		resp = send("GET", "/lfs/objects/"+strings.Repeat("c", 64), token, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
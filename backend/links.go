@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/graphia/particle"
+	"github.com/russross/blackfriday"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+const (
+	referenceKindLink        = "link"
+	referenceKindImage       = "image"
+	referenceKindHTML        = "html"
+	referenceKindShortcode   = "shortcode"
+	referenceKindFrontMatter = "front matter"
+)
+
+var (
+	// htmlTagPattern and shortcodePattern find raw HTML tags and Hugo
+	// shortcodes, eg {{< figure src="images/cat.jpg" >}}, whose attributes
+	// might refer to attachments
+	htmlTagPattern   = regexp.MustCompile(`<[a-zA-Z][^>]*>`)
+	shortcodePattern = regexp.MustCompile(`\{\{[<%].*?[>%]\}\}`)
+
+	// attributePattern matches the attributes of both that hold paths
+	attributePattern = regexp.MustCompile(`(?i)\b(?:src|href|poster|image)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// Reference is a link or image found in a document that points to
+// something else within the repository
+type Reference struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Target      string `json:"target"`
+	Kind        string `json:"kind"`
+}
+
+// LinkReport summarises the state of every internal link and image
+// in the repository at the given revision
+type LinkReport struct {
+	Revision   string      `json:"revision"`
+	Documents  int         `json:"documents"`
+	References int         `json:"references"`
+	Broken     []Reference `json:"broken"`
+}
+
+// BrokenLinksError is returned when a commit would introduce references
+// to documents or attachments that don't exist
+type BrokenLinksError struct {
+	References []Reference
+}
+
+func (ble BrokenLinksError) Error() string {
+	return fmt.Sprintf("%d broken link(s) found", len(ble.References))
+}
+
+// referenceRecorder wraps the regular HTML renderer and makes a note of
+// every link and image destination it's asked to render. Using the real
+// renderer means we find links exactly as Markdown defines them,
+// including reference-style links, and ignore anything in code blocks
+type referenceRecorder struct {
+	blackfriday.Renderer
+	references []Reference
+}
+
+func (rr *referenceRecorder) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
+	rr.references = append(rr.references, Reference{Destination: string(link), Kind: referenceKindLink})
+	rr.Renderer.Link(out, link, title, content)
+}
+
+func (rr *referenceRecorder) Image(out *bytes.Buffer, link []byte, title []byte, alt []byte) {
+	rr.references = append(rr.references, Reference{Destination: string(link), Kind: referenceKindImage})
+	rr.Renderer.Image(out, link, title, alt)
+}
+
+// extractReferences returns the destination of every link and image
+// in the supplied Markdown
+func extractReferences(md []byte) []Reference {
+	rr := &referenceRecorder{Renderer: blackfriday.HtmlRenderer(flags, "", "")}
+	blackfriday.Markdown(md, rr, extensions)
+	return rr.references
+}
+
+// extractEmbeddedReferences returns the paths in the src, href, poster
+// and image attributes of any raw HTML and Hugo shortcodes in the
+// Markdown. Unlike extractReferences it doesn't skip code blocks, so it
+// may find more than is really there
+func extractEmbeddedReferences(md []byte) (refs []Reference) {
+
+	patterns := []struct {
+		kind    string
+		pattern *regexp.Regexp
+	}{
+		{referenceKindHTML, htmlTagPattern},
+		{referenceKindShortcode, shortcodePattern},
+	}
+
+	for _, p := range patterns {
+		for _, tag := range p.pattern.FindAll(md, -1) {
+			for _, attr := range attributePattern.FindAllSubmatch(tag, -1) {
+				refs = append(refs, Reference{Destination: string(attr[1]) + string(attr[2]), Kind: p.kind})
+			}
+		}
+	}
+
+	return refs
+}
+
+// extractFrontMatterReferences returns every string in the front matter,
+// however deeply nested, that looks like the path of an attachment, so
+// fields like image or images: [...] are found whatever they're called
+func extractFrontMatterReferences(contents []byte) (refs []Reference) {
+
+	var fm map[string]interface{}
+
+	_, err := particle.YAMLEncoding.DecodeString(string(contents), &fm)
+	if err != nil {
+		return nil
+	}
+
+	var walk func(value interface{})
+
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case string:
+			ext := filepath.Ext(v)
+			if ext != "" && ext != ".md" && !strings.ContainsAny(v, " \n") {
+				refs = append(refs, Reference{Destination: v, Kind: referenceKindFrontMatter})
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[interface{}]interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[string]interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+
+	walk(fm)
+
+	return refs
+}
+
+// resolveReferences resolves the targets of the references found in a
+// document, dropping external links and anchors
+func resolveReferences(directory, document, filename string, found []Reference) (refs []Reference) {
+
+	source := filepath.Join(directory, document, filename)
+
+	for _, ref := range found {
+
+		target, internal := resolveReference(directory, document, ref.Destination)
+		if !internal {
+			continue
+		}
+
+		ref.Source = source
+		ref.Target = target
+
+		refs = append(refs, ref)
+	}
+
+	return refs
+}
+
+// documentReferences returns the internal references found in a document
+// with their targets resolved to paths within the repository. External
+// links and anchors are omitted
+func documentReferences(directory, document, filename string, md []byte) (refs []Reference) {
+	return resolveReferences(directory, document, filename, extractReferences(md))
+}
+
+// resolveReference works out which path in the repository a link refers
+// to. Relative destinations are relative to the document's directory,
+// which is how attachments are served by cmsGeneralHandler, and absolute
+// ones are relative to the root of the repository
+func resolveReference(directory, document, destination string) (target string, internal bool) {
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		Warning.Println("Could not parse link destination", destination)
+		return "", false
+	}
+
+	// anything with a scheme (http:, mailto:) or host is external and
+	// a destination without a path is an anchor within the page
+	if u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+
+	p := u.Path
+
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(directory, document, p)
+	}
+
+	return extractRepositoryPath(p), true
+}
+
+// referenceExists checks whether a reference's target can be served
+// from the supplied tree
+func referenceExists(tree *git.Tree, target string) bool {
+	_, found := locateReference(tree, target)
+	return found
+}
+
+// locateReference finds the path of the file in the supplied tree that
+// a reference's target will be served from
+func locateReference(tree *git.Tree, target string) (path string, found bool) {
+
+	// links to the root of the site
+	if target == "" || target == "." {
+		return "", true
+	}
+
+	entry, err := tree.EntryByPath(target)
+	if err == nil && entry != nil {
+
+		if entry.Type == git.ObjectBlob {
+			return target, true
+		}
+
+		// directories are served via their index, documents use
+		// index.md and directories _index.md
+		for _, index := range []string{"index.md", "_index.md"} {
+			path = filepath.Join(target, index)
+			ie, _ := tree.EntryByPath(path)
+			if ie != nil {
+				return path, true
+			}
+		}
+
+		return "", false
+	}
+
+	// links to documents needn't include the extension, it's trimmed
+	// by extractRepositoryPath anyway
+	path = fmt.Sprintf("%s.md", target)
+	entry, _ = tree.EntryByPath(path)
+	if entry == nil {
+		return "", false
+	}
+
+	return path, true
+}
+
+// checkLinks resolves every link and image in every document at the
+// repository's head and reports on any that are broken
+func checkLinks() (report LinkReport, err error) {
+
+	// Initialise the slice so [] is marshalled instead of null
+	report.Broken = []Reference{}
+
+	repo, err := repository(config)
+	if err != nil {
+		return report, err
+	}
+	defer repo.Free()
+
+	lr, err := getLatestRevision(repo)
+	if err != nil {
+		return report, err
+	}
+
+	report.Revision = lr.String()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return report, err
+	}
+	defer ht.Free()
+
+	documents, refs, err := treeReferences(repo, ht, false)
+	if err != nil {
+		return report, err
+	}
+
+	report.Documents = documents
+	report.References = len(refs)
+
+	for _, ref := range refs {
+		if !referenceExists(ht, ref.Target) {
+			report.Broken = append(report.Broken, ref)
+		}
+	}
+
+	return report, nil
+}
+
+// treeReferences walks the tree and returns the internal references
+// found in every Markdown file along with the number of files checked.
+// When embedded is set those in raw HTML, shortcodes and front matter
+// are included too
+func treeReferences(repo *git.Repository, tree *git.Tree, embedded bool) (documents int, refs []Reference, err error) {
+
+	walkIterator := func(root string, te *git.TreeEntry) int {
+
+		if te.Type != git.ObjectBlob || filepath.Ext(te.Name) != ".md" || root == "" {
+			return 0
+		}
+
+		blob, err := repo.LookupBlob(te.Id)
+		if err != nil {
+			Warning.Println("Failed to find blob", te.Id)
+			return 0
+		}
+		defer blob.Free()
+
+		directory, document := splitDocumentPath(root)
+
+		documents++
+
+		refs = append(refs, documentReferences(directory, document, te.Name, stripFrontMatter(blob.Contents()))...)
+
+		if embedded {
+			found := extractEmbeddedReferences(stripFrontMatter(blob.Contents()))
+			found = append(found, extractFrontMatterReferences(blob.Contents())...)
+			refs = append(refs, resolveReferences(directory, document, te.Name, found)...)
+		}
+
+		return 0
+	}
+
+	err = tree.Walk(walkIterator)
+
+	return documents, refs, err
+}
+
+// validateReferences ensures the documents being committed don't link
+// to anything that won't be present once the commit has been made, so
+// documents and attachments added in the same commit are fine
+func validateReferences(repo *git.Repository, index *git.Index, files []NewCommitFile) error {
+
+	var broken []Reference
+
+	treeID, err := index.WriteTree()
+	if err != nil {
+		return err
+	}
+
+	tree, err := repo.LookupTree(treeID)
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	for _, ncf := range files {
+
+		if !ncf.isDocument() {
+			continue
+		}
+
+		for _, ref := range documentReferences(ncf.Path, ncf.Document, ncf.Filename, []byte(ncf.Body)) {
+			if !referenceExists(tree, ref.Target) {
+				broken = append(broken, ref)
+			}
+		}
+	}
+
+	if len(broken) > 0 {
+		Warning.Println("Commit rejected due to broken links", broken)
+		return BrokenLinksError{References: broken}
+	}
+
+	return nil
+}
+
+// stripFrontMatter returns the Markdown body of a document, if the
+// frontmatter can't be decoded the entire contents are returned
+func stripFrontMatter(contents []byte) []byte {
+
+	var fm FrontMatter
+
+	md, err := particle.YAMLEncoding.DecodeString(string(contents), &fm)
+	if err != nil {
+		return contents
+	}
+
+	return md
+}
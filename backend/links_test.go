@@ -0,0 +1,250 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_extractReferences(t *testing.T) {
+
+	md := []byte(`
+# Links
+
+A [relative link](../document_2) and an [absolute one](/appendices/appendix_1).
+
+![An image](images/image_1.gif)
+
+A [reference-style link][ref] and [external link](https://www.example.com)
+
+    [not a link](in/a/code/block)
+
+[ref]: ../document_3
+`)
+
+	refs := extractReferences(md)
+
+	assert.Equal(
+		t,
+		[]Reference{
+			Reference{Destination: "../document_2", Kind: referenceKindLink},
+			Reference{Destination: "/appendices/appendix_1", Kind: referenceKindLink},
+			Reference{Destination: "images/image_1.gif", Kind: referenceKindImage},
+			Reference{Destination: "../document_3", Kind: referenceKindLink},
+			Reference{Destination: "https://www.example.com", Kind: referenceKindLink},
+		},
+		refs,
+	)
+}
+
+func Test_extractEmbeddedReferences(t *testing.T) {
+
+	md := []byte(`
+<img src="images/cat.jpg" alt="A cat"> and <a href='/appendices/appendix_1/report.pdf'>a report</a>
+
+{{< figure src="images/dog.png" title="A dog" >}}
+
+<video poster="images/poster.jpg"><source src="/media/clip.mp4"></video>
+`)
+
+	assert.Equal(
+		t,
+		[]Reference{
+			Reference{Destination: "images/cat.jpg", Kind: referenceKindHTML},
+			Reference{Destination: "/appendices/appendix_1/report.pdf", Kind: referenceKindHTML},
+			Reference{Destination: "images/poster.jpg", Kind: referenceKindHTML},
+			Reference{Destination: "/media/clip.mp4", Kind: referenceKindHTML},
+			Reference{Destination: "images/dog.png", Kind: referenceKindShortcode},
+		},
+		extractEmbeddedReferences(md),
+	)
+}
+
+func Test_extractFrontMatterReferences(t *testing.T) {
+
+	contents := []byte(`---
+title: Pets.md
+author: Troy McClure
+image: images/cat.jpg
+gallery:
+  - images/dog.png
+  - caption: A hamster
+    src: /documents/document_2/images/hamster.gif
+---
+
+# Pets
+`)
+
+	var destinations []string
+	for _, ref := range extractFrontMatterReferences(contents) {
+		assert.Equal(t, referenceKindFrontMatter, ref.Kind)
+		destinations = append(destinations, ref.Destination)
+	}
+
+	assert.ElementsMatch(
+		t,
+		[]string{"images/cat.jpg", "images/dog.png", "/documents/document_2/images/hamster.gif"},
+		destinations,
+	)
+}
+
+func Test_resolveReference(t *testing.T) {
+
+	tests := []struct {
+		name, destination, target string
+		internal                  bool
+	}{
+		{name: "Relative document", destination: "../document_2", target: "documents/document_2", internal: true},
+		{name: "Relative attachment", destination: "images/image_1.gif", target: "documents/document_1/images/image_1.gif", internal: true},
+		{name: "Absolute", destination: "/appendices/appendix_1", target: "appendices/appendix_1", internal: true},
+		{name: "Absolute CMS", destination: "/cms/appendices/appendix_1", target: "appendices/appendix_1", internal: true},
+		{name: "Markdown extension", destination: "../document_2/index.md", target: "documents/document_2/index", internal: true},
+		{name: "Fragment and query", destination: "../document_2?a=b#section", target: "documents/document_2", internal: true},
+		{name: "Escaped", destination: "images/image%201.gif", target: "documents/document_1/images/image 1.gif", internal: true},
+		{name: "External", destination: "https://www.example.com/documents", internal: false},
+		{name: "Protocol relative", destination: "//www.example.com/documents", internal: false},
+		{name: "Email", destination: "mailto:someone@example.com", internal: false},
+		{name: "Anchor", destination: "#section", internal: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, internal := resolveReference("documents", "document_1", tt.destination)
+			assert.Equal(t, tt.internal, internal)
+			assert.Equal(t, tt.target, target)
+		})
+	}
+}
+
+func Test_checkLinks(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/check_links"
+	lr, _ := setupMultipleFiletypesTestRepo(repoPath)
+
+	nc := NewCommit{
+		Message: "Add document 4",
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Filename: "index.md",
+				Document: "document_4",
+				Path:     "documents",
+				Body: `
+* [Document 1](../document_1)
+* [Document 1 (absolute)](/documents/document_1/index.md)
+* [Documents](/documents)
+* [Appendix 2](/cms/appendices/appendix_2)
+* [Missing](../document_9)
+* [Example](https://www.example.com)
+
+![Image 1](../document_1/images/image_1.gif)
+![Missing image](images/image_9.gif)
+`,
+				FrontMatter: FrontMatter{Title: "Document 4"},
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	oid, err := createFiles(nc, mh)
+	if err != nil {
+		panic(err)
+	}
+
+	report, err := checkLinks()
+
+	assert.Nil(t, err)
+	assert.Equal(t, oid.String(), report.Revision)
+	assert.Equal(t, 7, report.References)
+	assert.Equal(
+		t,
+		[]Reference{
+			Reference{
+				Source:      "documents/document_4/index.md",
+				Destination: "../document_9",
+				Target:      "documents/document_9",
+				Kind:        referenceKindLink,
+			},
+			Reference{
+				Source:      "documents/document_4/index.md",
+				Destination: "images/image_9.gif",
+				Target:      "documents/document_4/images/image_9.gif",
+				Kind:        referenceKindImage,
+			},
+		},
+		report.Broken,
+	)
+}
+
+func Test_validateLinksOnCommit(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/validate_links"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	config.ValidateLinksOnCommit = true
+	defer func() { config.ValidateLinksOnCommit = false }()
+
+	t.Run("Broken link", func(t *testing.T) {
+
+		nc := NewCommit{
+			Message: "Add document 4",
+			Files: []NewCommitFile{
+				NewCommitFile{
+					Filename:    "index.md",
+					Document:    "document_4",
+					Path:        "documents",
+					Body:        "See [document 9](../document_9)",
+					FrontMatter: FrontMatter{Title: "Document 4"},
+				},
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+
+		_, err := createFiles(nc, mh)
+		ble, ok := err.(BrokenLinksError)
+
+		assert.True(t, ok)
+		assert.Equal(
+			t,
+			[]Reference{
+				Reference{
+					Source:      "documents/document_4/index.md",
+					Destination: "../document_9",
+					Target:      "documents/document_9",
+					Kind:        referenceKindLink,
+				},
+			},
+			ble.References,
+		)
+
+		_, err = getRawFile("documents", "document_4", "index.md")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Links to files in the same commit", func(t *testing.T) {
+
+		nc := NewCommit{
+			Message: "Add documents 4 and 5",
+			Files: []NewCommitFile{
+				NewCommitFile{
+					Filename:    "index.md",
+					Document:    "document_4",
+					Path:        "documents",
+					Body:        "See [document 5](../document_5) and [document 1](/documents/document_1)",
+					FrontMatter: FrontMatter{Title: "Document 4"},
+				},
+				NewCommitFile{
+					Filename:    "index.md",
+					Document:    "document_5",
+					Path:        "documents",
+					Body:        "See [document 4](../document_4)",
+					FrontMatter: FrontMatter{Title: "Document 5"},
+				},
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+
+		_, err := createFiles(nc, mh)
+
+		assert.Nil(t, err)
+	})
+}
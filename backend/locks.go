@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+const defaultEditLockTimeout = 300
+
+var (
+	// ErrDocumentLocked is returned when attempting to lock a document
+	// that is being edited by somebody else
+	ErrDocumentLocked = errors.New("document is locked by another user")
+
+	// ErrLockNotFound is returned when there's no current lock matching
+	// the request
+	ErrLockNotFound = errors.New("lock not found")
+
+	// lockMutex ensures checking for an existing lock and replacing
+	// it happens in one step
+	lockMutex sync.Mutex
+)
+
+// DocumentLock is an advisory lock recording who is currently editing a
+// document. Locks expire unless they're kept alive by the editor's
+// heartbeat, so abandoned editing sessions don't block others forever
+type DocumentLock struct {
+	ID         int       `json:"id" storm:"id,increment"`
+	Path       string    `json:"path" storm:"unique"`
+	Username   string    `json:"username" storm:"index"`
+	Name       string    `json:"name"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired returns true once the lock's holder has stopped sending heartbeats
+func (dl DocumentLock) Expired() bool {
+	return time.Now().After(dl.ExpiresAt)
+}
+
+// HeldBy returns true if the lock belongs to the supplied user
+func (dl DocumentLock) HeldBy(user User) bool {
+	return dl.Username == user.Username
+}
+
+// editLockTimeout is the length of time a lock lasts without a heartbeat
+func editLockTimeout() time.Duration {
+	if config.EditLockTimeout <= 0 {
+		return defaultEditLockTimeout * time.Second
+	}
+	return time.Duration(config.EditLockTimeout) * time.Second
+}
+
+// acquireLock locks the document at the supplied path for the user. If
+// they already hold the lock it's extended, which is how heartbeats
+// work. If somebody else holds a current lock it's returned along with
+// ErrDocumentLocked
+func acquireLock(directory, document, filename string, user User) (lock DocumentLock, err error) {
+
+	lockMutex.Lock()
+	defer lockMutex.Unlock()
+
+	path := filepath.Join(directory, document, filename)
+	now := time.Now()
+
+	err = db.One("Path", path, &lock)
+	if err != nil && err != storm.ErrNotFound {
+		return lock, err
+	}
+
+	if err == nil {
+
+		if !lock.Expired() && !lock.HeldBy(user) {
+			return lock, ErrDocumentLocked
+		}
+
+		// the previous holder's lock has lapsed, start afresh
+		if !lock.HeldBy(user) {
+			err = db.DeleteStruct(&lock)
+			if err != nil {
+				return lock, err
+			}
+			lock = DocumentLock{}
+		}
+	}
+
+	if lock.ID == 0 {
+		lock = DocumentLock{
+			Path:       path,
+			Username:   user.Username,
+			Name:       user.Name,
+			AcquiredAt: now,
+		}
+	}
+
+	lock.ExpiresAt = now.Add(editLockTimeout())
+
+	err = db.Save(&lock)
+
+	return lock, err
+}
+
+// releaseLock removes the user's lock on the document at the supplied path,
+// locks belonging to other users are left alone
+func releaseLock(directory, document, filename string, user User) error {
+
+	lockMutex.Lock()
+	defer lockMutex.Unlock()
+
+	var lock DocumentLock
+
+	err := db.One("Path", filepath.Join(directory, document, filename), &lock)
+	if err == storm.ErrNotFound {
+		return ErrLockNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if !lock.HeldBy(user) {
+		return ErrDocumentLocked
+	}
+
+	return db.DeleteStruct(&lock)
+}
+
+// breakLock removes a lock regardless of who holds it
+func breakLock(id int) (lock DocumentLock, err error) {
+
+	lockMutex.Lock()
+	defer lockMutex.Unlock()
+
+	err = db.One("ID", id, &lock)
+	if err == storm.ErrNotFound {
+		return lock, ErrLockNotFound
+	}
+	if err != nil {
+		return lock, err
+	}
+
+	return lock, db.DeleteStruct(&lock)
+}
+
+// currentLocks returns every unexpired lock keyed by path
+func currentLocks() (locks map[string]DocumentLock, err error) {
+
+	var all []DocumentLock
+
+	locks = make(map[string]DocumentLock)
+
+	err = db.All(&all)
+	if err != nil && err != storm.ErrNotFound {
+		return locks, err
+	}
+
+	for _, lock := range all {
+		if !lock.Expired() {
+			locks[lock.Path] = lock
+		}
+	}
+
+	return locks, nil
+}
+
+// currentLock returns the unexpired lock on the document at the supplied
+// path, or nil if it isn't locked
+func currentLock(path string) (*DocumentLock, error) {
+
+	var lock DocumentLock
+
+	err := db.One("Path", path, &lock)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if lock.Expired() {
+		return nil, nil
+	}
+
+	return &lock, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_acquireLock(t *testing.T) {
+
+	db.Drop("DocumentLock")
+
+	first, err := acquireLock("documents", "document_1", "index.md", ds)
+	assert.Nil(t, err)
+	assert.Equal(t, "documents/document_1/index.md", first.Path)
+	assert.Equal(t, ds.Username, first.Username)
+	assert.True(t, first.ExpiresAt.After(time.Now()))
+
+	t.Run("Heartbeat extends the lock", func(t *testing.T) {
+		time.Sleep(10 * time.Millisecond)
+
+		second, err := acquireLock("documents", "document_1", "index.md", ds)
+		assert.Nil(t, err)
+		assert.Equal(t, first.ID, second.ID)
+		assert.Equal(t, first.AcquiredAt.Unix(), second.AcquiredAt.Unix())
+		assert.True(t, second.ExpiresAt.After(first.ExpiresAt))
+	})
+
+	t.Run("Locked by another user", func(t *testing.T) {
+		lock, err := acquireLock("documents", "document_1", "index.md", sb)
+		assert.Equal(t, ErrDocumentLocked, err)
+		assert.Equal(t, ds.Username, lock.Username)
+	})
+
+	t.Run("Other documents are unaffected", func(t *testing.T) {
+		lock, err := acquireLock("documents", "document_2", "index.md", sb)
+		assert.Nil(t, err)
+		assert.Equal(t, sb.Username, lock.Username)
+	})
+}
+
+func Test_acquireExpiredLock(t *testing.T) {
+
+	db.Drop("DocumentLock")
+
+	config.EditLockTimeout = 1
+	defer func() { config.EditLockTimeout = 0 }()
+
+	_, err := acquireLock("documents", "document_1", "index.md", ds)
+	assert.Nil(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	lock, err := acquireLock("documents", "document_1", "index.md", sb)
+	assert.Nil(t, err)
+	assert.Equal(t, sb.Username, lock.Username)
+
+	locks, _ := currentLocks()
+	assert.Len(t, locks, 1)
+}
+
+func Test_releaseLock(t *testing.T) {
+
+	db.Drop("DocumentLock")
+
+	acquireLock("documents", "document_1", "index.md", ds)
+
+	assert.Equal(t, ErrDocumentLocked, releaseLock("documents", "document_1", "index.md", sb))
+	assert.Nil(t, releaseLock("documents", "document_1", "index.md", ds))
+	assert.Equal(t, ErrLockNotFound, releaseLock("documents", "document_1", "index.md", ds))
+
+	lock, _ := currentLock("documents/document_1/index.md")
+	assert.Nil(t, lock)
+}
+
+func Test_breakLock(t *testing.T) {
+
+	db.Drop("DocumentLock")
+
+	lock, _ := acquireLock("documents", "document_1", "index.md", ds)
+
+	broken, err := breakLock(lock.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, lock.Path, broken.Path)
+
+	_, err = breakLock(lock.ID)
+	assert.Equal(t, ErrLockNotFound, err)
+}
+
+func Test_getFilesInDirIncludesLocks(t *testing.T) {
+
+	db.Drop("DocumentLock")
+
+	repoPath := "../tests/tmp/repositories/list_locks"
+	setupSmallTestRepo(repoPath)
+
+	acquireLock("documents", "document_2", "index.md", ds)
+
+	files, err := getFilesInDir("documents")
+	assert.Nil(t, err)
+
+	for _, fi := range files {
+		if fi.Document == "document_2" {
+			if assert.NotNil(t, fi.Lock) {
+				assert.Equal(t, ds.Username, fi.Lock.Username)
+			}
+		} else {
+			assert.Nil(t, fi.Lock)
+		}
+	}
+}
@@ -24,6 +24,7 @@ type emailData struct {
 	User        User
 	Subject     string
 	Body        string
+	Documents   []ReviewDocument
 	EmailConfig emailConfig
 }
 
@@ -16,14 +16,18 @@ import (
 )
 
 var (
-	config        Config
-	argConfigPath = flag.String("config", "/etc/graphia/cms.yml", "the config file")
-	logEnabled    = flag.Bool("log-to-file", false, "enable logging")
-	verifyKey     *rsa.PublicKey
-	signKey       *rsa.PrivateKey
-	db            storm.DB
-	validate      *validator.Validate
-	mailer        Mailer
+	config           Config
+	loadedConfigPath string
+	argConfigPath    = flag.String("config", "/etc/graphia/cms.yml", "the config file")
+	logEnabled       = flag.Bool("log-to-file", false, "enable logging")
+	scanMetadata     = flag.Bool("scan-image-metadata", false, "list images in the repository containing EXIF or XMP metadata, then exit")
+	stripExisting    = flag.Bool("strip-image-metadata", false, "remove EXIF and XMP metadata from images in the repository, then exit")
+	preReceive       = flag.Bool("pre-receive", false, "check a push against the upload policies, run by the git pre-receive hook")
+	verifyKey        *rsa.PublicKey
+	signKey          *rsa.PrivateKey
+	db               storm.DB
+	validate         *validator.Validate
+	mailer           Mailer
 )
 
 // init loads config and sets up logging without requiring
@@ -46,6 +50,8 @@ func init() {
 		p = *argConfigPath
 	}
 
+	loadedConfigPath = p
+
 	config, err = loadConfig(&p)
 	if err != nil {
 		panic(err)
@@ -62,14 +68,24 @@ func main() {
 
 	Debug.Println("Initialised with config:", config)
 
-	var r, pr, ar *vestigo.Router
+	// maintenance commands run instead of the server
+	if *scanMetadata || *stripExisting {
+		os.Exit(imageMetadataCommand(*stripExisting))
+	}
+
+	if *preReceive {
+		os.Exit(preReceiveCommand(os.Stdin, os.Stderr))
+	}
+
+	var r, pr, ar, lr *vestigo.Router
 	var n *negroni.Negroni
 
 	setupKeys()
 	r = unprotectedRouter()
 	pr = protectedRouter()
 	ar = adminRouter()
-	n = setupMiddleware(r, pr, ar)
+	lr = lfsRouter()
+	n = setupMiddleware(r, pr, ar, lr)
 	db = setupDB(config.Database)
 
 	Debug.Println("Router and Middleware set up")
@@ -83,6 +99,19 @@ func main() {
 
 	var err error
 
+	// the repository might not have been initialised yet, in which
+	// case the index will be built on the first lookup instead
+	err = refreshDocumentIndex()
+	if err != nil {
+		Warning.Println("Could not build document index", err.Error())
+	}
+
+	// scheduled changes live in the repository so any that fell due
+	// while the server was down are applied as soon as it starts
+	startScheduler(scheduleInterval())
+
+	startReviewReminders()
+
 	if config.HTTPSEnabled {
 
 		errors := make(chan error, 0)
@@ -160,7 +189,7 @@ func setupMailer() Mailer {
 	return Mailer{send: DefaultSender}
 }
 
-func setupMiddleware(r, pr, ar *vestigo.Router) (n *negroni.Negroni) {
+func setupMiddleware(r, pr, ar, lr *vestigo.Router) (n *negroni.Negroni) {
 	n = negroni.New()
 	n.UseHandler(r)
 
@@ -175,6 +204,11 @@ func setupMiddleware(r, pr, ar *vestigo.Router) (n *negroni.Negroni) {
 		negroni.Wrap(pr),
 	))
 
+	r.Handle("/lfs/*", negroni.New(
+		negroni.HandlerFunc(ValidateLFSTokenMiddleware),
+		negroni.Wrap(lr),
+	))
+
 	//n.Use(negroni.NewLogger())
 	n.Use(negroni.NewRecovery())
 	return
@@ -230,6 +264,7 @@ func protectedRouter() (r *vestigo.Router) {
 	// file endpoints
 	r.Get("/api/directories/:directory/documents", apiListFilesInDirectoryHandler)
 	r.Post("/api/directories/:directory/documents", apiCreateFileInDirectoryHandler)
+	r.Put("/api/directories/:directory/order", apiReorderDocumentsHandler)
 
 	r.Get("/api/directories/:directory/documents/:document/files/:file", apiGetFileInDirectoryHandler)
 	r.Get("/api/directories/:directory/documents/:document/files/:file/edit", apiEditFileInDirectoryHandler)
@@ -237,13 +272,69 @@ func protectedRouter() (r *vestigo.Router) {
 	r.Patch("/api/directories/:directory/documents/:document/files/:file", apiUpdateFileInDirectoryHandler)
 	r.Delete("/api/directories/:directory/documents/:document/files/:file", apiDeleteFileFromDirectoryHandler)
 	r.Post("/api/directories/:directory/documents/:document/files/:file/translate", apiTranslateFileHandler)
+	r.Get("/api/directories/:directory/documents/:document/files/:file/translation_status", apiGetTranslationStatusHandler)
 
 	r.Get("/api/directories/:directory/documents/:document/files/:file/history", apiGetFileHistoryHandler)
 
-	// attachment endpoint
-	// note filename used rather than :file because we're not using the extension
+	// comments
+	r.Get("/api/directories/:directory/documents/:document/files/:file/comments", apiListCommentsHandler)
+	r.Post("/api/directories/:directory/documents/:document/files/:file/comments", apiCreateCommentHandler)
+	r.Post("/api/directories/:directory/documents/:document/files/:file/comments/:id/replies", apiReplyToCommentHandler)
+	r.Post("/api/directories/:directory/documents/:document/files/:file/comments/:id/resolve", apiResolveCommentHandler)
+	r.Delete("/api/directories/:directory/documents/:document/files/:file/comments/:id/resolve", apiResolveCommentHandler)
+
+	// suggestions
+	r.Get("/api/directories/:directory/documents/:document/files/:file/suggestions", apiListSuggestionsHandler)
+	r.Post("/api/directories/:directory/documents/:document/files/:file/suggestions", apiCreateSuggestionHandler)
+	r.Post("/api/directories/:directory/documents/:document/files/:file/suggestions/:id/accept", apiAcceptSuggestionHandler)
+	r.Post("/api/directories/:directory/documents/:document/files/:file/suggestions/:id/reject", apiRejectSuggestionHandler)
+
+	// workflow
+	r.Get("/api/workflow", apiGetWorkflowHandler)
+	r.Get("/api/directories/:directory/documents/:document/files/:file/workflow", apiGetFileWorkflowHandler)
+	r.Post("/api/directories/:directory/documents/:document/files/:file/workflow", apiTransitionFileHandler)
+
+	// scheduled publishing
+	r.Get("/api/schedule", apiGetScheduleHandler)
+
+	// documents due for review or expired
+	r.Get("/api/reviews", apiGetOverdueDocumentsHandler)
+
+	// recently deleted directories and documents
+	r.Get("/api/trash", apiGetTrashHandler)
+	r.Post("/api/trash/restore", apiRestoreFromTrashHandler)
+
+	// every attachment in the repository and those no longer used
+	r.Get("/api/media", apiGetMediaLibraryHandler)
+	r.Get("/api/media/orphans", apiGetOrphanedMediaHandler)
+
+	// document lock endpoints, the post doubles as a heartbeat
+	r.Post("/api/directories/:directory/documents/:document/files/:file/lock", apiLockFileHandler)
+	r.Delete("/api/directories/:directory/documents/:document/files/:file/lock", apiUnlockFileHandler)
+
+	// collaborative editing endpoint, upgraded to a WebSocket
+	r.Get("/api/directories/:directory/documents/:document/files/:file/collaborate", apiCollaborateHandler)
+
+	// autosave endpoints, uncommitted changes are stored per-user
+	r.Get("/api/autosaves", apiListAutosavesHandler)
+	r.Get("/api/directories/:directory/documents/:document/files/:file/autosave", apiGetAutosaveHandler)
+	r.Put("/api/directories/:directory/documents/:document/files/:file/autosave", apiSaveAutosaveHandler)
+	r.Delete("/api/directories/:directory/documents/:document/files/:file/autosave", apiDiscardAutosaveHandler)
+
+	// document endpoints, addressing documents by their stable identifier
+	r.Get("/api/documents/:id", apiGetDocumentHandler)
+
+	// attachment endpoints, individual attachments are addressed by their
+	// path relative to the document, eg images/cat.jpg
 	r.Get("/api/directories/:directory/documents/:document/attachments", apiGetFileAttachmentsHandler)
-	r.Get("/api/directories/:directory/documents/:document/attachments/:file", apiGetFileAttachmentHandler)
+	r.Get("/api/directories/:directory/documents/:document/attachments/*", apiGetFileAttachmentHandler)
+	r.Post("/api/directories/:directory/documents/:document/attachments", apiUploadAttachmentsHandler)
+	r.Get("/api/directories/:directory/documents/:document/thumbnails/*", apiGetThumbnailHandler)
+
+	// data file endpoints, CSV, JSON and XML attachments can be previewed
+	// and edited in place
+	r.Get("/api/directories/:directory/documents/:document/data/*", apiGetDataPreviewHandler)
+	r.Patch("/api/directories/:directory/documents/:document/data/*", apiUpdateDataFileHandler)
 
 	// user retrieval endpoints
 	r.Get("/api/users", apiListUsersHandler)
@@ -267,11 +358,15 @@ func protectedRouter() (r *vestigo.Router) {
 	r.Get("/api/recent_commits", apiGetCommitsHandler)
 	r.Get("/api/commits/:hash", apiGetCommitHandler)
 	r.Get("/api/history", apiGetHistoryHandler)
+	r.Get("/api/link_report", apiGetLinkReportHandler)
 
 	// cms endpoints
 	r.Post("/api/publish", apiPublishHandler)
 	r.Get("/api/translation_info", apiGetLanguageInformationHandler)
 
+	// translations whose source has changed since they were translated
+	r.Get("/api/translations/outdated", apiGetOutdatedTranslationsHandler)
+
 	// missing operations:
 	// how should file and directory moves/copies be represented?
 
@@ -288,6 +383,27 @@ func adminRouter() (r *vestigo.Router) {
 	r.Patch("/api/admin/users/:username", apiUpdateUserHandler)
 	r.Delete("/api/admin/users/:username", apiDeleteUserHandler)
 
+	// admin lock endpoints
+	r.Get("/api/admin/locks", apiListLocksHandler)
+	r.Delete("/api/admin/locks/:id", apiBreakLockHandler)
+
+	// deleting unused media can't be undone from the media library so
+	// is left to admins
+	r.Delete("/api/admin/media/orphans", apiDeleteOrphanedMediaHandler)
+
+	return r
+}
+
+// Endpoints used by git-lfs clients, authenticated with the tokens issued
+// by git-lfs-authenticate over SSH
+func lfsRouter() (r *vestigo.Router) {
+
+	r = vestigo.NewRouter()
+
+	r.Post("/lfs/objects/batch", lfsBatchHandler)
+	r.Get("/lfs/objects/:oid", lfsDownloadHandler)
+	r.Put("/lfs/objects/:oid", lfsUploadHandler)
+
 	return r
 }
 
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+var (
+	// ErrMediaNotFound is returned when deleting something that isn't an
+	// attachment in the repository
+	ErrMediaNotFound = errors.New("media not found")
+
+	// ErrMediaInUse is returned when deleting orphaned media that is
+	// referenced by a document
+	ErrMediaInUse = errors.New("media is referenced by a document")
+)
+
+// MediaAsset is a file stored in the repository that isn't a document.
+// Identical files are only listed once, with every path they're stored
+// at, so UsedBy includes documents referencing any of the copies
+type MediaAsset struct {
+	Oid       string   `json:"oid"`
+	Filename  string   `json:"filename"`
+	Extension string   `json:"extension"`
+	MediaType string   `json:"filetype"`
+	Category  string   `json:"category"`
+	Size      int64    `json:"size"`
+	Width     int      `json:"width,omitempty"`
+	Height    int      `json:"height,omitempty"`
+	Paths     []string `json:"paths"`
+	UsedBy    []string `json:"used_by"`
+	Orphaned  bool     `json:"orphaned"`
+	LFS       bool     `json:"lfs,omitempty"`
+}
+
+// MediaDeletion is a request to delete media that's no longer used
+type MediaDeletion struct {
+	Message        string   `json:"message" validate:"required,min=5"`
+	Paths          []string `json:"paths"   validate:"required,min=1"`
+	RepositoryInfo `json:"repository_info"`
+}
+
+// fileCategory returns the category from config.FileCategories the file
+// belongs to, anything uncategorised is 'other' as in countFiles
+func fileCategory(filename string) string {
+
+	ext := filepath.Ext(filename)
+
+	for category, filetypes := range config.FileCategories {
+		for _, filetype := range filetypes {
+			if filetype == ext {
+				return category
+			}
+		}
+	}
+
+	return "other"
+}
+
+// getMediaLibrary lists every non-Markdown file in the repository,
+// optionally limited to a single category. Files with the same contents
+// are combined, whatever they're called
+func getMediaLibrary(category string) (assets []MediaAsset, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	assets = []MediaAsset{}
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer ht.Free()
+
+	err = backlinks.refresh(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int)
+
+	err = ht.Walk(func(root string, te *git.TreeEntry) int {
+
+		if te.Type != git.ObjectBlob || filepath.Ext(te.Name) == ".md" {
+			return 0
+		}
+
+		// the LFS attributes aren't media
+		if root == "" && te.Name == lfsAttributesFile {
+			return 0
+		}
+
+		fc := fileCategory(te.Name)
+		if category != "" && fc != category {
+			return 0
+		}
+
+		path := filepath.Join(root, te.Name)
+
+		i, found := index[te.Id.String()]
+		if !found {
+
+			blob, err := repo.LookupBlob(te.Id)
+			if err != nil {
+				Warning.Println("Failed to find blob", te.Id)
+				return 0
+			}
+			defer blob.Free()
+
+			attachment := newAttachment(root, te, blob)
+
+			assets = append(assets, MediaAsset{
+				Oid:       attachment.Oid,
+				Filename:  attachment.Filename,
+				Extension: attachment.Extension,
+				MediaType: attachment.MediaType,
+				Category:  fc,
+				Size:      attachment.Size,
+				Width:     attachment.Width,
+				Height:    attachment.Height,
+				LFS:       attachment.LFS,
+				Paths:     []string{},
+				UsedBy:    []string{},
+			})
+
+			i = len(assets) - 1
+			index[te.Id.String()] = i
+		}
+
+		assets[i].Paths = append(assets[i].Paths, path)
+
+		for _, ref := range backlinks.lookup(path) {
+			assets[i].UsedBy = appendUnique(assets[i].UsedBy, ref.Source)
+		}
+
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range assets {
+		sort.Strings(assets[i].UsedBy)
+		assets[i].Orphaned = len(assets[i].UsedBy) == 0
+	}
+
+	return assets, nil
+}
+
+// getOrphanedMedia lists the media that no document refers to
+func getOrphanedMedia(category string) (orphans []MediaAsset, err error) {
+
+	assets, err := getMediaLibrary(category)
+	if err != nil {
+		return nil, err
+	}
+
+	orphans = []MediaAsset{}
+
+	for _, asset := range assets {
+		if asset.Orphaned {
+			orphans = append(orphans, asset)
+		}
+	}
+
+	return orphans, nil
+}
+
+// mediaDeletionCommit checks every path is orphaned media and converts
+// the request into a regular commit deleting the files
+func mediaDeletionCommit(md MediaDeletion) (nc NewCommit, err error) {
+
+	assets, err := getMediaLibrary("")
+	if err != nil {
+		return nc, err
+	}
+
+	media := make(map[string]MediaAsset)
+	for _, asset := range assets {
+		for _, path := range asset.Paths {
+			media[path] = asset
+		}
+	}
+
+	nc = NewCommit{Message: md.Message, RepositoryInfo: md.RepositoryInfo}
+
+	for _, path := range md.Paths {
+
+		path = filepath.Clean(path)
+
+		asset, found := media[path]
+		if !found {
+			return nc, ErrMediaNotFound
+		}
+
+		if !asset.Orphaned {
+			return nc, ErrMediaInUse
+		}
+
+		nc.Files = append(nc.Files, NewCommitFile{Path: filepath.Dir(path), Filename: filepath.Base(path)})
+	}
+
+	return nc, nil
+}
+
+// deleteOrphanedMedia deletes the media in a single commit, refusing to
+// if any of it is still referenced
+func deleteOrphanedMedia(md MediaDeletion, user User) (oid *git.Oid, err error) {
+
+	nc, err := mediaDeletionCommit(md)
+	if err != nil {
+		return nil, err
+	}
+
+	return deleteFiles(nc, user)
+}
+
+// previewDeleteOrphanedMedia returns what deleting the media would do
+// without deleting it
+func previewDeleteOrphanedMedia(md MediaDeletion, user User) (dr DryRun, err error) {
+
+	nc, err := mediaDeletionCommit(md)
+	if err != nil {
+		return dr, err
+	}
+
+	return previewDeleteFiles(nc, user)
+}
+
+// appendUnique adds the item unless it's already present
+func appendUnique(items []string, item string) []string {
+	for _, existing := range items {
+		if existing == item {
+			return items
+		}
+	}
+	return append(items, item)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+// setupMediaTestRepo adds a copy of document 1's image to document 5
+// in the backlinks repository, so the image is stored twice but only
+// one of the copies is referenced
+func setupMediaTestRepo(repoPath string) (oid *git.Oid, err error) {
+
+	lr, err := setupBacklinksTestRepo(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	gif, _ := ioutil.ReadFile("../tests/data/repositories/multiple_filetypes/documents/document_1/images/image_1.gif")
+
+	upload, err := createBlobFromReader(repo, "copy.gif", bytes.NewReader(gif), maxAttachmentSize())
+	if err != nil {
+		return nil, err
+	}
+
+	nc := NewCommit{
+		Message:        "Add a copy of image 1",
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	return commitUploads("documents", "document_5", []Upload{upload}, nc, mh)
+}
+
+func Test_fileCategory(t *testing.T) {
+	assert.Equal(t, "images", fileCategory("cat.jpg"))
+	assert.Equal(t, "structured data", fileCategory("data.json"))
+	assert.Equal(t, "other", fileCategory("query.sql"))
+}
+
+func Test_getMediaLibrary(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/media_library"
+	setupMediaTestRepo(repoPath)
+
+	t.Run("All media", func(t *testing.T) {
+		assets, err := getMediaLibrary("")
+		assert.Nil(t, err)
+
+		for _, asset := range assets {
+			assert.NotEqual(t, ".md", asset.Extension)
+		}
+
+		categories := make(map[string]bool)
+		for _, asset := range assets {
+			categories[asset.Category] = true
+		}
+		assert.True(t, categories["images"])
+		assert.True(t, categories["tabular data"])
+		assert.True(t, categories["other"])
+	})
+
+	t.Run("Filtered by category", func(t *testing.T) {
+		assets, err := getMediaLibrary("images")
+		assert.Nil(t, err)
+
+		// five images are stored but two are identical
+		assert.Len(t, assets, 4)
+
+		for _, asset := range assets {
+			assert.Equal(t, "images", asset.Category)
+		}
+	})
+
+	t.Run("Duplicates combined", func(t *testing.T) {
+		assets, _ := getMediaLibrary("images")
+
+		var gif MediaAsset
+		for _, asset := range assets {
+			if asset.Extension == ".gif" {
+				gif = asset
+			}
+		}
+
+		assert.Equal(t, 40, len(gif.Oid))
+		assert.Equal(t,
+			[]string{"documents/document_1/images/image_1.gif", "documents/document_5/images/copy.gif"},
+			gif.Paths,
+		)
+		assert.Equal(t, []string{"documents/document_4/index.md"}, gif.UsedBy)
+		assert.False(t, gif.Orphaned)
+	})
+
+	t.Run("Unknown category", func(t *testing.T) {
+		assets, err := getMediaLibrary("spreadsheets")
+		assert.Nil(t, err)
+		assert.Empty(t, assets)
+	})
+}
+
+func Test_getOrphanedMedia(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/orphaned_media"
+	setupMediaTestRepo(repoPath)
+
+	orphans, err := getOrphanedMedia("images")
+	assert.Nil(t, err)
+
+	var paths []string
+	for _, orphan := range orphans {
+		assert.True(t, orphan.Orphaned)
+		assert.Empty(t, orphan.UsedBy)
+		paths = append(paths, orphan.Paths...)
+	}
+
+	assert.ElementsMatch(t, []string{
+		"appendices/appendix_1/images/image_1.png",
+		"appendices/appendix_1/images/image_2.jpg",
+		"documents/document_2/images/image_1.jpg",
+	}, paths)
+}
+
+func Test_getOrphanedMediaEmbeddedReferences(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/orphaned_media_embedded"
+	lr, _ := setupMediaTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	// written raw as NewCommitFile's front matter has no image field
+	contents := `---
+title: Embedded
+image: /documents/document_2/images/image_1.jpg
+---
+
+<img src="/appendices/appendix_1/images/image_1.png">
+
+{{< figure src="/appendices/appendix_1/images/image_2.jpg" >}}
+`
+
+	_, err := writeFiles(
+		repo,
+		NewCommit{
+			Message: "Refer to images without Markdown",
+			Files: []NewCommitFile{
+				NewCommitFile{
+					Path:          "documents",
+					Document:      "document_6",
+					Filename:      "index.md",
+					Body:          base64.StdEncoding.EncodeToString([]byte(contents)),
+					Base64Encoded: true,
+				},
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	orphans, err := getOrphanedMedia("images")
+	assert.Nil(t, err)
+	assert.Empty(t, orphans)
+
+	assets, _ := getMediaLibrary("images")
+	for _, asset := range assets {
+		if asset.Paths[0] == "appendices/appendix_1/images/image_1.png" {
+			assert.Equal(t, []string{"documents/document_6/index.md"}, asset.UsedBy)
+		}
+	}
+}
+
+func Test_deleteOrphanedMedia(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/delete_orphaned_media"
+
+	t.Run("Orphans deleted", func(t *testing.T) {
+		lr, _ := setupMediaTestRepo(repoPath)
+
+		md := MediaDeletion{
+			Message:        "Remove unused images",
+			Paths:          []string{"appendices/appendix_1/images/image_1.png", "documents/document_2/images/image_1.jpg"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+
+		oid, err := deleteOrphanedMedia(md, mh)
+		assert.Nil(t, err)
+		assert.NotNil(t, oid)
+
+		orphans, _ := getOrphanedMedia("images")
+		assert.Len(t, orphans, 1)
+		assert.Equal(t, []string{"appendices/appendix_1/images/image_2.jpg"}, orphans[0].Paths)
+	})
+
+	t.Run("Referenced copy refused", func(t *testing.T) {
+		lr, _ := setupMediaTestRepo(repoPath)
+
+		md := MediaDeletion{
+			Message:        "Remove unused images",
+			Paths:          []string{"documents/document_5/images/copy.gif"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+
+		_, err := deleteOrphanedMedia(md, mh)
+		assert.Equal(t, ErrMediaInUse, err)
+	})
+
+	t.Run("Documents refused", func(t *testing.T) {
+		lr, _ := setupMediaTestRepo(repoPath)
+
+		md := MediaDeletion{
+			Message:        "Remove unused images",
+			Paths:          []string{"documents/document_3/index.md"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+
+		_, err := deleteOrphanedMedia(md, mh)
+		assert.Equal(t, ErrMediaNotFound, err)
+	})
+
+	t.Run("Out of sync", func(t *testing.T) {
+		setupMediaTestRepo(repoPath)
+
+		md := MediaDeletion{
+			Message:        "Remove unused images",
+			Paths:          []string{"appendices/appendix_1/images/image_1.png"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: "0000000000000000000000000000000000000000"},
+		}
+
+		_, err := deleteOrphanedMedia(md, mh)
+		assert.Equal(t, ErrRepoOutOfSync, err)
+	})
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+var (
+	// maintenanceUser is the author of commits made by maintenance commands
+	maintenanceUser = User{Username: "maintenance", Name: "Graphia CMS Maintenance"}
+
+	jpegSignature = []byte{0xff, 0xd8}
+	pngSignature  = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+	// jpegMetadataSegments are the APPn and comment segments that hold EXIF,
+	// XMP, IPTC and vendor data. JFIF (APP0), ICC profiles (APP2) and
+	// Adobe's colour transform (APP14) are needed to display the image
+	// correctly so are kept, as is EXIF's Orientation (see orientationExif)
+	jpegMetadataSegments = map[byte]bool{
+		0xe1: true, 0xe3: true, 0xe4: true, 0xe5: true, 0xe6: true,
+		0xe7: true, 0xe8: true, 0xe9: true, 0xea: true, 0xeb: true,
+		0xec: true, 0xed: true, 0xef: true, 0xfe: true,
+	}
+
+	// pngMetadataChunks hold EXIF, XMP (in iTXt) and free text
+	pngMetadataChunks = map[string]bool{
+		"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true,
+	}
+)
+
+// metadataCategories are the file categories metadata is stripped from,
+// images unless configured otherwise
+func metadataCategories() []string {
+	if config.StripMetadata == nil {
+		return []string{"images"}
+	}
+	return config.StripMetadata
+}
+
+// shouldStripMetadata returns true if the file belongs to a category
+// metadata is stripped from
+func shouldStripMetadata(filename string) bool {
+
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	for _, category := range metadataCategories() {
+		for _, filetype := range config.FileCategories[category] {
+			if strings.ToLower(filetype) == ext {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// stripMetadata returns a reader that filters metadata out of the JPEG or
+// PNG being read, a segment or chunk at a time so the image is never held
+// in memory. Files that aren't JPEGs or PNGs, whatever their extension,
+// pass through unchanged. It must be closed if not read to the end
+func stripMetadata(filename string, r io.Reader) io.ReadCloser {
+
+	if !shouldStripMetadata(filename) {
+		return ioutil.NopCloser(r)
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(copyWithoutMetadata(pw, r))
+	}()
+
+	return pr
+}
+
+// stripMetadataFromBytes is stripMetadata for files already in memory
+func stripMetadataFromBytes(filename string, data []byte) ([]byte, error) {
+
+	if !shouldStripMetadata(filename) {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+
+	err := copyWithoutMetadata(&buf, bytes.NewReader(data))
+	if err != nil {
+		return data, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// maxExifSize is the largest EXIF that's read to find its Orientation,
+// anything bigger is dropped entirely
+const maxExifSize = 1 << 20
+
+// orientationExif returns the TIFF structure for EXIF containing nothing
+// but the Orientation, which is all that's kept of an image's EXIF so it
+// still displays the right way up. Images that are upright need none
+func orientationExif(orientation int) []byte {
+
+	if orientation <= 1 || orientation > 8 {
+		return nil
+	}
+
+	return []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big endian, IFD0 follows the header
+		0, 1, // one entry, a SHORT holding the Orientation
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0,
+		0, 0, 0, 0, // no more IFDs
+	}
+}
+
+func copyWithoutMetadata(dst io.Writer, src io.Reader) error {
+
+	br := bufio.NewReader(src)
+
+	if signature, _ := br.Peek(len(pngSignature)); bytes.Equal(signature, pngSignature) {
+		return copyPNGWithoutMetadata(dst, br)
+	}
+
+	if signature, _ := br.Peek(len(jpegSignature)); bytes.Equal(signature, jpegSignature) {
+		return copyJPEGWithoutMetadata(dst, br)
+	}
+
+	_, err := io.Copy(dst, br)
+	return err
+}
+
+// copyJPEGWithoutMetadata copies the segments preceding the image data,
+// skipping metadata, then everything from the start of scan onwards
+func copyJPEGWithoutMetadata(dst io.Writer, br *bufio.Reader) error {
+
+	_, err := io.CopyN(dst, br, int64(len(jpegSignature)))
+	if err != nil {
+		return err
+	}
+
+	for {
+
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if b != 0xff {
+			return fmt.Errorf("invalid JPEG, expected marker but found 0x%x", b)
+		}
+
+		// markers may be padded with any number of 0xff bytes
+		marker := byte(0xff)
+		for marker == 0xff {
+			marker, err = br.ReadByte()
+			if err != nil {
+				return err
+			}
+		}
+
+		// start of scan or end of image, the rest is image data
+		if marker == 0xda || marker == 0xd9 {
+			_, err = dst.Write([]byte{0xff, marker})
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(dst, br)
+			return err
+		}
+
+		// standalone markers have no length or payload
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			_, err = dst.Write([]byte{0xff, marker})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var length uint16
+		err = binary.Read(br, binary.BigEndian, &length)
+		if err != nil {
+			return err
+		}
+
+		if length < 2 {
+			return fmt.Errorf("invalid JPEG, segment 0x%x has length %d", marker, length)
+		}
+
+		if marker == 0xe1 {
+			payload := make([]byte, int(length)-2)
+			_, err = io.ReadFull(br, payload)
+			if err != nil {
+				return err
+			}
+
+			if !bytes.HasPrefix(payload, exifHeader) {
+				continue
+			}
+
+			tiff := orientationExif(tiffOrientation(payload[len(exifHeader):]))
+			if tiff == nil {
+				continue
+			}
+
+			payload = append(append([]byte{}, exifHeader...), tiff...)
+			length = uint16(len(payload) + 2)
+
+			_, err = dst.Write(append([]byte{0xff, marker, byte(length >> 8), byte(length)}, payload...))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if jpegMetadataSegments[marker] {
+			_, err = br.Discard(int(length) - 2)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = dst.Write([]byte{0xff, marker, byte(length >> 8), byte(length)})
+		if err != nil {
+			return err
+		}
+
+		_, err = io.CopyN(dst, br, int64(length)-2)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyPNGWithoutMetadata copies each chunk other than those containing
+// metadata. As every chunk has its own checksum nothing needs recalculating
+func copyPNGWithoutMetadata(dst io.Writer, br *bufio.Reader) error {
+
+	_, err := io.CopyN(dst, br, int64(len(pngSignature)))
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 8)
+
+	for {
+
+		_, err = io.ReadFull(br, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := string(header[4:])
+
+		// data followed by a four byte checksum
+		remaining := length + 4
+
+		if kind == "eXIf" && length <= maxExifSize {
+			chunk := make([]byte, remaining)
+			_, err = io.ReadFull(br, chunk)
+			if err != nil {
+				return err
+			}
+
+			tiff := orientationExif(tiffOrientation(chunk[:length]))
+			if tiff == nil {
+				continue
+			}
+
+			chunk = make([]byte, 8+len(tiff)+4)
+			binary.BigEndian.PutUint32(chunk, uint32(len(tiff)))
+			copy(chunk[4:], kind)
+			copy(chunk[8:], tiff)
+			binary.BigEndian.PutUint32(chunk[8+len(tiff):], crc32.ChecksumIEEE(chunk[4:8+len(tiff)]))
+
+			_, err = dst.Write(chunk)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if pngMetadataChunks[kind] {
+			_, err = io.CopyN(ioutil.Discard, br, remaining)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = dst.Write(header)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.CopyN(dst, br, remaining)
+		if err != nil {
+			return err
+		}
+
+		if kind == "IEND" {
+			_, err = io.Copy(dst, br)
+			return err
+		}
+	}
+}
+
+// imagesWithMetadata lists the images in the tree that still contain
+// metadata that would be stripped if they were uploaded now
+func imagesWithMetadata(repo *git.Repository, tree *git.Tree) (paths []string, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	paths = []string{}
+
+	err = tree.Walk(func(root string, te *git.TreeEntry) int {
+
+		if te.Type != git.ObjectBlob || !shouldStripMetadata(te.Name) {
+			return 0
+		}
+
+		blob, err := repo.LookupBlob(te.Id)
+		if err != nil {
+			return 0
+		}
+		defer blob.Free()
+
+		stripped, err := stripMetadataFromBytes(te.Name, blob.Contents())
+		if err != nil {
+			Warning.Println("Could not check", filepath.Join(root, te.Name), "for metadata", err.Error())
+			return 0
+		}
+
+		if len(stripped) != int(blob.Size()) {
+			paths = append(paths, filepath.Join(root, te.Name))
+		}
+
+		return 0
+	})
+
+	return paths, err
+}
+
+// stripRepositoryMetadata removes metadata from every image already in
+// the repository in a single commit. When nothing needs stripping no
+// commit is made and oid is nil
+func stripRepositoryMetadata(user User) (oid *git.Oid, paths []string, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer repo.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ht.Free()
+
+	paths, err = imagesWithMetadata(repo, ht)
+	if err != nil || len(paths) == 0 {
+		return nil, paths, err
+	}
+
+	index, err := repo.Index()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer index.Free()
+
+	for _, path := range paths {
+
+		te, err := ht.EntryByPath(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		blob, err := repo.LookupBlob(te.Id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stripped, err := stripMetadataFromBytes(path, blob.Contents())
+		blob.Free()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		id, err := repo.CreateBlobFromBuffer(stripped)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ie := git.IndexEntry{
+			Id:   id,
+			Path: path,
+			Size: uint32(len(stripped)),
+			Mode: te.Filemode,
+			Gid:  uint32(os.Getgid()),
+			Uid:  uint32(os.Getuid()),
+		}
+
+		err = index.Add(&ie)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	message := fmt.Sprintf("Remove metadata from %d images", len(paths))
+
+	oid, err = writeTreeAndCommit(repo, index, message, user)
+
+	return oid, paths, err
+}
+
+// imageMetadataCommand lists the images in the repository containing
+// metadata and, when strip is set, removes it. The return value is the
+// exit status
+func imageMetadataCommand(strip bool) int {
+
+	if strip {
+		oid, paths, err := stripRepositoryMetadata(maintenanceUser)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not strip metadata:", err.Error())
+			return 1
+		}
+
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+
+		if oid == nil {
+			fmt.Println("No images contain metadata")
+			return 0
+		}
+
+		fmt.Printf("Removed metadata from %d images in %s\n", len(paths), oid)
+		return 0
+	}
+
+	repo, err := repository(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not open repository:", err.Error())
+		return 1
+	}
+	defer repo.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read repository:", err.Error())
+		return 1
+	}
+	defer ht.Free()
+
+	paths, err := imagesWithMetadata(repo, ht)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not scan images:", err.Error())
+		return 1
+	}
+
+	for _, path := range paths {
+		fmt.Println(path)
+	}
+
+	fmt.Printf("%d images contain metadata\n", len(paths))
+	return 0
+}
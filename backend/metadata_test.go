@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gpsMarker stands in for the coordinates a camera would record
+var gpsMarker = []byte("GPSLatitude 39.7817 N GPSLongitude 89.6501 W")
+
+// jpegWithExif inserts an APP1 segment straight after the start of image
+func jpegWithExif() []byte {
+
+	plain := testImage(20, 20, "jpeg")
+
+	payload := append([]byte("Exif\x00\x00"), gpsMarker...)
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	return append(append(append([]byte{}, plain[:2]...), segment...), plain[2:]...)
+}
+
+// pngWithText inserts a tEXt chunk straight after the header chunk
+func pngWithText() []byte {
+
+	plain := testImage(20, 20, "png")
+
+	// signature (8) and IHDR (4 length, 4 type, 13 data, 4 crc)
+	split := 8 + 25
+
+	data := append([]byte("Comment\x00"), gpsMarker...)
+	chunk := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, []byte("tEXt")...)
+	chunk = append(chunk, data...)
+
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+
+	return append(append(append([]byte{}, plain[:split]...), chunk...), plain[split:]...)
+}
+
+func Test_stripMetadata(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+	}{
+		{name: "JPEG", filename: "photo.jpg", data: jpegWithExif()},
+		{name: "PNG", filename: "photo.png", data: pngWithText()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			assert.True(t, bytes.Contains(tt.data, gpsMarker))
+
+			stripped, err := stripMetadataFromBytes(tt.filename, tt.data)
+			assert.Nil(t, err)
+			assert.False(t, bytes.Contains(stripped, gpsMarker))
+
+			// the image itself is untouched
+			_, _, err = image.Decode(bytes.NewReader(stripped))
+			assert.Nil(t, err)
+
+			again, _ := stripMetadataFromBytes(tt.filename, stripped)
+			assert.Equal(t, stripped, again)
+
+			streamed, err := ioutil.ReadAll(stripMetadata(tt.filename, bytes.NewReader(tt.data)))
+			assert.Nil(t, err)
+			assert.Equal(t, stripped, streamed)
+		})
+	}
+
+	t.Run("Orientation", func(t *testing.T) {
+
+		data := withOrientation(jpegWithExif(), 6)
+		assert.Equal(t, 6, exifOrientation(data))
+
+		stripped, err := stripMetadataFromBytes("photo.jpg", data)
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(stripped, gpsMarker))
+		assert.Equal(t, 6, exifOrientation(stripped))
+
+		again, _ := stripMetadataFromBytes("photo.jpg", stripped)
+		assert.Equal(t, stripped, again)
+
+		// upright images don't need any EXIF at all
+		stripped, _ = stripMetadataFromBytes("photo.jpg", withOrientation(jpegWithExif(), 1))
+		assert.Nil(t, exifData(stripped))
+	})
+
+	t.Run("Other categories", func(t *testing.T) {
+		data := jpegWithExif()
+		stripped, _ := stripMetadataFromBytes("photo.json", data)
+		assert.Equal(t, data, stripped)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		config.StripMetadata = []string{}
+		defer func() { config.StripMetadata = nil }()
+
+		data := jpegWithExif()
+		stripped, _ := stripMetadataFromBytes("photo.jpg", data)
+		assert.Equal(t, data, stripped)
+	})
+
+	t.Run("Not really an image", func(t *testing.T) {
+		stripped, err := stripMetadataFromBytes("photo.jpg", []byte("plain text"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("plain text"), stripped)
+	})
+}
+
+func Test_stripRepositoryMetadata(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/strip_metadata"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	// written directly, as they would have been before metadata was stripped
+	_, err := writeFiles(
+		repo,
+		NewCommit{
+			Message: "Add photos",
+			Files: []NewCommitFile{
+				NewCommitFile{Path: "documents", Document: "document_1/images", Filename: "springfield.jpg", Body: string(jpegWithExif())},
+				NewCommitFile{Path: "documents", Document: "document_1/images", Filename: "shelbyville.png", Body: string(testImage(10, 10, "png"))},
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	ht, _ := headTree(repo)
+	paths, err := imagesWithMetadata(repo, ht)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"documents/document_1/images/springfield.jpg"}, paths)
+
+	oid, stripped, err := stripRepositoryMetadata(maintenanceUser)
+	assert.Nil(t, err)
+	assert.Equal(t, paths, stripped)
+
+	commit, _ := repo.LookupCommit(oid)
+	assert.Equal(t, "Remove metadata from 1 images", commit.Message())
+
+	contents, _ := ioutil.ReadFile(repoPath + "/documents/document_1/images/springfield.jpg")
+	assert.False(t, bytes.Contains(contents, gpsMarker))
+
+	// nothing left to do
+	oid, _, err = stripRepositoryMetadata(maintenanceUser)
+	assert.Nil(t, err)
+	assert.Nil(t, oid)
+}
@@ -40,6 +40,14 @@ func (ncf NewCommitFile) ToMarkdown() (b []byte) {
 	return b
 }
 
+// isDocument returns true when a NewCommitFile will be written
+// as a Markdown document complete with frontmatter
+func (ncf NewCommitFile) isDocument() bool {
+	return !ncf.Base64Encoded &&
+		filepath.Ext(ncf.Filename) == ".md" &&
+		ncf.Filename != "_index.md"
+}
+
 // NewTranslation creates a new copy of a file ready for translation
 type NewTranslation struct {
 	SourceFilename string `json:"source_filename" validate:"required"`
@@ -62,13 +70,23 @@ func (nt NewTranslation) TargetFilename() string {
 // other than read/write it, and Go has no sane 'Date' type
 // https://github.com/golang/go/issues/21365
 type FrontMatter struct {
-	Author   string   `json:"author"         yaml:"author"`
-	Date     string   `json:"date,omitempty" yaml:"date"`
-	Draft    bool     `json:"draft"          yaml:"draft"`
-	Synopsis string   `json:"synopsis"       yaml:"synopsis"`
-	Tags     []string `json:"tags"           yaml:"tags"`
-	Title    string   `json:"title"          yaml:"title"`
-	Version  string   `json:"version"        yaml:"version"`
+	Author         string   `json:"author"                    yaml:"author"`
+	Authors        []string `json:"authors,omitempty"         yaml:"authors,omitempty"`
+	Date           string   `json:"date,omitempty"            yaml:"date"`
+	Draft          bool     `json:"draft"                     yaml:"draft"`
+	Expires        string   `json:"expires,omitempty"         yaml:"expires,omitempty"`
+	ID             string   `json:"id,omitempty"              yaml:"id,omitempty"`
+	Owner          string   `json:"owner,omitempty"           yaml:"owner,omitempty"`
+	PublishAt      string   `json:"publish_at,omitempty"      yaml:"publish_at,omitempty"`
+	ReviewBy       string   `json:"review_by,omitempty"       yaml:"review_by,omitempty"`
+	State          string   `json:"state"                     yaml:"state,omitempty"`
+	Synopsis       string   `json:"synopsis"                  yaml:"synopsis"`
+	Tags           []string `json:"tags"                      yaml:"tags"`
+	Title          string   `json:"title"                     yaml:"title"`
+	TranslatedFrom string   `json:"translated_from,omitempty" yaml:"translated_from,omitempty"`
+	UnpublishAt    string   `json:"unpublish_at,omitempty"    yaml:"unpublish_at,omitempty"`
+	Version        string   `json:"version"                   yaml:"version"`
+	Weight         int      `json:"weight"                    yaml:"weight,omitempty"`
 }
 
 // Directory contains the directory's metadata
@@ -125,11 +143,13 @@ type Language struct {
 // FileItem contains enough file information for listing
 // HTML and raw Markdown content is omitted
 type FileItem struct {
-	Filename    string      `json:"filename"`
-	Path        string      `json:"path"`
-	Document    string      `json:"document"`
-	Date        time.Time   `json:"updated_at"`
-	FrontMatter FrontMatter `json:"frontmatter"`
+	Filename    string        `json:"filename"`
+	Path        string        `json:"path"`
+	Document    string        `json:"document"`
+	Date        time.Time     `json:"updated_at"`
+	FrontMatter FrontMatter   `json:"frontmatter"`
+	State       string        `json:"state"`
+	Lock        *DocumentLock `json:"lock,omitempty"`
 }
 
 // File represents a Markdown file and can be returned with
@@ -145,6 +165,15 @@ type File struct {
 	DirectoryInfo  *DirectoryInfo  `json:"directory_info,omitempty"`
 	RepositoryInfo *RepositoryInfo `json:"repository_info,omitempty"`
 	Translations   []string        `json:"translations"`
+	IncomingLinks  []Reference     `json:"incoming_links"`
+	Lock           *DocumentLock   `json:"lock,omitempty"`
+	Authors        []Contributor   `json:"authors"`
+	Contributors   []Contributor   `json:"contributors"`
+
+	// translations say whether they've kept up with their source and
+	// sources list the languages whose translations haven't
+	TranslationStatus    *TranslationStatus `json:"translation_status,omitempty"`
+	OutdatedTranslations []string           `json:"outdated_translations,omitempty"`
 }
 
 // FullPath constructs the absolute path using the path, document and filename
@@ -166,7 +195,11 @@ type Attachment struct {
 	Filename  string `json:"filename"`
 	Extension string `json:"extension"`
 	MediaType string `json:"filetype"`
-	Data      string `json:"data"`
+	Size      int64  `json:"size"`
+	Oid       string `json:"oid"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	LFS       bool   `json:"lfs,omitempty"`
 }
 
 // Token holds a JSON Web Token
@@ -219,4 +252,5 @@ type Changeset struct {
 type ChangesetFiles struct {
 	Old string `json:"old,omitempty"`
 	New string `json:"new,omitempty"`
+	LFS bool   `json:"lfs,omitempty"` // Old and New are LFS pointers
 }
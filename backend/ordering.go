@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/graphia/particle"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+// ErrInvalidOrder is returned when a new document order doesn't list
+// every document in the directory exactly once
+var ErrInvalidOrder = errors.New("order must contain every document in the directory exactly once")
+
+// DocumentOrder is the desired order of the documents in a directory,
+// it's written to the repository as each document's weight
+type DocumentOrder struct {
+	Message        string   `json:"message"`
+	Documents      []string `json:"documents" validate:"required"`
+	RepositoryInfo `json:"repository_info"`
+}
+
+// sortDocuments orders a directory listing by weight, as Hugo does.
+// Documents without a weight come after those with one and otherwise
+// keep their tree order. A document's files (its translations) are kept
+// together using the first weight found among them
+func sortDocuments(files []FileItem) {
+
+	weights := make(map[string]int)
+
+	for _, fi := range files {
+		if _, found := weights[fi.Document]; !found || weights[fi.Document] == 0 {
+			weights[fi.Document] = fi.FrontMatter.Weight
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		wi, wj := weights[files[i].Document], weights[files[j].Document]
+
+		switch {
+		case wi == wj:
+			return false
+		case wi == 0:
+			return false
+		case wj == 0:
+			return true
+		default:
+			return wi < wj
+		}
+	})
+}
+
+// reorderDocuments rewrites the weight of every Markdown file in the
+// directory's documents so they're listed in the supplied order. All
+// changes are made in a single commit, files already carrying the correct
+// weight are left alone
+func reorderDocuments(directory string, order DocumentOrder, user User) (oid *git.Oid, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	err = checkLatestRevision(repo, order.LatestRevision)
+	if err != nil {
+		return nil, err
+	}
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer ht.Free()
+
+	entry, _ := ht.EntryByPath(directory)
+	if entry == nil || entry.Type != git.ObjectTree {
+		return nil, ErrDirectoryNotFound
+	}
+
+	tree, err := repo.LookupTree(entry.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	existing, err := documentFiles(repo, directory, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(order.Documents) != len(existing) {
+		return nil, ErrInvalidOrder
+	}
+
+	var files []NewCommitFile
+
+	for i, document := range order.Documents {
+
+		ncfs, found := existing[document]
+		if !found {
+			return nil, ErrInvalidOrder
+		}
+
+		// prevent a document being listed twice
+		delete(existing, document)
+
+		for _, ncf := range ncfs {
+
+			if ncf.FrontMatter.Weight == i+1 {
+				continue
+			}
+
+			ncf.FrontMatter.Weight = i + 1
+			files = append(files, ncf)
+		}
+	}
+
+	// already in the right order, there's nothing to commit
+	if len(files) == 0 {
+		return getLatestRevision(repo)
+	}
+
+	message := order.Message
+	if message == "" {
+		message = fmt.Sprintf("Reorder documents in %s", directory)
+	}
+
+	nc := NewCommit{
+		Message:        message,
+		Files:          files,
+		RepositoryInfo: order.RepositoryInfo,
+	}
+
+	retainDocumentIDs(repo, nc.Files)
+
+	return writeFiles(repo, nc, user)
+}
+
+// documentFiles reads the Markdown files belonging to each document in the
+// directory's tree, keyed by document name
+func documentFiles(repo *git.Repository, directory string, tree *git.Tree) (documents map[string][]NewCommitFile, err error) {
+
+	documents = make(map[string][]NewCommitFile)
+
+	walkIterator := func(currentDir string, te *git.TreeEntry) int {
+
+		if te.Type != git.ObjectBlob || filepath.Ext(te.Name) != ".md" || te.Name == "_index.md" {
+			return 0
+		}
+
+		blob, err := repo.LookupBlob(te.Id)
+		if err != nil {
+			Warning.Println("Failed to find blob", te.Id)
+			return -1
+		}
+		defer blob.Free()
+
+		var fm FrontMatter
+
+		md, err := particle.YAMLEncoding.DecodeString(string(blob.Contents()), &fm)
+		if err != nil {
+			Warning.Println("Failed to read frontmatter", te.Id)
+			return -1
+		}
+
+		document := filepath.Clean(currentDir)
+
+		documents[document] = append(documents[document], NewCommitFile{
+			Path:        directory,
+			Document:    document,
+			Filename:    te.Name,
+			Body:        string(md),
+			FrontMatter: fm,
+		})
+
+		return 0
+	}
+
+	err = tree.Walk(walkIterator)
+
+	return documents, err
+}
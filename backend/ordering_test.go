@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func documentNames(files []FileItem) (names []string) {
+	for _, fi := range files {
+		names = append(names, fi.Document)
+	}
+	return names
+}
+
+func Test_sortDocuments(t *testing.T) {
+
+	files := []FileItem{
+		FileItem{Document: "document_1", Filename: "index.md"},
+		FileItem{Document: "document_2", Filename: "index.md", FrontMatter: FrontMatter{Weight: 2}},
+		FileItem{Document: "document_2", Filename: "index.sv.md"},
+		FileItem{Document: "document_3", Filename: "index.md"},
+		FileItem{Document: "document_4", Filename: "index.md", FrontMatter: FrontMatter{Weight: 1}},
+	}
+
+	sortDocuments(files)
+
+	// weighted documents first, translations stay with their document and
+	// unweighted documents keep their original order
+	assert.Equal(
+		t,
+		[]string{"document_4", "document_2", "document_2", "document_1", "document_3"},
+		documentNames(files),
+	)
+}
+
+func Test_reorderDocuments(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/reorder_documents"
+	lr, _ := setupTranslationsTestRepo(repoPath)
+
+	files, _ := getFilesInDir("documents")
+	assert.Equal(t, "document_1", files[0].Document)
+
+	t.Run("Missing documents", func(t *testing.T) {
+		order := DocumentOrder{
+			Documents:      []string{"document_3", "document_1"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+		_, err := reorderDocuments("documents", order, mh)
+		assert.Equal(t, ErrInvalidOrder, err)
+	})
+
+	t.Run("Duplicate documents", func(t *testing.T) {
+		order := DocumentOrder{
+			Documents:      []string{"document_3", "document_1", "document_3"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+		_, err := reorderDocuments("documents", order, mh)
+		assert.Equal(t, ErrInvalidOrder, err)
+	})
+
+	t.Run("Missing directory", func(t *testing.T) {
+		order := DocumentOrder{
+			Documents:      []string{"document_1"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+		_, err := reorderDocuments("nothing", order, mh)
+		assert.Equal(t, ErrDirectoryNotFound, err)
+	})
+
+	t.Run("Out of sync", func(t *testing.T) {
+		order := DocumentOrder{
+			Documents:      []string{"document_3", "document_1", "document_2"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: "0000000000000000000000000000000000000000"},
+		}
+		_, err := reorderDocuments("documents", order, mh)
+		assert.Equal(t, ErrRepoOutOfSync, err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		order := DocumentOrder{
+			Documents:      []string{"document_3", "document_1", "document_2"},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		}
+
+		oid, err := reorderDocuments("documents", order, mh)
+		assert.Nil(t, err)
+
+		repo, _ := repository(config)
+		defer repo.Free()
+
+		// one commit covering every file, translations included
+		commit, _ := repo.LookupCommit(oid)
+		assert.Equal(t, lr.String(), commit.ParentId(0).String())
+		assert.Equal(t, "Reorder documents in documents", commit.Message())
+
+		files, _ := getFilesInDir("documents")
+
+		assert.Equal(
+			t,
+			[]string{"document_3", "document_3", "document_1", "document_1", "document_2", "document_2", "document_2"},
+			documentNames(files),
+		)
+
+		for _, fi := range files {
+			assert.NotZero(t, fi.FrontMatter.Weight)
+		}
+
+		// the document bodies are untouched
+		file, _ := getRawFile("documents", "document_1", "index.md")
+		assert.Contains(t, *file.Markdown, "Lorem ipsum")
+	})
+}
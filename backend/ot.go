@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// ErrOperationMismatch is returned when an operation can't be applied to
+// or transformed against a document or operation of a different length
+var ErrOperationMismatch = errors.New("operation does not match document length")
+
+// TextOperation is a sequence of retains, inserts and deletes that covers an
+// entire document. It's a port of ot.js's TextOperation and uses the same
+// JSON representation, an array where positive integers are retains,
+// negative integers deletes and strings inserts, so the browser can use
+// ot.js directly. Lengths are in UTF-16 code units to match JavaScript
+type TextOperation struct {
+	components   []opComponent
+	baseLength   int
+	targetLength int
+}
+
+// opComponent is a single step of an operation, only one field is set
+type opComponent struct {
+	retain int
+	delete int
+	insert string
+}
+
+func utf16Length(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// Retain skips over n characters
+func (op *TextOperation) Retain(n int) *TextOperation {
+	if n <= 0 {
+		return op
+	}
+
+	op.baseLength += n
+	op.targetLength += n
+
+	if last := len(op.components) - 1; last >= 0 && op.components[last].retain > 0 {
+		op.components[last].retain += n
+		return op
+	}
+
+	op.components = append(op.components, opComponent{retain: n})
+	return op
+}
+
+// Insert adds the string at the current position
+func (op *TextOperation) Insert(s string) *TextOperation {
+	if s == "" {
+		return op
+	}
+
+	op.targetLength += utf16Length(s)
+
+	last := len(op.components) - 1
+
+	// merge with a preceding insert
+	if last >= 0 && op.components[last].insert != "" {
+		op.components[last].insert += s
+		return op
+	}
+
+	// inserts always come before deletes at the same position, this
+	// keeps operations that have the same effect identical
+	if last >= 0 && op.components[last].delete > 0 {
+		if last > 0 && op.components[last-1].insert != "" {
+			op.components[last-1].insert += s
+			return op
+		}
+
+		op.components = append(op.components, op.components[last])
+		op.components[last] = opComponent{insert: s}
+		return op
+	}
+
+	op.components = append(op.components, opComponent{insert: s})
+	return op
+}
+
+// Delete removes n characters from the current position
+func (op *TextOperation) Delete(n int) *TextOperation {
+	if n <= 0 {
+		return op
+	}
+
+	op.baseLength += n
+
+	if last := len(op.components) - 1; last >= 0 && op.components[last].delete > 0 {
+		op.components[last].delete += n
+		return op
+	}
+
+	op.components = append(op.components, opComponent{delete: n})
+	return op
+}
+
+// isNoop returns true if the operation leaves the document unchanged
+func (op *TextOperation) isNoop() bool {
+	return len(op.components) == 0 || (len(op.components) == 1 && op.components[0].retain > 0)
+}
+
+// Apply performs the operation on the document, which is supplied and
+// returned as UTF-16
+func (op *TextOperation) Apply(doc []uint16) ([]uint16, error) {
+
+	if len(doc) != op.baseLength {
+		return nil, ErrOperationMismatch
+	}
+
+	result := make([]uint16, 0, op.targetLength)
+	i := 0
+
+	for _, c := range op.components {
+		switch {
+		case c.retain > 0:
+			result = append(result, doc[i:i+c.retain]...)
+			i += c.retain
+		case c.insert != "":
+			result = append(result, utf16.Encode([]rune(c.insert))...)
+		case c.delete > 0:
+			i += c.delete
+		}
+	}
+
+	return result, nil
+}
+
+// MarshalJSON encodes the operation in ot.js's format
+func (op TextOperation) MarshalJSON() ([]byte, error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	parts := []interface{}{}
+
+	for _, c := range op.components {
+		switch {
+		case c.retain > 0:
+			parts = append(parts, c.retain)
+		case c.insert != "":
+			parts = append(parts, c.insert)
+		case c.delete > 0:
+			parts = append(parts, -c.delete)
+		}
+	}
+
+	return json.Marshal(parts)
+}
+
+// UnmarshalJSON decodes an operation in ot.js's format
+func (op *TextOperation) UnmarshalJSON(data []byte) error {
+
+	var parts []interface{}
+
+	err := json.Unmarshal(data, &parts)
+	if err != nil {
+		return err
+	}
+
+	*op = TextOperation{}
+
+	for _, part := range parts {
+		switch v := part.(type) {
+		case float64:
+			if v != float64(int(v)) || v == 0 {
+				return fmt.Errorf("invalid operation component %v", v)
+			}
+			if v > 0 {
+				op.Retain(int(v))
+			} else {
+				op.Delete(int(-v))
+			}
+		case string:
+			op.Insert(v)
+		default:
+			return fmt.Errorf("invalid operation component %v", v)
+		}
+	}
+
+	return nil
+}
+
+// transformOperations takes two operations made concurrently to the same
+// document and returns versions of them that can be applied after each
+// other, so that apply(apply(doc, a), b') == apply(apply(doc, b), a').
+// When both insert at the same position a's insert comes first
+func transformOperations(a, b *TextOperation) (aPrime, bPrime *TextOperation, err error) {
+
+	if a.baseLength != b.baseLength {
+		return nil, nil, ErrOperationMismatch
+	}
+
+	aPrime, bPrime = &TextOperation{}, &TextOperation{}
+
+	// work on copies, components are consumed as we go
+	ac := append([]opComponent{}, a.components...)
+	bc := append([]opComponent{}, b.components...)
+
+	var c1, c2 *opComponent
+
+	next := func(cs *[]opComponent) *opComponent {
+		if len(*cs) == 0 {
+			return nil
+		}
+		c := (*cs)[0]
+		*cs = (*cs)[1:]
+		return &c
+	}
+
+	c1, c2 = next(&ac), next(&bc)
+
+	for c1 != nil || c2 != nil {
+
+		if c1 != nil && c1.insert != "" {
+			aPrime.Insert(c1.insert)
+			bPrime.Retain(utf16Length(c1.insert))
+			c1 = next(&ac)
+			continue
+		}
+
+		if c2 != nil && c2.insert != "" {
+			aPrime.Retain(utf16Length(c2.insert))
+			bPrime.Insert(c2.insert)
+			c2 = next(&bc)
+			continue
+		}
+
+		if c1 == nil || c2 == nil {
+			return nil, nil, ErrOperationMismatch
+		}
+
+		switch {
+
+		case c1.retain > 0 && c2.retain > 0:
+			min := minInt(c1.retain, c2.retain)
+			aPrime.Retain(min)
+			bPrime.Retain(min)
+			c1, c2 = consume(c1, min, &ac, next), consume(c2, min, &bc, next)
+
+		case c1.delete > 0 && c2.delete > 0:
+			// both deleted the same text, nothing left to do
+			min := minInt(c1.delete, c2.delete)
+			c1, c2 = consume(c1, min, &ac, next), consume(c2, min, &bc, next)
+
+		case c1.delete > 0 && c2.retain > 0:
+			min := minInt(c1.delete, c2.retain)
+			aPrime.Delete(min)
+			c1, c2 = consume(c1, min, &ac, next), consume(c2, min, &bc, next)
+
+		case c1.retain > 0 && c2.delete > 0:
+			min := minInt(c1.retain, c2.delete)
+			bPrime.Delete(min)
+			c1, c2 = consume(c1, min, &ac, next), consume(c2, min, &bc, next)
+		}
+	}
+
+	return aPrime, bPrime, nil
+}
+
+// diffOperation returns an operation that turns before into after. Only
+// the common prefix and suffix are retained, which is all that's needed
+// to transform changes made elsewhere against it
+func diffOperation(before, after []uint16) *TextOperation {
+
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(before)-prefix && suffix < len(after)-prefix &&
+		before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+
+	inserted := after[prefix : len(after)-suffix]
+
+	return (&TextOperation{}).
+		Retain(prefix).
+		Delete(len(before) - prefix - suffix).
+		Insert(string(utf16.Decode(inserted))).
+		Retain(suffix)
+}
+
+// transformIndex moves a position in the document the operation was made
+// to so it refers to the same place afterwards, a port of ot.js's
+// Selection transform
+func transformIndex(op *TextOperation, index int) int {
+
+	transformed := index
+
+	for _, c := range op.components {
+
+		switch {
+		case c.retain > 0:
+			index -= c.retain
+		case c.insert != "":
+			transformed += utf16Length(c.insert)
+		case c.delete > 0:
+			transformed -= minInt(index, c.delete)
+			index -= c.delete
+		}
+
+		if index < 0 {
+			break
+		}
+	}
+
+	return transformed
+}
+
+// consume shortens a retain or delete by n, moving on to the next
+// component once it's been used up
+func consume(c *opComponent, n int, cs *[]opComponent, next func(*[]opComponent) *opComponent) *opComponent {
+
+	if c.retain > 0 {
+		c.retain -= n
+		if c.retain == 0 {
+			return next(cs)
+		}
+		return c
+	}
+
+	c.delete -= n
+	if c.delete == 0 {
+		return next(cs)
+	}
+	return c
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func apply(t *testing.T, op *TextOperation, doc string) string {
+	result, err := op.Apply(utf16.Encode([]rune(doc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(utf16.Decode(result))
+}
+
+func TestTextOperationApply(t *testing.T) {
+
+	op := (&TextOperation{}).Retain(4).Insert("slow ").Delete(6).Retain(9)
+
+	assert.Equal(t, "The slow brown fox", apply(t, op, "The quick brown fox"))
+
+	_, err := op.Apply(utf16.Encode([]rune("Too short")))
+	assert.Equal(t, ErrOperationMismatch, err)
+}
+
+func TestTextOperationJSON(t *testing.T) {
+
+	op := (&TextOperation{}).Retain(4).Delete(6).Insert("slow ").Retain(9)
+
+	data, err := json.Marshal(op)
+	assert.Nil(t, err)
+
+	// inserts are always placed before deletes
+	assert.Equal(t, `[4,"slow ",-6,9]`, string(data))
+
+	var decoded TextOperation
+	err = json.Unmarshal(data, &decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, *op, decoded)
+
+	assert.NotNil(t, json.Unmarshal([]byte(`[4, true]`), &decoded))
+	assert.NotNil(t, json.Unmarshal([]byte(`[4, 1.5]`), &decoded))
+}
+
+func TestTextOperationUTF16(t *testing.T) {
+
+	// the emoji is two UTF-16 code units, as it would be in the browser
+	doc := "Hi 👋 there"
+
+	op := (&TextOperation{}).Retain(5).Insert(" and welcome").Retain(6)
+
+	assert.Equal(t, "Hi 👋 and welcome there", apply(t, op, doc))
+}
+
+func Test_diffOperation(t *testing.T) {
+
+	tests := []struct {
+		before string
+		after  string
+	}{
+		{before: "The quick brown fox", after: "The slow brown fox"},
+		{before: "The quick brown fox", after: "The quick brown fox jumped"},
+		{before: "The quick brown fox", after: "quick brown fox"},
+		{before: "The quick brown fox", after: "The quick brown fox"},
+		{before: "", after: "Hi 👋 there"},
+		{before: "aaa", after: "aaaa"},
+	}
+
+	for _, tt := range tests {
+		op := diffOperation(utf16.Encode([]rune(tt.before)), utf16.Encode([]rune(tt.after)))
+		assert.Equal(t, tt.after, apply(t, op, tt.before), tt.after)
+	}
+
+	op := diffOperation(utf16.Encode([]rune("The quick brown fox")), utf16.Encode([]rune("The slow brown fox")))
+	assert.Equal(t, (&TextOperation{}).Retain(4).Delete(5).Insert("slow").Retain(10), op)
+
+	assert.True(t, diffOperation(utf16.Encode([]rune("fox")), utf16.Encode([]rune("fox"))).isNoop())
+}
+
+func Test_transformIndex(t *testing.T) {
+
+	// "The quick brown fox" to "The slow brown fox"
+	op := (&TextOperation{}).Retain(4).Delete(5).Insert("slow").Retain(10)
+
+	assert.Equal(t, 2, transformIndex(op, 2))
+	// inserts at the index move it along
+	assert.Equal(t, 8, transformIndex(op, 4))
+	assert.Equal(t, 8, transformIndex(op, 6))
+	assert.Equal(t, 14, transformIndex(op, 15))
+
+	assert.Equal(t, 9, transformIndex((&TextOperation{}).Insert("First ").Retain(10), 3))
+}
+
+func Test_transformOperations(t *testing.T) {
+
+	doc := "The quick brown fox"
+
+	tests := []struct {
+		name     string
+		a, b     *TextOperation
+		expected string
+	}{
+		{
+			name:     "Inserts at different positions",
+			a:        (&TextOperation{}).Retain(4).Insert("very ").Retain(15),
+			b:        (&TextOperation{}).Retain(19).Insert(" jumped"),
+			expected: "The very quick brown fox jumped",
+		},
+		{
+			name:     "Inserts at the same position",
+			a:        (&TextOperation{}).Retain(4).Insert("A").Retain(15),
+			b:        (&TextOperation{}).Retain(4).Insert("B").Retain(15),
+			expected: "The ABquick brown fox",
+		},
+		{
+			name:     "Overlapping deletes",
+			a:        (&TextOperation{}).Retain(4).Delete(6).Retain(9),
+			b:        (&TextOperation{}).Retain(8).Delete(8).Retain(3),
+			expected: "The fox",
+		},
+		{
+			name:     "Insert inside a deletion",
+			a:        (&TextOperation{}).Retain(4).Delete(6).Retain(9),
+			b:        (&TextOperation{}).Retain(6).Insert("!!").Retain(13),
+			expected: "The !!brown fox",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			aPrime, bPrime, err := transformOperations(tt.a, tt.b)
+			assert.Nil(t, err)
+
+			// whichever order they're applied in, the result is the same
+			ab := apply(t, bPrime, apply(t, tt.a, doc))
+			ba := apply(t, aPrime, apply(t, tt.b, doc))
+
+			assert.Equal(t, tt.expected, ab)
+			assert.Equal(t, tt.expected, ba)
+		})
+	}
+
+	t.Run("Mismatched lengths", func(t *testing.T) {
+		_, _, err := transformOperations(
+			(&TextOperation{}).Retain(3),
+			(&TextOperation{}).Retain(4),
+		)
+		assert.Equal(t, ErrOperationMismatch, err)
+	})
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/asdine/storm"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+// sniffLength is the most http.DetectContentType considers
+const sniffLength = 512
+
+var (
+	// ErrStorageQuotaExceeded is returned when a commit would take the
+	// author's attachments over their storage quota
+	ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+
+	// sniffableTypes are the media types http.DetectContentType recognises
+	// by signature. Files claiming to be one of these must really be one,
+	// and files that turn out to be one must be named accordingly
+	sniffableTypes = map[string]bool{
+		"image/bmp": true, "image/gif": true, "image/jpeg": true, "image/png": true,
+		"image/webp": true, "image/x-icon": true,
+		"application/pdf": true, "application/postscript": true, "application/ogg": true,
+		"application/zip": true, "application/x-gzip": true, "application/x-rar-compressed": true,
+		"application/wasm": true, "application/vnd.ms-fontobject": true,
+		"audio/aiff": true, "audio/basic": true, "audio/midi": true, "audio/mpeg": true, "audio/wave": true,
+		"video/avi": true, "video/mp4": true, "video/webm": true,
+		"font/otf": true, "font/ttf": true, "font/woff": true, "font/woff2": true,
+	}
+)
+
+// UploadPolicy restricts the files that can be committed to a top level
+// directory, a file category from file_categories, or a combination of
+// the two. When several policies apply to a file it must satisfy them all
+type UploadPolicy struct {
+	Directory  string   `yaml:"directory"`  // all directories when empty
+	Category   string   `yaml:"category"`   // all categories when empty
+	Extensions []string `yaml:"extensions"` // any extension when empty
+	MaxSize    int      `yaml:"max_size"`   // megabytes, no limit when zero
+	Sniff      bool     `yaml:"sniff"`      // contents must match the extension
+}
+
+// IncomingFile is a file being added or changed by a commit or push,
+// only the start of its contents is needed to check it
+type IncomingFile struct {
+	Path string
+	Oid  string
+	Size int64
+	Head []byte
+}
+
+// PolicyViolation describes why a file was rejected
+type PolicyViolation struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// PolicyViolationsError is returned when a commit contains files that
+// break the upload policies
+type PolicyViolationsError struct {
+	Violations []PolicyViolation
+}
+
+func (pve PolicyViolationsError) Error() string {
+	return fmt.Sprintf("%d file(s) break the upload policy", len(pve.Violations))
+}
+
+// StoredBlob records an attachment committed by a user, counting towards
+// their storage quota for as long as it remains in the repository
+type StoredBlob struct {
+	ID       int    `storm:"id,increment"`
+	Username string `storm:"index"`
+	Oid      string `storm:"index"`
+	Size     int64
+}
+
+func newIncomingFile(path, oid string, contents []byte) IncomingFile {
+
+	head := contents
+	if len(head) > sniffLength {
+		head = head[:sniffLength]
+	}
+
+	return IncomingFile{Path: path, Oid: oid, Size: int64(len(contents)), Head: head}
+}
+
+// countsTowardsQuota is true for anything other than documents
+func countsTowardsQuota(path string) bool {
+	return filepath.Ext(path) != ".md"
+}
+
+// storageQuota is the most each user can store in attachments, in bytes.
+// Zero means there is no limit
+func storageQuota() int64 {
+	if config.StorageQuota <= 0 {
+		return 0
+	}
+	return int64(config.StorageQuota) * 1024 * 1024
+}
+
+// appliesTo returns true if the file is in the policy's directory and
+// category. Documents are written by the editor so, as with quotas,
+// policies only apply to attachments
+func (up UploadPolicy) appliesTo(path string) bool {
+
+	if !countsTowardsQuota(path) {
+		return false
+	}
+
+	if up.Directory != "" && strings.SplitN(path, "/", 2)[0] != strings.Trim(up.Directory, "/") {
+		return false
+	}
+
+	if up.Category != "" && fileCategory(path) != up.Category {
+		return false
+	}
+
+	return true
+}
+
+// check returns the reasons the file breaks the policy, if any
+func (up UploadPolicy) check(file IncomingFile) (reasons []string) {
+
+	ext := strings.ToLower(filepath.Ext(file.Path))
+
+	if len(up.Extensions) > 0 {
+
+		allowed := false
+		for _, e := range up.Extensions {
+			if strings.ToLower(e) == ext {
+				allowed = true
+			}
+		}
+
+		if !allowed {
+			reasons = append(reasons, fmt.Sprintf("'%s' files are not allowed here", ext))
+		}
+	}
+
+	if up.MaxSize > 0 && file.Size > int64(up.MaxSize)*1024*1024 {
+		reasons = append(reasons, fmt.Sprintf("larger than %dMB", up.MaxSize))
+	}
+
+	if up.Sniff && !contentMatchesExtension(file.Path, file.Head) {
+		reasons = append(reasons, "contents don't match the extension")
+	}
+
+	return reasons
+}
+
+// contentMatchesExtension compares the media type the extension claims
+// with the one detected from the file's contents. The detector only
+// recognises a handful of binary formats, so anything it can't place is
+// accepted as long as it wasn't expected to recognise it
+func contentMatchesExtension(filename string, head []byte) bool {
+
+	sniffed := strings.SplitN(http.DetectContentType(head), ";", 2)[0]
+	declared := getMediaType(strings.ToLower(filepath.Ext(filename)))
+
+	if sniffed == declared {
+		return true
+	}
+
+	return !sniffableTypes[sniffed] && !sniffableTypes[declared]
+}
+
+// checkUploadPolicies checks every file against each of the policies that
+// apply to it, returning a PolicyViolationsError listing every problem
+func checkUploadPolicies(files []IncomingFile) error {
+
+	var violations []PolicyViolation
+
+	for _, file := range files {
+		for _, policy := range config.UploadPolicies {
+
+			if !policy.appliesTo(file.Path) {
+				continue
+			}
+
+			for _, reason := range policy.check(file) {
+				violations = append(violations, PolicyViolation{Path: file.Path, Reason: reason})
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return PolicyViolationsError{Violations: violations}
+	}
+
+	return nil
+}
+
+// newStorage is the total size of the attachments being added that
+// aren't already somewhere in the repository
+func newStorage(files []IncomingFile, present map[string]bool) (size int64) {
+
+	counted := make(map[string]bool)
+
+	for _, file := range files {
+
+		if !countsTowardsQuota(file.Path) || present[file.Oid] || counted[file.Oid] {
+			continue
+		}
+
+		counted[file.Oid] = true
+		size += file.Size
+	}
+
+	return size
+}
+
+// storedOids returns the identifiers of every attachment in the tree
+func storedOids(tree *git.Tree) (oids map[string]bool, err error) {
+
+	oids = make(map[string]bool)
+
+	err = tree.Walk(func(root string, te *git.TreeEntry) int {
+		if te.Type == git.ObjectBlob && countsTowardsQuota(te.Name) {
+			oids[te.Id.String()] = true
+		}
+		return 0
+	})
+
+	return oids, err
+}
+
+// storageUsed totals the attachments committed by the user that are
+// still in the repository, copies are only counted once
+func storageUsed(username string, present map[string]bool) (used int64, err error) {
+
+	var blobs []StoredBlob
+
+	err = db.Find("Username", username, &blobs)
+	if err == storm.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	counted := make(map[string]bool)
+
+	for _, blob := range blobs {
+
+		if !present[blob.Oid] || counted[blob.Oid] {
+			continue
+		}
+
+		counted[blob.Oid] = true
+		used += blob.Size
+	}
+
+	return used, nil
+}
+
+// storageRemaining is how much more the user can store, or -1 when
+// there's no quota
+func storageRemaining(repo *git.Repository, username string) (int64, error) {
+
+	quota := storageQuota()
+	if quota == 0 {
+		return -1, nil
+	}
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return 0, err
+	}
+	defer ht.Free()
+
+	present, err := storedOids(ht)
+	if err != nil {
+		return 0, err
+	}
+
+	used, err := storageUsed(username, present)
+	if err != nil {
+		return 0, err
+	}
+
+	if used > quota {
+		return 0, nil
+	}
+
+	return quota - used, nil
+}
+
+// recordStorage notes the attachments a user has committed, so they
+// count towards the user's quota
+func recordStorage(username string, files []IncomingFile) error {
+
+	var blobs []StoredBlob
+
+	err := db.Find("Username", username, &blobs)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	recorded := make(map[string]bool)
+	for _, blob := range blobs {
+		recorded[blob.Oid] = true
+	}
+
+	for _, file := range files {
+
+		if !countsTowardsQuota(file.Path) || recorded[file.Oid] {
+			continue
+		}
+
+		err = db.Save(&StoredBlob{Username: username, Oid: file.Oid, Size: file.Size})
+		if err != nil {
+			return err
+		}
+
+		recorded[file.Oid] = true
+	}
+
+	return nil
+}
+
+// sniffingRequired is true when a policy that checks the file's contents
+// applies to it
+func sniffingRequired(path string) bool {
+	for _, policy := range config.UploadPolicies {
+		if policy.Sniff && policy.appliesTo(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// newIncomingBlob describes the blob using its size from the object
+// database. As libgit2 loads a blob's entire contents, they're only read
+// for files small enough to be LFS pointers or that need sniffing
+func newIncomingBlob(repo *git.Repository, odb *git.Odb, path string, oid *git.Oid) (file IncomingFile, err error) {
+
+	size, _, err := odb.ReadHeader(oid)
+	if err != nil {
+		return file, err
+	}
+
+	file = IncomingFile{Path: path, Oid: oid.String(), Size: int64(size)}
+
+	if size > maxLFSPointerSize && !sniffingRequired(path) {
+		return file, nil
+	}
+
+	blob, err := repo.LookupBlob(oid)
+	if err != nil {
+		return file, err
+	}
+	defer blob.Free()
+
+	return resolveLFSIncomingFile(newIncomingFile(path, oid.String(), blob.Contents()))
+}
+
+// incomingFiles lists the blobs added or changed between the trees
+func incomingFiles(repo *git.Repository, oldTree, newTree *git.Tree) (files []IncomingFile, err error) {
+
+	odb, err := repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	defer odb.Free()
+
+	diff, err := repo.DiffTreeToTree(oldTree, newTree, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+
+	err = diff.ForEach(func(delta git.DiffDelta, progress float64) (git.DiffForEachHunkCallback, error) {
+
+		if delta.Status != git.DeltaAdded && delta.Status != git.DeltaModified {
+			return nil, nil
+		}
+
+		file, err := newIncomingBlob(repo, odb, delta.NewFile.Path, delta.NewFile.Oid)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, file)
+
+		return nil, nil
+
+	}, git.DiffDetailFiles)
+
+	return files, err
+}
+
+// enforceUploadPolicies checks the files a commit of tree would add
+// against the upload policies and the author's storage quota, returning
+// the files so they can be recorded once committed
+func enforceUploadPolicies(repo *git.Repository, tree *git.Tree, author User) (files []IncomingFile, err error) {
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer ht.Free()
+
+	files, err = incomingFiles(repo, ht, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkUploadPolicies(files)
+	if err != nil {
+		return nil, err
+	}
+
+	// maintenance commands run without the database and don't add to
+	// anyone's storage
+	quota := storageQuota()
+	if quota == 0 || author.Username == maintenanceUser.Username {
+		return files, nil
+	}
+
+	present, err := storedOids(ht)
+	if err != nil {
+		return nil, err
+	}
+
+	used, err := storageUsed(author.Username, present)
+	if err != nil {
+		return nil, err
+	}
+
+	if used+newStorage(files, present) > quota {
+		return nil, ErrStorageQuotaExceeded
+	}
+
+	return files, nil
+}
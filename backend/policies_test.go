@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPolicy_appliesTo(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		policy   UploadPolicy
+		path     string
+		expected bool
+	}{
+		{name: "Everything", policy: UploadPolicy{}, path: "documents/document_1/images/cat.jpg", expected: true},
+		{name: "Directory", policy: UploadPolicy{Directory: "documents"}, path: "documents/document_1/images/cat.jpg", expected: true},
+		{name: "Other directory", policy: UploadPolicy{Directory: "appendices"}, path: "documents/document_1/images/cat.jpg", expected: false},
+		{name: "Directory prefix", policy: UploadPolicy{Directory: "doc"}, path: "documents/document_1/images/cat.jpg", expected: false},
+		{name: "Category", policy: UploadPolicy{Category: "images"}, path: "documents/document_1/images/cat.jpg", expected: true},
+		{name: "Other category", policy: UploadPolicy{Category: "images"}, path: "documents/document_1/data/data.csv", expected: false},
+		{name: "Both", policy: UploadPolicy{Directory: "documents", Category: "images"}, path: "appendices/appendix_1/images/cat.jpg", expected: false},
+		{name: "Document", policy: UploadPolicy{}, path: "documents/document_1/index.md", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.policy.appliesTo(tt.path))
+		})
+	}
+}
+
+func Test_sniffingRequired(t *testing.T) {
+
+	config.UploadPolicies = []UploadPolicy{
+		UploadPolicy{Category: "images", Sniff: true},
+		UploadPolicy{Directory: "documents", MaxSize: 1},
+	}
+	defer func() { config.UploadPolicies = nil }()
+
+	assert.True(t, sniffingRequired("documents/document_1/images/cat.jpg"))
+	assert.False(t, sniffingRequired("documents/document_1/data/data.csv"))
+	assert.False(t, sniffingRequired("documents/document_1/index.md"))
+}
+
+func TestUploadPolicy_check(t *testing.T) {
+
+	png := testImage(10, 10, "png")
+
+	tests := []struct {
+		name    string
+		policy  UploadPolicy
+		file    IncomingFile
+		reasons []string
+	}{
+		{
+			name:   "Allowed",
+			policy: UploadPolicy{Extensions: []string{".png"}, MaxSize: 1, Sniff: true},
+			file:   newIncomingFile("images/cat.png", "", png),
+		},
+		{
+			name:    "Extension",
+			policy:  UploadPolicy{Extensions: []string{".jpg", ".gif"}},
+			file:    newIncomingFile("images/cat.png", "", png),
+			reasons: []string{"'.png' files are not allowed here"},
+		},
+		{
+			name:   "Extension case",
+			policy: UploadPolicy{Extensions: []string{".PNG"}},
+			file:   newIncomingFile("images/cat.png", "", png),
+		},
+		{
+			name:    "Too large",
+			policy:  UploadPolicy{MaxSize: 1},
+			file:    IncomingFile{Path: "data/large.csv", Size: 2 * 1024 * 1024},
+			reasons: []string{"larger than 1MB"},
+		},
+		{
+			name:    "Disguised",
+			policy:  UploadPolicy{Sniff: true},
+			file:    newIncomingFile("images/cat.jpg", "", png),
+			reasons: []string{"contents don't match the extension"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.reasons, tt.policy.check(tt.file))
+		})
+	}
+}
+
+func Test_contentMatchesExtension(t *testing.T) {
+
+	png := testImage(10, 10, "png")
+
+	tests := []struct {
+		name     string
+		filename string
+		contents []byte
+		expected bool
+	}{
+		{name: "PNG", filename: "cat.png", contents: png, expected: true},
+		{name: "PNG named as JPEG", filename: "cat.jpg", contents: png, expected: false},
+		{name: "Text named as PNG", filename: "cat.png", contents: []byte("<script>alert('hi')</script>"), expected: false},
+		{name: "PNG named as CSV", filename: "data.csv", contents: png, expected: false},
+		{name: "CSV", filename: "data.csv", contents: []byte("name,age\nLisa,8\n"), expected: true},
+		{name: "Unrecognised", filename: "query.sql", contents: []byte("select * from springfield;"), expected: true},
+		{name: "Empty image", filename: "empty.gif", contents: []byte{}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, contentMatchesExtension(tt.filename, tt.contents))
+		})
+	}
+}
+
+func Test_checkUploadPolicies(t *testing.T) {
+
+	config.UploadPolicies = []UploadPolicy{
+		UploadPolicy{Category: "images", Extensions: []string{".png", ".jpg"}},
+		UploadPolicy{Directory: "documents", MaxSize: 1},
+	}
+	defer func() { config.UploadPolicies = nil }()
+
+	files := []IncomingFile{
+		IncomingFile{Path: "documents/document_1/images/cat.png", Size: 1024},
+		IncomingFile{Path: "documents/document_1/images/dog.gif", Size: 2 * 1024 * 1024},
+		IncomingFile{Path: "appendices/appendix_1/data/data.csv", Size: 2 * 1024 * 1024},
+	}
+
+	err := checkUploadPolicies(files)
+
+	pve, ok := err.(PolicyViolationsError)
+	assert.True(t, ok)
+	assert.Equal(t,
+		[]PolicyViolation{
+			PolicyViolation{Path: "documents/document_1/images/dog.gif", Reason: "'.gif' files are not allowed here"},
+			PolicyViolation{Path: "documents/document_1/images/dog.gif", Reason: "larger than 1MB"},
+		},
+		pve.Violations,
+	)
+
+	assert.Nil(t, checkUploadPolicies(files[:1]))
+}
+
+func Test_newStorage(t *testing.T) {
+
+	files := []IncomingFile{
+		IncomingFile{Path: "documents/document_1/index.md", Oid: "a", Size: 100},
+		IncomingFile{Path: "documents/document_1/images/cat.png", Oid: "b", Size: 200},
+		IncomingFile{Path: "documents/document_2/images/cat.png", Oid: "b", Size: 200},
+		IncomingFile{Path: "documents/document_2/images/dog.png", Oid: "c", Size: 400},
+	}
+
+	assert.Equal(t, int64(600), newStorage(files, map[string]bool{}))
+	assert.Equal(t, int64(200), newStorage(files, map[string]bool{"c": true}))
+}
+
+func Test_enforceUploadPolicies(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/enforce_upload_policies"
+
+	upload := func(filename string, contents []byte) error {
+
+		repo, _ := repository(config)
+		defer repo.Free()
+
+		lr, _ := getLatestRevision(repo)
+
+		u, err := createBlobFromReader(repo, filename, bytes.NewReader(contents), maxAttachmentSize())
+		if err != nil {
+			return err
+		}
+
+		nc := NewCommit{Message: "Add " + filename, RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}
+
+		_, err = commitUploads("documents", "document_1", []Upload{u}, nc, mh)
+		return err
+	}
+
+	t.Run("Disguised file rejected", func(t *testing.T) {
+		setupSmallTestRepo(repoPath)
+
+		config.UploadPolicies = []UploadPolicy{UploadPolicy{Category: "images", Sniff: true}}
+		defer func() { config.UploadPolicies = nil }()
+
+		err := upload("cat.png", []byte("<html><script>alert('hi')</script></html>"))
+
+		pve, ok := err.(PolicyViolationsError)
+		assert.True(t, ok)
+		assert.Equal(t, "documents/document_1/images/cat.png", pve.Violations[0].Path)
+
+		assert.Nil(t, upload("cat.png", testImage(10, 10, "png")))
+	})
+
+	t.Run("Storage quota", func(t *testing.T) {
+		setupSmallTestRepo(repoPath)
+		db.Drop(&StoredBlob{})
+
+		config.StorageQuota = 1
+		defer func() { config.StorageQuota = 0 }()
+
+		large := []byte(strings.Repeat("a", 600*1024))
+
+		assert.Nil(t, upload("first.txt", large))
+
+		// identical contents are already stored
+		assert.Nil(t, upload("copy.txt", large))
+
+		err := upload("second.txt", []byte(strings.Repeat("b", 600*1024)))
+		assert.Equal(t, ErrStorageQuotaExceeded, err)
+
+		repo, _ := repository(config)
+		defer repo.Free()
+
+		remaining, err := storageRemaining(repo, mh.Username)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1024*1024-600*1024), remaining)
+	})
+
+	t.Run("Maintenance commits skip the quota", func(t *testing.T) {
+		setupSmallTestRepo(repoPath)
+
+		config.StorageQuota = 1
+		defer func() { config.StorageQuota = 0 }()
+
+		// maintenance commands run before the database is opened
+		original := db
+		db = storm.DB{}
+		defer func() { db = original }()
+
+		repo, _ := repository(config)
+		defer repo.Free()
+
+		ht, _ := headTree(repo)
+		defer ht.Free()
+
+		_, err := enforceUploadPolicies(repo, ht, maintenanceUser)
+		assert.Nil(t, err)
+	})
+}
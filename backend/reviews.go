@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+const (
+	defaultReviewReminderInterval = 7 // days
+
+	// reviewCheckInterval is how often overdue documents are looked for,
+	// reminders themselves are limited by the reminder interval
+	reviewCheckInterval = time.Hour
+)
+
+// ReviewDocument is a document that's due for review or has expired
+type ReviewDocument struct {
+	DocumentLocation
+	Title    string `json:"title"`
+	Owner    string `json:"owner"`
+	ReviewBy string `json:"review_by,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	Overdue  bool   `json:"overdue"`
+	Expired  bool   `json:"expired"`
+}
+
+// ReviewOwner is a user along with the documents they're responsible for
+// that need attention. Documents without an owner are listed with an
+// empty Owner
+type ReviewOwner struct {
+	Owner     string           `json:"owner"`
+	Documents []ReviewDocument `json:"documents"`
+}
+
+// ReviewReminder records when a user was last sent a reminder so they
+// aren't sent one every time overdue documents are checked
+type ReviewReminder struct {
+	Username string    `json:"username" storm:"id"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+// reviewReminderInterval is the minimum time between reminders to a user
+func reviewReminderInterval() time.Duration {
+	days := config.ReviewReminderInterval
+	if days <= 0 {
+		days = defaultReviewReminderInterval
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// parseReviewDate accepts plain dates, as used by the date field, as
+// well as the times accepted by the scheduler
+func parseReviewDate(value string) (time.Time, error) {
+
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err == nil {
+		return t, nil
+	}
+
+	return parseScheduleTime(value)
+}
+
+// reviewStatus returns the document's review details if it's overdue for
+// review or has expired at the supplied time
+func (fm FrontMatter) reviewStatus(dl DocumentLocation, now time.Time) (rd ReviewDocument, due bool) {
+
+	rd = ReviewDocument{
+		DocumentLocation: dl,
+		Title:            fm.Title,
+		Owner:            fm.Owner,
+		ReviewBy:         fm.ReviewBy,
+		Expires:          fm.Expires,
+	}
+
+	if fm.ReviewBy != "" {
+		at, err := parseReviewDate(fm.ReviewBy)
+		if err != nil {
+			Warning.Printf("Ignoring review_by in %s, %s", dl.FullPath(), err.Error())
+		} else {
+			rd.Overdue = !now.Before(at)
+		}
+	}
+
+	if fm.Expires != "" {
+		at, err := parseReviewDate(fm.Expires)
+		if err != nil {
+			Warning.Printf("Ignoring expires in %s, %s", dl.FullPath(), err.Error())
+		} else {
+			rd.Expired = !now.Before(at)
+		}
+	}
+
+	return rd, rd.Overdue || rd.Expired
+}
+
+// getOverdueDocuments returns the documents due for review or expired by
+// now, grouped by owner. When owner is supplied only their documents
+// are returned
+func getOverdueDocuments(owner string, now time.Time) (owners []ReviewOwner, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	owners = []ReviewOwner{}
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	grouped := make(map[string][]ReviewDocument)
+
+	err = walkDocuments(repo, func(dl DocumentLocation, fm FrontMatter) {
+
+		rd, due := fm.reviewStatus(dl, now)
+		if !due {
+			return
+		}
+
+		grouped[rd.Owner] = append(grouped[rd.Owner], rd)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for o, documents := range grouped {
+
+		if owner != "" && o != owner {
+			continue
+		}
+
+		owners = append(owners, ReviewOwner{Owner: o, Documents: documents})
+	}
+
+	sort.Slice(owners, func(i, j int) bool {
+		return owners[i].Owner < owners[j].Owner
+	})
+
+	return owners, nil
+}
+
+// sendReviewReminders emails each owner a list of their overdue
+// documents. Documents without an owner, or whose owner no longer has
+// an account, are sent to the administrators instead. Users are reminded
+// at most once per reminder interval
+func sendReviewReminders(now time.Time) (sent int, err error) {
+
+	owners, err := getOverdueDocuments("", now)
+	if err != nil {
+		return 0, err
+	}
+
+	recipients := make(map[string]User)
+	documents := make(map[string][]ReviewDocument)
+
+	for _, ro := range owners {
+
+		users := []User{}
+
+		if ro.Owner != "" {
+			user, err := getUserByUsername(ro.Owner)
+			if err == nil {
+				users = append(users, user)
+			}
+		}
+
+		if len(users) == 0 {
+			users, err = administrators()
+			if err != nil {
+				return sent, err
+			}
+		}
+
+		for _, user := range users {
+			recipients[user.Username] = user
+			documents[user.Username] = append(documents[user.Username], ro.Documents...)
+		}
+	}
+
+	for username, user := range recipients {
+
+		var rr ReviewReminder
+
+		err = db.One("Username", username, &rr)
+		if err != nil && err != storm.ErrNotFound {
+			return sent, err
+		}
+
+		if err == nil && now.Sub(rr.SentAt) < reviewReminderInterval() {
+			continue
+		}
+
+		err = sendReviewReminder(user, documents[username])
+		if err != nil {
+			Error.Println("Could not send review reminder to", username, err.Error())
+			continue
+		}
+
+		err = db.Save(&ReviewReminder{Username: username, SentAt: now})
+		if err != nil {
+			return sent, err
+		}
+
+		sent++
+	}
+
+	return sent, nil
+}
+
+func administrators() (admins []User, err error) {
+
+	var users []User
+
+	err = db.All(&users)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if user.Admin && user.Active {
+			admins = append(admins, user)
+		}
+	}
+
+	return admins, nil
+}
+
+func sendReviewReminder(user User, documents []ReviewDocument) error {
+	var ed emailData
+	var body bytes.Buffer
+
+	tmpl, err := loadTemplate("review_reminder")
+	if err != nil {
+		return err
+	}
+
+	ed = emailData{
+		User:        user,
+		Subject:     fmt.Sprintf("%d documents need reviewing", len(documents)),
+		Documents:   documents,
+		EmailConfig: extractEmailConfigFromConfig(config),
+	}
+
+	if len(documents) == 1 {
+		ed.Subject = fmt.Sprintf("%s needs reviewing", documents[0].Title)
+	}
+
+	err = tmpl.ExecuteTemplate(&body, "review_reminder", ed)
+	if err != nil {
+		return err
+	}
+
+	ed.setBody(body.String())
+
+	return mailer.send(ed)
+}
+
+// startReviewReminders checks for overdue documents regularly in the
+// background until stop is called
+func startReviewReminders() (stop func()) {
+	return runEvery(reviewCheckInterval, func() {
+
+		sent, err := sendReviewReminders(time.Now())
+		if err != nil {
+			Error.Println("Review reminders failed", err.Error())
+		}
+
+		if sent > 0 {
+			Info.Println("Sent review reminders to", sent, "users")
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrontMatterReviewStatus(t *testing.T) {
+
+	now := time.Date(2018, 5, 14, 9, 0, 0, 0, time.Local)
+	dl := DocumentLocation{Path: "policies", Document: "data_protection", Filename: "index.md"}
+
+	tests := []struct {
+		name    string
+		fm      FrontMatter
+		overdue bool
+		expired bool
+	}{
+		{name: "No dates", fm: FrontMatter{}},
+		{name: "Review due later", fm: FrontMatter{ReviewBy: "2018-06-01"}},
+		{name: "Review due today", fm: FrontMatter{ReviewBy: "2018-05-14"}, overdue: true},
+		{name: "Review overdue", fm: FrontMatter{ReviewBy: "2017-05-14"}, overdue: true},
+		{name: "Expired", fm: FrontMatter{Expires: "2018-05-14T08:00"}, expired: true},
+		{name: "Expiring later", fm: FrontMatter{Expires: "2018-05-14T10:00"}},
+		{name: "Invalid", fm: FrontMatter{ReviewBy: "annually"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, due := tt.fm.reviewStatus(dl, now)
+			assert.Equal(t, tt.overdue || tt.expired, due)
+			assert.Equal(t, tt.overdue, rd.Overdue)
+			assert.Equal(t, tt.expired, rd.Expired)
+		})
+	}
+}
+
+func Test_sendReviewReminders(t *testing.T) {
+
+	db.Drop("User")
+	db.Drop("ReviewReminder")
+
+	_ = createUser(mh)
+	_ = createUser(ck)
+
+	repoPath := "../tests/tmp/repositories/review_reminders"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	review := func(document string, fm FrontMatter) NewCommitFile {
+		file, _ := getRawFile("documents", document, "index.md")
+		fm.Title = file.FrontMatter.Title
+		return NewCommitFile{Path: "documents", Document: document, Filename: "index.md", Body: *file.Markdown, FrontMatter: fm}
+	}
+
+	_, err := writeFiles(
+		repo,
+		NewCommit{
+			Message: "Set review dates",
+			Files: []NewCommitFile{
+				review("document_1", FrontMatter{Owner: mh.Username, ReviewBy: "2018-01-01"}),
+				review("document_2", FrontMatter{Expires: "2018-01-01"}),
+				review("document_3", FrontMatter{Owner: ck.Username, ReviewBy: "2999-01-01"}),
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	t.Run("Overdue documents by owner", func(t *testing.T) {
+
+		owners, err := getOverdueDocuments("", now)
+		assert.Nil(t, err)
+
+		if assert.Len(t, owners, 2) {
+			assert.Empty(t, owners[0].Owner)
+			assert.Equal(t, "document_2", owners[0].Documents[0].Document)
+			assert.True(t, owners[0].Documents[0].Expired)
+
+			assert.Equal(t, mh.Username, owners[1].Owner)
+			assert.Equal(t, "document_1", owners[1].Documents[0].Document)
+			assert.True(t, owners[1].Documents[0].Overdue)
+		}
+
+		owners, _ = getOverdueDocuments(mh.Username, now)
+		assert.Len(t, owners, 1)
+
+		owners, _ = getOverdueDocuments(ck.Username, now)
+		assert.Len(t, owners, 0)
+	})
+
+	reminders := func(to string) (found []emailRecorder) {
+		for _, er := range queue {
+			if er.To == to && strings.HasSuffix(er.Subject, "needs reviewing") {
+				found = append(found, er)
+			}
+		}
+		return found
+	}
+
+	t.Run("Reminders", func(t *testing.T) {
+
+		sent, err := sendReviewReminders(now)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, sent)
+
+		// owners are sent their own documents
+		if sent := reminders(mh.Email); assert.Len(t, sent, 1) {
+			assert.Equal(t, "document 1 needs reviewing", sent[0].Subject)
+			assert.Contains(t, sent[0].Body, fmt.Sprintf("Dear %s,", mh.Name))
+			assert.Contains(t, sent[0].Body, fmt.Sprintf("%s/cms/documents/document_1", config.URL))
+		}
+
+		// and administrators are sent those without an owner
+		if sent := reminders(ck.Email); assert.Len(t, sent, 1) {
+			assert.Contains(t, sent[0].Body, "expired on 2018-01-01")
+		}
+	})
+
+	t.Run("Reminders aren't repeated straight away", func(t *testing.T) {
+
+		sent, _ := sendReviewReminders(now.Add(time.Hour))
+		assert.Equal(t, 0, sent)
+
+		sent, _ = sendReviewReminders(now.Add(reviewReminderInterval()))
+		assert.Equal(t, 2, sent)
+	})
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+const (
+	defaultScanTimeout = 30 // seconds
+
+	// clamdChunkSize is how much of a file is sent in each INSTREAM chunk,
+	// clamd's StreamMaxLength limits the total rather than the chunks
+	clamdChunkSize = 64 * 1024
+
+	// pusherEnv passes the username of whoever's pushing from the SSH
+	// server to the pre-receive hook, so quarantined files can be traced
+	pusherEnv = "GRAPHIA_PUSHER"
+)
+
+var (
+	// ErrScannerUnavailable is returned when files can't be scanned, they
+	// aren't committed until they can be
+	ErrScannerUnavailable = errors.New("content scanner unavailable")
+
+	// ErrUnknownScanner is returned when the configured scanner isn't
+	// one that's supported
+	ErrUnknownScanner = errors.New("unknown content scanner")
+
+	// ErrScanTooLarge is returned when a file is larger than the scanner
+	// accepts and oversized files aren't allowed through unscanned
+	ErrScanTooLarge = errors.New("file too large to be scanned")
+)
+
+// Scanner checks files for malware before they're committed. Scan returns
+// the name of what was found or an empty string if the file is clean
+type Scanner interface {
+	Name() string
+	Scan(r io.Reader) (signature string, err error)
+}
+
+// ScanResult is the outcome of scanning one incoming file
+type ScanResult struct {
+	Path      string `json:"path"`
+	Oid       string `json:"oid"`
+	Clean     bool   `json:"clean"`
+	Signature string `json:"signature,omitempty"`
+	Scanner   string `json:"scanner"`
+	Unscanned bool   `json:"unscanned,omitempty"` // too large, allowed by scan_oversized
+}
+
+// ScanRecord keeps the results of scanning a commit's files so they can
+// be reported and audited later
+type ScanRecord struct {
+	ID        int    `storm:"id,increment"`
+	Commit    string `storm:"index"`
+	ScannedAt time.Time
+	ScanResult
+}
+
+// QuarantinedFile describes a rejected file, it's written alongside the
+// file's contents in the quarantine directory
+type QuarantinedFile struct {
+	Path          string    `json:"path"`
+	Oid           string    `json:"oid"`
+	Signature     string    `json:"signature"`
+	Username      string    `json:"username"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// ScanRejectedError is returned when a commit contains files the scanner
+// found malware in
+type ScanRejectedError struct {
+	Results []ScanResult
+}
+
+func (sre ScanRejectedError) Error() string {
+	return fmt.Sprintf("%d infected file(s) found", len(sre.Results))
+}
+
+// ClamdScanner scans files with ClamAV's daemon, streaming them over a
+// TCP or unix socket with the INSTREAM command
+type ClamdScanner struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// newClamdScanner accepts addresses like tcp://127.0.0.1:3310 and
+// unix:///var/run/clamav/clamd.ctl
+func newClamdScanner(address string) (cs ClamdScanner, err error) {
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return cs, err
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		cs.Network, cs.Address = "tcp", u.Host
+	case "unix":
+		cs.Network, cs.Address = "unix", u.Path
+	default:
+		return cs, fmt.Errorf("clamd address must be tcp:// or unix://, not %s", address)
+	}
+
+	cs.Timeout = scanTimeout()
+
+	return cs, nil
+}
+
+// Name identifies the scanner in results
+func (cs ClamdScanner) Name() string {
+	return "clamd"
+}
+
+// Scan streams the file to clamd in length-prefixed chunks, ending with a
+// zero length chunk, and reads the verdict
+func (cs ClamdScanner) Scan(r io.Reader) (signature string, err error) {
+
+	conn, err := net.DialTimeout(cs.Network, cs.Address, cs.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(cs.Timeout))
+
+	_, err = conn.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return "", err
+	}
+
+	chunk := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+
+	for {
+		n, err := r.Read(chunk)
+
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+
+			_, werr := conn.Write(append(size, chunk[:n]...))
+			if werr != nil {
+				// clamd replies and hangs up as soon as the stream is
+				// longer than it accepts
+				if _, perr := parseClamdReply(readClamdReply(conn)); perr == ErrScanTooLarge {
+					return "", perr
+				}
+				return "", werr
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	_, err = conn.Write([]byte{0, 0, 0, 0})
+	if err != nil {
+		return "", err
+	}
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+
+	return parseClamdReply(string(reply))
+}
+
+// readClamdReply reads whatever clamd has sent, ignoring any error
+func readClamdReply(conn net.Conn) string {
+	reply, _ := ioutil.ReadAll(conn)
+	return string(reply)
+}
+
+// parseClamdReply interprets replies like "stream: OK" and
+// "stream: Eicar-Test-Signature FOUND". Files over clamd's
+// StreamMaxLength are ErrScanTooLarge
+func parseClamdReply(reply string) (signature string, err error) {
+
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	verdict := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case verdict == "OK":
+		return "", nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return strings.TrimSuffix(verdict, " FOUND"), nil
+	case strings.HasPrefix(verdict, "INSTREAM size limit exceeded"):
+		return "", ErrScanTooLarge
+	}
+
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+func scanTimeout() time.Duration {
+	seconds := config.ScanTimeout
+	if seconds <= 0 {
+		seconds = defaultScanTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// allowOversized is true when files too large to be scanned are let
+// through rather than rejected
+func allowOversized() bool {
+	return config.ScanOversized == "allow"
+}
+
+// contentScanner returns the configured scanner, or nil when files
+// aren't scanned
+func contentScanner() (Scanner, error) {
+
+	switch config.Scanner {
+	case "":
+		return nil, nil
+	case "clamd":
+		return newClamdScanner(config.ClamdAddress)
+	}
+
+	return nil, ErrUnknownScanner
+}
+
+// quarantineDirectory is where rejected files are kept, by default next
+// to the database
+func quarantineDirectory() string {
+	if config.QuarantineDirectory == "" {
+		return filepath.Join(filepath.Dir(config.Database), "quarantine")
+	}
+	return config.QuarantineDirectory
+}
+
+// quarantine keeps a copy of a rejected file, named by its oid, and a
+// description of why it was rejected so it can be reviewed
+func quarantine(qf QuarantinedFile, contents io.Reader) error {
+
+	dir := quarantineDirectory()
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, qf.Oid), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, contents)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	description, err := json.MarshalIndent(qf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, qf.Oid+".json"), description, 0600)
+}
+
+// scanFiles scans every incoming attachment, documents aren't scanned.
+// contents opens a file by its oid so it can be streamed to the scanner.
+// Infected files are quarantined and the commit rejected with a
+// ScanRejectedError
+func scanFiles(s Scanner, files []IncomingFile, contents func(oid string) (io.ReadCloser, error), username string) (results []ScanResult, err error) {
+
+	if s == nil {
+		return nil, nil
+	}
+
+	var infected []ScanResult
+
+	for _, file := range files {
+
+		if !countsTowardsQuota(file.Path) {
+			continue
+		}
+
+		r, err := contents(file.Oid)
+		if err != nil {
+			return nil, err
+		}
+
+		signature, err := s.Scan(r)
+		r.Close()
+
+		if err == ErrScanTooLarge && allowOversized() {
+			Warning.Println("Allowing", file.Path, "from", username, "without scanning it, it's too large")
+			results = append(results, ScanResult{Path: file.Path, Oid: file.Oid, Scanner: s.Name(), Unscanned: true})
+			continue
+		}
+
+		if err == ErrScanTooLarge {
+			Warning.Println("Rejected", file.Path, "from", username, "as it's too large to scan")
+			return nil, err
+		}
+
+		if err != nil {
+			Error.Println("Could not scan", file.Path, err.Error())
+			return nil, ErrScannerUnavailable
+		}
+
+		result := ScanResult{
+			Path:      file.Path,
+			Oid:       file.Oid,
+			Clean:     signature == "",
+			Signature: signature,
+			Scanner:   s.Name(),
+		}
+
+		results = append(results, result)
+
+		if result.Clean {
+			continue
+		}
+
+		infected = append(infected, result)
+
+		qf := QuarantinedFile{
+			Path:          file.Path,
+			Oid:           file.Oid,
+			Signature:     signature,
+			Username:      username,
+			QuarantinedAt: time.Now(),
+		}
+
+		r, err = contents(file.Oid)
+		if err == nil {
+			err = quarantine(qf, r)
+			r.Close()
+		}
+		if err != nil {
+			Error.Println("Could not quarantine", file.Path, err.Error())
+		}
+
+		Warning.Printf("Rejected %s from %s, found %s", file.Path, username, signature)
+	}
+
+	if len(infected) > 0 {
+		return results, ScanRejectedError{Results: infected}
+	}
+
+	return results, nil
+}
+
+// scanIncomingFiles scans the files a commit adds or changes, reading
+// them from the repository's object database
+func scanIncomingFiles(repo *git.Repository, files []IncomingFile, author User) ([]ScanResult, error) {
+
+	s, err := contentScanner()
+	if err != nil {
+		return nil, err
+	}
+
+	contents := func(oid string) (io.ReadCloser, error) {
+
+		id, err := git.NewOid(oid)
+		if err != nil {
+			return nil, err
+		}
+
+		blob, err := repo.LookupBlob(id)
+		if err != nil {
+			return nil, err
+		}
+		defer blob.Free()
+
+		return openBlob(blob)
+	}
+
+	return scanFiles(s, files, contents, author.Username)
+}
+
+// recordScanResults stores the results against the commit they were
+// scanned for
+func recordScanResults(commit *git.Oid, results []ScanResult) error {
+
+	for _, result := range results {
+		sr := ScanRecord{Commit: commit.String(), ScannedAt: time.Now(), ScanResult: result}
+
+		err := db.Save(&sr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commitScanResults returns the results of scanning the commit's files,
+// there are none if scanning is disabled or only documents changed
+func commitScanResults(commit *git.Oid) []ScanResult {
+
+	var records []ScanRecord
+
+	err := db.Find("Commit", commit.String(), &records)
+	if err != nil {
+		return nil
+	}
+
+	results := make([]ScanResult, len(records))
+	for i, record := range records {
+		results[i] = record.ScanResult
+	}
+
+	return results
+}
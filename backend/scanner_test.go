@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eicar is the industry standard test file, every scanner detects it
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd speaks enough of clamd's protocol to answer INSTREAM scans,
+// reporting files containing the EICAR string as infected. It returns
+// the address to connect to and the number of bytes of each stream
+func fakeClamd(t *testing.T) (address string, received *[]int) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received = &[]int{}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			var contents bytes.Buffer
+
+			command := make([]byte, len("zINSTREAM\x00"))
+			io.ReadFull(conn, command)
+
+			for {
+				var size uint32
+				if binary.Read(conn, binary.BigEndian, &size) != nil || size == 0 {
+					break
+				}
+				io.CopyN(&contents, conn, int64(size))
+			}
+
+			*received = append(*received, contents.Len())
+
+			if strings.Contains(contents.String(), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE") {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+
+			conn.Close()
+		}
+	}()
+
+	return "tcp://" + listener.Addr().String(), received
+}
+
+// useFakeClamd configures scanning with a fake clamd and a temporary
+// quarantine, returning a function that restores the configuration
+func useFakeClamd(t *testing.T) (quarantine string, reset func()) {
+
+	address, _ := fakeClamd(t)
+
+	quarantine = "../tests/tmp/quarantine"
+	os.RemoveAll(quarantine)
+
+	config.Scanner = "clamd"
+	config.ClamdAddress = address
+	config.QuarantineDirectory = quarantine
+
+	return quarantine, func() {
+		config.Scanner = ""
+		config.ClamdAddress = ""
+		config.QuarantineDirectory = ""
+	}
+}
+
+func Test_parseClamdReply(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		reply     string
+		signature string
+		err       bool
+	}{
+		{name: "Clean", reply: "stream: OK\x00"},
+		{name: "Infected", reply: "stream: Eicar-Test-Signature FOUND\x00", signature: "Eicar-Test-Signature"},
+		{name: "Newline terminated", reply: "stream: Win.Trojan.Agent-1 FOUND\n", signature: "Win.Trojan.Agent-1"},
+		{name: "Too large", reply: "INSTREAM size limit exceeded. ERROR\x00", err: true},
+		{name: "Error", reply: "stream: Can't allocate memory ERROR\x00", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature, err := parseClamdReply(tt.reply)
+			assert.Equal(t, tt.signature, signature)
+			assert.Equal(t, tt.err, err != nil)
+		})
+	}
+}
+
+// oversizedScanner rejects everything as clamd does files over its
+// StreamMaxLength
+type oversizedScanner struct{}
+
+func (oversizedScanner) Name() string {
+	return "oversized"
+}
+
+func (oversizedScanner) Scan(r io.Reader) (string, error) {
+	return "", ErrScanTooLarge
+}
+
+func Test_scanFilesOversized(t *testing.T) {
+
+	files := []IncomingFile{IncomingFile{Path: "documents/document_1/files/video.mp4", Oid: "a1b2c3"}}
+
+	contents := func(oid string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("a very long video")), nil
+	}
+
+	t.Run("Rejected", func(t *testing.T) {
+		_, err := scanFiles(oversizedScanner{}, files, contents, mh.Username)
+		assert.Equal(t, ErrScanTooLarge, err)
+	})
+
+	t.Run("Allowed", func(t *testing.T) {
+		config.ScanOversized = "allow"
+		defer func() { config.ScanOversized = "" }()
+
+		results, err := scanFiles(oversizedScanner{}, files, contents, mh.Username)
+		assert.Nil(t, err)
+		if assert.Len(t, results, 1) {
+			assert.True(t, results[0].Unscanned)
+			assert.False(t, results[0].Clean)
+		}
+	})
+}
+
+func Test_newClamdScanner(t *testing.T) {
+
+	cs, err := newClamdScanner("tcp://127.0.0.1:3310")
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp", cs.Network)
+	assert.Equal(t, "127.0.0.1:3310", cs.Address)
+	assert.Equal(t, time.Duration(defaultScanTimeout)*time.Second, cs.Timeout)
+
+	cs, err = newClamdScanner("unix:///var/run/clamav/clamd.ctl")
+	assert.Nil(t, err)
+	assert.Equal(t, "unix", cs.Network)
+	assert.Equal(t, "/var/run/clamav/clamd.ctl", cs.Address)
+
+	_, err = newClamdScanner("127.0.0.1:3310")
+	assert.NotNil(t, err)
+}
+
+func TestClamdScanner_Scan(t *testing.T) {
+
+	address, received := fakeClamd(t)
+	cs, _ := newClamdScanner(address)
+
+	t.Run("Clean", func(t *testing.T) {
+		signature, err := cs.Scan(strings.NewReader("name,age\nBart,10\n"))
+		assert.Nil(t, err)
+		assert.Equal(t, "", signature)
+	})
+
+	t.Run("Infected", func(t *testing.T) {
+		signature, err := cs.Scan(strings.NewReader(eicar))
+		assert.Nil(t, err)
+		assert.Equal(t, "Eicar-Test-Signature", signature)
+	})
+
+	t.Run("Several chunks", func(t *testing.T) {
+		large := bytes.Repeat([]byte("a"), clamdChunkSize*2+10)
+		_, err := cs.Scan(bytes.NewReader(large))
+		assert.Nil(t, err)
+		assert.Equal(t, len(large), (*received)[len(*received)-1])
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		unavailable, _ := newClamdScanner("tcp://127.0.0.1:1")
+		_, err := unavailable.Scan(strings.NewReader(eicar))
+		assert.NotNil(t, err)
+	})
+}
+
+func Test_contentScanner(t *testing.T) {
+
+	s, err := contentScanner()
+	assert.Nil(t, s)
+	assert.Nil(t, err)
+
+	config.Scanner = "virustotal"
+	defer func() { config.Scanner = "" }()
+
+	_, err = contentScanner()
+	assert.Equal(t, ErrUnknownScanner, err)
+}
+
+func Test_scanIncomingFiles(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/scan_incoming_files"
+
+	quarantine, reset := useFakeClamd(t)
+	defer reset()
+
+	upload := func(filename, contents string) (string, error) {
+
+		repo, _ := repository(config)
+		defer repo.Free()
+
+		lr, _ := getLatestRevision(repo)
+
+		u, err := createBlobFromReader(repo, filename, strings.NewReader(contents), maxAttachmentSize())
+		if err != nil {
+			return "", err
+		}
+
+		nc := NewCommit{Message: "Add " + filename, RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}
+
+		oid, err := commitUploads("documents", "document_1", []Upload{u}, nc, mh)
+		if err != nil {
+			return "", err
+		}
+
+		return oid.String(), nil
+	}
+
+	t.Run("Clean", func(t *testing.T) {
+		setupSmallTestRepo(repoPath)
+
+		oid, err := upload("notes.txt", "Remember to feed Santa's Little Helper")
+		assert.Nil(t, err)
+
+		repo, _ := repository(config)
+		defer repo.Free()
+
+		head, _ := getLatestRevision(repo)
+		assert.Equal(t, oid, head.String())
+
+		results := commitScanResults(head)
+		assert.Len(t, results, 1)
+		assert.Equal(t, "documents/document_1/files/notes.txt", results[0].Path)
+		assert.True(t, results[0].Clean)
+		assert.Equal(t, "clamd", results[0].Scanner)
+	})
+
+	t.Run("Infected", func(t *testing.T) {
+		setupSmallTestRepo(repoPath)
+
+		_, err := upload("totally-safe.txt", eicar)
+
+		sre, ok := err.(ScanRejectedError)
+		assert.True(t, ok)
+		assert.Len(t, sre.Results, 1)
+		assert.False(t, sre.Results[0].Clean)
+		assert.Equal(t, "Eicar-Test-Signature", sre.Results[0].Signature)
+
+		// kept in quarantine with a description
+		contents, err := ioutil.ReadFile(filepath.Join(quarantine, sre.Results[0].Oid))
+		assert.Nil(t, err)
+		assert.Equal(t, eicar, string(contents))
+
+		var qf QuarantinedFile
+		description, _ := ioutil.ReadFile(filepath.Join(quarantine, sre.Results[0].Oid+".json"))
+		json.Unmarshal(description, &qf)
+		assert.Equal(t, mh.Username, qf.Username)
+		assert.Equal(t, "Eicar-Test-Signature", qf.Signature)
+
+		// and never committed
+		_, err = os.Stat(filepath.Join(repoPath, "documents/document_1/files/totally-safe.txt"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Scanner unavailable", func(t *testing.T) {
+		setupSmallTestRepo(repoPath)
+
+		config.ClamdAddress = "tcp://127.0.0.1:1"
+
+		_, err := upload("notes.txt", "Remember to feed Santa's Little Helper")
+		assert.Equal(t, ErrScannerUnavailable, err)
+	})
+}
+
+func Test_scanPushedFiles(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/scan_pushed_files"
+	before, after := setupPushTestRepo(repoPath, []byte(eicar))
+
+	_, reset := useFakeClamd(t)
+	defer reset()
+
+	gitDir, _ := filepath.Abs(filepath.Join(repoPath, ".git"))
+	os.Setenv("GIT_DIR", gitDir)
+	defer os.Unsetenv("GIT_DIR")
+
+	var stderr bytes.Buffer
+	push := fmt.Sprintf("%s %s refs/heads/master\n", before, after)
+
+	assert.Equal(t, 1, preReceiveCommand(strings.NewReader(push), &stderr))
+	assert.Contains(t, stderr.String(), "documents/document_1/images/cat.png: Eicar-Test-Signature")
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+const (
+	defaultScheduleInterval = 60
+
+	schedulePublish   = "publish"
+	scheduleUnpublish = "unpublish"
+)
+
+var (
+	// ErrScheduleForbidden is returned when a user changes when a document
+	// is published or withdrawn without being permitted to make the
+	// transitions the scheduler would make on their behalf
+	ErrScheduleForbidden = errors.New("not permitted to schedule this change")
+
+	// scheduleTimeLayouts are the formats accepted for publish_at and
+	// unpublish_at, times without a zone are in the server's local time
+	scheduleTimeLayouts = []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04",
+		"2006-01-02 15:04",
+	}
+
+	// schedulerUser is the author of commits made by the scheduler
+	schedulerUser = User{Username: "scheduler", Name: "Graphia CMS Scheduler"}
+)
+
+// ScheduledChange is a document's publication or withdrawal that is due
+// to happen at a specific time. The schedule lives in the frontmatter so
+// it's versioned with the document and survives restarts
+type ScheduledChange struct {
+	DocumentLocation
+	Action string    `json:"action"`
+	At     time.Time `json:"at"`
+}
+
+// scheduleInterval is how often the scheduler checks for due changes
+func scheduleInterval() time.Duration {
+	if config.ScheduleInterval <= 0 {
+		return defaultScheduleInterval * time.Second
+	}
+	return time.Duration(config.ScheduleInterval) * time.Second
+}
+
+func parseScheduleTime(value string) (t time.Time, err error) {
+	for _, layout := range scheduleTimeLayouts {
+		t, err = time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return t, fmt.Errorf("'%s' is not a valid time", value)
+}
+
+// scheduled returns the changes requested by a document's frontmatter
+func (fm FrontMatter) scheduled(dl DocumentLocation) (changes []ScheduledChange) {
+
+	requested := []struct{ action, value string }{
+		{schedulePublish, fm.PublishAt},
+		{scheduleUnpublish, fm.UnpublishAt},
+	}
+
+	for _, r := range requested {
+
+		action, value := r.action, r.value
+
+		if value == "" {
+			continue
+		}
+
+		at, err := parseScheduleTime(value)
+		if err != nil {
+			Warning.Printf("Ignoring %s_at in %s, %s", action, dl.FullPath(), err.Error())
+			continue
+		}
+
+		changes = append(changes, ScheduledChange{DocumentLocation: dl, Action: action, At: at})
+	}
+
+	return changes
+}
+
+// schedulePermitted returns true if the user may make every transition
+// the scheduler could use to publish (or withdraw) a document
+func (wf Workflow) schedulePermitted(publish bool, user User) bool {
+
+	for _, t := range wf.Transitions {
+
+		if wf.published(t.To) != publish {
+			continue
+		}
+
+		for _, from := range t.From {
+			if wf.published(from) != publish && !t.permitted(user) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// checkScheduleChanges prevents users from setting, moving or clearing
+// publish_at and unpublish_at unless they could make the change
+// themselves, the scheduler runs as schedulerUser so doesn't check
+func checkScheduleChanges(repo *git.Repository, files []NewCommitFile, user User) error {
+
+	wf := currentWorkflow()
+
+	for _, ncf := range files {
+
+		if !ncf.isDocument() {
+			continue
+		}
+
+		fm, _ := existingFrontMatter(repo, filepath.Join(ncf.Path, ncf.Document, ncf.Filename))
+
+		if ncf.FrontMatter.PublishAt != fm.PublishAt && !wf.schedulePermitted(true, user) {
+			return ErrScheduleForbidden
+		}
+
+		if ncf.FrontMatter.UnpublishAt != fm.UnpublishAt && !wf.schedulePermitted(false, user) {
+			return ErrScheduleForbidden
+		}
+	}
+
+	return nil
+}
+
+// scheduledChanges walks the head tree collecting every scheduled change,
+// earliest first
+func scheduledChanges(repo *git.Repository) (changes []ScheduledChange, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	changes = []ScheduledChange{}
+
+	err = walkDocuments(repo, func(dl DocumentLocation, fm FrontMatter) {
+		changes = append(changes, fm.scheduled(dl)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].At.Before(changes[j].At)
+	})
+
+	return changes, nil
+}
+
+// getScheduledChanges returns the changes that are yet to happen
+func getScheduledChanges() (changes []ScheduledChange, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	return scheduledChanges(repo)
+}
+
+// runScheduledChanges applies every change due by now, one commit per
+// document, and rebuilds the site if anything was committed. Changes
+// missed while the server was down are due so are caught up here
+func runScheduledChanges(now time.Time) (oids []*git.Oid, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	changes, err := scheduledChanges(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	// group the due changes by document, they're already in order
+	var paths []string
+	due := make(map[string][]ScheduledChange)
+
+	for _, c := range changes {
+
+		if c.At.After(now) {
+			continue
+		}
+
+		path := c.FullPath()
+
+		if _, found := due[path]; !found {
+			paths = append(paths, path)
+		}
+
+		due[path] = append(due[path], c)
+	}
+
+	for _, path := range paths {
+
+		oid, err := applyScheduledChanges(repo, due[path])
+		if err != nil {
+			Error.Println("Could not apply scheduled changes to", path, err.Error())
+			continue
+		}
+
+		if oid != nil {
+			oids = append(oids, oid)
+		}
+	}
+
+	if len(oids) > 0 {
+		_, err = buildStaticSite()
+		if err != nil {
+			return oids, err
+		}
+	}
+
+	return oids, nil
+}
+
+// applyScheduledChanges publishes or withdraws a document. Documents in a
+// workflow state are moved using a transition so they can't skip review,
+// a publication waits until a transition to a published state exists
+func applyScheduledChanges(repo *git.Repository, changes []ScheduledChange) (oid *git.Oid, err error) {
+
+	dl := changes[0].DocumentLocation
+	path := dl.FullPath()
+
+	file, err := getRawFile(dl.Path, dl.Document, dl.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	wf := currentWorkflow()
+
+	fm := file.FrontMatter
+	from := wf.stateOf(fm)
+
+	var events []WorkflowEvent
+	var actions []string
+
+	for _, c := range changes {
+
+		publish := c.Action == schedulePublish
+
+		if fm.State != "" && wf.published(fm.State) != publish {
+
+			t, found := wf.scheduledTransition(fm.State, publish)
+			if !found {
+				Debug.Printf("Postponing scheduled %s of %s, no transition from %s", c.Action, path, fm.State)
+				continue
+			}
+
+			events = append(events, WorkflowEvent{
+				DocumentID: fm.ID,
+				Path:       path,
+				Transition: t.Name,
+				From:       fm.State,
+				To:         t.To,
+				Username:   schedulerUser.Username,
+				Name:       schedulerUser.Name,
+				Comment:    fmt.Sprintf("Scheduled for %s", c.At.Format(time.RFC3339)),
+			})
+
+			fm.State = t.To
+		}
+
+		if publish {
+			fm.PublishAt = ""
+		} else {
+			fm.UnpublishAt = ""
+		}
+
+		fm.Draft = !publish
+		if fm.State != "" {
+			fm.Draft = !wf.published(fm.State)
+		}
+
+		actions = append(actions, c.Action)
+	}
+
+	if len(actions) == 0 {
+		return nil, nil
+	}
+
+	lr, err := getLatestRevision(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	nc := NewCommit{
+		Message: fmt.Sprintf("Scheduled %s of %s", joinActions(actions), path),
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Path:        dl.Path,
+				Document:    dl.Document,
+				Filename:    dl.Filename,
+				Body:        *file.Markdown,
+				FrontMatter: fm,
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	oid, err = writeFiles(repo, nc, schedulerUser)
+	if err != nil {
+		return nil, err
+	}
+
+	Info.Printf("Scheduled change to %s moved it from %s to %s", path, from, wf.stateOf(fm))
+
+	for _, event := range events {
+
+		event.Oid = oid.String()
+		event.At = time.Now()
+
+		err = db.Save(&event)
+		if err != nil {
+			Warning.Println("Could not record workflow transition", path, err.Error())
+		}
+	}
+
+	return oid, nil
+}
+
+// scheduledTransition finds the first transition from the state that
+// publishes or withdraws the document
+func (wf Workflow) scheduledTransition(state string, publish bool) (WorkflowTransition, bool) {
+	for _, t := range wf.Transitions {
+		if contains(t.From, state) && wf.published(t.To) == publish {
+			return t, true
+		}
+	}
+	return WorkflowTransition{}, false
+}
+
+func joinActions(actions []string) string {
+	if len(actions) == 1 {
+		return fmt.Sprintf("%sing", actions[0])
+	}
+	return fmt.Sprintf("%sing and %sing", actions[0], actions[len(actions)-1])
+}
+
+// startScheduler applies due changes straight away and then checks again
+// every interval until stop is called
+func startScheduler(interval time.Duration) (stop func()) {
+	return runEvery(interval, func() {
+
+		oids, err := runScheduledChanges(time.Now())
+		if err != nil {
+			Error.Println("Scheduled changes failed", err.Error())
+		}
+
+		if len(oids) > 0 {
+			Info.Println("Applied scheduled changes to", len(oids), "documents")
+		}
+	})
+}
+
+// runEvery calls job immediately and then at every interval in the
+// background until stop is called
+func runEvery(interval time.Duration, job func()) (stop func()) {
+
+	done := make(chan bool)
+	ticker := time.NewTicker(interval)
+
+	go func() {
+
+		job()
+
+		for {
+			select {
+			case <-ticker.C:
+				job()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseScheduleTime(t *testing.T) {
+
+	expected := time.Date(2018, 5, 14, 9, 0, 0, 0, time.Local)
+
+	for _, value := range []string{"2018-05-14T09:00:00", "2018-05-14T09:00", "2018-05-14 09:00"} {
+		at, err := parseScheduleTime(value)
+		assert.Nil(t, err)
+		assert.True(t, expected.Equal(at), value)
+	}
+
+	at, err := parseScheduleTime("2018-05-14T09:00:00Z")
+	assert.Nil(t, err)
+	assert.Equal(t, time.UTC, at.Location())
+
+	_, err = parseScheduleTime("next Monday")
+	assert.NotNil(t, err)
+}
+
+func TestWorkflowScheduledTransition(t *testing.T) {
+
+	publish, found := defaultWorkflow.scheduledTransition("approved", true)
+	assert.True(t, found)
+	assert.Equal(t, "publish", publish.Name)
+
+	unpublish, found := defaultWorkflow.scheduledTransition("published", false)
+	assert.True(t, found)
+	assert.Equal(t, "unpublish", unpublish.Name)
+
+	// drafts must be reviewed before they're published
+	_, found = defaultWorkflow.scheduledTransition("draft", true)
+	assert.False(t, found)
+}
+
+func TestWorkflowSchedulePermitted(t *testing.T) {
+
+	// publishing and unpublishing are for administrators only
+	assert.False(t, defaultWorkflow.schedulePermitted(true, mh))
+	assert.False(t, defaultWorkflow.schedulePermitted(false, mh))
+	assert.True(t, defaultWorkflow.schedulePermitted(true, ck))
+	assert.True(t, defaultWorkflow.schedulePermitted(false, ck))
+
+	wf := defaultWorkflow
+	wf.Transitions = []WorkflowTransition{
+		{Name: "publish", From: []string{"draft"}, To: "published", Users: []string{mh.Username}},
+		{Name: "unpublish", From: []string{"published"}, To: "draft", AdminOnly: true},
+	}
+
+	assert.True(t, wf.schedulePermitted(true, mh))
+	assert.False(t, wf.schedulePermitted(false, mh))
+}
+
+func Test_checkScheduleChanges(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/check_schedule_changes"
+	setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	file, _ := getRawFile("documents", "document_1", "index.md")
+
+	change := func(fm FrontMatter) []NewCommitFile {
+		return []NewCommitFile{
+			NewCommitFile{Path: "documents", Document: "document_1", Filename: "index.md", Body: *file.Markdown, FrontMatter: fm},
+		}
+	}
+
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+
+	scheduled := file.FrontMatter
+	scheduled.UnpublishAt = tomorrow
+
+	t.Run("Unchanged", func(t *testing.T) {
+		assert.Nil(t, checkScheduleChanges(repo, change(file.FrontMatter), mh))
+	})
+
+	t.Run("Scheduled by an editor", func(t *testing.T) {
+		assert.Equal(t, ErrScheduleForbidden, checkScheduleChanges(repo, change(scheduled), mh))
+	})
+
+	t.Run("Scheduled by an administrator", func(t *testing.T) {
+		assert.Nil(t, checkScheduleChanges(repo, change(scheduled), ck))
+	})
+}
+
+func Test_runScheduledChanges(t *testing.T) {
+
+	db.Drop("WorkflowEvent")
+
+	repoPath := "../tests/tmp/repositories/scheduled_changes"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	config.HugoBin = "hugo"
+	config.HugoConfigFile = "../config/hugo.test.yml"
+
+	now := time.Now()
+	past := now.Add(-time.Hour).Format(time.RFC3339)
+	future := now.Add(24 * time.Hour).Format(time.RFC3339)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	schedule := func(directory, document string, fm FrontMatter) NewCommitFile {
+		file, _ := getRawFile(directory, document, "index.md")
+		fm.Title = file.FrontMatter.Title
+		return NewCommitFile{Path: directory, Document: document, Filename: "index.md", Body: *file.Markdown, FrontMatter: fm}
+	}
+
+	_, err := writeFiles(
+		repo,
+		NewCommit{
+			Message: "Schedule some changes",
+			Files: []NewCommitFile{
+				schedule("documents", "document_1", FrontMatter{State: "approved", Draft: true, PublishAt: past}),
+				schedule("documents", "document_2", FrontMatter{Draft: true, PublishAt: past}),
+				schedule("documents", "document_3", FrontMatter{UnpublishAt: future}),
+				schedule("appendices", "appendix_1", FrontMatter{State: "draft", Draft: true, PublishAt: past}),
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	t.Run("Due changes are applied", func(t *testing.T) {
+
+		oids, err := runScheduledChanges(now)
+		assert.Nil(t, err)
+		assert.Len(t, oids, 2)
+
+		file, _ := getRawFile("documents", "document_2", "index.md")
+		assert.False(t, file.FrontMatter.Draft)
+		assert.Empty(t, file.FrontMatter.PublishAt)
+
+		commit, _ := repo.LookupCommit(oids[0])
+		assert.Equal(t, schedulerUser.Name, commit.Author().Name)
+	})
+
+	t.Run("Workflow states are moved by a transition", func(t *testing.T) {
+
+		file, _ := getRawFile("documents", "document_1", "index.md")
+		assert.Equal(t, "published", file.FrontMatter.State)
+		assert.False(t, file.FrontMatter.Draft)
+
+		history, _ := workflowHistory(file.FrontMatter.ID, "documents/document_1/index.md")
+		if assert.Len(t, history, 1) {
+			assert.Equal(t, "publish", history[0].Transition)
+			assert.Equal(t, schedulerUser.Username, history[0].Username)
+		}
+
+		// drafts wait until they've been approved
+		file, _ = getRawFile("appendices", "appendix_1", "index.md")
+		assert.Equal(t, "draft", file.FrontMatter.State)
+		assert.Equal(t, past, file.FrontMatter.PublishAt)
+	})
+
+	t.Run("Upcoming changes", func(t *testing.T) {
+
+		changes, err := getScheduledChanges()
+		assert.Nil(t, err)
+
+		if assert.Len(t, changes, 2) {
+			assert.Equal(t, "appendix_1", changes[0].Document)
+			assert.Equal(t, "document_3", changes[1].Document)
+			assert.Equal(t, scheduleUnpublish, changes[1].Action)
+		}
+	})
+
+	t.Run("Later", func(t *testing.T) {
+
+		oids, err := runScheduledChanges(now.Add(48 * time.Hour))
+		assert.Nil(t, err)
+		assert.Len(t, oids, 1)
+
+		file, _ := getRawFile("documents", "document_3", "index.md")
+		assert.True(t, file.FrontMatter.Draft)
+		assert.Empty(t, file.FrontMatter.UnpublishAt)
+	})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// schemaKeywords are the validation keywords validateSchema supports
+	schemaKeywords = map[string]bool{
+		"type": true, "enum": true, "const": true, "required": true,
+		"properties": true, "additionalProperties": true, "items": true,
+		"minItems": true, "maxItems": true, "minLength": true, "maxLength": true,
+		"pattern": true, "minimum": true, "maximum": true,
+	}
+
+	// schemaAnnotations don't affect validation so are allowed anywhere
+	schemaAnnotations = map[string]bool{
+		"$schema": true, "$id": true, "id": true, "$comment": true,
+		"title": true, "description": true, "default": true, "examples": true,
+		"readOnly": true, "writeOnly": true,
+	}
+)
+
+// validateSchema checks the decoded JSON value against a JSON Schema. Only
+// the commonly used validation keywords are supported, they are:
+//
+//	type, enum, const, required, properties, additionalProperties,
+//	items, minItems, maxItems, minLength, maxLength, pattern,
+//	minimum, maximum
+//
+// A schema using anything else, like $ref, allOf or format, would let
+// invalid values through so it's reported as an error instead of being
+// used. pointer is the JSON Pointer of the value being checked, "" for
+// the document itself
+func validateSchema(schema map[string]interface{}, value interface{}, pointer string) (errs []DataError) {
+
+	patterns := make(map[string]*regexp.Regexp)
+
+	errs = checkSchema(schema, "", patterns)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return validateValue(schema, value, pointer, patterns)
+}
+
+// checkSchema reports keywords in the schema, or any of its subschemas,
+// that validateSchema doesn't support and compiles each pattern once
+func checkSchema(schema map[string]interface{}, pointer string, patterns map[string]*regexp.Regexp) (errs []DataError) {
+
+	fail := func(format string, args ...interface{}) {
+		message := fmt.Sprintf(format, args...)
+		errs = append(errs, DataError{Message: fmt.Sprintf("schema is invalid: %s at %s", message, schemaPointer(pointer))})
+	}
+
+	// sorted so errors are reported in a stable order
+	keywords := make([]string, 0, len(schema))
+	for keyword := range schema {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	for _, keyword := range keywords {
+
+		child := pointer + "/" + escapePointer(keyword)
+
+		if !schemaKeywords[keyword] && !schemaAnnotations[keyword] {
+			fail("'%s' is not supported", keyword)
+			continue
+		}
+
+		switch keyword {
+
+		case "properties":
+			properties, _ := schema[keyword].(map[string]interface{})
+
+			names := make([]string, 0, len(properties))
+			for name := range properties {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				if ps, ok := properties[name].(map[string]interface{}); ok {
+					errs = append(errs, checkSchema(ps, child+"/"+escapePointer(name), patterns)...)
+				}
+			}
+
+		case "additionalProperties", "items":
+			switch sub := schema[keyword].(type) {
+			case map[string]interface{}:
+				errs = append(errs, checkSchema(sub, child, patterns)...)
+			case []interface{}:
+				fail("'%s' as a list is not supported", keyword)
+			}
+
+		case "pattern":
+			pattern, ok := schema[keyword].(string)
+			if !ok {
+				fail("'pattern' must be a string")
+				continue
+			}
+
+			if _, compiled := patterns[pattern]; compiled {
+				continue
+			}
+
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				fail("pattern '%s' is invalid", pattern)
+				continue
+			}
+			patterns[pattern] = re
+		}
+	}
+
+	return errs
+}
+
+// validateValue does the work for validateSchema once the schema has been
+// checked, the patterns have all been compiled by checkSchema
+func validateValue(schema map[string]interface{}, value interface{}, pointer string, patterns map[string]*regexp.Regexp) (errs []DataError) {
+
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, DataError{Path: schemaPointer(pointer), Message: fmt.Sprintf(format, args...)})
+	}
+
+	if t, found := schema["type"]; found && !matchesSchemaType(t, value) {
+		fail("expected %s but found %s", describeSchemaType(t), jsonType(value))
+		return errs
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		matched := false
+		for _, option := range enum {
+			if reflect.DeepEqual(option, value) {
+				matched = true
+			}
+		}
+		if !matched {
+			fail("must be one of the permitted values")
+		}
+	}
+
+	if c, found := schema["const"]; found && !reflect.DeepEqual(c, value) {
+		fail("must be %v", c)
+	}
+
+	switch v := value.(type) {
+
+	case map[string]interface{}:
+
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				if name, ok := r.(string); ok {
+					if _, found := v[name]; !found {
+						fail("missing required property '%s'", name)
+					}
+				}
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+
+		// sorted so errors are reported in a stable order
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+
+			child := pointer + "/" + escapePointer(key)
+
+			if ps, ok := properties[key].(map[string]interface{}); ok {
+				errs = append(errs, validateValue(ps, v[key], child, patterns)...)
+				continue
+			}
+
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					fail("property '%s' is not allowed", key)
+				}
+			case map[string]interface{}:
+				errs = append(errs, validateValue(additional, v[key], child, patterns)...)
+			}
+		}
+
+	case []interface{}:
+
+		if min, ok := schemaNumber(schema, "minItems"); ok && float64(len(v)) < min {
+			fail("must contain at least %v items", min)
+		}
+
+		if max, ok := schemaNumber(schema, "maxItems"); ok && float64(len(v)) > max {
+			fail("must contain at most %v items", max)
+		}
+
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				errs = append(errs, validateValue(items, item, fmt.Sprintf("%s/%d", pointer, i), patterns)...)
+			}
+		}
+
+	case string:
+
+		length := float64(utf8.RuneCountInString(v))
+
+		if min, ok := schemaNumber(schema, "minLength"); ok && length < min {
+			fail("must be at least %v characters", min)
+		}
+
+		if max, ok := schemaNumber(schema, "maxLength"); ok && length > max {
+			fail("must be at most %v characters", max)
+		}
+
+		if pattern, ok := schema["pattern"].(string); ok && !patterns[pattern].MatchString(v) {
+			fail("must match the pattern '%s'", pattern)
+		}
+
+	case float64:
+
+		if min, ok := schemaNumber(schema, "minimum"); ok && v < min {
+			fail("must be at least %v", min)
+		}
+
+		if max, ok := schemaNumber(schema, "maximum"); ok && v > max {
+			fail("must be at most %v", max)
+		}
+	}
+
+	return errs
+}
+
+func schemaNumber(schema map[string]interface{}, keyword string) (float64, bool) {
+	n, ok := schema[keyword].(float64)
+	return n, ok
+}
+
+// matchesSchemaType handles type being a single name or a list of them
+func matchesSchemaType(t interface{}, value interface{}) bool {
+
+	switch t := t.(type) {
+	case string:
+		return t == jsonType(value) || (t == "number" && jsonType(value) == "integer")
+	case []interface{}:
+		for _, option := range t {
+			if matchesSchemaType(option, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// an invalid type keyword doesn't restrict anything
+	return true
+}
+
+func describeSchemaType(t interface{}) string {
+	if types, ok := t.([]interface{}); ok {
+		names := make([]string, len(types))
+		for i, name := range types {
+			names[i] = fmt.Sprint(name)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+// jsonType returns the JSON Schema type name of a value decoded by
+// encoding/json
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// escapePointer escapes a property name for use in a JSON Pointer
+func escapePointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
+
+func schemaPointer(pointer string) string {
+	if pointer == "" {
+		return "/"
+	}
+	return pointer
+}
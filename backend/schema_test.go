@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_validateSchema(t *testing.T) {
+
+	schema := `{
+		"type": "object",
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 2, "pattern": "^[A-Z]"},
+			"age": {"type": "integer", "minimum": 0, "maximum": 120},
+			"grade": {"enum": ["3rd", "4th"]},
+			"siblings": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+			"nickname": {"type": ["string", "null"]}
+		}
+	}`
+
+	tests := []struct {
+		name     string
+		document string
+		errors   []DataError
+	}{
+		{
+			name:     "Valid",
+			document: `{"name": "Bart", "age": 10, "grade": "4th", "siblings": ["Lisa", "Maggie"], "nickname": null}`,
+		},
+		{
+			name:     "Wrong type",
+			document: `["Bart"]`,
+			errors:   []DataError{DataError{Path: "/", Message: "expected object but found array"}},
+		},
+		{
+			name:     "Missing property",
+			document: `{"name": "Bart"}`,
+			errors:   []DataError{DataError{Path: "/", Message: "missing required property 'age'"}},
+		},
+		{
+			name:     "Additional property",
+			document: `{"name": "Bart", "age": 10, "catchphrase": "Ay, caramba!"}`,
+			errors:   []DataError{DataError{Path: "/", Message: "property 'catchphrase' is not allowed"}},
+		},
+		{
+			name:     "Nested",
+			document: `{"name": "b", "age": 10.5, "grade": "1st", "siblings": ["Lisa", 1, "Hugo"]}`,
+			errors: []DataError{
+				DataError{Path: "/age", Message: "expected integer but found number"},
+				DataError{Path: "/grade", Message: "must be one of the permitted values"},
+				DataError{Path: "/name", Message: "must be at least 2 characters"},
+				DataError{Path: "/name", Message: "must match the pattern '^[A-Z]'"},
+				DataError{Path: "/siblings", Message: "must contain at most 2 items"},
+				DataError{Path: "/siblings/1", Message: "expected string but found integer"},
+			},
+		},
+		{
+			name:     "Out of range",
+			document: `{"name": "Abe", "age": 121, "nickname": 4}`,
+			errors: []DataError{
+				DataError{Path: "/age", Message: "must be at most 120"},
+				DataError{Path: "/nickname", Message: "expected string or null but found integer"},
+			},
+		},
+	}
+
+	var s map[string]interface{}
+	json.Unmarshal([]byte(schema), &s)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var document interface{}
+			json.Unmarshal([]byte(tt.document), &document)
+
+			assert.Equal(t, tt.errors, validateSchema(s, document, ""))
+		})
+	}
+}
+
+func Test_validateSchemaUnsupported(t *testing.T) {
+
+	schema := `{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title": "Person",
+		"definitions": {"name": {"type": "string"}},
+		"properties": {
+			"name": {"$ref": "#/definitions/name"},
+			"email": {"type": "string", "format": "email"},
+			"code": {"type": "string", "pattern": "("},
+			"pets": {"items": [{"type": "string"}]},
+			"age": {"anyOf": [{"type": "integer"}, {"type": "null"}]}
+		}
+	}`
+
+	var s map[string]interface{}
+	json.Unmarshal([]byte(schema), &s)
+
+	// the document would pass if the unsupported keywords were ignored
+	assert.Equal(
+		t,
+		[]DataError{
+			DataError{Message: "schema is invalid: 'definitions' is not supported at /"},
+			DataError{Message: "schema is invalid: 'anyOf' is not supported at /properties/age"},
+			DataError{Message: "schema is invalid: pattern '(' is invalid at /properties/code"},
+			DataError{Message: "schema is invalid: 'format' is not supported at /properties/email"},
+			DataError{Message: "schema is invalid: '$ref' is not supported at /properties/name"},
+			DataError{Message: "schema is invalid: 'items' as a list is not supported at /properties/pets"},
+		},
+		validateSchema(s, map[string]interface{}{"email": "not an email"}, ""),
+	)
+}
+
+func Test_escapePointer(t *testing.T) {
+	assert.Equal(t, "a~1b~0c", escapePointer("a/b~c"))
+}
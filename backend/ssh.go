@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
+	"gopkg.in/libgit2/git2go.v25"
 )
 
 // PublicKey holds a User's Public Key
@@ -62,8 +64,135 @@ func resolvePath(name string) (ap string, err error) {
 
 }
 
+// sessionUser finds the user the session's key belongs to
+func sessionUser(s ssh.Session) (user User, err error) {
+
+	if s.PublicKey() == nil {
+		return user, fmt.Errorf("No public key provided")
+	}
+
+	var pk PublicKey
+
+	err = db.One("Fingerprint", gossh.FingerprintSHA256(s.PublicKey()), &pk)
+	if err != nil {
+		return user, err
+	}
+
+	return pk.User()
+}
+
+// preparePush returns the user pushing and the revision being pushed to
+func preparePush(s ssh.Session) (user User, before string, err error) {
+
+	user, err = sessionUser(s)
+	if err != nil {
+		return user, before, err
+	}
+
+	repo, err := repository(config)
+	if err != nil {
+		return user, before, err
+	}
+	defer repo.Free()
+
+	lr, err := getLatestRevision(repo)
+	if err != nil {
+		return user, before, err
+	}
+
+	return user, lr.String(), nil
+}
+
+func storageRemainingFor(user User) (int64, error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return 0, err
+	}
+	defer repo.Free()
+
+	return storageRemaining(repo, user.Username)
+}
+
+// recordPushedStorage counts the attachments added by a push towards the
+// pusher's quota
+func recordPushedStorage(user User, before string) error {
+
+	repo, err := repository(config)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	oid, err := git.NewOid(before)
+	if err != nil {
+		return err
+	}
+
+	commit, err := repo.LookupCommit(oid)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+
+	oldTree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer oldTree.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return err
+	}
+	defer ht.Free()
+
+	files, err := incomingFiles(repo, oldTree, ht)
+	if err != nil {
+		return err
+	}
+
+	return recordStorage(user.Username, files)
+}
+
+// lfsAuthenticate responds to git-lfs-authenticate with a token for the
+// session's user. The command is in the format:
+// git-lfs-authenticate repo-name operation
+func lfsAuthenticate(s ssh.Session) error {
+
+	if !config.LFSEnabled {
+		return fmt.Errorf("Git LFS is not enabled")
+	}
+
+	if len(s.Command()) < 2 {
+		return fmt.Errorf("Invalid command")
+	}
+
+	rp, err := resolvePath(s.Command()[1])
+	if err != nil || rp != config.Repository {
+		return fmt.Errorf("Git LFS is only available for the content repository")
+	}
+
+	user, err := sessionUser(s)
+	if err != nil {
+		return err
+	}
+
+	la, err := lfsAuthentication(user)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(s).Encode(la)
+}
+
 func setupSSH() {
 
+	err := installPreReceiveHook()
+	if err != nil {
+		Error.Println("Could not install pre-receive hook, pushes won't be checked", err.Error())
+	}
+
 	ssh.Handle(func(s ssh.Session) {
 
 		Debug.Println("Incoming SSH connection")
@@ -79,6 +208,19 @@ func setupSSH() {
 			return
 		}
 
+		// git-lfs asks where the LFS server is and for a token to use it
+		// with before transferring objects
+		if s.Command()[0] == "git-lfs-authenticate" {
+			err := lfsAuthenticate(s)
+			if err != nil {
+				Error.Println("Could not authenticate LFS", err.Error())
+				io.WriteString(s.Stderr(), err.Error()+"\n")
+				return
+			}
+			s.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+			return
+		}
+
 		// Only git-upload-pack and git-receive-pack are valid
 		// get the operation (either git-upload-pack or git-receive-pack)
 		// and the repo. the actual command is in the format:
@@ -108,10 +250,39 @@ func setupSSH() {
 			return
 		}
 
+		// pushes to the content repository are checked by the pre-receive
+		// hook, which needs to know how much more the pusher can store
+		pushingContent := filepath.Base(operation) == "git-receive-pack" && rp == config.Repository
+
+		var user User
+		var before string
+
+		if pushingContent {
+			user, before, err = preparePush(s)
+			if err != nil {
+				Error.Println("Could not prepare push", err.Error())
+				io.WriteString(s.Stderr(), "Push could not be checked\n")
+				s.Exit(1)
+				return
+			}
+		}
+
 		Debug.Println("executing", operation, rp)
 		cmd := exec.Command(operation, rp)
 		cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+operation)
 
+		if pushingContent {
+			remaining, err := storageRemainingFor(user)
+			if err != nil {
+				Error.Println("Could not calculate storage for", user.Username, err.Error())
+				io.WriteString(s.Stderr(), "Push could not be checked\n")
+				s.Exit(1)
+				return
+			}
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", storageRemainingEnv, remaining))
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", pusherEnv, user.Username))
+		}
+
 		stdout, err := cmd.StdoutPipe()
 		if err != nil {
 			Info.Printf("SSH: StdoutPipe: %v", err)
@@ -146,6 +317,13 @@ func setupSSH() {
 			return
 		}
 
+		if pushingContent {
+			err = recordPushedStorage(user, before)
+			if err != nil {
+				Warning.Println("Could not record storage used by", user.Username, err.Error())
+			}
+		}
+
 		s.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
 		return
 
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf16"
+
+	"github.com/asdine/storm"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+const (
+	suggestionPending  = "pending"
+	suggestionAccepted = "accepted"
+	suggestionRejected = "rejected"
+)
+
+var (
+	// ErrSuggestionNotFound is returned when there's no suggestion with the
+	// requested ID on the document
+	ErrSuggestionNotFound = errors.New("suggestion not found")
+
+	// ErrSuggestionClosed is returned when accepting or rejecting a
+	// suggestion that has already been dealt with
+	ErrSuggestionClosed = errors.New("suggestion has already been accepted or rejected")
+
+	// ErrSuggestionConflict is returned when the text a suggestion replaces
+	// has since been changed
+	ErrSuggestionConflict = errors.New("suggestion conflicts with changes made to the document")
+
+	// ErrOwnSuggestion is returned when a reviewer tries to accept their
+	// own suggestion
+	ErrOwnSuggestion = errors.New("suggestions must be accepted by somebody else")
+
+	// ErrSuggestionForbidden is returned when somebody other than the
+	// document's owner, its authors or an administrator tries to accept
+	// a suggestion
+	ErrSuggestionForbidden = errors.New("suggestions can only be accepted by the document's owner or authors")
+)
+
+// Suggestion is a reviewer's proposed replacement of part of a document,
+// kept out of the repository until it's accepted. Start and End are
+// UTF-16 offsets into the document's Markdown at BaseRevision, an empty
+// range is an insertion and an empty Replacement a deletion. Like comments
+// they're kept against the document's ID, Path is where the document was
+// when the suggestion was last seen
+type Suggestion struct {
+	ID           int        `json:"id" storm:"id,increment"`
+	DocumentID   string     `json:"document_id" storm:"index"`
+	Path         string     `json:"path" storm:"index"`
+	BaseRevision string     `json:"base_revision" validate:"required"`
+	Start        int        `json:"start"`
+	End          int        `json:"end"`
+	Original     string     `json:"original"`
+	Replacement  string     `json:"replacement"`
+	Comment      string     `json:"comment"`
+	Username     string     `json:"username"`
+	Name         string     `json:"name"`
+	Status       string     `json:"status"`
+	ReviewedBy   string     `json:"reviewed_by,omitempty"`
+	ReviewedAt   *time.Time `json:"reviewed_at,omitempty"`
+	Oid          string     `json:"oid,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+
+	// Before and After are the lines affected by the suggestion in the
+	// current version of the document with and without it applied, so
+	// they can be shown as a diff
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	Conflicted bool   `json:"conflicted"`
+}
+
+// createSuggestion stores a reviewer's suggested change to the document
+// at path, recording the text it replaces
+func createSuggestion(path string, s Suggestion, user User) (Suggestion, error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return s, err
+	}
+	defer repo.Free()
+
+	body, err := documentBodyAt(repo, path, s.BaseRevision)
+	if err != nil {
+		return s, err
+	}
+
+	if s.Start < 0 || s.End < s.Start || s.End > len(body) {
+		return s, ErrInvalidAnchor
+	}
+
+	s.ID = 0
+	s.DocumentID = existingDocumentID(repo, path)
+	s.Path = path
+	s.Original = string(utf16.Decode(body[s.Start:s.End]))
+	s.Username = user.Username
+	s.Name = user.Name
+	s.Status = suggestionPending
+	s.ReviewedBy = ""
+	s.ReviewedAt = nil
+	s.Oid = ""
+	s.CreatedAt = time.Now()
+
+	err = db.Save(&s)
+	if err != nil {
+		return s, err
+	}
+
+	err = s.preview(repo, path)
+
+	return s, err
+}
+
+// getSuggestions returns the suggestions made to the document at path,
+// oldest first, with previews against the current version of the document
+func getSuggestions(path, status string) (suggestions []Suggestion, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	suggestions = []Suggestion{}
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	documentID := existingDocumentID(repo, path)
+
+	suggestions, err = findSuggestions(documentID, path)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		return suggestions[i].ID < suggestions[j].ID
+	})
+
+	filtered := []Suggestion{}
+
+	for _, s := range suggestions {
+
+		// suggestions made before the document had an ID are moved over
+		// to it, so they aren't lost if it's moved
+		if s.DocumentID == "" && documentID != "" {
+			s.DocumentID = documentID
+
+			err = db.Save(&s)
+			if err != nil {
+				Warning.Println("Could not update suggestion", s.ID, err.Error())
+			}
+		}
+
+		if status != "" && s.Status != status {
+			continue
+		}
+
+		if s.Status == suggestionPending {
+			err = s.preview(repo, path)
+			if err != nil {
+				Warning.Println("Could not preview suggestion", s.ID, err.Error())
+			}
+		}
+
+		filtered = append(filtered, s)
+	}
+
+	return filtered, nil
+}
+
+// findSuggestions returns every suggestion made to the document,
+// including any made before it had an ID
+func findSuggestions(documentID, path string) (suggestions []Suggestion, err error) {
+
+	suggestions = []Suggestion{}
+
+	if documentID != "" {
+		err = db.Find("DocumentID", documentID, &suggestions)
+		if err != nil && err != storm.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	var unidentified []Suggestion
+
+	err = db.Find("Path", path, &unidentified)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	for _, s := range unidentified {
+		if s.DocumentID == "" {
+			suggestions = append(suggestions, s)
+		}
+	}
+
+	return suggestions, nil
+}
+
+func getSuggestion(path string, id int) (s Suggestion, err error) {
+
+	documentID, err := documentIDAt(path)
+	if err != nil {
+		return s, err
+	}
+
+	err = db.One("ID", id, &s)
+	if err == storm.ErrNotFound || (err == nil && !s.belongsTo(documentID, path)) {
+		return s, ErrSuggestionNotFound
+	}
+
+	return s, err
+}
+
+// belongsTo returns true if the suggestion was made to the document,
+// those made before it had an ID are matched by path instead
+func (s Suggestion) belongsTo(documentID, path string) bool {
+
+	if s.DocumentID != "" {
+		return s.DocumentID == documentID
+	}
+
+	return s.Path == path
+}
+
+// maintainedBy returns true if the user is the document's owner or one
+// of its authors
+func (fm FrontMatter) maintainedBy(user User) bool {
+	return fm.Owner == user.Username || contains(fm.Authors, user.Username)
+}
+
+// acceptSuggestion applies the suggestion to the current version of the
+// document. Only the document's owner, its authors and administrators may
+// accept suggestions. The commit is authored by the reviewer who made the
+// suggestion and committed by the user accepting it
+func acceptSuggestion(path string, id int, message string, user User) (oid *git.Oid, err error) {
+
+	s, err := getSuggestion(path, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Status != suggestionPending {
+		return nil, ErrSuggestionClosed
+	}
+
+	if s.Username == user.Username {
+		return nil, ErrOwnSuggestion
+	}
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	lr, err := getLatestRevision(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	body, start, end, err := s.locate(repo, path, lr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	updated := append(append(append([]uint16{}, body[:start]...), utf16.Encode([]rune(s.Replacement))...), body[end:]...)
+
+	directory, document := splitDocumentPath(filepath.Dir(path))
+
+	file, err := getRawFile(directory, document, filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+
+	if !user.Admin && !file.FrontMatter.maintainedBy(user) {
+		return nil, ErrSuggestionForbidden
+	}
+
+	if message == "" {
+		message = fmt.Sprintf("Accept suggestion to %s", path)
+	}
+
+	nc := NewCommit{
+		Message: message,
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Path:        directory,
+				Document:    document,
+				Filename:    filepath.Base(path),
+				Body:        string(utf16.Decode(updated)),
+				FrontMatter: file.FrontMatter,
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	retainDocumentIDs(repo, nc.Files)
+
+	err = retainWorkflowStates(repo, nc.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	reviewer, err := getUserByUsername(s.Username)
+	if err != nil {
+		// the reviewer's account may since have been removed
+		reviewer = User{Username: s.Username, Name: s.Name}
+	}
+
+	oid, err = writeFilesAs(repo, nc, reviewer, user)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Path = path
+
+	err = s.close(suggestionAccepted, user, oid.String())
+
+	return oid, err
+}
+
+// rejectSuggestion closes the suggestion without changing the document
+func rejectSuggestion(path string, id int, user User) (s Suggestion, err error) {
+
+	s, err = getSuggestion(path, id)
+	if err != nil {
+		return s, err
+	}
+
+	if s.Status != suggestionPending {
+		return s, ErrSuggestionClosed
+	}
+
+	err = s.close(suggestionRejected, user, "")
+
+	return s, err
+}
+
+func (s *Suggestion) close(status string, user User, oid string) error {
+
+	now := time.Now()
+
+	s.Status = status
+	s.ReviewedBy = user.Username
+	s.ReviewedAt = &now
+	s.Oid = oid
+
+	return db.Save(s)
+}
+
+// locate finds the text the suggestion replaces in the document, which
+// is at path at the supplied revision, returning its body and the range
+func (s Suggestion) locate(repo *git.Repository, path, revision string) (body []uint16, start, end int, err error) {
+
+	before, err := documentBodyAt(repo, s.Path, s.BaseRevision)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	body, err = documentBodyAt(repo, path, revision)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	anchor := mapAnchor(CommentAnchor{Start: s.Start, End: s.End, Quote: s.Original}, before, body)
+
+	// insertions have no text to look for so can only be placed when the
+	// surrounding text is untouched
+	if anchor.Orphaned || anchor.End > len(body) ||
+		string(utf16.Decode(body[anchor.Start:anchor.End])) != s.Original {
+		return nil, 0, 0, ErrSuggestionConflict
+	}
+
+	return body, anchor.Start, anchor.End, nil
+}
+
+// preview populates Before and After with the affected lines of the
+// current document, at path, without and with the suggestion
+func (s *Suggestion) preview(repo *git.Repository, path string) error {
+
+	lr, err := getLatestRevision(repo)
+	if err != nil {
+		return err
+	}
+
+	body, start, end, err := s.locate(repo, path, lr.String())
+	if err == ErrSuggestionConflict {
+		s.Conflicted = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	first, last := start, end
+
+	for first > 0 && body[first-1] != '\n' {
+		first--
+	}
+
+	for last < len(body) && body[last] != '\n' {
+		last++
+	}
+
+	s.Before = string(utf16.Decode(body[first:last]))
+	s.After = string(utf16.Decode(body[first:start])) + s.Replacement + string(utf16.Decode(body[end:last]))
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuggestions(t *testing.T) {
+
+	db.Drop("Suggestion")
+
+	repoPath := "../tests/tmp/repositories/suggestions"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	path := "documents/document_1/index.md"
+
+	file, _ := getRawFile("documents", "document_1", "index.md")
+	md := *file.Markdown
+
+	// only the document's owner, authors and administrators can accept
+	// suggestions
+	file.FrontMatter.Owner = mh.Username
+
+	lr, err := updateFiles(
+		NewCommit{
+			Message: "Set the owner",
+			Files: []NewCommitFile{
+				NewCommitFile{Path: "documents", Document: "document_1", Filename: "index.md", Body: md, FrontMatter: file.FrontMatter},
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	offset := func(s string) int {
+		return utf16Length(md[:strings.Index(md, s)])
+	}
+
+	lorem := offset("Lorem ipsum")
+	aenean := offset("Aenean massa")
+
+	first, err := createSuggestion(
+		path,
+		Suggestion{BaseRevision: lr.String(), Start: lorem, End: lorem + 11, Replacement: "Hello world"},
+		ds,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, "Lorem ipsum", first.Original)
+	assert.Equal(t, suggestionPending, first.Status)
+	assert.Contains(t, first.Before, "Lorem ipsum dolor")
+	assert.Contains(t, first.After, "Hello world dolor")
+
+	// made against the same revision so will have moved by the time
+	// it's accepted
+	second, _ := createSuggestion(
+		path,
+		Suggestion{BaseRevision: lr.String(), Start: aenean, End: aenean + 12, Replacement: "Aenean maxima"},
+		ds,
+	)
+
+	// conflicts with the first
+	conflicting, _ := createSuggestion(
+		path,
+		Suggestion{BaseRevision: lr.String(), Start: lorem, End: lorem + 5, Replacement: "Ipsum"},
+		ck,
+	)
+
+	t.Run("Outside the document", func(t *testing.T) {
+		_, err := createSuggestion(path, Suggestion{BaseRevision: lr.String(), Start: 5, End: 99999}, ds)
+		assert.Equal(t, ErrInvalidAnchor, err)
+	})
+
+	t.Run("Can't accept your own", func(t *testing.T) {
+		_, err := acceptSuggestion(path, first.ID, "", ds)
+		assert.Equal(t, ErrOwnSuggestion, err)
+	})
+
+	t.Run("Can't accept without maintaining the document", func(t *testing.T) {
+		_, err := acceptSuggestion(path, first.ID, "", sb)
+		assert.Equal(t, ErrSuggestionForbidden, err)
+	})
+
+	t.Run("Accepting", func(t *testing.T) {
+
+		oid, err := acceptSuggestion(path, first.ID, "", mh)
+		assert.Nil(t, err)
+
+		repo, _ := repository(config)
+		defer repo.Free()
+
+		commit, _ := repo.LookupCommit(oid)
+		assert.Equal(t, ds.Name, commit.Author().Name)
+		assert.Equal(t, mh.Name, commit.Committer().Name)
+		assert.Equal(t, "Accept suggestion to documents/document_1/index.md", commit.Message())
+
+		file, _ := getRawFile("documents", "document_1", "index.md")
+		assert.Contains(t, *file.Markdown, "Hello world dolor sit amet")
+
+		accepted, _ := getSuggestion(path, first.ID)
+		assert.Equal(t, suggestionAccepted, accepted.Status)
+		assert.Equal(t, mh.Username, accepted.ReviewedBy)
+		assert.Equal(t, oid.String(), accepted.Oid)
+
+		_, err = acceptSuggestion(path, first.ID, "", mh)
+		assert.Equal(t, ErrSuggestionClosed, err)
+	})
+
+	t.Run("Accepting after the document has changed", func(t *testing.T) {
+
+		oid, err := acceptSuggestion(path, second.ID, "Maxima", mh)
+		assert.Nil(t, err)
+		assert.NotNil(t, oid)
+
+		file, _ := getRawFile("documents", "document_1", "index.md")
+		assert.Contains(t, *file.Markdown, "Hello world dolor")
+		assert.Contains(t, *file.Markdown, "Aenean maxima. Cum sociis")
+	})
+
+	t.Run("Conflicts", func(t *testing.T) {
+
+		pending, _ := getSuggestions(path, suggestionPending)
+		if assert.Len(t, pending, 1) {
+			assert.True(t, pending[0].Conflicted)
+		}
+
+		_, err := acceptSuggestion(path, conflicting.ID, "", mh)
+		assert.Equal(t, ErrSuggestionConflict, err)
+	})
+
+	t.Run("Rejecting", func(t *testing.T) {
+
+		rejected, err := rejectSuggestion(path, conflicting.ID, mh)
+		assert.Nil(t, err)
+		assert.Equal(t, suggestionRejected, rejected.Status)
+
+		_, err = rejectSuggestion(path, conflicting.ID, mh)
+		assert.Equal(t, ErrSuggestionClosed, err)
+
+		_, err = rejectSuggestion("documents/document_2/index.md", first.ID, mh)
+		assert.Equal(t, ErrSuggestionNotFound, err)
+
+		all, _ := getSuggestions(path, "")
+		assert.Len(t, all, 3)
+	})
+}
+
+func TestWriteFilesAs(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/write_files_as"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	nc := NewCommit{
+		Message: "Approved changes",
+		Files: []NewCommitFile{
+			NewCommitFile{Path: "documents", Document: "document_2", Filename: "index.md", Body: "# Approved"},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	oid, err := writeFilesAs(repo, nc, ds, ck)
+	assert.Nil(t, err)
+
+	commit, _ := repo.LookupCommit(oid)
+
+	assert.Equal(t, ds.Email, commit.Author().Email)
+	assert.Equal(t, ck.Email, commit.Committer().Email)
+}
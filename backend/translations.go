@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/graphia/particle"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+var (
+	// ErrTranslationNotEnabled is returned when checking translations
+	// without translation being enabled
+	ErrTranslationNotEnabled = errors.New("translation is not enabled")
+
+	// ErrNotTranslation is returned when the file is in the default
+	// language, so isn't translated from anything
+	ErrNotTranslation = errors.New("file is not a translation")
+)
+
+// TranslationStatus describes whether a translation has kept up with the
+// document it was translated from. Translations created before their
+// source revision was recorded can't be checked so are never outdated
+type TranslationStatus struct {
+	Path           string     `json:"path"`
+	Document       string     `json:"document"`
+	Filename       string     `json:"filename"`
+	Language       string     `json:"language"`
+	SourceFilename string     `json:"source_filename"`
+	TranslatedFrom string     `json:"translated_from,omitempty"`
+	Outdated       bool       `json:"outdated"`
+	Diff           *Changeset `json:"diff,omitempty"`
+}
+
+// translationLanguage returns the language code of a translation's
+// filename, eg fi for index.fi.md
+func translationLanguage(filename string) (code string, ok bool) {
+
+	parts := strings.Split(filename, ".")
+	if len(parts) != 3 || parts[2] != "md" {
+		return "", false
+	}
+
+	code = parts[1]
+
+	if code == config.DefaultLanguage || !contains(config.EnabledLanguages, code) {
+		return "", false
+	}
+
+	return code, true
+}
+
+// translationStatus compares the source document at head with how it was
+// when it was translated, including the source's diff when requested
+func translationStatus(repo *git.Repository, ht *git.Tree, directory, document, filename string, withDiff bool) (ts TranslationStatus, err error) {
+
+	code, ok := translationLanguage(filename)
+	if !ok {
+		return ts, ErrNotTranslation
+	}
+
+	ts = TranslationStatus{
+		Path:           directory,
+		Document:       document,
+		Filename:       filename,
+		Language:       code,
+		SourceFilename: translationFilename(filename, config.DefaultLanguage),
+	}
+
+	entry, err := ht.EntryByPath(filepath.Join(directory, document, filename))
+	if err != nil {
+		return ts, ErrDocumentNotFound
+	}
+
+	blob, err := repo.LookupBlob(entry.Id)
+	if err != nil {
+		return ts, err
+	}
+	defer blob.Free()
+
+	fm, err := getMetadataFromBlob(blob)
+	if err != nil {
+		return ts, err
+	}
+
+	ts.TranslatedFrom = fm.TranslatedFrom
+	if ts.TranslatedFrom == "" {
+		return ts, nil
+	}
+
+	source := filepath.Join(directory, document, ts.SourceFilename)
+
+	// a source that's since been deleted has nothing to catch up with
+	current, err := ht.EntryByPath(source)
+	if err != nil {
+		return ts, nil
+	}
+
+	oid, err := git.NewOid(ts.TranslatedFrom)
+	if err != nil {
+		Warning.Println("Invalid source revision for", filename, ts.TranslatedFrom)
+		return ts, nil
+	}
+
+	commit, err := repo.LookupCommit(oid)
+	if err != nil {
+		Warning.Println("Could not find source revision for", filename, ts.TranslatedFrom)
+		return ts, nil
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return ts, err
+	}
+	defer tree.Free()
+
+	original, err := tree.EntryByPath(source)
+	if err != nil {
+		ts.Outdated = true
+	} else if !original.Id.Equal(current.Id) {
+		same, err := sameTranslatableContents(repo, original.Id, current.Id)
+		if err != nil {
+			return ts, err
+		}
+		ts.Outdated = !same
+	}
+
+	if !ts.Outdated || !withDiff {
+		return ts, nil
+	}
+
+	cs, _, err := diffTrees(repo, tree, ht, source)
+	if err != nil {
+		return ts, err
+	}
+
+	ts.Diff = &cs
+
+	return ts, nil
+}
+
+// sameTranslatableContents compares the parts of two revisions of a
+// document that are translated, the body, title and synopsis, so changes
+// to the rest of the front matter don't outdate translations
+func sameTranslatableContents(repo *git.Repository, a, b *git.Oid) (bool, error) {
+
+	var fms [2]FrontMatter
+	var bodies [2]string
+
+	for i, oid := range []*git.Oid{a, b} {
+
+		blob, err := repo.LookupBlob(oid)
+		if err != nil {
+			return false, err
+		}
+
+		body, err := particle.YAMLEncoding.DecodeString(string(blob.Contents()), &fms[i])
+		blob.Free()
+		if err != nil {
+			return false, err
+		}
+
+		bodies[i] = string(body)
+	}
+
+	return bodies[0] == bodies[1] &&
+		fms[0].Title == fms[1].Title &&
+		fms[0].Synopsis == fms[1].Synopsis, nil
+}
+
+// getTranslationStatus returns the translation's status along with the
+// changes made to its source since it was translated
+func getTranslationStatus(directory, document, filename string) (ts TranslationStatus, err error) {
+
+	if !config.TranslationEnabled {
+		return ts, ErrTranslationNotEnabled
+	}
+
+	repo, err := repository(config)
+	if err != nil {
+		return ts, err
+	}
+	defer repo.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return ts, err
+	}
+	defer ht.Free()
+
+	return translationStatus(repo, ht, directory, document, filename, true)
+}
+
+// getOutdatedTranslations lists every translation whose source document
+// has changed since it was translated, with the source's changes
+func getOutdatedTranslations() (outdated []TranslationStatus, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	outdated = []TranslationStatus{}
+
+	if !config.TranslationEnabled {
+		return nil, ErrTranslationNotEnabled
+	}
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer ht.Free()
+
+	err = ht.Walk(func(root string, te *git.TreeEntry) int {
+
+		if te.Type != git.ObjectBlob {
+			return 0
+		}
+
+		if _, ok := translationLanguage(te.Name); !ok {
+			return 0
+		}
+
+		// translations are stored alongside their source as
+		// directory/document/index.code.md
+		directory, document := filepath.Split(strings.TrimSuffix(root, "/"))
+
+		ts, err := translationStatus(repo, ht, filepath.Clean(directory), document, te.Name, true)
+		if err != nil {
+			Warning.Println("Could not check translation", root, te.Name, err.Error())
+			return 0
+		}
+
+		if ts.Outdated {
+			outdated = append(outdated, ts)
+		}
+
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return outdated, nil
+}
+
+// outdatedTranslations returns the language codes of the document's
+// translations that are behind it
+func outdatedTranslations(repo *git.Repository, ht *git.Tree, directory, document, filename string) (codes []string) {
+
+	codes = []string{}
+
+	for _, lc := range config.EnabledLanguages {
+
+		if lc == config.DefaultLanguage {
+			continue
+		}
+
+		ts, err := translationStatus(repo, ht, directory, document, translationFilename(filename, lc), false)
+		if err != nil {
+			continue
+		}
+
+		if ts.Outdated {
+			codes = append(codes, lc)
+		}
+	}
+
+	return codes
+}
+
+// retainTranslatedFrom keeps the revision a translation was translated
+// from unless a known revision is supplied, which is how translators
+// mark a translation as caught up with its source
+func retainTranslatedFrom(repo *git.Repository, files []NewCommitFile) {
+
+	for i, ncf := range files {
+
+		if !ncf.isDocument() {
+			continue
+		}
+
+		if revision := ncf.FrontMatter.TranslatedFrom; revision != "" {
+
+			oid, err := git.NewOid(revision)
+			if err == nil {
+				commit, err := repo.LookupCommit(oid)
+				if err == nil {
+					commit.Free()
+					continue
+				}
+			}
+		}
+
+		fm, _ := existingFrontMatter(repo, filepath.Join(ncf.Path, ncf.Document, ncf.Filename))
+
+		files[i].FrontMatter.TranslatedFrom = fm.TranslatedFrom
+	}
+}
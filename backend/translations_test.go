@@ -0,0 +1,178 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useMultilingualConfig enables translation into Finnish and Swedish for
+// the repository, returning a function that restores the configuration
+func useMultilingualConfig(repoPath string) (reset func()) {
+
+	original := config
+
+	multilingualConfig := "../config/test/multilingual.yml"
+	config, _ = loadConfig(&multilingualConfig)
+	config.Repository = repoPath
+
+	return func() { config = original }
+}
+
+func Test_translationLanguage(t *testing.T) {
+
+	reset := useMultilingualConfig("")
+	defer reset()
+
+	tests := []struct {
+		filename string
+		code     string
+		ok       bool
+	}{
+		{filename: "index.fi.md", code: "fi", ok: true},
+		{filename: "index.sv.md", code: "sv", ok: true},
+		{filename: "index.md"},
+		{filename: "index.en.md"},
+		{filename: "index.no.md"},
+		{filename: "data.fi.json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			code, ok := translationLanguage(tt.filename)
+			assert.Equal(t, tt.code, code)
+			assert.Equal(t, tt.ok, ok)
+		})
+	}
+}
+
+func Test_outdatedTranslations(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/outdated_translations"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	reset := useMultilingualConfig(repoPath)
+	defer reset()
+
+	oid, _, err := createTranslation(NewTranslation{
+		Path:           "documents",
+		SourceFilename: "index.md",
+		SourceDocument: "document_1",
+		LanguageCode:   "fi",
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}, mh)
+	assert.Nil(t, err)
+
+	update := func(filename, body string, fm FrontMatter, revision string) string {
+		nc := NewCommit{
+			Message: "Update " + filename,
+			Files: []NewCommitFile{
+				NewCommitFile{
+					Filename:    filename,
+					Document:    "document_1",
+					Path:        "documents",
+					Body:        body,
+					FrontMatter: fm,
+				},
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: revision},
+		}
+
+		oid, err := updateFiles(nc, mh)
+		if err != nil {
+			panic(err)
+		}
+
+		return oid.String()
+	}
+
+	latest := func() string {
+		repo, _ := repository(config)
+		defer repo.Free()
+
+		oid, _ := getLatestRevision(repo)
+		return oid.String()
+	}
+
+	t.Run("Up to date", func(t *testing.T) {
+		ts, err := getTranslationStatus("documents", "document_1", "index.fi.md")
+		assert.Nil(t, err)
+		assert.Equal(t, "fi", ts.Language)
+		assert.Equal(t, "index.md", ts.SourceFilename)
+		assert.Equal(t, lr.String(), ts.TranslatedFrom)
+		assert.False(t, ts.Outdated)
+		assert.Nil(t, ts.Diff)
+
+		outdated, _ := getOutdatedTranslations()
+		assert.Len(t, outdated, 0)
+	})
+
+	// only the translation changing doesn't make it outdated
+	head := update("index.fi.md", "Nopea ruskea kettu", FrontMatter{Title: "Asiakirja 1"}, oid.String())
+
+	t.Run("Translation updated", func(t *testing.T) {
+		ts, _ := getTranslationStatus("documents", "document_1", "index.fi.md")
+		assert.Equal(t, lr.String(), ts.TranslatedFrom)
+		assert.False(t, ts.Outdated)
+	})
+
+	head = update("index.md", "The quick brown fox jumped over the lazy dog", FrontMatter{Title: "Document 1"}, head)
+
+	t.Run("Source updated", func(t *testing.T) {
+		ts, err := getTranslationStatus("documents", "document_1", "index.fi.md")
+		assert.Nil(t, err)
+		assert.True(t, ts.Outdated)
+
+		if assert.NotNil(t, ts.Diff) {
+			assert.Equal(t, 1, ts.Diff.NumDeltas)
+			assert.Contains(t, ts.Diff.Files, "documents/document_1/index.md")
+			assert.Contains(t, ts.Diff.FullDiff, "+The quick brown fox jumped over the lazy dog")
+		}
+
+		outdated, _ := getOutdatedTranslations()
+		if assert.Len(t, outdated, 1) {
+			assert.Equal(t, "documents", outdated[0].Path)
+			assert.Equal(t, "document_1", outdated[0].Document)
+			assert.Equal(t, "index.fi.md", outdated[0].Filename)
+		}
+
+		source, _ := getFile("documents", "document_1", "index.md", false, false)
+		assert.Nil(t, source.OutdatedTranslations)
+
+		describeFile(source)
+		assert.Equal(t, []string{"fi"}, source.OutdatedTranslations)
+		assert.Nil(t, source.TranslationStatus)
+
+		translation, _ := getFile("documents", "document_1", "index.fi.md", false, false)
+		describeFile(translation)
+		assert.True(t, translation.TranslationStatus.Outdated)
+		assert.Nil(t, translation.TranslationStatus.Diff)
+	})
+
+	t.Run("Marked as up to date", func(t *testing.T) {
+		update("index.fi.md", "Nopea ruskea kettu hyppäsi laiskan koiran yli", FrontMatter{Title: "Asiakirja 1", TranslatedFrom: head}, head)
+
+		ts, _ := getTranslationStatus("documents", "document_1", "index.fi.md")
+		assert.Equal(t, head, ts.TranslatedFrom)
+		assert.False(t, ts.Outdated)
+	})
+
+	t.Run("Source front matter updated", func(t *testing.T) {
+		update("index.md", "The quick brown fox jumped over the lazy dog", FrontMatter{Title: "Document 1", Tags: []string{"foxes"}, Draft: true}, latest())
+
+		ts, _ := getTranslationStatus("documents", "document_1", "index.fi.md")
+		assert.False(t, ts.Outdated)
+	})
+
+	t.Run("Source synopsis updated", func(t *testing.T) {
+		update("index.md", "The quick brown fox jumped over the lazy dog", FrontMatter{Title: "Document 1", Synopsis: "A fox and a dog"}, latest())
+
+		ts, _ := getTranslationStatus("documents", "document_1", "index.fi.md")
+		assert.True(t, ts.Outdated)
+	})
+
+	t.Run("Not a translation", func(t *testing.T) {
+		_, err := getTranslationStatus("documents", "document_1", "index.md")
+		assert.Equal(t, ErrNotTranslation, err)
+	})
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+const (
+	defaultTrashRetention = 30 // days
+
+	trashDirectory = "directory"
+	trashDocument  = "document"
+)
+
+var (
+	// ErrTrashItemNotFound is returned when the commit didn't delete the
+	// requested path
+	ErrTrashItemNotFound = errors.New("deleted item not found")
+
+	// ErrTrashItemRestored is returned when restoring something that has
+	// since been restored or replaced by something with the same path
+	ErrTrashItemRestored = errors.New("path is in use, the item has already been restored or replaced")
+)
+
+// TrashItem is a directory or document deleted by a commit. Files lists
+// everything deleted along with it, including attachments and
+// translations, all of which are put back when it's restored
+type TrashItem struct {
+	Type      string    `json:"type"`
+	Path      string    `json:"path"`
+	Title     string    `json:"title"`
+	Files     []string  `json:"files"`
+	Oid       string    `json:"oid"`
+	Message   string    `json:"message"`
+	DeletedBy string    `json:"deleted_by"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// TrashRestore is a request to restore the item at Path deleted by the
+// commit Oid
+type TrashRestore struct {
+	Oid            string `json:"oid"  validate:"required"`
+	Path           string `json:"path" validate:"required"`
+	RepositoryInfo `json:"repository_info"`
+}
+
+// trashRetention is how far back through the history deletions are listed
+func trashRetention() time.Duration {
+	days := config.TrashRetention
+	if days <= 0 {
+		days = defaultTrashRetention
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// getTrash lists directories and documents deleted within the retention
+// period that haven't since been restored, most recent first. There's no
+// separate store, the history is the trash
+func getTrash() (items []TrashItem, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	items = []TrashItem{}
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer ht.Free()
+
+	hc, err := headCommit(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	revWalk, err := repo.Walk()
+	if err != nil {
+		return nil, err
+	}
+	defer revWalk.Free()
+
+	err = revWalk.Push(hc.Id())
+	if err != nil {
+		return nil, err
+	}
+
+	since := time.Now().Add(-trashRetention())
+	seen := make(map[string]bool)
+
+	revWalkIterator := func(c *git.Commit) bool {
+
+		if c.Committer().When.Before(since) {
+			return false
+		}
+
+		deleted, err := deletedItems(repo, c)
+		if err != nil {
+			Warning.Println("Could not find items deleted by", c.Id(), err.Error())
+			return true
+		}
+
+		for _, item := range deleted {
+
+			// only the most recent deletion of a path can be restored
+			if seen[item.Path] {
+				continue
+			}
+			seen[item.Path] = true
+
+			if pathInUse(repo, ht, item) {
+				continue
+			}
+
+			items = append(items, item)
+		}
+
+		return true
+	}
+
+	err = revWalk.Iterate(revWalkIterator)
+
+	return items, err
+}
+
+// deletedItems compares the commit's tree with its parent's, returning
+// the directories and documents that no longer exist. Documents are
+// considered deleted once none of their Markdown files remain, even if
+// attachments are left behind. Documents deleted along with their
+// directory are part of the directory's item
+func deletedItems(repo *git.Repository, c *git.Commit) (items []TrashItem, err error) {
+
+	if c.ParentCount() == 0 {
+		return items, nil
+	}
+
+	parent := c.Parent(0)
+	defer parent.Free()
+
+	before, err := parent.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer before.Free()
+
+	after, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer after.Free()
+
+	for _, de := range subtrees(before) {
+
+		ae := after.EntryByName(de.Name)
+		if ae != nil && ae.Id.Equal(de.Id) {
+			continue
+		}
+
+		dt, err := repo.LookupTree(de.Id)
+		if err != nil {
+			return nil, err
+		}
+		defer dt.Free()
+
+		if ae == nil {
+			items = append(items, newTrashItem(repo, c, trashDirectory, de.Name, dt))
+			continue
+		}
+
+		at, err := repo.LookupTree(ae.Id)
+		if err != nil {
+			return nil, err
+		}
+		defer at.Free()
+
+		for _, be := range subtrees(dt) {
+
+			ae := at.EntryByName(be.Name)
+			if ae != nil && ae.Id.Equal(be.Id) {
+				continue
+			}
+
+			bt, err := repo.LookupTree(be.Id)
+			if err != nil {
+				return nil, err
+			}
+			defer bt.Free()
+
+			if !containsDocuments(bt) {
+				continue
+			}
+
+			if ae != nil {
+				remaining, err := repo.LookupTree(ae.Id)
+				if err != nil {
+					return nil, err
+				}
+				defer remaining.Free()
+
+				if containsDocuments(remaining) {
+					continue
+				}
+			}
+
+			path := filepath.Join(de.Name, be.Name)
+			items = append(items, newTrashItem(repo, c, trashDocument, path, bt))
+		}
+	}
+
+	return items, nil
+}
+
+// subtrees returns the tree's immediate subdirectories
+func subtrees(tree *git.Tree) (entries []*git.TreeEntry) {
+	for i := uint64(0); i < tree.EntryCount(); i++ {
+		te := tree.EntryByIndex(i)
+		if te.Type == git.ObjectTree {
+			entries = append(entries, te)
+		}
+	}
+	return entries
+}
+
+// containsDocuments returns true if there are any Markdown files in the
+// root of a document's tree
+func containsDocuments(tree *git.Tree) bool {
+	for i := uint64(0); i < tree.EntryCount(); i++ {
+		te := tree.EntryByIndex(i)
+		if te.Type == git.ObjectBlob && filepath.Ext(te.Name) == ".md" {
+			return true
+		}
+	}
+	return false
+}
+
+// newTrashItem describes the tree deleted from path by the commit
+func newTrashItem(repo *git.Repository, c *git.Commit, kind, path string, tree *git.Tree) TrashItem {
+
+	item := TrashItem{
+		Type:      kind,
+		Path:      path,
+		Title:     filepath.Base(path),
+		Files:     []string{},
+		Oid:       c.Id().String(),
+		Message:   c.Summary(),
+		DeletedBy: c.Author().Name,
+		DeletedAt: c.Committer().When,
+	}
+
+	// directories are titled in _index.md, documents in index.md
+	titleFile := "index.md"
+	if kind == trashDirectory {
+		titleFile = "_index.md"
+	}
+
+	tree.Walk(func(root string, te *git.TreeEntry) int {
+
+		if te.Type != git.ObjectBlob {
+			return 0
+		}
+
+		item.Files = append(item.Files, filepath.Join(path, root, te.Name))
+
+		if root != "" || te.Name != titleFile {
+			return 0
+		}
+
+		blob, err := repo.LookupBlob(te.Id)
+		if err != nil {
+			return 0
+		}
+		defer blob.Free()
+
+		fm, err := getMetadataFromBlob(blob)
+		if err == nil && fm.Title != "" {
+			item.Title = fm.Title
+		}
+
+		return 0
+	})
+
+	return item
+}
+
+// pathInUse returns true if the item's path is occupied at head, either
+// because it's been restored or something new has taken its place
+func pathInUse(repo *git.Repository, ht *git.Tree, item TrashItem) bool {
+
+	te, err := ht.EntryByPath(item.Path)
+	if err != nil || te == nil {
+		return false
+	}
+
+	if item.Type == trashDirectory {
+		return true
+	}
+
+	tree, err := repo.LookupTree(te.Id)
+	if err != nil {
+		return false
+	}
+	defer tree.Free()
+
+	return containsDocuments(tree)
+}
+
+// restoreFromTrash puts back every file deleted along with the item that
+// is still missing, as they were immediately before it was deleted
+func restoreFromTrash(tr TrashRestore, user User) (oid *git.Oid, err error) {
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	err = checkLatestRevision(repo, tr.RepositoryInfo.LatestRevision)
+	if err != nil {
+		return nil, err
+	}
+
+	deletion, err := git.NewOid(tr.Oid)
+	if err != nil {
+		return nil, ErrTrashItemNotFound
+	}
+
+	c, err := repo.LookupCommit(deletion)
+	if err != nil {
+		return nil, ErrTrashItemNotFound
+	}
+	defer c.Free()
+
+	deleted, err := deletedItems(repo, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var item TrashItem
+	var found bool
+
+	for _, di := range deleted {
+		if di.Path == filepath.Clean(tr.Path) {
+			item, found = di, true
+			break
+		}
+	}
+
+	if !found {
+		return nil, ErrTrashItemNotFound
+	}
+
+	ht, err := headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer ht.Free()
+
+	if pathInUse(repo, ht, item) {
+		return nil, ErrTrashItemRestored
+	}
+
+	parent := c.Parent(0)
+	defer parent.Free()
+
+	before, err := parent.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer before.Free()
+
+	index, err := repo.Index()
+	if err != nil {
+		return nil, err
+	}
+	defer index.Free()
+
+	for _, path := range item.Files {
+
+		// files that weren't deleted along with the item, or have been
+		// added since, are left as they are now
+		if _, err := ht.EntryByPath(path); err == nil {
+			continue
+		}
+
+		te, err := before.EntryByPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		ie := git.IndexEntry{
+			Id:   te.Id,
+			Path: path,
+			Mode: te.Filemode,
+			Gid:  uint32(os.Getgid()),
+			Uid:  uint32(os.Getuid()),
+		}
+
+		err = index.Add(&ie)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	message := fmt.Sprintf("Restore %s %s from trash", item.Type, item.Path)
+
+	return writeTreeAndCommit(repo, index, message, user)
+}
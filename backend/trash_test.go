@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrash(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/trash"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	// give document 1 an attachment and a translation so we can make sure
+	// the whole bundle is restored
+	lr, err := writeFiles(
+		repo,
+		NewCommit{
+			Message: "Add an attachment and translation",
+			Files: []NewCommitFile{
+				NewCommitFile{Path: "documents", Document: "document_1/images", Filename: "notes.txt", Body: "Notes"},
+				NewCommitFile{Path: "documents", Document: "document_1", Filename: "index.es.md", Body: "# Documento 1", FrontMatter: FrontMatter{Title: "documento 1"}},
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	lr, err = deleteFiles(
+		NewCommit{
+			Message: "Delete document 1",
+			Files: []NewCommitFile{
+				NewCommitFile{Path: "documents", Document: "document_1", Filename: "index.md"},
+				NewCommitFile{Path: "documents", Document: "document_1", Filename: "index.es.md"},
+			},
+			Directories:    []NewCommitDirectory{NewCommitDirectory{Path: "documents/document_1/images"}},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	lr, err = deleteDirectories(
+		NewCommit{
+			Message:        "Delete appendices",
+			Directories:    []NewCommitDirectory{NewCommitDirectory{Path: "appendices"}},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		ck,
+	)
+	assert.Nil(t, err)
+
+	var document TrashItem
+
+	t.Run("Listing", func(t *testing.T) {
+
+		items, err := getTrash()
+		assert.Nil(t, err)
+
+		if assert.Len(t, items, 2) {
+
+			assert.Equal(t, trashDirectory, items[0].Type)
+			assert.Equal(t, "appendices", items[0].Path)
+			assert.Equal(t, ck.Name, items[0].DeletedBy)
+			assert.Contains(t, items[0].Files, "appendices/appendix_2/index.md")
+			assert.Contains(t, items[0].Files, "appendices/another_file.txt")
+
+			document = items[1]
+
+			assert.Equal(t, trashDocument, document.Type)
+			assert.Equal(t, "documents/document_1", document.Path)
+			assert.Equal(t, "document 1", document.Title)
+			assert.Equal(t, "Delete document 1", document.Message)
+			assert.ElementsMatch(
+				t,
+				[]string{
+					"documents/document_1/index.md",
+					"documents/document_1/index.es.md",
+					"documents/document_1/images/notes.txt",
+				},
+				document.Files,
+			)
+		}
+	})
+
+	t.Run("Restoring", func(t *testing.T) {
+
+		_, err := restoreFromTrash(TrashRestore{Oid: document.Oid, Path: document.Path, RepositoryInfo: RepositoryInfo{LatestRevision: "abc"}}, mh)
+		assert.Equal(t, ErrRepoOutOfSync, err)
+
+		_, err = restoreFromTrash(TrashRestore{Oid: document.Oid, Path: "documents/document_2", RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}, mh)
+		assert.Equal(t, ErrTrashItemNotFound, err)
+
+		lr, err = restoreFromTrash(TrashRestore{Oid: document.Oid, Path: document.Path, RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}, mh)
+		assert.Nil(t, err)
+
+		for _, file := range document.Files {
+			_, err = os.Stat(filepath.Join(repoPath, file))
+			assert.False(t, os.IsNotExist(err), file)
+		}
+
+		commit, _ := repo.LookupCommit(lr)
+		assert.Equal(t, "Restore document documents/document_1 from trash", commit.Message())
+
+		items, _ := getTrash()
+		if assert.Len(t, items, 1) {
+			assert.Equal(t, "appendices", items[0].Path)
+		}
+
+		_, err = restoreFromTrash(TrashRestore{Oid: document.Oid, Path: document.Path, RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}, mh)
+		assert.Equal(t, ErrTrashItemRestored, err)
+	})
+}
+
+func Test_restoreFromTrashRetainsLaterChanges(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/trash_later_changes"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	notes := func(body string) {
+		var err error
+		lr, err = writeFiles(
+			repo,
+			NewCommit{
+				Message: "Write notes",
+				Files: []NewCommitFile{
+					NewCommitFile{Path: "documents", Document: "document_1/images", Filename: "notes.txt", Body: body},
+				},
+				RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+			},
+			mh,
+		)
+		assert.Nil(t, err)
+	}
+
+	notes("Notes")
+
+	// only the document is deleted, its attachment stays and is edited
+	lr, err := deleteFiles(
+		NewCommit{
+			Message: "Delete document 1",
+			Files: []NewCommitFile{
+				NewCommitFile{Path: "documents", Document: "document_1", Filename: "index.md"},
+			},
+			RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+		},
+		mh,
+	)
+	assert.Nil(t, err)
+
+	notes("Updated notes")
+
+	var document TrashItem
+
+	items, _ := getTrash()
+	for _, item := range items {
+		if item.Path == "documents/document_1" {
+			document = item
+		}
+	}
+
+	_, err = restoreFromTrash(TrashRestore{Oid: document.Oid, Path: document.Path, RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}, mh)
+	assert.Nil(t, err)
+
+	_, err = os.Stat(filepath.Join(repoPath, "documents/document_1/index.md"))
+	assert.Nil(t, err)
+
+	contents, _ := ioutil.ReadFile(filepath.Join(repoPath, "documents/document_1/images/notes.txt"))
+	assert.Equal(t, "Updated notes", string(contents))
+}
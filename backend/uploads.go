@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+const (
+	defaultMaxAttachmentSize = 20 // megabytes
+
+	// otherAttachmentsDirectory is where uploads that don't belong to a
+	// category with a directory of its own are stored, relative to
+	// the document
+	otherAttachmentsDirectory = "files"
+
+	// uploadChunkSize is the most read from an upload at a time
+	uploadChunkSize = 32 * 1024
+)
+
+var (
+	// ErrAttachmentTooLarge is returned when an upload exceeds the
+	// maximum attachment size
+	ErrAttachmentTooLarge = errors.New("attachment exceeds the maximum size")
+
+	// ErrInvalidAttachmentName is returned when an upload's filename
+	// is empty or would place it outside the attachments directory
+	ErrInvalidAttachmentName = errors.New("invalid attachment filename")
+
+	// ErrNoAttachments is returned when an upload contains no files
+	ErrNoAttachments = errors.New("no attachments uploaded")
+
+	// ErrInvalidAttachmentDirectory is returned when the requested
+	// directory would place uploads outside the document
+	ErrInvalidAttachmentDirectory = errors.New("invalid attachment directory")
+
+	// defaultUploadDirectories is used when upload_directories isn't
+	// configured, it matches the layout Hugo sites usually have
+	defaultUploadDirectories = map[string]string{
+		"images":          "images",
+		"structured data": "data",
+		"tabular data":    "data",
+	}
+)
+
+// Upload is a file that's been streamed into a blob but not yet
+// committed. Directory is where it will be stored, relative to the
+// document
+type Upload struct {
+	Filename  string   `json:"filename"`
+	Directory string   `json:"directory"`
+	Size      int64    `json:"size"`
+	Oid       *git.Oid `json:"-"`
+}
+
+// maxAttachmentSize is the largest file that can be uploaded, in bytes
+func maxAttachmentSize() int64 {
+	mb := config.MaxAttachmentSize
+	if mb <= 0 {
+		mb = defaultMaxAttachmentSize
+	}
+	return int64(mb) * 1024 * 1024
+}
+
+// attachmentFilename strips any directories from an uploaded file's name,
+// rejecting names that can't be stored
+func attachmentFilename(name string) (string, error) {
+
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "", ErrInvalidAttachmentName
+	}
+
+	return name, nil
+}
+
+// uploadDirectory returns the directory, relative to the document, that
+// files of the filename's category are uploaded to
+func uploadDirectory(filename string) string {
+
+	directories := config.UploadDirectories
+	if len(directories) == 0 {
+		directories = defaultUploadDirectories
+	}
+
+	if directory, found := directories[fileCategory(filename)]; found {
+		return directory
+	}
+
+	return otherAttachmentsDirectory
+}
+
+// attachmentDirectory cleans a directory requested for uploads, rejecting
+// any that would be outside the document
+func attachmentDirectory(name string) (string, error) {
+
+	name = filepath.Clean(strings.Replace(name, "\\", "/", -1))
+
+	if name == "." || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", ErrInvalidAttachmentDirectory
+	}
+
+	return name, nil
+}
+
+// sizeLimitReader fails with ErrAttachmentTooLarge as soon as more than
+// the limit has been read
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, ErrAttachmentTooLarge
+	}
+	return n, err
+}
+
+// createBlobFromReader streams the reader into a new blob a chunk at a
+// time so the whole file is never held in memory. Metadata is stripped
+// from images on the way through. Anything larger than limit is
+// abandoned with ErrAttachmentTooLarge, though the chunks already
+// written remain as unreferenced objects until git gc
+func createBlobFromReader(repo *git.Repository, filename string, r io.Reader, limit int64) (upload Upload, err error) {
+
+	upload.Filename, err = attachmentFilename(filename)
+	if err != nil {
+		return upload, err
+	}
+
+	upload.Directory = uploadDirectory(upload.Filename)
+
+	src := stripMetadata(upload.Filename, &sizeLimitReader{r: r, remaining: limit})
+	defer src.Close()
+
+	// large files go to the LFS store with a pointer committed instead
+	if lfsTracked(upload.Filename) {
+		var p LFSPointer
+		upload.Oid, p, err = createLFSBlob(repo, src)
+		upload.Size = p.Size
+		return upload, err
+	}
+
+	// libgit2 keeps asking for chunks until it's given an empty one,
+	// which git2go signals with io.EOF
+	chunks := func(maxLen int) ([]byte, error) {
+
+		if maxLen > uploadChunkSize {
+			maxLen = uploadChunkSize
+		}
+
+		buf := make([]byte, maxLen)
+
+		n, err := io.ReadAtLeast(src, buf, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		upload.Size += int64(n)
+
+		return buf[:n], nil
+	}
+
+	upload.Oid, err = repo.CreateBlobFromChunks(upload.Filename, chunks)
+
+	return upload, err
+}
+
+// commitUploads commits the uploaded files to their directories within
+// the document. If a document is supplied in the commit it's updated in the
+// same commit, so an image and the text referring to it arrive together
+func commitUploads(directory, document string, uploads []Upload, nc NewCommit, user User) (oid *git.Oid, err error) {
+
+	if len(uploads) == 0 {
+		return nil, ErrNoAttachments
+	}
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	err = checkAuthors(repo, nc.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	retainDocumentIDs(repo, nc.Files)
+	retainTranslatedFrom(repo, nc.Files)
+
+	err = retainWorkflowStates(repo, nc.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkScheduleChanges(repo, nc.Files, user)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := repo.Index()
+	if err != nil {
+		return nil, err
+	}
+	defer index.Free()
+
+	err = checkLatestRevision(repo, nc.RepositoryInfo.LatestRevision)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stageFiles(repo, index, nc.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, upload := range uploads {
+		if lfsTracked(upload.Filename) {
+			err = stageLFSAttributes(repo, index)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	uploads = processUploads(repo, uploads)
+
+	for _, upload := range uploads {
+
+		ie := buildIndexEntryUpload(directory, document, upload)
+
+		err = index.Add(&ie)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ValidateLinksOnCommit {
+		err = validateReferences(repo, index, nc.Files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return writeTreeAndCommit(repo, index, nc.Message, user)
+}
+
+// processUploads resizes and re-encodes uploaded images, adding WebP
+// copies when enabled. Images that can't be processed, or are stored
+// with LFS, are kept as they were uploaded
+func processUploads(repo *git.Repository, uploads []Upload) (processed []Upload) {
+
+	for _, upload := range uploads {
+
+		if imageFormat(upload.Filename) == "" || lfsTracked(upload.Filename) {
+			processed = append(processed, upload)
+			continue
+		}
+
+		blob, err := repo.LookupBlob(upload.Oid)
+		if err != nil {
+			Warning.Println("Could not find uploaded image", upload.Filename, err.Error())
+			processed = append(processed, upload)
+			continue
+		}
+
+		data, changed, err := processImage(upload.Filename, blob.Contents())
+		blob.Free()
+
+		if err != nil {
+			Warning.Println("Could not process image", upload.Filename, err.Error())
+		}
+
+		if changed {
+			oid, err := repo.CreateBlobFromBuffer(data)
+			if err != nil {
+				Warning.Println("Could not store processed image", upload.Filename, err.Error())
+			} else {
+				upload.Oid, upload.Size = oid, int64(len(data))
+			}
+		}
+
+		processed = append(processed, upload)
+
+		if !config.ImageWebP || err != nil {
+			continue
+		}
+
+		webp, err := convertToWebP(data)
+		if err != nil {
+			Warning.Println("Could not make a WebP copy of", upload.Filename, err.Error())
+			continue
+		}
+
+		oid, err := repo.CreateBlobFromBuffer(webp)
+		if err != nil {
+			Warning.Println("Could not store WebP copy of", upload.Filename, err.Error())
+			continue
+		}
+
+		processed = append(processed, Upload{Filename: webpFilename(upload.Filename), Directory: upload.Directory, Size: int64(len(webp)), Oid: oid})
+	}
+
+	return processed
+}
+
+func buildIndexEntryUpload(directory, document string, upload Upload) git.IndexEntry {
+	return git.IndexEntry{
+		Id:   upload.Oid,
+		Path: filepath.Join(directory, document, upload.Directory, upload.Filename),
+		Size: uint32(upload.Size),
+
+		Ctime: git.IndexTime{},
+		Gid:   uint32(os.Getgid()),
+		Uid:   uint32(os.Getuid()),
+		Mode:  git.FilemodeBlob,
+		Mtime: git.IndexTime{},
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_attachmentFilename(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		filename string
+		expected string
+		err      error
+	}{
+		{name: "Plain", filename: "cat.jpg", expected: "cat.jpg"},
+		{name: "Directories stripped", filename: "../../.git/config", expected: "config"},
+		{name: "Windows paths", filename: `C:\Users\lisa\saxophone.png`, expected: "saxophone.png"},
+		{name: "Empty", filename: "", err: ErrInvalidAttachmentName},
+		{name: "Parent", filename: "..", err: ErrInvalidAttachmentName},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename, err := attachmentFilename(tt.filename)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.expected, filename)
+		})
+	}
+}
+
+func Test_uploadDirectory(t *testing.T) {
+
+	assert.Equal(t, "images", uploadDirectory("cat.png"))
+	assert.Equal(t, "data", uploadDirectory("people.csv"))
+	assert.Equal(t, "data", uploadDirectory("people.json"))
+	assert.Equal(t, "files", uploadDirectory("manual.pdf"))
+
+	config.UploadDirectories = map[string]string{"images": "static/img"}
+	defer func() { config.UploadDirectories = nil }()
+
+	assert.Equal(t, "static/img", uploadDirectory("cat.png"))
+	assert.Equal(t, "files", uploadDirectory("people.csv"))
+}
+
+func Test_attachmentDirectory(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		directory string
+		expected  string
+		err       error
+	}{
+		{name: "Plain", directory: "downloads", expected: "downloads"},
+		{name: "Nested", directory: "downloads/2018/", expected: "downloads/2018"},
+		{name: "Windows paths", directory: `downloads\2018`, expected: "downloads/2018"},
+		{name: "Empty", directory: "", err: ErrInvalidAttachmentDirectory},
+		{name: "Parent", directory: "../document_2", err: ErrInvalidAttachmentDirectory},
+		{name: "Escaping", directory: "downloads/../../..", err: ErrInvalidAttachmentDirectory},
+		{name: "Absolute", directory: "/etc", err: ErrInvalidAttachmentDirectory},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			directory, err := attachmentDirectory(tt.directory)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.expected, directory)
+		})
+	}
+}
+
+func Test_createBlobFromReader(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/create_blob_from_reader"
+	setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	t.Run("Streamed in chunks", func(t *testing.T) {
+
+		contents := bytes.Repeat([]byte("Everything's coming up Milhouse! "), 4096)
+
+		upload, err := createBlobFromReader(repo, "milhouse.txt", bytes.NewReader(contents), int64(len(contents)))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(contents)), upload.Size)
+
+		blob, _ := repo.LookupBlob(upload.Oid)
+		assert.Equal(t, contents, blob.Contents())
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		upload, err := createBlobFromReader(repo, "empty.txt", strings.NewReader(""), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), upload.Size)
+	})
+
+	t.Run("Too large", func(t *testing.T) {
+		_, err := createBlobFromReader(repo, "large.txt", strings.NewReader("eleven bytes"), 10)
+		assert.Equal(t, ErrAttachmentTooLarge, err)
+	})
+}
+
+func Test_commitUploads(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/commit_uploads"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	upload, _ := createBlobFromReader(repo, "diagram.svg", strings.NewReader("<svg></svg>"), maxAttachmentSize())
+
+	document, _ := getRawFile("documents", "document_1", "index.md")
+
+	nc := NewCommit{
+		Message: "Add a diagram",
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Path:        "documents",
+				Document:    "document_1",
+				Filename:    "index.md",
+				Body:        *document.Markdown + "\n![Diagram](files/diagram.svg)",
+				FrontMatter: document.FrontMatter,
+			},
+		},
+		RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+	}
+
+	_, err := commitUploads("documents", "document_1", []Upload{}, nc, mh)
+	assert.Equal(t, ErrNoAttachments, err)
+
+	oid, err := commitUploads("documents", "document_1", []Upload{upload}, nc, mh)
+	assert.Nil(t, err)
+
+	hc, _ := headCommit(repo)
+	assert.Equal(t, oid, hc.Id())
+
+	contents, _ := ioutil.ReadFile(filepath.Join(repoPath, "documents/document_1/files/diagram.svg"))
+	assert.Equal(t, "<svg></svg>", string(contents))
+
+	contents, _ = ioutil.ReadFile(filepath.Join(repoPath, "documents/document_1/index.md"))
+	assert.Contains(t, string(contents), "![Diagram](files/diagram.svg)")
+
+	_, err = commitUploads("documents", "document_1", []Upload{upload}, nc, mh)
+	assert.Equal(t, ErrRepoOutOfSync, err)
+}
+
+func Test_processUploads(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/process_uploads"
+	setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	config.ImageMaxWidth = 100
+	defer func() { config.ImageMaxWidth = 0 }()
+
+	photo, _ := createBlobFromReader(repo, "photo.png", bytes.NewReader(testImage(400, 300, "png")), maxAttachmentSize())
+	notes, _ := createBlobFromReader(repo, "notes.txt", strings.NewReader("Notes"), maxAttachmentSize())
+
+	processed := processUploads(repo, []Upload{photo, notes})
+
+	if assert.Len(t, processed, 2) {
+
+		assert.NotEqual(t, photo.Oid, processed[0].Oid)
+		assert.True(t, processed[0].Size < photo.Size)
+
+		blob, _ := repo.LookupBlob(processed[0].Oid)
+		ic, _, _ := image.DecodeConfig(bytes.NewReader(blob.Contents()))
+		assert.Equal(t, 100, ic.Width)
+		assert.Equal(t, 75, ic.Height)
+
+		assert.Equal(t, notes, processed[1])
+	}
+}
+
+func Test_createBlobFromReaderStripsMetadata(t *testing.T) {
+
+	repoPath := "../tests/tmp/repositories/create_blob_strips_metadata"
+	setupSmallTestRepo(repoPath)
+
+	repo, _ := repository(config)
+	defer repo.Free()
+
+	upload, err := createBlobFromReader(repo, "photo.jpg", bytes.NewReader(jpegWithExif()), maxAttachmentSize())
+	assert.Nil(t, err)
+
+	blob, _ := repo.LookupBlob(upload.Oid)
+	assert.False(t, bytes.Contains(blob.Contents(), gpsMarker))
+	assert.Equal(t, int64(len(blob.Contents())), upload.Size)
+}
@@ -187,7 +187,7 @@ func getUserByUsername(username string) (user User, err error) {
 }
 
 func getUserByEmail(email string) (user User, err error) {
-	err = db.One("Username", email, &user)
+	err = db.One("Email", email, &user)
 
 	if user.ID == 0 {
 		Warning.Println("Cannot find user with email address", email)
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/asdine/storm"
+	"gopkg.in/libgit2/git2go.v25"
+)
+
+var (
+	// ErrUnknownTransition is returned when the requested transition isn't
+	// part of the workflow
+	ErrUnknownTransition = errors.New("unknown workflow transition")
+
+	// ErrTransitionNotAvailable is returned when a transition can't be made
+	// from the document's current state
+	ErrTransitionNotAvailable = errors.New("transition not available from the current state")
+
+	// ErrTransitionForbidden is returned when the user isn't permitted to
+	// perform the transition
+	ErrTransitionForbidden = errors.New("not permitted to perform this transition")
+
+	// ErrDraftRequiresTransition is returned when an update tries to
+	// publish or unpublish a document directly instead of by a transition
+	ErrDraftRequiresTransition = errors.New("draft can only be changed by a workflow transition")
+
+	// defaultWorkflow is used when none is configured
+	defaultWorkflow = Workflow{
+		States:          []string{"draft", "in_review", "approved", "published", "archived"},
+		InitialState:    "draft",
+		PublishedStates: []string{"published"},
+		Transitions: []WorkflowTransition{
+			{Name: "submit", From: []string{"draft"}, To: "in_review"},
+			{Name: "request_changes", From: []string{"in_review", "approved"}, To: "draft", AdminOnly: true},
+			{Name: "approve", From: []string{"in_review"}, To: "approved", AdminOnly: true},
+			{Name: "publish", From: []string{"approved"}, To: "published", AdminOnly: true},
+			{Name: "unpublish", From: []string{"published"}, To: "draft", AdminOnly: true},
+			{Name: "archive", From: []string{"draft", "published"}, To: "archived", AdminOnly: true},
+			{Name: "restore", From: []string{"archived"}, To: "draft", AdminOnly: true},
+		},
+	}
+)
+
+// Workflow describes the states a document moves through on its way to
+// publication and the transitions between them
+type Workflow struct {
+	States          []string             `json:"states"           yaml:"states"`
+	InitialState    string               `json:"initial_state"    yaml:"initial_state"`
+	PublishedStates []string             `json:"published_states" yaml:"published_states"`
+	Transitions     []WorkflowTransition `json:"transitions"      yaml:"transitions"`
+}
+
+// WorkflowTransition moves a document from any of the From states to the
+// To state. When Users is set only those users (and administrators) may
+// perform it, AdminOnly restricts it to administrators
+type WorkflowTransition struct {
+	Name      string   `json:"name"            yaml:"name"`
+	From      []string `json:"from"            yaml:"from"`
+	To        string   `json:"to"              yaml:"to"`
+	AdminOnly bool     `json:"admin_only"      yaml:"admin_only"`
+	Users     []string `json:"users,omitempty" yaml:"users"`
+}
+
+// WorkflowEvent records a transition made to a document. Events are
+// found by the document's ID so they follow it when it's moved, those
+// recorded before it had an ID are found by path instead
+type WorkflowEvent struct {
+	ID         int       `json:"id" storm:"id,increment"`
+	DocumentID string    `json:"document_id" storm:"index"`
+	Path       string    `json:"path" storm:"index"`
+	Transition string    `json:"transition"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Username   string    `json:"username"`
+	Name       string    `json:"name"`
+	Comment    string    `json:"comment"`
+	Oid        string    `json:"oid"`
+	At         time.Time `json:"at"`
+}
+
+// WorkflowStatus is a document's current state, the transitions the
+// current user can make from it and how it got there
+type WorkflowStatus struct {
+	State       string               `json:"state"`
+	Transitions []WorkflowTransition `json:"transitions"`
+	History     []WorkflowEvent      `json:"history"`
+}
+
+// WorkflowChange is a request to perform a transition on a document
+type WorkflowChange struct {
+	Transition     string `json:"transition" validate:"required"`
+	Comment        string `json:"comment"`
+	RepositoryInfo `json:"repository_info"`
+}
+
+// currentWorkflow returns the configured workflow or the default one
+// if there isn't one
+func currentWorkflow() Workflow {
+	if len(config.Workflow.States) == 0 {
+		return defaultWorkflow
+	}
+	return config.Workflow
+}
+
+// validate makes sure every state referred to by the workflow exists and
+// transition names are unique
+func (wf Workflow) validate() error {
+
+	if !contains(wf.States, wf.InitialState) {
+		return fmt.Errorf("Workflow initial state '%s' not found", wf.InitialState)
+	}
+
+	for _, ps := range wf.PublishedStates {
+		if !contains(wf.States, ps) {
+			return fmt.Errorf("Workflow published state '%s' not found", ps)
+		}
+	}
+
+	names := make(map[string]bool)
+
+	for _, t := range wf.Transitions {
+
+		if names[t.Name] {
+			return fmt.Errorf("Workflow transition '%s' defined more than once", t.Name)
+		}
+		names[t.Name] = true
+
+		if !contains(wf.States, t.To) {
+			return fmt.Errorf("Workflow transition '%s' leads to unknown state '%s'", t.Name, t.To)
+		}
+
+		for _, from := range t.From {
+			if !contains(wf.States, from) {
+				return fmt.Errorf("Workflow transition '%s' starts from unknown state '%s'", t.Name, from)
+			}
+		}
+	}
+
+	return nil
+}
+
+// stateOf returns the document's state. Documents written before the
+// workflow was introduced have no state so it's derived from draft
+func (wf Workflow) stateOf(fm FrontMatter) string {
+
+	if fm.State != "" {
+		return fm.State
+	}
+
+	if !fm.Draft && len(wf.PublishedStates) > 0 {
+		return wf.PublishedStates[0]
+	}
+
+	return wf.InitialState
+}
+
+// published returns true if documents in the state should appear on
+// the published site
+func (wf Workflow) published(state string) bool {
+	return contains(wf.PublishedStates, state)
+}
+
+func (wf Workflow) transition(name string) (WorkflowTransition, error) {
+	for _, t := range wf.Transitions {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return WorkflowTransition{}, ErrUnknownTransition
+}
+
+// available lists the transitions the user can make from the state
+func (wf Workflow) available(state string, user User) (transitions []WorkflowTransition) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	transitions = []WorkflowTransition{}
+
+	for _, t := range wf.Transitions {
+		if contains(t.From, state) && t.permitted(user) {
+			transitions = append(transitions, t)
+		}
+	}
+
+	return transitions
+}
+
+// permitted returns true if the user may perform the transition
+func (t WorkflowTransition) permitted(user User) bool {
+
+	if user.Admin {
+		return true
+	}
+
+	if t.AdminOnly {
+		return false
+	}
+
+	return len(t.Users) == 0 || contains(t.Users, user.Username)
+}
+
+// transitionDocument moves the document into a new state, writing the
+// state to its frontmatter and recording the transition in its history
+func transitionDocument(directory, document, filename string, change WorkflowChange, user User) (oid *git.Oid, err error) {
+
+	wf := currentWorkflow()
+
+	t, err := wf.transition(change.Transition)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := getRawFile(directory, document, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	from := wf.stateOf(file.FrontMatter)
+
+	if !contains(t.From, from) {
+		return nil, ErrTransitionNotAvailable
+	}
+
+	if !t.permitted(user) {
+		return nil, ErrTransitionForbidden
+	}
+
+	repo, err := repository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	fm := file.FrontMatter
+	fm.State = t.To
+	fm.Draft = !wf.published(t.To)
+
+	path := filepath.Join(directory, document, filename)
+
+	nc := NewCommit{
+		Message: fmt.Sprintf("Move %s from %s to %s", path, from, t.To),
+		Files: []NewCommitFile{
+			NewCommitFile{
+				Path:        directory,
+				Document:    document,
+				Filename:    filename,
+				Body:        *file.Markdown,
+				FrontMatter: fm,
+			},
+		},
+		RepositoryInfo: change.RepositoryInfo,
+	}
+
+	retainDocumentIDs(repo, nc.Files)
+
+	oid, err = writeFiles(repo, nc, user)
+	if err != nil {
+		return nil, err
+	}
+
+	event := WorkflowEvent{
+		DocumentID: nc.Files[0].FrontMatter.ID,
+		Path:       path,
+		Transition: t.Name,
+		From:       from,
+		To:         t.To,
+		Username:   user.Username,
+		Name:       user.Name,
+		Comment:    change.Comment,
+		Oid:        oid.String(),
+		At:         time.Now(),
+	}
+
+	err = db.Save(&event)
+	if err != nil {
+		Warning.Println("Could not record workflow transition", path, err.Error())
+	}
+
+	return oid, nil
+}
+
+// workflowHistory returns the transitions made to the document with the
+// supplied ID, along with any made at its path before it had one, oldest
+// first
+func workflowHistory(documentID, path string) (events []WorkflowEvent, err error) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	events = []WorkflowEvent{}
+
+	if documentID != "" {
+		err = db.Find("DocumentID", documentID, &events)
+		if err != nil && err != storm.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	var unidentified []WorkflowEvent
+
+	err = db.Find("Path", path, &unidentified)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	for _, event := range unidentified {
+
+		if event.DocumentID != "" {
+			continue
+		}
+
+		// events recorded before the document had an ID are moved over
+		// to it, so they aren't lost if it's moved
+		if documentID != "" {
+			event.DocumentID = documentID
+
+			err = db.Save(&event)
+			if err != nil {
+				Warning.Println("Could not update workflow event", event.ID, err.Error())
+			}
+		}
+
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+
+	return events, nil
+}
+
+// getWorkflowStatus returns the document's state along with the
+// transitions available to the user
+func getWorkflowStatus(directory, document, filename string, user User) (status WorkflowStatus, err error) {
+
+	wf := currentWorkflow()
+
+	file, err := getRawFile(directory, document, filename)
+	if err != nil {
+		return status, err
+	}
+
+	status.State = wf.stateOf(file.FrontMatter)
+	status.Transitions = wf.available(status.State, user)
+
+	status.History, err = workflowHistory(file.FrontMatter.ID, file.FullPath())
+
+	return status, err
+}
+
+// retainWorkflowStates prevents a document's state being changed by a
+// regular update, that can only be done by a transition. New documents
+// start in the workflow's initial state and documents written before the
+// workflow was introduced can't be published or unpublished by changing
+// draft either
+func retainWorkflowStates(repo *git.Repository, files []NewCommitFile) error {
+
+	wf := currentWorkflow()
+
+	for i, ncf := range files {
+
+		if !ncf.isDocument() {
+			continue
+		}
+
+		fm, found := existingFrontMatter(repo, filepath.Join(ncf.Path, ncf.Document, ncf.Filename))
+
+		switch {
+		case !found:
+			files[i].FrontMatter.State = wf.InitialState
+			files[i].FrontMatter.Draft = !wf.published(wf.InitialState)
+
+		case fm.State == "":
+			if ncf.FrontMatter.Draft != fm.Draft {
+				return ErrDraftRequiresTransition
+			}
+			files[i].FrontMatter.State = ""
+
+		default:
+			files[i].FrontMatter.State = fm.State
+			files[i].FrontMatter.Draft = !wf.published(fm.State)
+		}
+	}
+
+	return nil
+}
+
+// filterFilesByState returns only the files in the supplied state
+func filterFilesByState(files []FileItem, state string) (filtered []FileItem) {
+
+	// Initialising the slice so json.Marshal returns an empty
+	// array instead of `null`
+	filtered = []FileItem{}
+
+	for _, fi := range files {
+		if fi.State == state {
+			filtered = append(filtered, fi)
+		}
+	}
+
+	return filtered
+}
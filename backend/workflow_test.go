@@ -0,0 +1,221 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkflowValidate(t *testing.T) {
+
+	assert.Nil(t, defaultWorkflow.validate())
+
+	tests := []struct {
+		name     string
+		workflow Workflow
+		message  string
+	}{
+		{
+			name:     "Unknown initial state",
+			workflow: Workflow{States: []string{"draft"}, InitialState: "new"},
+			message:  "Workflow initial state 'new' not found",
+		},
+		{
+			name:     "Unknown published state",
+			workflow: Workflow{States: []string{"draft"}, InitialState: "draft", PublishedStates: []string{"live"}},
+			message:  "Workflow published state 'live' not found",
+		},
+		{
+			name: "Unknown destination",
+			workflow: Workflow{
+				States:       []string{"draft"},
+				InitialState: "draft",
+				Transitions:  []WorkflowTransition{{Name: "publish", From: []string{"draft"}, To: "live"}},
+			},
+			message: "Workflow transition 'publish' leads to unknown state 'live'",
+		},
+		{
+			name: "Unknown origin",
+			workflow: Workflow{
+				States:       []string{"draft"},
+				InitialState: "draft",
+				Transitions:  []WorkflowTransition{{Name: "redraft", From: []string{"live"}, To: "draft"}},
+			},
+			message: "Workflow transition 'redraft' starts from unknown state 'live'",
+		},
+		{
+			name: "Duplicate transitions",
+			workflow: Workflow{
+				States:       []string{"draft", "live"},
+				InitialState: "draft",
+				Transitions: []WorkflowTransition{
+					{Name: "publish", From: []string{"draft"}, To: "live"},
+					{Name: "publish", From: []string{"live"}, To: "live"},
+				},
+			},
+			message: "Workflow transition 'publish' defined more than once",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.workflow.validate()
+			if assert.NotNil(t, err) {
+				assert.Equal(t, tt.message, err.Error())
+			}
+		})
+	}
+}
+
+func TestWorkflowStateOf(t *testing.T) {
+	assert.Equal(t, "in_review", defaultWorkflow.stateOf(FrontMatter{State: "in_review", Draft: true}))
+	assert.Equal(t, "draft", defaultWorkflow.stateOf(FrontMatter{Draft: true}))
+	assert.Equal(t, "published", defaultWorkflow.stateOf(FrontMatter{Draft: false}))
+}
+
+func TestWorkflowAvailable(t *testing.T) {
+
+	wf := Workflow{
+		States:       []string{"draft", "in_review", "published"},
+		InitialState: "draft",
+		Transitions: []WorkflowTransition{
+			{Name: "submit", From: []string{"draft"}, To: "in_review"},
+			{Name: "publish", From: []string{"in_review"}, To: "published", Users: []string{mh.Username}},
+			{Name: "reject", From: []string{"in_review"}, To: "draft", AdminOnly: true},
+		},
+	}
+
+	names := func(transitions []WorkflowTransition) (names []string) {
+		for _, t := range transitions {
+			names = append(names, t.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"submit"}, names(wf.available("draft", ds)))
+	assert.Equal(t, []string{"publish"}, names(wf.available("in_review", mh)))
+	assert.Equal(t, []string{"publish", "reject"}, names(wf.available("in_review", ck)))
+	assert.Empty(t, wf.available("in_review", ds))
+	assert.Empty(t, wf.available("published", ck))
+}
+
+func Test_transitionDocument(t *testing.T) {
+
+	db.Drop("WorkflowEvent")
+
+	repoPath := "../tests/tmp/repositories/transition_document"
+	lr, _ := setupSmallTestRepo(repoPath)
+
+	transition := func(name string, user User) error {
+		change := WorkflowChange{Transition: name, RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()}}
+		oid, err := transitionDocument("documents", "document_1", "index.md", change, user)
+		if err == nil {
+			lr = oid
+		}
+		return err
+	}
+
+	t.Run("Unknown transition", func(t *testing.T) {
+		assert.Equal(t, ErrUnknownTransition, transition("defenestrate", ck))
+	})
+
+	t.Run("Not available from the current state", func(t *testing.T) {
+		assert.Equal(t, ErrTransitionNotAvailable, transition("approve", ck))
+	})
+
+	t.Run("Forbidden", func(t *testing.T) {
+		assert.Equal(t, ErrTransitionForbidden, transition("unpublish", mh))
+	})
+
+	t.Run("Through the workflow", func(t *testing.T) {
+
+		assert.Nil(t, transition("unpublish", ck))
+		assert.Nil(t, transition("submit", mh))
+
+		file, _ := getRawFile("documents", "document_1", "index.md")
+		assert.Equal(t, "in_review", file.FrontMatter.State)
+		assert.True(t, file.FrontMatter.Draft)
+
+		assert.Nil(t, transition("approve", ck))
+		assert.Nil(t, transition("publish", ck))
+
+		file, _ = getRawFile("documents", "document_1", "index.md")
+		assert.Equal(t, "published", file.FrontMatter.State)
+		assert.False(t, file.FrontMatter.Draft)
+	})
+
+	t.Run("History", func(t *testing.T) {
+
+		status, err := getWorkflowStatus("documents", "document_1", "index.md", mh)
+		assert.Nil(t, err)
+
+		assert.Equal(t, "published", status.State)
+		assert.Empty(t, status.Transitions)
+
+		var transitions []string
+		for _, event := range status.History {
+			transitions = append(transitions, event.Transition)
+		}
+
+		assert.Equal(t, []string{"unpublish", "submit", "approve", "publish"}, transitions)
+		assert.Equal(t, mh.Username, status.History[1].Username)
+		assert.Equal(t, "draft", status.History[1].From)
+		assert.Equal(t, "in_review", status.History[1].To)
+	})
+
+	t.Run("Regular updates retain the state", func(t *testing.T) {
+
+		_, err := updateFiles(
+			NewCommit{
+				Message: "Try to skip review",
+				Files: []NewCommitFile{
+					NewCommitFile{
+						Path:        "documents",
+						Document:    "document_1",
+						Filename:    "index.md",
+						Body:        "# Document 1",
+						FrontMatter: FrontMatter{Title: "document 1", State: "archived", Draft: true},
+					},
+				},
+				RepositoryInfo: RepositoryInfo{LatestRevision: lr.String()},
+			},
+			mh,
+		)
+		assert.Nil(t, err)
+
+		file, _ := getRawFile("documents", "document_1", "index.md")
+		assert.Equal(t, "published", file.FrontMatter.State)
+		assert.False(t, file.FrontMatter.Draft)
+	})
+
+	t.Run("Filtering listings", func(t *testing.T) {
+
+		files, _ := getFilesInDir("documents")
+
+		published := filterFilesByState(files, "published")
+		assert.Len(t, published, 3)
+
+		assert.Empty(t, filterFilesByState(files, "in_review"))
+	})
+
+	t.Run("History follows moved documents", func(t *testing.T) {
+
+		// events recorded before documents had IDs are found by path and
+		// moved over to the ID when they are
+		legacy := WorkflowEvent{Path: "documents/document_1/index.md", Transition: "submit"}
+		db.Save(&legacy)
+
+		status, _ := getWorkflowStatus("documents", "document_1", "index.md", mh)
+		assert.Len(t, status.History, 5)
+
+		repo, _ := repository(config)
+		defer repo.Free()
+
+		_, err := moveFile(repo, "documents/document_1/index.md", "appendices/appendix_5/index.md", mh)
+		assert.Nil(t, err)
+
+		status, err = getWorkflowStatus("appendices", "appendix_5", "index.md", mh)
+		assert.Nil(t, err)
+		assert.Len(t, status.History, 5)
+	})
+}
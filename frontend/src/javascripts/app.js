@@ -16,6 +16,8 @@ import MyProfile from '../components/Settings/MyProfile.vue';
 import SSHKeySettings from '../components/Settings/SSHKeySettings.vue';
 import ThemeSettings from '../components/Settings/Theme.vue';
 import History from '../components/History.vue';
+import Trash from '../components/Trash.vue';
+import Media from '../components/Media.vue';
 
 // User Paths
 import UserSettings from '../components/Settings/UserSettings.vue';
@@ -27,6 +29,7 @@ import DocumentShow from '../components/Document/Show.vue';
 import DocumentEdit from '../components/Document/Edit.vue';
 import DocumentNew from '../components/Document/New.vue';
 import DocumentHistory from '../components/Document/History.vue';
+import DocumentData from '../components/Document/Data.vue';
 
 // Directory Paths
 import DirectoryIndex from '../components/Directory/Index.vue';
@@ -78,6 +81,8 @@ const routes = [
 
 	// Directory pages
 	{path: '/cms/history', component: History, name: 'history'},
+	{path: '/cms/trash', component: Trash, name: 'trash'},
+	{path: '/cms/media', component: Media, name: 'media'},
 	{path: '/cms/new', component: DirectoryNew, name: 'directory_new'},
 
 	{path: '/cms/commits/:hash', component: Commit, name: 'commit'},
@@ -87,6 +92,7 @@ const routes = [
 	{path: '/cms/:directory/edit', component: DirectoryEdit, name: 'directory_edit'},
 	{path: '/cms/:directory/new', component: DocumentNew, name: 'document_new'},
 
+	{path: '/cms/:directory/:document/data/:path(.*)', component: DocumentData, name: 'data'},
 	{path: '/cms/:directory/:document/:language_code?/edit', component: DocumentEdit, name: 'document_edit'},
 	{path: '/cms/:directory/:document/:language_code?/history', component: DocumentHistory, name: 'document_history'},
 	{path: '/cms/:directory/:document/:language_code?', component: DocumentShow, name: 'document_show'},
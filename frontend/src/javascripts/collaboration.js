@@ -0,0 +1,252 @@
+import store from './store.js';
+import config from './config.js';
+
+var ot = require('ot');
+
+// CMSCollaboration connects the editor to a document's collaborative
+// editing session. Edits are exchanged as ot.js operations, ot's Client
+// keeps track of those waiting to be acknowledged and transforms the
+// server's operations against them
+export default class CMSCollaboration {
+
+	constructor(file, editor) {
+		this.file = file;
+		this.editor = editor;		// the document's CodeMirror instance
+		this.participants = [];
+		this.cursors = {};			// other participants' cursor markers
+		this.client = null;
+		this.socket = null;
+		this.onSaved = null;		// called with the new revision when we save
+		this.onPresence = null;		// called when people join or leave
+
+		// bound so they can be removed from the editor's events
+		this.changed = this.changed.bind(this);
+		this.cursorMoved = this.cursorMoved.bind(this);
+	};
+
+	get url() {
+		let protocol = window.location.protocol == "https:" ? "wss:" : "ws:";
+		let path = `${config.api}/directories/${this.file.path}/documents/${this.file.document}/files/${this.file.filename}/collaborate`;
+
+		// WebSocket requests can't have an Authorization header
+		return `${protocol}//${window.location.host}${path}?access_token=${store.state.auth.token}`;
+	};
+
+	connect() {
+
+		this.socket = new WebSocket(this.url);
+
+		this.socket.onmessage = (event) => {
+			this.receive(JSON.parse(event.data));
+		};
+
+		this.socket.onclose = () => {
+			this.clearCursors();
+			this.joined([]);
+		};
+
+		this.editor.on('change', this.changed);
+		this.editor.on('cursorActivity', this.cursorMoved);
+	};
+
+	disconnect() {
+
+		this.editor.off('change', this.changed);
+		this.editor.off('cursorActivity', this.cursorMoved);
+
+		this.clearCursors();
+
+		if (this.socket) {
+			this.socket.close();
+		};
+	};
+
+	send(message) {
+		this.socket.send(JSON.stringify(message));
+	};
+
+	// save commits the session's contents, the front matter and commit
+	// message are taken from the form
+	save(message, frontmatter) {
+		this.send({type: "save", message, frontmatter});
+	};
+
+	receive(message) {
+
+		switch (message.type) {
+
+			case "init":
+				this.start(message);
+				break;
+
+			case "operation":
+				this.client.applyServer(ot.TextOperation.fromJSON(message.operation));
+				break;
+
+			case "ack":
+				this.client.serverAck();
+				break;
+
+			case "cursor":
+				this.showCursor(message.username, message.cursor);
+				break;
+
+			case "presence":
+				this.joined(message.participants);
+				break;
+
+			case "saved":
+				this.saved(message);
+				break;
+
+			case "error":
+				store.state.broadcast.addMessage("danger", "Collaboration", message.message, 10);
+				break;
+		};
+	};
+
+	// start replaces the editor's contents with the session's, which may
+	// include changes others haven't saved yet
+	start(message) {
+
+		this.joined(message.participants);
+
+		this.editor.operation(() => {
+			this.editor.replaceRange(
+				message.body,
+				{line: this.editor.firstLine(), ch: 0},
+				{line: this.editor.lastLine()},
+				"collaboration"
+			);
+		});
+
+		this.client = new ot.Client(message.revision);
+
+		this.client.sendOperation = (revision, operation) => {
+			this.send({type: "operation", revision, operation: operation.toJSON()});
+		};
+
+		this.client.applyOperation = (operation) => {
+			this.apply(operation);
+		};
+	};
+
+	joined(participants) {
+
+		this.participants = participants;
+
+		if (this.onPresence) {
+			this.onPresence(participants);
+		};
+	};
+
+	saved(message) {
+
+		store.commit("setLatestRevision", message.oid);
+
+		if (message.username == store.state.user.username) {
+			if (this.onSaved) {
+				this.onSaved(message.oid);
+			};
+			return;
+		};
+
+		store.state.broadcast.addMessage("info", "Saved", `${message.username} saved the document`, 5);
+	};
+
+	// changed turns the editor's changes into operations, changes made by
+	// applying others' operations are skipped
+	changed(editor, change) {
+
+		if (change.origin == "collaboration" || !this.client) {
+			return;
+		};
+
+		let inserted = change.text.join("\n");
+		let removed = change.removed.join("\n");
+
+		let start = editor.indexFromPos(change.from);
+		let length = editor.getValue().length - inserted.length + removed.length;
+
+		let operation = new ot.TextOperation()
+			.retain(start)
+			.delete(removed.length)
+			.insert(inserted)
+			.retain(length - start - removed.length);
+
+		this.client.applyClient(operation);
+	};
+
+	cursorMoved(editor) {
+
+		if (!this.client) {
+			return;
+		};
+
+		// the server moves the cursor past any operations we haven't
+		// received yet
+		this.send({
+			type: "cursor",
+			revision: this.client.revision,
+			cursor: {
+				position: editor.indexFromPos(editor.getCursor("head")),
+				selection_end: editor.indexFromPos(editor.getCursor("anchor"))
+			}
+		});
+	};
+
+	// apply makes another participant's changes to the editor
+	apply(operation) {
+
+		let index = 0;
+
+		this.editor.operation(() => {
+			for (let component of operation.ops) {
+
+				if (ot.TextOperation.isRetain(component)) {
+					index += component;
+				} else if (ot.TextOperation.isInsert(component)) {
+					this.editor.replaceRange(component, this.editor.posFromIndex(index), null, "collaboration");
+					index += component.length;
+				} else {
+					this.editor.replaceRange(
+						"",
+						this.editor.posFromIndex(index),
+						this.editor.posFromIndex(index - component),
+						"collaboration"
+					);
+				};
+			};
+		});
+	};
+
+	showCursor(username, cursor) {
+
+		if (this.cursors[username]) {
+			this.cursors[username].clear();
+			delete this.cursors[username];
+		};
+
+		if (!cursor) {
+			return;
+		};
+
+		let participant = this.participants.find(p => p.username == username);
+
+		let marker = document.createElement("span");
+		marker.className = "collaborator-cursor";
+		marker.title = (participant && participant.name) || username;
+
+		this.cursors[username] = this.editor.setBookmark(
+			this.editor.posFromIndex(cursor.position),
+			{widget: marker, insertLeft: true}
+		);
+	};
+
+	clearCursors() {
+		for (let username in this.cursors) {
+			this.cursors[username].clear();
+		};
+		this.cursors = {};
+	};
+};
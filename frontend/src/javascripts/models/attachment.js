@@ -1,3 +1,4 @@
+import config from '../config.js';
 import store from '../store.js';
 
 export default class CMSFileAttachment {
@@ -10,6 +11,10 @@ export default class CMSFileAttachment {
 
 		this.options = options;
 
+		// keep hold of the original so it can be uploaded as-is rather
+		// than base64 encoded
+		this.file = file;
+
 		this.lastModified = file.lastModified;
 		this.lastModifiedDate = file.lastModifiedDate;
 		this.name = file.name;
@@ -22,32 +27,61 @@ export default class CMSFileAttachment {
 		return this;
 	};
 
-	// Convert a file retrieved from the CMS into a CMSFileAttachment
-	static fromData(object) {
+	// Convert an attachment listed by the CMS into a CMSFileAttachment.
+	// Only metadata is listed, the contents are downloaded separately
+	// by fetchContents
+	static fromMetadata(object) {
 
-		let ab = new ArrayBuffer(object.data.length);
+		let attachment = new CMSFileAttachment(
+			{
+				name: object.filename,
+				size: object.size,
+				type: object.filetype,
+				lastModifiedDate: new Date()
+			},
+			null,
+			{base64Encoded: false, newFile: false}
+		);
 
-		let ia = new Uint8Array(ab);
+		attachment.dir    = object.path;
+		attachment.oid    = object.oid;
+		attachment.width  = object.width;
+		attachment.height = object.height;
 
-		for (const [i, _] of object.data) {
-			ia[i] = object.data.charCodeAt(i)
-		}
+		return attachment;
+	}
 
-		// write the ArrayBuffer to a blob
-		let blob = new Blob([ia], { type: object.filetype });
+	isImage() {
+		return (this.type || "").startsWith("image/");
+	};
 
-		// Make the blob look like a File by adding name and timestamp
-		blob.lastModifiedDate = new Date();
-		blob.name = object.filename;
+	// fetchContents downloads the attachment from its path relative to the
+	// document and keeps it as an object URL so it can be displayed
+	async fetchContents(directory, document) {
+		this.data = await this._fetchObjectURL(directory, document, "attachments");
+	};
 
-		let attachment = new CMSFileAttachment(
-			blob,
-			`data:${object.filetype};base64,${object.data}`,
-			{base64Encoded: true, newFile: false}
-		);
+	// fetchThumbnail downloads a thumbnail, cached on the server, for use
+	// in the gallery
+	async fetchThumbnail(directory, document, size = 200) {
+		this.thumbnail = await this._fetchObjectURL(directory, document, "thumbnails", `?size=${size}`);
+	};
 
-		return attachment;
-	}
+	async _fetchObjectURL(directory, document, endpoint, query = "") {
+
+		let documentDir = [directory, document].join("/");
+		let relative = [this.dir.substring(documentDir.length + 1), this.name].join("/");
+		let path = `${config.api}/directories/${directory}/documents/${document}/${endpoint}/${relative}${query}`;
+
+		let response = await fetch(path, {headers: store.state.auth.authHeader()});
+
+		if (response.status != 200) {
+			console.warn(`Could not retrieve ${endpoint}`, relative);
+			return;
+		};
+
+		return window.URL.createObjectURL(await response.blob());
+	};
 
 	isNew() {
 		return this.options.newFile;
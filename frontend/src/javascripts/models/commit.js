@@ -32,7 +32,7 @@ export default class CMSCommit {
 		this.directories = [];
 	};
 
-	prepareJSON() {
+	prepareJSON(includeAttachments=true) {
 
 		return {
 			message: this.message,
@@ -40,7 +40,7 @@ export default class CMSCommit {
 				latest_revision: store.state.server.repositoryInfo.latestRevision
 			},
 			files: this.files
-				.map((f) => {return f.prepareJSON()})
+				.map((f) => {return f.prepareJSON(includeAttachments)})
 				.reduce((acc,cur) => {return [...acc, ...cur]}, []),
 			directories: this.directories.map((d) => {return d.prepareJSON()})
 		};
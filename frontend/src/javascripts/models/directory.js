@@ -102,9 +102,34 @@ export default class CMSDirectory {
 
 	}
 
-	async destroy(commit) {
+	// reorder sets the order documents are listed in, every document in
+	// the directory must be included
+	async reorder(documents) {
 
-		const path = `${config.api}/directories/${this.path}`;
+		const path = `${config.api}/directories/${this.path}/order`;
+
+		let response = await fetch(path, {
+			method: "PUT",
+			headers: store.state.auth.authHeader(),
+			body: JSON.stringify({
+				documents: documents,
+				repository_info: {latest_revision: store.state.server.repositoryInfo.latestRevision}
+			})
+		});
+
+		return response;
+
+	};
+
+	// destroy deletes the directory and everything in it, when dryRun is
+	// set nothing is deleted and the paths that would be are returned
+	async destroy(commit, dryRun = false) {
+
+		var path = `${config.api}/directories/${this.path}`;
+
+		if (dryRun) {
+			path = `${path}?dry_run=true`;
+		};
 
 		let response = await fetch(path, {
 			method: "DELETE",
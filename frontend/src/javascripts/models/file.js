@@ -30,6 +30,8 @@ export default class CMSFile {
 			this.markdown        = "";
 			this.title           = "";
 			this.author          = "";
+			this.authors         = [];
+			this.contributors    = [];
 			this.synopsis        = "";
 			this.tags            = [];
 			this.version         = "";
@@ -52,15 +54,31 @@ export default class CMSFile {
 			this.html                  = file.html;
 			this.markdown              = file.markdown;
 			this.translations          = file.translations;
+			this.lock                  = file.lock;
+			this.contributors          = file.contributors || [];
+
+			// translations say whether they've kept up with their source,
+			// sources which of their translations haven't
+			this.translationStatus     = file.translation_status;
+			this.outdatedTranslations  = file.outdated_translations || [];
 
 			// frontmatter fields
 			this.title                 = file.frontmatter.title;
 			this.author                = file.frontmatter.author;
+			this.authors               = file.frontmatter.authors || [];
 			this.synopsis              = file.frontmatter.synopsis;
 			this.tags                  = file.frontmatter.tags;
 			this.version               = file.frontmatter.version;
 			this.draft                 = file.frontmatter.draft;
 			this.date                  = file.frontmatter.date || this.todayString();
+			this.weight                = file.frontmatter.weight;
+			this.publish_at            = file.frontmatter.publish_at;
+			this.unpublish_at          = file.frontmatter.unpublish_at;
+			this.owner                 = file.frontmatter.owner;
+			this.review_by             = file.frontmatter.review_by;
+			this.expires               = file.frontmatter.expires;
+			this.translated_from       = file.frontmatter.translated_from;
+			this.state                 = file.state || file.frontmatter.state;
 
 			// we don't *always* need to return directory_info with a file,
 			// but if it is here, set it up
@@ -192,11 +210,19 @@ export default class CMSFile {
 				frontmatter: {
 					title: this.title,
 					author: this.author,
+					authors: this.authors,
 					tags: this.tags,
 					synopsis: this.synopsis,
 					version: this.version,
 					draft: this.draft,
-					date: this.date
+					date: this.date,
+					weight: this.weight,
+					publish_at: this.publish_at,
+					unpublish_at: this.unpublish_at,
+					owner: this.owner,
+					review_by: this.review_by,
+					expires: this.expires,
+					translated_from: this.translated_from
 				}
 			}
 		];
@@ -349,6 +375,14 @@ export default class CMSFile {
 			console.warn("Update called but content hasn't changed");
 		};
 
+		// new attachments are streamed to the server alongside the update
+		// instead of being base64 encoded within it
+		let attachments = this.attachments.filter(attachment => attachment.isNew());
+
+		if (attachments.length > 0) {
+			return this.uploadAttachments(commit, attachments);
+		};
+
 		var path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}`;
 
 		let response = await fetch(path, {
@@ -361,10 +395,41 @@ export default class CMSFile {
 
 	};
 
-	async destroy(commit) {
+	// uploadAttachments sends the attachments as multipart/form-data
+	// along with the commit, they're saved together
+	async uploadAttachments(commit, attachments) {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/attachments`;
+
+		let form = new FormData();
+		form.append("commit", JSON.stringify(commit.prepareJSON(false)));
+
+		attachments.forEach((attachment) => {
+			form.append("attachments", attachment.file, attachment.name);
+		});
+
+		let response = await fetch(path, {
+			method: "POST",
+			headers: store.state.auth.authHeader(),
+			body: form
+		});
+
+		return response;
+
+	};
+
+	// destroy deletes the file, when dryRun is set nothing is deleted and
+	// the paths that would be are returned along with any broken links
+	async destroy(commit, force = false, dryRun = false) {
 
 		var path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}`;
 
+		if (force) {
+			path = `${path}?force=true`;
+		} else if (dryRun) {
+			path = `${path}?dry_run=true`;
+		};
+
 		let response = await fetch(path, {
 			method: "DELETE",
 			headers: store.state.auth.authHeader(),
@@ -375,6 +440,279 @@ export default class CMSFile {
 
 	};
 
+	// lock marks the document as being edited by the current user, calling
+	// it periodically acts as a heartbeat and keeps the lock alive
+	async acquireLock() {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/lock`;
+
+		let response = await fetch(path, {
+			method: "POST",
+			headers: store.state.auth.authHeader()
+		});
+
+		if (response.status == 200 || response.status == 423) {
+			this.lock = await response.json();
+		};
+
+		return response;
+
+	};
+
+	async releaseLock() {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/lock`;
+
+		let response = await fetch(path, {
+			method: "DELETE",
+			headers: store.state.auth.authHeader()
+		});
+
+		return response;
+
+	};
+
+	// autosave stores the in-progress changes on the server so they
+	// survive the browser being closed
+	async autosave() {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/autosave`;
+		let file = this.prepareJSON(false)[0];
+
+		let response = await fetch(path, {
+			method: "PUT",
+			headers: store.state.auth.authHeader(),
+			body: JSON.stringify({
+				base_revision: store.state.server.repositoryInfo.latestRevision,
+				body: file.body,
+				frontmatter: file.frontmatter
+			})
+		});
+
+		return response;
+
+	};
+
+	async fetchAutosave() {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/autosave`;
+
+		let response = await fetch(path, {headers: store.state.auth.authHeader()});
+
+		if (response.status != 200) {
+			return;
+		};
+
+		return response.json();
+
+	};
+
+	async discardAutosave() {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/autosave`;
+
+		let response = await fetch(path, {
+			method: "DELETE",
+			headers: store.state.auth.authHeader()
+		});
+
+		return response;
+
+	};
+
+	// resumeAutosave replaces the document's contents with those of an
+	// autosave, leaving initialMarkdown alone so the changes are detected
+	resumeAutosave(autosave) {
+		this.markdown = autosave.body;
+		this.title    = autosave.frontmatter.title;
+		this.author   = autosave.frontmatter.author;
+		this.authors  = autosave.frontmatter.authors || this.authors;
+		this.synopsis = autosave.frontmatter.synopsis;
+		this.tags     = autosave.frontmatter.tags;
+		this.version  = autosave.frontmatter.version;
+		this.draft    = autosave.frontmatter.draft;
+		this.date     = autosave.frontmatter.date || this.date;
+	};
+
+	lockedByOtherUser() {
+		return (this.lock && store.state.user && this.lock.username != store.state.user.username);
+	};
+
+	async comments() {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/comments`;
+
+		let response = await fetch(path, {headers: store.state.auth.authHeader()});
+
+		if (!checkResponse(response.status)) {
+			return [];
+		};
+
+		return response.json();
+
+	};
+
+	// addComment starts a new thread, anchor is optional and can be
+	// either {start, end} offsets or a {line}
+	async addComment(body, anchor) {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/comments`;
+
+		let response = await fetch(path, {
+			method: "POST",
+			headers: store.state.auth.authHeader(),
+			body: JSON.stringify({body, anchor})
+		});
+
+		return response;
+
+	};
+
+	async replyToComment(id, body) {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/comments/${id}/replies`;
+
+		let response = await fetch(path, {
+			method: "POST",
+			headers: store.state.auth.authHeader(),
+			body: JSON.stringify({body})
+		});
+
+		return response;
+
+	};
+
+	async resolveComment(id, resolved=true) {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/comments/${id}/resolve`;
+
+		let response = await fetch(path, {
+			method: resolved ? "POST" : "DELETE",
+			headers: store.state.auth.authHeader()
+		});
+
+		return response;
+
+	};
+
+	async suggestions(status) {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/suggestions`;
+
+		if (status) {
+			path = `${path}?status=${status}`;
+		};
+
+		let response = await fetch(path, {headers: store.state.auth.authHeader()});
+
+		if (!checkResponse(response.status)) {
+			return [];
+		};
+
+		return response.json();
+
+	};
+
+	// suggest proposes replacing the text between the start and end
+	// offsets of the document's markdown, leaving the document unchanged
+	// until somebody accepts it
+	async suggest(start, end, replacement, comment) {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/suggestions`;
+
+		let response = await fetch(path, {
+			method: "POST",
+			headers: store.state.auth.authHeader(),
+			body: JSON.stringify({
+				base_revision: store.state.server.repositoryInfo.latestRevision,
+				start,
+				end,
+				replacement,
+				comment
+			})
+		});
+
+		return response;
+
+	};
+
+	async acceptSuggestion(id, message) {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/suggestions/${id}/accept`;
+
+		let response = await fetch(path, {
+			method: "POST",
+			headers: store.state.auth.authHeader(),
+			body: JSON.stringify({message})
+		});
+
+		return response;
+
+	};
+
+	async rejectSuggestion(id) {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/suggestions/${id}/reject`;
+
+		let response = await fetch(path, {
+			method: "POST",
+			headers: store.state.auth.authHeader()
+		});
+
+		return response;
+
+	};
+
+	// workflow returns the document's workflow state, the transitions
+	// available to the current user and its transition history
+	async workflow() {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/workflow`;
+
+		let response = await fetch(path, {headers: store.state.auth.authHeader()});
+
+		if (!checkResponse(response.status)) {
+			return;
+		};
+
+		return response.json();
+
+	};
+
+	async transition(name, comment) {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/workflow`;
+
+		let response = await fetch(path, {
+			method: "POST",
+			headers: store.state.auth.authHeader(),
+			body: JSON.stringify({
+				transition: name,
+				comment: comment,
+				repository_info: {latest_revision: store.state.server.repositoryInfo.latestRevision}
+			})
+		});
+
+		return response;
+
+	};
+
+	// fetchTranslationStatus includes the changes made to the source
+	// since the translation was last brought up to date
+	async fetchTranslationStatus() {
+
+		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/translation_status`;
+
+		let response = await fetch(path, {headers: store.state.auth.authHeader()});
+
+		if (!checkResponse(response.status)) {
+			return;
+		};
+
+		return response.json();
+
+	};
+
 	async log() {
 
 		let path = `${config.api}/directories/${this.path}/documents/${this.document}/files/${this.filename}/history`;
@@ -414,9 +752,20 @@ export default class CMSFile {
 		};
 
 		this.attachments = data.map((att) => {
-			return CMSFileAttachment.fromData(att);
+			return CMSFileAttachment.fromMetadata(att);
 		});
 
+		// only images are needed straight away, thumbnails for the gallery
+		// and the full image for the preview
+		await Promise.all(
+			this.attachments
+				.filter(attachment => attachment.isImage())
+				.map(attachment => Promise.all([
+					attachment.fetchContents(this.path, this.document),
+					attachment.fetchThumbnail(this.path, this.document)
+				]))
+		);
+
 		return;
 
 	};
@@ -2,12 +2,15 @@ import Diff from 'text-diff';
 
 export default class CMSPatch {
 
-	constructor(hash, filename, oldFile, newFile) {
+	constructor(hash, filename, oldFile, newFile, lfs = false) {
 		this.hash = hash;
 		this.filename = filename;
 		this.oldFile = oldFile;
 		this.newFile = newFile;
 
+		// LFS files are diffed by their pointers
+		this.lfs = lfs;
+
 		this.oldFilePresent = !!this.oldFile;
 		this.newFilePresent = !!this.newFile;
 
@@ -21,16 +21,11 @@ Feature: Publishing drafts
 		Given I am on the new document page
 		Then the "Draft" checkbox should be checked
 
-	Scenario: Creating a non-draft document
-		Given I am on the new document page
-		When I uncheck the "Draft" checkbox
-		And I fill in the rest of the document form and submit it
-		Then my document should not be a draft
-
-	Scenario: Marking an existing document as a draft
+	Scenario: Draft status can only be changed by the workflow
 		Given I am on the edit document page for "document_1.md"
-		When I uncheck the "Draft" checkbox
-		And I enter 'the first document' in the 'Title' field
-		And I enter 'commit-message' in the 'Commit Message' field
-		And I submit the form
-		Then my document should be a draft
\ No newline at end of file
+		Then the "Draft" checkbox should be disabled
+
+	Scenario: New documents are always drafts
+		Given I am on the new document page
+		When I fill in the rest of the document form and submit it
+		Then my document should be a draft
@@ -10,6 +10,12 @@ Then %r{^the "(.*?)" checkbox should be unchecked$} do |name|
   end
 end
 
+Then %r{^the "(.*?)" checkbox should be disabled$} do |name|
+  within("label", text: /^#{name}$/) do
+    expect(page.find("input[type='checkbox']")).to be_disabled
+  end
+end
+
 When %r{^I fill in the rest of the document form and submit it$} do
   steps %{
     And I enter some text into the editor